@@ -0,0 +1,75 @@
+// Command oauthclient registers an application that signs users in with
+// auth4me. The client secret is printed once and only its hash is stored.
+//
+//	oauthclient -name "Billing" -redirect-uris https://billing.example.com/callback
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/revandpratama/auth4me/config"
+	"github.com/revandpratama/auth4me/internal/app"
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+	"github.com/revandpratama/auth4me/internal/auth/repository"
+	"github.com/revandpratama/auth4me/internal/auth/usecase"
+	"github.com/revandpratama/auth4me/pkg"
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+
+	name := flag.String("name", "", "name shown to users on the consent page")
+	redirectURIs := flag.String("redirect-uris", "", "comma separated redirect URIs")
+	scopes := flag.String("scopes", strings.Join(pkg.SupportedScopes, " "), "space separated scopes the client may request")
+	grantTypes := flag.String("grant-types", "authorization_code refresh_token", "space separated grant types")
+	public := flag.Bool("public", false, "register a public client without a secret, for SPAs and native apps")
+	flag.Parse()
+
+	if *name == "" || *redirectURIs == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	req := &dto.ClientRegistrationRequest{
+		ClientName:              *name,
+		GrantTypes:              strings.Fields(*grantTypes),
+		TokenEndpointAuthMethod: usecase.AuthMethodClientSecretBasic,
+		Scope:                   *scopes,
+	}
+	for _, uri := range strings.Split(*redirectURIs, ",") {
+		req.RedirectURIs = append(req.RedirectURIs, strings.TrimSpace(uri))
+	}
+	if *public {
+		req.TokenEndpointAuthMethod = usecase.AuthMethodNone
+	}
+
+	if err := config.LoadConfig(); err != nil {
+		log.Fatal().Err(err).Msg("failed to load config")
+	}
+
+	apps, err := app.NewApp(app.WithDB(), app.WithMigration())
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to create app")
+	}
+	defer func() {
+		if err := apps.Stop(); err != nil {
+			log.Error().Err(err).Msg("failed to stop app cleanly")
+		}
+	}()
+
+	// the same validation as dynamic registration, minus the registration
+	// access token
+	client, err := usecase.NewOAuthClientUsecase(repository.NewOAuthClientRepository(apps.DB)).CreateClient(req)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create oauth client")
+		return
+	}
+
+	fmt.Printf("client_id:     %s\n", client.ClientID)
+	if client.ClientSecret != "" {
+		fmt.Printf("client_secret: %s\n", client.ClientSecret)
+	}
+}
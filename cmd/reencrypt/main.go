@@ -0,0 +1,47 @@
+// Command reencrypt rewrites every encrypted column with the active
+// encryption key. Run it after changing ENCRYPTION_ACTIVE_KEY_ID, and only
+// then drop the retired key from ENCRYPTION_KEYS. It also encrypts values
+// written before ENCRYPTION_KEYS was configured.
+package main
+
+import (
+	"github.com/revandpratama/auth4me/config"
+	"github.com/revandpratama/auth4me/internal/app"
+	"github.com/revandpratama/auth4me/internal/auth/repository"
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+
+	if err := config.LoadConfig(); err != nil {
+		log.Fatal().Err(err).Msg("failed to load config")
+	}
+
+	if config.ENV.ENCRYPTION_KEYS == "" {
+		log.Fatal().Msg("ENCRYPTION_KEYS is not set, nothing to encrypt with")
+	}
+
+	apps, err := app.NewApp(app.WithDB())
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to create app")
+	}
+	defer func() {
+		if err := apps.Stop(); err != nil {
+			log.Error().Err(err).Msg("failed to stop app cleanly")
+		}
+	}()
+
+	secrets, err := repository.NewAuthRepository(apps.DB).ReencryptMFASecrets()
+	if err != nil {
+		log.Error().Err(err).Int("rewritten", secrets).Msg("failed to reencrypt mfa secrets")
+		return
+	}
+	log.Info().Int("rewritten", secrets).Msg("mfa secrets reencrypted")
+
+	tokens, err := repository.NewOAuthRepository(apps.DB).ReencryptTokens()
+	if err != nil {
+		log.Error().Err(err).Int("rewritten", tokens).Msg("failed to reencrypt oauth tokens")
+		return
+	}
+	log.Info().Int("rewritten", tokens).Msg("oauth tokens reencrypted")
+}
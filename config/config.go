@@ -18,11 +18,174 @@ type Config struct {
 	GOOGLE_CLIENT_SECRET string `mapstructure:"GOOGLE_CLIENT_SECRET"`
 	GOOGLE_REDIRECT_URL  string `mapstructure:"GOOGLE_REDIRECT_URL"`
 
+	// Each OAuth provider below is enabled when its client id is set.
+	GITHUB_CLIENT_ID     string `mapstructure:"GITHUB_CLIENT_ID"`
+	GITHUB_CLIENT_SECRET string `mapstructure:"GITHUB_CLIENT_SECRET"`
+	GITHUB_REDIRECT_URL  string `mapstructure:"GITHUB_REDIRECT_URL"`
+
+	MICROSOFT_CLIENT_ID     string `mapstructure:"MICROSOFT_CLIENT_ID"`
+	MICROSOFT_CLIENT_SECRET string `mapstructure:"MICROSOFT_CLIENT_SECRET"`
+	MICROSOFT_REDIRECT_URL  string `mapstructure:"MICROSOFT_REDIRECT_URL"`
+	MICROSOFT_TENANT        string `mapstructure:"MICROSOFT_TENANT"`
+
+	GITLAB_CLIENT_ID     string `mapstructure:"GITLAB_CLIENT_ID"`
+	GITLAB_CLIENT_SECRET string `mapstructure:"GITLAB_CLIENT_SECRET"`
+	GITLAB_REDIRECT_URL  string `mapstructure:"GITLAB_REDIRECT_URL"`
+	GITLAB_URL           string `mapstructure:"GITLAB_URL"` // for self-hosted instances
+
+	DISCORD_CLIENT_ID     string `mapstructure:"DISCORD_CLIENT_ID"`
+	DISCORD_CLIENT_SECRET string `mapstructure:"DISCORD_CLIENT_SECRET"`
+	DISCORD_REDIRECT_URL  string `mapstructure:"DISCORD_REDIRECT_URL"`
+
+	// Any other OpenID Connect issuer, configured through discovery and
+	// served under /oauth/<OIDC_PROVIDER_NAME>.
+	OIDC_PROVIDER_NAME string `mapstructure:"OIDC_PROVIDER_NAME"`
+	OIDC_ISSUER        string `mapstructure:"OIDC_ISSUER"`
+	OIDC_CLIENT_ID     string `mapstructure:"OIDC_CLIENT_ID"`
+	OIDC_CLIENT_SECRET string `mapstructure:"OIDC_CLIENT_SECRET"`
+	OIDC_REDIRECT_URL  string `mapstructure:"OIDC_REDIRECT_URL"`
+
+	// Origins the OAuth callback may redirect to with return_to, comma
+	// separated.
+	OAUTH_RETURN_TO_ALLOWLIST string `mapstructure:"OAUTH_RETURN_TO_ALLOWLIST"`
+	// Link a new identity to the account with the same email when both
+	// the provider and the account have verified it.
+	OAUTH_AUTO_LINK_ENABLED bool `mapstructure:"OAUTH_AUTO_LINK_ENABLED"`
+
+	// SAML service provider. IdPs are configured by dropping their metadata
+	// into SAML_IDP_METADATA_DIR as <name>.xml; SAML is off without it.
+	SAML_SP_BASE_URL      string `mapstructure:"SAML_SP_BASE_URL"`  // public URL of the /api/saml routes
+	SAML_SP_ENTITY_ID     string `mapstructure:"SAML_SP_ENTITY_ID"` // defaults to the metadata URL
+	SAML_IDP_METADATA_DIR string `mapstructure:"SAML_IDP_METADATA_DIR"`
+	// Email domains each IdP is authoritative for, as
+	// "idp=domain,domain;idp=domain". Other emails count as unverified.
+	SAML_IDP_DOMAINS string `mapstructure:"SAML_IDP_DOMAINS"`
+	// Attribute names for the profile fields, as "email=mail,name=cn,groups=memberOf".
+	SAML_ATTRIBUTE_MAP string `mapstructure:"SAML_ATTRIBUTE_MAP"`
+
+	// LDAP or Active Directory logins, off without LDAP_URL. Emails in
+	// LDAP_DOMAINS are checked against the directory only; with
+	// LDAP_FALLBACK, unknown and passwordless accounts are tried there too.
+	LDAP_URL             string `mapstructure:"LDAP_URL"` // ldap:// or ldaps://
+	LDAP_START_TLS       bool   `mapstructure:"LDAP_START_TLS"`
+	LDAP_CA_FILE         string `mapstructure:"LDAP_CA_FILE"`
+	LDAP_BIND_DN         string `mapstructure:"LDAP_BIND_DN"` // service account for lookups, empty binds anonymously
+	LDAP_BIND_PASSWORD   string `mapstructure:"LDAP_BIND_PASSWORD"`
+	LDAP_BASE_DN         string `mapstructure:"LDAP_BASE_DN"`
+	LDAP_USER_FILTER     string `mapstructure:"LDAP_USER_FILTER"` // {email} is replaced by the escaped login email
+	LDAP_EMAIL_ATTRIBUTE string `mapstructure:"LDAP_EMAIL_ATTRIBUTE"`
+	LDAP_NAME_ATTRIBUTE  string `mapstructure:"LDAP_NAME_ATTRIBUTE"`
+	LDAP_GROUP_ATTRIBUTE string `mapstructure:"LDAP_GROUP_ATTRIBUTE"`
+	LDAP_DOMAINS         string `mapstructure:"LDAP_DOMAINS"` // comma separated
+	LDAP_FALLBACK        bool   `mapstructure:"LDAP_FALLBACK"`
+	// Re-map the role of directory users from their groups on every login
+	// instead of only when the account is provisioned.
+	LDAP_SYNC_ROLES     bool `mapstructure:"LDAP_SYNC_ROLES"`
+	LDAP_TIMEOUT_SECOND int  `mapstructure:"LDAP_TIMEOUT_SECOND"`
+
+	// auth4me as an OAuth 2.1 / OpenID Connect provider for other apps.
+	// Tokens are signed with the RSA key in OAUTH_SERVER_SIGNING_KEY_FILE;
+	// without it a key is generated at startup and tokens do not survive
+	// a restart.
+	OAUTH_SERVER_ISSUER                  string `mapstructure:"OAUTH_SERVER_ISSUER"` // public URL the /oauth2 routes are served under
+	OAUTH_SERVER_SIGNING_KEY_FILE        string `mapstructure:"OAUTH_SERVER_SIGNING_KEY_FILE"`
+	OAUTH_SERVER_CONSENT_URL             string `mapstructure:"OAUTH_SERVER_CONSENT_URL"` // frontend page that signs the user in and asks for consent
+	OAUTH_SERVER_DEVICE_URL              string `mapstructure:"OAUTH_SERVER_DEVICE_URL"`  // frontend page where users enter device user codes
+	OAUTH_SERVER_ACCESS_TOKEN_TTL_SECOND int    `mapstructure:"OAUTH_SERVER_ACCESS_TOKEN_TTL_SECOND"`
+	OAUTH_SERVER_REFRESH_TOKEN_TTL_DAY   int    `mapstructure:"OAUTH_SERVER_REFRESH_TOKEN_TTL_DAY"`
+
+	// Initial access tokens that allow dynamic client registration, comma
+	// separated; registration is off without them.
+	OAUTH_SERVER_INITIAL_ACCESS_TOKENS string `mapstructure:"OAUTH_SERVER_INITIAL_ACCESS_TOKENS"`
+
+	// Keys internal services present in X-Service-Key, comma separated.
+	SERVICE_API_KEYS string `mapstructure:"SERVICE_API_KEYS"`
+	// Lifetime of client_credentials tokens, which cannot be refreshed.
+	SERVICE_ACCOUNT_TOKEN_TTL_SECOND int `mapstructure:"SERVICE_ACCOUNT_TOKEN_TTL_SECOND"`
+
 	DB_HOST     string `mapstructure:"DB_HOST"`
 	DB_PORT     string `mapstructure:"DB_PORT"`
 	DB_USER     string `mapstructure:"DB_USER"`
 	DB_PASSWORD string `mapstructure:"DB_PASSWORD"`
 	DB_NAME     string `mapstructure:"DB_NAME"`
+
+	APP_URL string `mapstructure:"APP_URL"`
+
+	SMTP_HOST     string `mapstructure:"SMTP_HOST"`
+	SMTP_PORT     string `mapstructure:"SMTP_PORT"`
+	SMTP_USERNAME string `mapstructure:"SMTP_USERNAME"`
+	SMTP_PASSWORD string `mapstructure:"SMTP_PASSWORD"`
+	SMTP_FROM     string `mapstructure:"SMTP_FROM"`
+
+	PASSWORD_HISTORY_SIZE     int `mapstructure:"PASSWORD_HISTORY_SIZE"`
+	PASSWORD_RESET_TTL_SECOND int `mapstructure:"PASSWORD_RESET_TTL_SECOND"`
+	PASSWORD_MAX_AGE_DAY      int `mapstructure:"PASSWORD_MAX_AGE_DAY"` // 0 disables expiry
+
+	REGISTRATION_ENABLED bool `mapstructure:"REGISTRATION_ENABLED"`
+	// When enabled, registering an existing email answers like a success
+	// and notifies the owner by email instead of reporting the conflict.
+	REGISTRATION_ENUMERATION_SAFE bool `mapstructure:"REGISTRATION_ENUMERATION_SAFE"`
+
+	// Role name given to new users no ROLE_MAPPING_RULES entry matches.
+	DEFAULT_ROLE string `mapstructure:"DEFAULT_ROLE"`
+	// Role name allowed to manage other users and credentials.
+	ADMIN_ROLE string `mapstructure:"ADMIN_ROLE"`
+	// Semicolon separated kind=value:role rules, see pkg.ParseRoleRules.
+	ROLE_MAPPING_RULES string `mapstructure:"ROLE_MAPPING_RULES"`
+	// Email domains accounts may be created for, comma separated; empty
+	// allows any domain.
+	ALLOWED_SIGNUP_DOMAINS string `mapstructure:"ALLOWED_SIGNUP_DOMAINS"`
+
+	LOGIN_MAX_ATTEMPTS   int `mapstructure:"LOGIN_MAX_ATTEMPTS"`
+	LOGIN_LOCKOUT_SECOND int `mapstructure:"LOGIN_LOCKOUT_SECOND"`
+
+	STEP_UP_MAX_AGE_SECOND int `mapstructure:"STEP_UP_MAX_AGE_SECOND"`
+
+	MAGIC_LINK_TTL_SECOND     int  `mapstructure:"MAGIC_LINK_TTL_SECOND"`
+	MAGIC_LINK_SIGNUP_ENABLED bool `mapstructure:"MAGIC_LINK_SIGNUP_ENABLED"`
+
+	EMAIL_OTP_LENGTH       int `mapstructure:"EMAIL_OTP_LENGTH"`
+	EMAIL_OTP_TTL_SECOND   int `mapstructure:"EMAIL_OTP_TTL_SECOND"`
+	EMAIL_OTP_MAX_ATTEMPTS int `mapstructure:"EMAIL_OTP_MAX_ATTEMPTS"`
+
+	MFA_ISSUER              string `mapstructure:"MFA_ISSUER"`
+	MFA_RECOVERY_CODE_COUNT int    `mapstructure:"MFA_RECOVERY_CODE_COUNT"`
+	TRUSTED_DEVICE_TTL_DAY  int    `mapstructure:"TRUSTED_DEVICE_TTL_DAY"` // 0 disables remembering devices
+
+	SMS_PROVIDER            string `mapstructure:"SMS_PROVIDER"` // log or twilio
+	SMS_OTP_TTL_SECOND      int    `mapstructure:"SMS_OTP_TTL_SECOND"`
+	SMS_MAX_PER_HOUR        int    `mapstructure:"SMS_MAX_PER_HOUR"`
+	SMS_MIN_INTERVAL_SECOND int    `mapstructure:"SMS_MIN_INTERVAL_SECOND"`
+	TWILIO_ACCOUNT_SID      string `mapstructure:"TWILIO_ACCOUNT_SID"`
+	TWILIO_AUTH_TOKEN       string `mapstructure:"TWILIO_AUTH_TOKEN"`
+	TWILIO_FROM             string `mapstructure:"TWILIO_FROM"`
+
+	WEBAUTHN_RP_ID      string `mapstructure:"WEBAUTHN_RP_ID"`
+	WEBAUTHN_RP_NAME    string `mapstructure:"WEBAUTHN_RP_NAME"`
+	WEBAUTHN_RP_ORIGINS string `mapstructure:"WEBAUTHN_RP_ORIGINS"` // comma separated
+
+	// Master keys wrapping the data keys of encrypted columns, as
+	// comma separated id:base64 pairs of 32 byte keys. New values are
+	// encrypted with the active key; the others are kept for decryption
+	// until the reencrypt command has rotated every row.
+	ENCRYPTION_KEYS          string `mapstructure:"ENCRYPTION_KEYS"`
+	ENCRYPTION_ACTIVE_KEY_ID string `mapstructure:"ENCRYPTION_ACTIVE_KEY_ID"`
+
+	BLOB_STORE      string `mapstructure:"BLOB_STORE"` // local or s3
+	BLOB_LOCAL_DIR  string `mapstructure:"BLOB_LOCAL_DIR"`
+	BLOB_PUBLIC_URL string `mapstructure:"BLOB_PUBLIC_URL"` // base URL blobs are served from
+	// S3 or any S3-compatible store, addressed path-style as
+	// S3_ENDPOINT/S3_BUCKET/key.
+	S3_ENDPOINT          string `mapstructure:"S3_ENDPOINT"`
+	S3_REGION            string `mapstructure:"S3_REGION"`
+	S3_BUCKET            string `mapstructure:"S3_BUCKET"`
+	S3_ACCESS_KEY_ID     string `mapstructure:"S3_ACCESS_KEY_ID"`
+	S3_SECRET_ACCESS_KEY string `mapstructure:"S3_SECRET_ACCESS_KEY"`
+
+	AVATAR_MAX_BYTES int `mapstructure:"AVATAR_MAX_BYTES"`
+	// Copy the provider picture into the blob store when an OAuth login
+	// creates the account, instead of linking to the provider.
+	AVATAR_IMPORT_ENABLED bool `mapstructure:"AVATAR_IMPORT_ENABLED"`
 }
 
 var ENV Config
@@ -53,6 +216,52 @@ func LoadConfig() error {
 	viper.AddConfigPath(".")
 
 	viper.SetDefault("REST_PORT", "8080")
+	viper.SetDefault("APP_URL", "http://localhost:8080")
+	viper.SetDefault("MICROSOFT_TENANT", "common")
+	viper.SetDefault("GITLAB_URL", "https://gitlab.com")
+	viper.SetDefault("OIDC_PROVIDER_NAME", "oidc")
+	viper.SetDefault("OAUTH_RETURN_TO_ALLOWLIST", "http://localhost:3000")
+	viper.SetDefault("OAUTH_AUTO_LINK_ENABLED", true)
+	viper.SetDefault("SAML_SP_BASE_URL", "http://localhost:8080/api/saml")
+	viper.SetDefault("LDAP_USER_FILTER", "(|(mail={email})(userPrincipalName={email}))")
+	viper.SetDefault("LDAP_EMAIL_ATTRIBUTE", "mail")
+	viper.SetDefault("LDAP_NAME_ATTRIBUTE", "displayName")
+	viper.SetDefault("LDAP_GROUP_ATTRIBUTE", "memberOf")
+	viper.SetDefault("LDAP_TIMEOUT_SECOND", 10)
+	viper.SetDefault("OAUTH_SERVER_ISSUER", "http://localhost:8080")
+	viper.SetDefault("OAUTH_SERVER_CONSENT_URL", "http://localhost:3000/oauth/consent")
+	viper.SetDefault("OAUTH_SERVER_DEVICE_URL", "http://localhost:3000/device")
+	viper.SetDefault("OAUTH_SERVER_ACCESS_TOKEN_TTL_SECOND", 3600)
+	viper.SetDefault("OAUTH_SERVER_REFRESH_TOKEN_TTL_DAY", 30)
+	viper.SetDefault("SERVICE_ACCOUNT_TOKEN_TTL_SECOND", 900)
+	viper.SetDefault("SMTP_PORT", "587")
+	viper.SetDefault("PASSWORD_HISTORY_SIZE", 5)
+	viper.SetDefault("PASSWORD_RESET_TTL_SECOND", 1800)
+	viper.SetDefault("REGISTRATION_ENABLED", true)
+	viper.SetDefault("DEFAULT_ROLE", "user")
+	viper.SetDefault("ADMIN_ROLE", "admin")
+	viper.SetDefault("MAGIC_LINK_TTL_SECOND", 900)
+	viper.SetDefault("LOGIN_MAX_ATTEMPTS", 5)
+	viper.SetDefault("LOGIN_LOCKOUT_SECOND", 900)
+	viper.SetDefault("STEP_UP_MAX_AGE_SECOND", 900)
+	viper.SetDefault("EMAIL_OTP_LENGTH", 6)
+	viper.SetDefault("EMAIL_OTP_TTL_SECOND", 300)
+	viper.SetDefault("EMAIL_OTP_MAX_ATTEMPTS", 5)
+	viper.SetDefault("MFA_ISSUER", "auth4me")
+	viper.SetDefault("MFA_RECOVERY_CODE_COUNT", 10)
+	viper.SetDefault("TRUSTED_DEVICE_TTL_DAY", 30)
+	viper.SetDefault("SMS_PROVIDER", "log")
+	viper.SetDefault("SMS_OTP_TTL_SECOND", 300)
+	viper.SetDefault("SMS_MAX_PER_HOUR", 5)
+	viper.SetDefault("SMS_MIN_INTERVAL_SECOND", 60)
+	viper.SetDefault("WEBAUTHN_RP_ID", "localhost")
+	viper.SetDefault("WEBAUTHN_RP_NAME", "auth4me")
+	viper.SetDefault("WEBAUTHN_RP_ORIGINS", "http://localhost:3000")
+	viper.SetDefault("BLOB_STORE", "local")
+	viper.SetDefault("BLOB_LOCAL_DIR", "./data/blobs")
+	viper.SetDefault("BLOB_PUBLIC_URL", "http://localhost:8080/blobs")
+	viper.SetDefault("S3_REGION", "us-east-1")
+	viper.SetDefault("AVATAR_MAX_BYTES", 2<<20)
 
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
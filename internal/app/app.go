@@ -30,8 +30,10 @@ func (a *App) Stop() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := a.fiberApp.ShutdownWithContext(ctx); err != nil {
-		return err
+	if a.fiberApp != nil {
+		if err := a.fiberApp.ShutdownWithContext(ctx); err != nil {
+			return err
+		}
 	}
 
 	sqlDb, _ := a.DB.DB()
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/revandpratama/auth4me/config"
+	"github.com/revandpratama/auth4me/internal/auth/entity"
 	"github.com/rs/zerolog/log"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -50,3 +51,71 @@ func WithDB() Option {
 		return nil
 	}
 }
+
+// WithMigration creates the tables owned by auth4me features that are not
+// provisioned together with the base schema.
+func WithMigration() Option {
+	return func(app *App) error {
+
+		if err := app.DB.AutoMigrate(
+			&entity.PasswordHistory{},
+			&entity.EmailOTP{},
+			&entity.MFARecoveryCode{},
+			&entity.WebAuthnCredential{},
+			&entity.SMSOTP{},
+			&entity.TrustedDevice{},
+			&entity.OAuthClient{},
+			&entity.OAuthConsent{},
+			&entity.ServiceAccount{},
+		); err != nil {
+			return fmt.Errorf("auto migrate failed: %w", err)
+		}
+
+		if err := addMissingColumns(app.DB, &entity.User{},
+			"PasswordChangedAt",
+			"MustChangePassword",
+			"PhoneNumber",
+			"PhoneVerified",
+			"SMSMFAEnabled",
+			"AvatarKey",
+			"MFALastTOTPStep",
+		); err != nil {
+			return fmt.Errorf("auto migrate failed: %w", err)
+		}
+
+		if err := addMissingColumns(app.DB, &entity.Role{}, "System"); err != nil {
+			return fmt.Errorf("auto migrate failed: %w", err)
+		}
+		// ADMIN_ROLE is trusted by the admin check only once it is a
+		// system role, which the RBAC API can no longer rename or delete
+		if err := app.DB.Model(&entity.Role{}).Where("name = ?", config.ENV.ADMIN_ROLE).Update("system", true).Error; err != nil {
+			return fmt.Errorf("auto migrate failed: %w", err)
+		}
+
+		// encrypted tokens outgrow the original varchar(500) columns
+		for _, field := range []string{"AccessToken", "RefreshToken"} {
+			if err := app.DB.Migrator().AlterColumn(&entity.OAuthProvider{}, field); err != nil {
+				return fmt.Errorf("auto migrate failed: %w", err)
+			}
+		}
+
+		log.Info().Msg("database migrated")
+
+		return nil
+	}
+}
+
+// addMissingColumns adds columns introduced after a table was provisioned
+// without touching the existing ones.
+func addMissingColumns(db *gorm.DB, model any, fields ...string) error {
+	migrator := db.Migrator()
+	for _, field := range fields {
+		if migrator.HasColumn(model, field) {
+			continue
+		}
+		if err := migrator.AddColumn(model, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
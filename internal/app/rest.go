@@ -8,8 +8,8 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/revandpratama/auth4me/config"
 	"github.com/revandpratama/auth4me/internal/auth"
+	"github.com/revandpratama/auth4me/pkg"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/oauth2"
 )
 
 func WithRESTServer() Option {
@@ -17,6 +17,8 @@ func WithRESTServer() Option {
 
 		fiberApp := fiber.New(fiber.Config{
 			DisableStartupMessage: true,
+			// room for an avatar plus the multipart framing around it
+			BodyLimit: max(fiber.DefaultBodyLimit, config.ENV.AVATAR_MAX_BYTES+64<<10),
 		})
 
 		fiberApp.Use(func(c *fiber.Ctx) error {
@@ -28,6 +30,14 @@ func WithRESTServer() Option {
 			return c.SendString("Hello, World!")
 		})
 
+		blobs, err := pkg.NewBlobStore()
+		if err != nil {
+			return fmt.Errorf("failed to init blob store: %w", err)
+		}
+		if config.ENV.BLOB_STORE != "s3" {
+			fiberApp.Static("/blobs", config.ENV.BLOB_LOCAL_DIR)
+		}
+
 		api := fiberApp.Group("/api")
 
 		api.Get("/test-700ms", func(c *fiber.Ctx) error {
@@ -35,29 +45,55 @@ func WithRESTServer() Option {
 			return c.SendString("Hello. 700ms delay!")
 		})
 
-		authHandler := auth.InitAuthHandler(app.DB)
-		auth.InitAuthRoutes(api, authHandler)
+		// registered before the auth routes, whose group middleware would
+		// otherwise reject the public and restricted routes below /auth
+		mfaHandler := auth.InitMFAHandler(app.DB)
+		auth.InitMFARoutes(api, mfaHandler, auth.InitMFAEnrolledMiddleware(app.DB))
+
+		webAuthnHandler, err := auth.InitWebAuthnHandler(app.DB)
+		if err != nil {
+			return fmt.Errorf("failed to init webauthn: %w", err)
+		}
+		auth.InitWebAuthnRoutes(api, webAuthnHandler)
+
+		ldap, err := pkg.NewLDAPAuthenticator()
+		if err != nil {
+			return fmt.Errorf("failed to init ldap: %w", err)
+		}
+		requireAdmin := auth.InitAdminMiddleware(app.DB)
+
+		authHandler := auth.InitAuthHandler(app.DB, blobs, ldap)
+		auth.InitAuthRoutes(api, authHandler, requireAdmin)
 
 		rbacHandler := auth.InitRBACHandler(app.DB)
-		auth.InitRBACRoutes(api, rbacHandler)
-
-		oauthConfig := &oauth2.Config{
-			ClientID:     config.ENV.GOOGLE_CLIENT_ID,
-			ClientSecret: config.ENV.GOOGLE_CLIENT_SECRET,
-			Scopes: []string{
-				"https://www.googleapis.com/auth/userinfo.email",
-				"https://www.googleapis.com/auth/userinfo.profile",
-			},
-			Endpoint: oauth2.Endpoint{
-				AuthURL:  "https://accounts.google.com/o/oauth2/auth",
-				TokenURL: "https://oauth2.googleapis.com/token",
-			},
-			RedirectURL: config.ENV.GOOGLE_REDIRECT_URL,
-			// RedirectURL: "http://localhost:3000/auth/google/callback",
+		auth.InitRBACRoutes(api, rbacHandler, requireAdmin)
+
+		serviceAccountHandler := auth.InitServiceAccountHandler(app.DB)
+		auth.InitServiceAccountRoutes(api, serviceAccountHandler, requireAdmin)
+
+		oauthProviders, err := pkg.LoadOAuthProviders()
+		if err != nil {
+			return fmt.Errorf("failed to load oauth providers: %w", err)
 		}
-		oauthHandler := auth.InitOauthHandler(app.DB, oauthConfig)
+		oauthHandler := auth.InitOauthHandler(app.DB, oauthProviders, blobs)
 		auth.InitOauthRoutes(api, oauthHandler)
 
+		samlProviders, err := pkg.LoadSAMLProviders()
+		if err != nil {
+			return fmt.Errorf("failed to load saml providers: %w", err)
+		}
+		samlHandler := auth.InitSAMLHandler(app.DB, samlProviders, blobs)
+		auth.InitSAMLRoutes(api, samlHandler)
+
+		oauthServerHandler, err := auth.InitOAuthServerHandler(app.DB)
+		if err != nil {
+			return fmt.Errorf("failed to init oauth server: %w", err)
+		}
+		auth.InitOAuthServerRoutes(fiberApp, api, oauthServerHandler)
+
+		oauthClientHandler := auth.InitOAuthClientHandler(app.DB)
+		auth.InitOAuthClientRoutes(fiberApp, api, oauthClientHandler, requireAdmin)
+
 		app.fiberApp = fiberApp
 
 		go func() {
@@ -8,13 +8,54 @@ type LoginRequest struct {
 type TokenResponse struct {
 	AccessToken  string `json:"access_token,omitempty"`
 	RefreshToken string `json:"refresh_token,omitempty"`
+	// NextStep is set when AccessToken is a restricted token and names the
+	// step the client must complete before it receives a full token pair.
+	NextStep string `json:"next_step,omitempty"`
 }
 
 type RegisterRequest struct {
 	Email           string `json:"email" validate:"required,email"`
 	FullName        string `json:"full_name" validate:"required"`
-	RoleID          uint   `json:"role_id" validate:"required"`
-	AvatarPath      string `json:"avatar_path,omitempty" validate:"omitempty"`
 	Password        string `json:"password" validate:"required,min=8"`
 	ConfirmPassword string `json:"confirm_password" validate:"required,min=8,eqfield=Password"`
 }
+
+type MagicLinkRequest struct {
+	Email       string `json:"email" validate:"required,email"`
+	BindBrowser bool   `json:"bind_browser,omitempty"`
+}
+
+type MagicLinkVerifyRequest struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type EmailOTPRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type EmailOTPVerifyRequest struct {
+	Email string `json:"email" validate:"required,email"`
+	Code  string `json:"code" validate:"required,numeric"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required,min=8"`
+	ConfirmPassword string `json:"confirm_password" validate:"required,min=8,eqfield=NewPassword"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token           string `json:"token" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required,min=8"`
+	ConfirmPassword string `json:"confirm_password" validate:"required,min=8,eqfield=NewPassword"`
+}
+
+type AvatarResponse struct {
+	AvatarPath string `json:"avatar_path"`
+	// Sizes maps each stored size in pixels to its URL.
+	Sizes map[int]string `json:"sizes"`
+}
@@ -0,0 +1,20 @@
+package dto
+
+type TOTPEnrollResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURL string `json:"otpauth_url"`
+	QRCode     string `json:"qr_code"` // data:image/png;base64 URI
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type MFACodeRequest struct {
+	Code           string `json:"code" validate:"required"`
+	RememberDevice bool   `json:"remember_device"`
+}
+
+type SMSEnrollRequest struct {
+	PhoneNumber string `json:"phone_number" validate:"required"`
+}
@@ -0,0 +1,41 @@
+package dto
+
+import "github.com/revandpratama/auth4me/internal/auth/entity"
+
+// ClientRegistrationRequest is the client metadata of RFC 7591. On update
+// (RFC 7592) the client repeats its client_id, and its client_secret if it
+// sends one must be the current secret.
+type ClientRegistrationRequest struct {
+	RedirectURIs            []string `json:"redirect_uris"`
+	ClientName              string   `json:"client_name"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	Scope                   string   `json:"scope"`
+	ClientID                string   `json:"client_id"`
+	ClientSecret            string   `json:"client_secret"`
+}
+
+// ClientInformationResponse describes a registered client. The secret and
+// the registration access token are only present when they are issued.
+type ClientInformationResponse struct {
+	ClientID                string   `json:"client_id"`
+	ClientSecret            string   `json:"client_secret,omitempty"`
+	ClientIDIssuedAt        int64    `json:"client_id_issued_at"`
+	ClientSecretExpiresAt   int64    `json:"client_secret_expires_at"` // 0, secrets do not expire
+	RegistrationAccessToken string   `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string   `json:"registration_client_uri,omitempty"`
+	ClientName              string   `json:"client_name"`
+	RedirectURIs            []string `json:"redirect_uris"`
+	GrantTypes              []string `json:"grant_types"`
+	ResponseTypes           []string `json:"response_types"`
+	TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+	Scope                   string   `json:"scope"`
+}
+
+// OAuthClientCredentialsResponse is returned when an admin rotates a client
+// secret; the secret cannot be read back later.
+type OAuthClientCredentialsResponse struct {
+	Client       *entity.OAuthClient `json:"client"`
+	ClientSecret string              `json:"client_secret"`
+}
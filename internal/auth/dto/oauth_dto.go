@@ -1,9 +1,11 @@
 package dto
 
-type GoogleUserInfo struct {
-	Sub           string `json:"sub"`
-	Email         string `json:"email"`
-	Name          string `json:"name"`
-	Picture       string `json:"picture"`
-	EmailVerified bool   `json:"email_verified"`
+import "time"
+
+// UpstreamTokenResponse is a provider access token handed to an internal
+// service calling the provider's API on the user's behalf.
+type UpstreamTokenResponse struct {
+	AccessToken string    `json:"access_token"`
+	TokenType   string    `json:"token_type"`
+	ExpiresAt   time.Time `json:"expires_at"`
 }
@@ -0,0 +1,111 @@
+package dto
+
+// AuthorizeRequest holds the query parameters of an OAuth authorization
+// request made to auth4me.
+type AuthorizeRequest struct {
+	ResponseType        string `query:"response_type"`
+	ClientID            string `query:"client_id"`
+	RedirectURI         string `query:"redirect_uri"`
+	Scope               string `query:"scope"`
+	State               string `query:"state"`
+	Nonce               string `query:"nonce"`
+	CodeChallenge       string `query:"code_challenge"`
+	CodeChallengeMethod string `query:"code_challenge_method"`
+	Prompt              string `query:"prompt"`
+	MaxAge              string `query:"max_age"`
+}
+
+// AuthorizationRequestResponse tells the consent page what a client asks
+// for. When LoginRequired is set the user must sign in again first.
+type AuthorizationRequestResponse struct {
+	ClientID        string   `json:"client_id"`
+	ClientName      string   `json:"client_name"`
+	Scopes          []string `json:"scopes"`
+	ConsentRequired bool     `json:"consent_required"`
+	LoginRequired   bool     `json:"login_required"`
+}
+
+type AuthorizationDecisionRequest struct {
+	Approve bool `json:"approve"`
+}
+
+// AuthorizationDecisionResponse carries the client redirect the browser
+// must follow with the code or the error.
+type AuthorizationDecisionResponse struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+// OAuthTokenRequest is the form posted to the token endpoint. ClientID and
+// ClientSecret may come from HTTP Basic authentication instead.
+type OAuthTokenRequest struct {
+	GrantType    string `form:"grant_type"`
+	Code         string `form:"code"`
+	RedirectURI  string `form:"redirect_uri"`
+	CodeVerifier string `form:"code_verifier"`
+	RefreshToken string `form:"refresh_token"`
+	DeviceCode   string `form:"device_code"`
+	Scope        string `form:"scope"`
+	ClientID     string `form:"client_id"`
+	ClientSecret string `form:"client_secret"`
+}
+
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// DeviceAuthorizationRequest starts a device login (RFC 8628). Client
+// credentials may come from HTTP Basic authentication instead.
+type DeviceAuthorizationRequest struct {
+	ClientID     string `form:"client_id"`
+	ClientSecret string `form:"client_secret"`
+	Scope        string `form:"scope"`
+}
+
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// DeviceVerificationResponse tells the verification page which client a
+// user code belongs to, so the user can check it is the device in front
+// of them.
+type DeviceVerificationResponse struct {
+	ClientID   string   `json:"client_id"`
+	ClientName string   `json:"client_name"`
+	Scopes     []string `json:"scopes"`
+}
+
+type DeviceDecisionRequest struct {
+	UserCode string `json:"user_code" validate:"required"`
+	Approve  bool   `json:"approve"`
+}
+
+// OpenIDConfiguration is the OpenID Connect discovery document.
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+	RegistrationEndpoint              string   `json:"registration_endpoint,omitempty"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	ResponseModesSupported            []string `json:"response_modes_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	AuthorizationResponseIssParameter bool     `json:"authorization_response_iss_parameter_supported"`
+}
@@ -0,0 +1,17 @@
+package dto
+
+import "github.com/revandpratama/auth4me/internal/auth/entity"
+
+type ServiceAccountRequest struct {
+	Name        string `json:"name" validate:"required"`
+	Description string `json:"description"`
+	RoleID      uint   `json:"role_id" validate:"required"`
+	Disabled    bool   `json:"disabled"`
+}
+
+// ServiceAccountCredentialsResponse is returned when a secret is created or
+// rotated; the secret cannot be read back later.
+type ServiceAccountCredentialsResponse struct {
+	ServiceAccount *entity.ServiceAccount `json:"service_account"`
+	ClientSecret   string                 `json:"client_secret"`
+}
@@ -0,0 +1,12 @@
+package dto
+
+import "github.com/go-webauthn/webauthn/protocol"
+
+type WebAuthnLoginRequest struct {
+	Email string `json:"email,omitempty" validate:"omitempty,email"`
+}
+
+type WebAuthnLoginBeginResponse struct {
+	SessionID string                        `json:"session_id"`
+	Options   *protocol.CredentialAssertion `json:"options"`
+}
@@ -0,0 +1,16 @@
+package entity
+
+import "time"
+
+type EmailOTP struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Email     string    `gorm:"size:255;index;not null" json:"email"`
+	CodeHash  string    `gorm:"size:64;not null" json:"-"`
+	Attempts  int       `gorm:"default:0" json:"attempts"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (EmailOTP) TableName() string {
+	return "auth4me.email_otps"
+}
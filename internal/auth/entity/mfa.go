@@ -0,0 +1,46 @@
+package entity
+
+import "time"
+
+type MFARecoveryCode struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    string     `gorm:"type:uuid;index;not null" json:"user_id"`
+	CodeHash  string     `gorm:"size:64;not null" json:"-"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (MFARecoveryCode) TableName() string {
+	return "auth4me.mfa_recovery_codes"
+}
+
+type SMSOTP struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	UserID      string    `gorm:"type:uuid;index;not null" json:"user_id"`
+	PhoneNumber string    `gorm:"size:32;not null" json:"phone_number"`
+	CodeHash    string    `gorm:"size:64;not null" json:"-"`
+	Attempts    int       `gorm:"default:0" json:"attempts"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (SMSOTP) TableName() string {
+	return "auth4me.sms_otps"
+}
+
+// TrustedDevice lets a browser that already passed MFA skip the second factor
+// on password login until ExpiresAt.
+type TrustedDevice struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     string     `gorm:"type:uuid;index;not null" json:"user_id"`
+	TokenHash  string     `gorm:"size:64;uniqueIndex;not null" json:"-"`
+	UserAgent  string     `gorm:"size:255" json:"user_agent"`
+	IPAddress  string     `gorm:"size:45" json:"ip_address"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func (TrustedDevice) TableName() string {
+	return "auth4me.trusted_devices"
+}
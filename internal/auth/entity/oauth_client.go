@@ -0,0 +1,56 @@
+package entity
+
+import (
+	"slices"
+	"strings"
+	"time"
+)
+
+// OAuthClient is an application that signs users in with auth4me.
+type OAuthClient struct {
+	ID               uint   `gorm:"primaryKey" json:"id"`
+	ClientID         string `gorm:"size:64;uniqueIndex;not null" json:"client_id"`
+	ClientSecretHash string `gorm:"size:64" json:"-"` // empty for public clients
+	Name             string `gorm:"size:255" json:"name"`
+	RedirectURIs     string `gorm:"type:text" json:"redirect_uris"` // space separated
+	Scopes           string `gorm:"type:text" json:"scopes"`        // space separated
+	GrantTypes       string `gorm:"size:255" json:"grant_types"`    // space separated
+	Public           bool   `gorm:"default:false" json:"public"`
+	// Set for clients that registered themselves, which manage their
+	// registration with this token (RFC 7592).
+	RegistrationAccessTokenHash string    `gorm:"size:64" json:"-"`
+	RegisteredDynamically       bool      `gorm:"default:false" json:"registered_dynamically"`
+	CreatedAt                   time.Time `json:"created_at"`
+	UpdatedAt                   time.Time `json:"updated_at"`
+}
+
+func (OAuthClient) TableName() string {
+	return "auth4me.oauth_clients"
+}
+
+func (c *OAuthClient) HasRedirectURI(uri string) bool {
+	return slices.Contains(strings.Fields(c.RedirectURIs), uri)
+}
+
+func (c *OAuthClient) AllowsScope(scope string) bool {
+	return slices.Contains(strings.Fields(c.Scopes), scope)
+}
+
+func (c *OAuthClient) AllowsGrantType(grantType string) bool {
+	return slices.Contains(strings.Fields(c.GrantTypes), grantType)
+}
+
+// OAuthConsent records the scopes a user has granted a client, so they are
+// not asked again.
+type OAuthConsent struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    string    `gorm:"type:uuid;uniqueIndex:idx_oauth_consent_user_client;not null" json:"user_id"`
+	ClientID  string    `gorm:"size:64;uniqueIndex:idx_oauth_consent_user_client;not null" json:"client_id"`
+	Scopes    string    `gorm:"type:text" json:"scopes"` // space separated
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (OAuthConsent) TableName() string {
+	return "auth4me.oauth_consents"
+}
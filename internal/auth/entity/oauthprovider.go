@@ -7,8 +7,8 @@ type OAuthProvider struct {
 	UserID       string    `gorm:"type:uuid;index" json:"user_id"`
 	Provider     string    `gorm:"size:100;index" json:"provider"`    
 	ProviderID   string    `gorm:"size:255;index" json:"provider_id"`
-	AccessToken  string    `gorm:"size:500" json:"-"`
-	RefreshToken string    `gorm:"size:500" json:"-"`
+	AccessToken  string    `gorm:"type:text" json:"-"` // encrypted
+	RefreshToken string    `gorm:"type:text" json:"-"` // encrypted
 	ExpiresAt    time.Time `json:"expires_at"`
 }
 
@@ -0,0 +1,14 @@
+package entity
+
+import "time"
+
+type PasswordHistory struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    string    `gorm:"type:uuid;index;not null" json:"user_id"`
+	Password  string    `gorm:"not null" json:"-"` // hashed password
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+func (PasswordHistory) TableName() string {
+	return "auth4me.password_histories"
+}
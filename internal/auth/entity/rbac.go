@@ -3,8 +3,11 @@ package entity
 import "time"
 
 type Role struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	Name      string    `gorm:"uniqueIndex;not null" json:"name"`
+	ID   uint   `gorm:"primaryKey" json:"id"`
+	Name string `gorm:"uniqueIndex;not null" json:"name"`
+	// System roles, such as ADMIN_ROLE, cannot be renamed or deleted
+	// through the API.
+	System    bool      `gorm:"not null;default:false" json:"system"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 
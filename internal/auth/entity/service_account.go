@@ -0,0 +1,26 @@
+package entity
+
+import "time"
+
+// ServiceAccount is a non-human principal, such as a cron job or another
+// service, that gets tokens with the client_credentials grant.
+type ServiceAccount struct {
+	ID               string     `gorm:"primaryKey;type:uuid;default:gen_random_uuid()" json:"id"`
+	ClientID         string     `gorm:"size:64;uniqueIndex;not null" json:"client_id"`
+	ClientSecretHash string     `gorm:"size:64;not null" json:"-"`
+	Name             string     `gorm:"size:255;not null" json:"name"`
+	Description      string     `gorm:"size:500" json:"description"`
+	Disabled         bool       `gorm:"default:false" json:"disabled"`
+	SecretRotatedAt  time.Time  `json:"secret_rotated_at"`
+	LastUsedAt       *time.Time `json:"last_used_at"`
+
+	RoleID uint `gorm:"not null" json:"role_id"`
+	Role   Role `gorm:"foreignKey:RoleID;references:ID" json:"role"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (ServiceAccount) TableName() string {
+	return "auth4me.service_accounts"
+}
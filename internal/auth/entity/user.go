@@ -12,6 +12,10 @@ type User struct {
 	Password   string `gorm:"" json:"-"` // hashed password; can be empty for OAuth users
 	FullName   string `gorm:"size:255" json:"full_name"`
 	AvatarPath string `gorm:"size:500" json:"avatar_path"`
+	AvatarKey  string `gorm:"size:255" json:"-"` // blob key prefix of an uploaded avatar
+
+	PasswordChangedAt  time.Time `json:"password_changed_at"`
+	MustChangePassword bool      `gorm:"default:false" json:"must_change_password"`
 
 	Providers []OAuthProvider `gorm:"foreignKey:UserID" json:"providers,omitempty"`
 
@@ -19,8 +23,14 @@ type User struct {
 	VerificationToken  string    `gorm:"size:255" json:"-"`
 	VerificationSentAt time.Time `json:"-"`
 
-	MFAEnabled bool   `gorm:"default:false" json:"mfa_enabled"`
-	MFASecret  string `gorm:"size:255" json:"-"`
+	MFAEnabled bool   `gorm:"default:false" json:"mfa_enabled"` // TOTP confirmed
+	MFASecret  string `gorm:"size:255" json:"-"`                // encrypted
+	// Time step of the last TOTP code accepted, so no code works twice.
+	MFALastTOTPStep int64 `gorm:"default:0" json:"-"`
+
+	PhoneNumber   string `gorm:"size:32" json:"phone_number,omitempty"` // E.164
+	PhoneVerified bool   `gorm:"default:false" json:"phone_verified"`
+	SMSMFAEnabled bool   `gorm:"default:false" json:"sms_mfa_enabled"`
 
 	RoleID uint `gorm:"not null" json:"role_id"`
 	Role   Role `gorm:"foreignKey:RoleID;references:ID"`
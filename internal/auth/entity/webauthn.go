@@ -0,0 +1,24 @@
+package entity
+
+import "time"
+
+type WebAuthnCredential struct {
+	ID              uint       `gorm:"primaryKey" json:"id"`
+	UserID          string     `gorm:"type:uuid;index;not null" json:"user_id"`
+	Name            string     `gorm:"size:255" json:"name"`
+	CredentialID    []byte     `gorm:"uniqueIndex;not null" json:"-"`
+	PublicKey       []byte     `gorm:"not null" json:"-"`
+	AttestationType string     `gorm:"size:50" json:"attestation_type"`
+	AAGUID          []byte     `json:"-"`
+	SignCount       uint32     `gorm:"default:0" json:"sign_count"`
+	Transports      string     `gorm:"size:255" json:"transports"` // comma separated
+	UserVerified    bool       `gorm:"default:false" json:"user_verified"`
+	BackupEligible  bool       `gorm:"default:false" json:"backup_eligible"`
+	BackupState     bool       `gorm:"default:false" json:"backup_state"`
+	LastUsedAt      *time.Time `json:"last_used_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+func (WebAuthnCredential) TableName() string {
+	return "auth4me.webauthn_credentials"
+}
@@ -1,13 +1,19 @@
 package handler
 
 import (
+	"errors"
+	"io"
 	"log"
 	"net/http"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/revandpratama/auth4me/config"
 	"github.com/revandpratama/auth4me/internal/auth/dto"
 	"github.com/revandpratama/auth4me/internal/auth/usecase"
+	"github.com/revandpratama/auth4me/pkg"
+	"gorm.io/gorm"
 )
 
 type AuthHandler interface {
@@ -16,6 +22,16 @@ type AuthHandler interface {
 	RegisterHandler(c *fiber.Ctx) error
 	LogoutHandler(c *fiber.Ctx) error
 	RefreshTokenHandler(c *fiber.Ctx) error
+	ChangePasswordHandler(c *fiber.Ctx) error
+	ForcePasswordChangeHandler(c *fiber.Ctx) error
+	ForgotPasswordHandler(c *fiber.Ctx) error
+	MagicLinkHandler(c *fiber.Ctx) error
+	VerifyMagicLinkHandler(c *fiber.Ctx) error
+	EmailOTPHandler(c *fiber.Ctx) error
+	VerifyEmailOTPHandler(c *fiber.Ctx) error
+	ResetPasswordHandler(c *fiber.Ctx) error
+	UploadAvatarHandler(c *fiber.Ctx) error
+	DeleteAvatarHandler(c *fiber.Ctx) error
 }
 
 type authHandler struct {
@@ -44,8 +60,19 @@ func (h *authHandler) LoginHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	refreshToken, accessToken, err := h.authUsecase.Login(loginRequest.Email, loginRequest.Password)
+	tokens, err := h.authUsecase.Login(loginRequest.Email, loginRequest.Password, c.Cookies(trustedDeviceCookie))
 	if err != nil {
+		if errors.Is(err, usecase.ErrLockedOut) {
+			return lockedOutResponse(c)
+		}
+		// only after the directory accepted the password, so it tells
+		// nothing to someone guessing
+		if errors.Is(err, usecase.ErrAccountLinkRequired) {
+			return c.Status(http.StatusConflict).JSON(&Response{
+				Code:    http.StatusConflict,
+				Message: err.Error(),
+			})
+		}
 		return c.Status(http.StatusUnauthorized).JSON(&Response{
 			Code:    http.StatusUnauthorized,
 			Message: "unauthorized",
@@ -54,11 +81,8 @@ func (h *authHandler) LoginHandler(c *fiber.Ctx) error {
 
 	return c.Status(http.StatusOK).JSON(&Response{
 		Code:    http.StatusOK,
-		Message: "login success",
-		Data: dto.TokenResponse{
-			AccessToken:  accessToken,
-			RefreshToken: refreshToken,
-		},
+		Message: loginMessage(tokens, "login success"),
+		Data:    tokens,
 	})
 }
 
@@ -70,6 +94,24 @@ func (h *authHandler) RegisterHandler(c *fiber.Ctx) error {
 	}
 
 	if err := h.authUsecase.Register(&registerRequest); err != nil {
+		if errors.Is(err, usecase.ErrRegistrationDisabled) {
+			return c.Status(http.StatusForbidden).JSON(&Response{
+				Code:    http.StatusForbidden,
+				Message: "forbidden, registration is disabled",
+			})
+		}
+		if errors.Is(err, usecase.ErrSignupDomainNotAllowed) {
+			return c.Status(http.StatusForbidden).JSON(&Response{
+				Code:    http.StatusForbidden,
+				Message: "forbidden, " + err.Error(),
+			})
+		}
+		if errors.Is(err, usecase.ErrEmailExists) || errors.Is(err, usecase.ErrPasswordMismatch) {
+			return c.Status(http.StatusBadRequest).JSON(&Response{
+				Code:    http.StatusBadRequest,
+				Message: err.Error(),
+			})
+		}
 		return err
 	}
 
@@ -109,7 +151,7 @@ func (h *authHandler) RefreshTokenHandler(c *fiber.Ctx) error {
 
 	accessToken := strings.TrimPrefix(authHeader, bearerPrefix)
 
-	newRefreshToken, newAccessToken, err := h.authUsecase.RefreshToken(refreshToken, accessToken)
+	tokens, err := h.authUsecase.RefreshToken(refreshToken, accessToken)
 	if err != nil {
 		// LOG THE REAL ERROR
 		log.Printf("CRITICAL: Token refresh failed. Raw Error: %v", err)
@@ -124,10 +166,7 @@ func (h *authHandler) RefreshTokenHandler(c *fiber.Ctx) error {
 	return c.Status(http.StatusOK).JSON(&Response{
 		Code:    http.StatusOK,
 		Message: "refresh token success",
-		Data: dto.TokenResponse{
-			AccessToken:  newAccessToken,
-			RefreshToken: newRefreshToken,
-		},
+		Data:    tokens,
 	})
 }
 
@@ -159,3 +198,343 @@ func (h *authHandler) GetUserHandler(c *fiber.Ctx) error {
 		Data:    user,
 	})
 }
+
+func (h *authHandler) ChangePasswordHandler(c *fiber.Ctx) error {
+
+	userID := c.Locals("userID")
+	if userID == nil {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	var changePasswordRequest dto.ChangePasswordRequest
+	if err := c.BodyParser(&changePasswordRequest); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request body",
+		})
+	}
+
+	if err := h.authUsecase.ChangePassword(userID.(string), &changePasswordRequest); err != nil {
+		return passwordErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "change password success",
+	})
+}
+
+func (h *authHandler) ForcePasswordChangeHandler(c *fiber.Ctx) error {
+
+	userID := c.Params("id")
+	if userID == "" {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request: user id is required",
+		})
+	}
+
+	if err := h.authUsecase.ForcePasswordChange(userID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(http.StatusNotFound).JSON(&Response{
+				Code:    http.StatusNotFound,
+				Message: "user not found",
+			})
+		}
+		return c.Status(http.StatusInternalServerError).JSON(&Response{
+			Code:    http.StatusInternalServerError,
+			Message: "internal server error",
+		})
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "force password change success",
+	})
+}
+
+func (h *authHandler) ForgotPasswordHandler(c *fiber.Ctx) error {
+
+	var forgotPasswordRequest dto.ForgotPasswordRequest
+	if err := c.BodyParser(&forgotPasswordRequest); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request body",
+		})
+	}
+
+	if err := h.authUsecase.ForgotPassword(forgotPasswordRequest.Email); err != nil {
+		log.Printf("forgot password failed: %v", err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "if the email is registered, a password reset link has been sent",
+	})
+}
+
+func (h *authHandler) ResetPasswordHandler(c *fiber.Ctx) error {
+
+	var resetPasswordRequest dto.ResetPasswordRequest
+	if err := c.BodyParser(&resetPasswordRequest); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request body",
+		})
+	}
+
+	if err := h.authUsecase.ResetPassword(&resetPasswordRequest); err != nil {
+		return passwordErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "reset password success",
+	})
+}
+
+const magicLinkCookie = "auth4me_magic_link"
+
+func (h *authHandler) MagicLinkHandler(c *fiber.Ctx) error {
+
+	var magicLinkRequest dto.MagicLinkRequest
+	if err := c.BodyParser(&magicLinkRequest); err != nil || magicLinkRequest.Email == "" {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request body",
+		})
+	}
+
+	browserBinding := ""
+	if magicLinkRequest.BindBrowser {
+		browserBinding = uuid.NewString()
+		c.Cookie(&fiber.Cookie{
+			Name:     magicLinkCookie,
+			Value:    browserBinding,
+			MaxAge:   config.ENV.MAGIC_LINK_TTL_SECOND,
+			HTTPOnly: true,
+			Secure:   c.Protocol() == "https",
+			SameSite: fiber.CookieSameSiteLaxMode,
+		})
+	}
+
+	if err := h.authUsecase.RequestMagicLink(magicLinkRequest.Email, browserBinding); err != nil {
+		log.Printf("magic link request failed: %v", err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "if the email can sign in, a sign-in link has been sent",
+	})
+}
+
+func (h *authHandler) VerifyMagicLinkHandler(c *fiber.Ctx) error {
+
+	var verifyRequest dto.MagicLinkVerifyRequest
+	if err := c.BodyParser(&verifyRequest); err != nil || verifyRequest.Token == "" {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request body",
+		})
+	}
+
+	tokens, err := h.authUsecase.VerifyMagicLink(verifyRequest.Token, c.Cookies(magicLinkCookie))
+	if err != nil {
+		if !errors.Is(err, usecase.ErrInvalidToken) && !errors.Is(err, usecase.ErrRegistrationDisabled) {
+			log.Printf("magic link verification failed: %v", err)
+		}
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, invalid or expired link",
+		})
+	}
+
+	c.ClearCookie(magicLinkCookie)
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: loginMessage(tokens, "login success"),
+		Data:    tokens,
+	})
+}
+
+func (h *authHandler) EmailOTPHandler(c *fiber.Ctx) error {
+
+	var otpRequest dto.EmailOTPRequest
+	if err := c.BodyParser(&otpRequest); err != nil || otpRequest.Email == "" {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request body",
+		})
+	}
+
+	if err := h.authUsecase.RequestEmailOTP(otpRequest.Email); err != nil {
+		log.Printf("email otp request failed: %v", err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "if the email can sign in, a sign-in code has been sent",
+	})
+}
+
+func (h *authHandler) VerifyEmailOTPHandler(c *fiber.Ctx) error {
+
+	var verifyRequest dto.EmailOTPVerifyRequest
+	if err := c.BodyParser(&verifyRequest); err != nil || verifyRequest.Email == "" || verifyRequest.Code == "" {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request body",
+		})
+	}
+
+	tokens, err := h.authUsecase.VerifyEmailOTP(verifyRequest.Email, verifyRequest.Code)
+	if err != nil {
+		if errors.Is(err, usecase.ErrLockedOut) {
+			return lockedOutResponse(c)
+		}
+		if !errors.Is(err, usecase.ErrInvalidToken) && !errors.Is(err, usecase.ErrRegistrationDisabled) {
+			log.Printf("email otp verification failed: %v", err)
+		}
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, invalid or expired code",
+		})
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: loginMessage(tokens, "login success"),
+		Data:    tokens,
+	})
+}
+
+// loginMessage tells the client when the returned token is restricted and
+// another step is needed before it gets a full token pair.
+func loginMessage(tokens *dto.TokenResponse, success string) string {
+	switch tokens.NextStep {
+	case pkg.PurposePasswordChange:
+		return "password change required"
+	case pkg.PurposeMFA:
+		return "mfa required"
+	default:
+		return success
+	}
+}
+
+func lockedOutResponse(c *fiber.Ctx) error {
+	return c.Status(http.StatusTooManyRequests).JSON(&Response{
+		Code:    http.StatusTooManyRequests,
+		Message: usecase.ErrLockedOut.Error(),
+	})
+}
+
+func passwordErrorResponse(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, usecase.ErrPasswordMismatch), errors.Is(err, usecase.ErrPasswordReused):
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		})
+	case errors.Is(err, usecase.ErrInvalidPassword), errors.Is(err, usecase.ErrInvalidToken):
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, " + err.Error(),
+		})
+	default:
+		log.Printf("password update failed: %v", err)
+		return c.Status(http.StatusInternalServerError).JSON(&Response{
+			Code:    http.StatusInternalServerError,
+			Message: "internal server error",
+		})
+	}
+}
+
+// UploadAvatarHandler takes the image in the avatar field of a multipart form.
+func (h *authHandler) UploadAvatarHandler(c *fiber.Ctx) error {
+
+	userID := c.Locals("userID")
+	if userID == nil {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	fileHeader, err := c.FormFile("avatar")
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request: avatar file is required",
+		})
+	}
+	if fileHeader.Size > int64(config.ENV.AVATAR_MAX_BYTES) {
+		return avatarErrorResponse(c, pkg.ErrAvatarTooLarge)
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, int64(config.ENV.AVATAR_MAX_BYTES)+1))
+	if err != nil {
+		return err
+	}
+
+	avatar, err := h.authUsecase.UploadAvatar(userID.(string), data)
+	if err != nil {
+		return avatarErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "upload avatar success",
+		Data:    avatar,
+	})
+}
+
+func (h *authHandler) DeleteAvatarHandler(c *fiber.Ctx) error {
+
+	userID := c.Locals("userID")
+	if userID == nil {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	if err := h.authUsecase.DeleteAvatar(userID.(string)); err != nil {
+		return err
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "delete avatar success",
+	})
+}
+
+func avatarErrorResponse(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, pkg.ErrAvatarTooLarge):
+		return c.Status(http.StatusRequestEntityTooLarge).JSON(&Response{
+			Code:    http.StatusRequestEntityTooLarge,
+			Message: err.Error(),
+		})
+	case errors.Is(err, pkg.ErrUnsupportedAvatarImage):
+		return c.Status(http.StatusUnsupportedMediaType).JSON(&Response{
+			Code:    http.StatusUnsupportedMediaType,
+			Message: err.Error(),
+		})
+	default:
+		log.Printf("avatar upload failed: %v", err)
+		return c.Status(http.StatusInternalServerError).JSON(&Response{
+			Code:    http.StatusInternalServerError,
+			Message: "internal server error",
+		})
+	}
+}
@@ -0,0 +1,409 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+	"github.com/revandpratama/auth4me/internal/auth/usecase"
+	"github.com/revandpratama/auth4me/pkg"
+)
+
+type MFAHandler interface {
+	EnrollTOTP(c *fiber.Ctx) error
+	ConfirmTOTP(c *fiber.Ctx) error
+	DisableTOTP(c *fiber.Ctx) error
+	VerifyMFA(c *fiber.Ctx) error
+	RegenerateRecoveryCodes(c *fiber.Ctx) error
+	EnrollSMS(c *fiber.Ctx) error
+	ConfirmSMS(c *fiber.Ctx) error
+	DisableSMS(c *fiber.Ctx) error
+	SendSMSCode(c *fiber.Ctx) error
+	ListTrustedDevices(c *fiber.Ctx) error
+	RevokeTrustedDevice(c *fiber.Ctx) error
+}
+
+const trustedDeviceCookie = "auth4me_trusted_device"
+
+type mfaHandler struct {
+	usecase usecase.MFAUsecase
+}
+
+func NewMFAHandler(usecase usecase.MFAUsecase) MFAHandler {
+	return &mfaHandler{
+		usecase: usecase,
+	}
+}
+
+func (h *mfaHandler) EnrollTOTP(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	enrollment, err := h.usecase.EnrollTOTP(userID)
+	if err != nil {
+		return mfaErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "totp enrollment started",
+		Data:    enrollment,
+	})
+}
+
+func (h *mfaHandler) ConfirmTOTP(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	var codeRequest dto.MFACodeRequest
+	if err := c.BodyParser(&codeRequest); err != nil || codeRequest.Code == "" {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request body",
+		})
+	}
+
+	recoveryCodes, err := h.usecase.ConfirmTOTP(userID, codeRequest.Code)
+	if err != nil {
+		return mfaErrorResponse(c, err)
+	}
+
+	if recoveryCodes == nil {
+		return c.Status(http.StatusOK).JSON(&Response{
+			Code:    http.StatusOK,
+			Message: "totp enabled, your existing recovery codes stay valid",
+		})
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "totp enabled, store the recovery codes safely, they will not be shown again",
+		Data:    recoveryCodes,
+	})
+}
+
+func (h *mfaHandler) RegenerateRecoveryCodes(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	recoveryCodes, err := h.usecase.RegenerateRecoveryCodes(userID)
+	if err != nil {
+		return mfaErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "recovery codes regenerated, previous codes no longer work",
+		Data:    recoveryCodes,
+	})
+}
+
+func (h *mfaHandler) DisableTOTP(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	var codeRequest dto.MFACodeRequest
+	if err := c.BodyParser(&codeRequest); err != nil || codeRequest.Code == "" {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request body",
+		})
+	}
+
+	if err := h.usecase.DisableTOTP(userID, codeRequest.Code); err != nil {
+		return mfaErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "totp disabled",
+	})
+}
+
+func (h *mfaHandler) VerifyMFA(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+	provider, _ := c.Locals("provider").(string)
+
+	var codeRequest dto.MFACodeRequest
+	if err := c.BodyParser(&codeRequest); err != nil || codeRequest.Code == "" {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request body",
+		})
+	}
+
+	prior, _ := c.Locals("authentication").(pkg.Authentication)
+
+	tokens, err := h.usecase.VerifyMFA(userID, provider, prior, codeRequest.Code)
+	if err != nil {
+		return mfaErrorResponse(c, err)
+	}
+
+	if codeRequest.RememberDevice {
+		h.trustDevice(c, userID)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "mfa verification success",
+		Data:    tokens,
+	})
+}
+
+func (h *mfaHandler) EnrollSMS(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	var enrollRequest dto.SMSEnrollRequest
+	if err := c.BodyParser(&enrollRequest); err != nil || enrollRequest.PhoneNumber == "" {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request body",
+		})
+	}
+
+	if err := h.usecase.EnrollSMS(userID, enrollRequest.PhoneNumber); err != nil {
+		return mfaErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "sms enrollment started, a verification code has been sent",
+	})
+}
+
+func (h *mfaHandler) ConfirmSMS(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	var codeRequest dto.MFACodeRequest
+	if err := c.BodyParser(&codeRequest); err != nil || codeRequest.Code == "" {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request body",
+		})
+	}
+
+	recoveryCodes, err := h.usecase.ConfirmSMS(userID, codeRequest.Code)
+	if err != nil {
+		return mfaErrorResponse(c, err)
+	}
+
+	if recoveryCodes == nil {
+		return c.Status(http.StatusOK).JSON(&Response{
+			Code:    http.StatusOK,
+			Message: "sms mfa enabled, your existing recovery codes stay valid",
+		})
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "sms mfa enabled, store the recovery codes safely, they will not be shown again",
+		Data:    recoveryCodes,
+	})
+}
+
+func (h *mfaHandler) DisableSMS(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	var codeRequest dto.MFACodeRequest
+	if err := c.BodyParser(&codeRequest); err != nil || codeRequest.Code == "" {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request body",
+		})
+	}
+
+	if err := h.usecase.DisableSMS(userID, codeRequest.Code); err != nil {
+		return mfaErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "sms mfa disabled",
+	})
+}
+
+func (h *mfaHandler) SendSMSCode(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	if err := h.usecase.SendSMSCode(userID); err != nil {
+		return mfaErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "sms code sent",
+	})
+}
+
+// trustDevice sets the trusted device cookie. Failing to remember the device
+// does not fail the login that asked for it.
+func (h *mfaHandler) trustDevice(c *fiber.Ctx, userID string) {
+
+	token, expiresAt, err := h.usecase.TrustDevice(userID, c.Get(fiber.HeaderUserAgent), c.IP())
+	if err != nil {
+		log.Printf("failed to trust device: %v", err)
+		return
+	}
+	if token == "" {
+		return
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     trustedDeviceCookie,
+		Value:    token,
+		Expires:  expiresAt,
+		HTTPOnly: true,
+		Secure:   c.Protocol() == "https",
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+func (h *mfaHandler) ListTrustedDevices(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	devices, err := h.usecase.ListTrustedDevices(userID)
+	if err != nil {
+		return mfaErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "get trusted devices success",
+		Data:    devices,
+	})
+}
+
+func (h *mfaHandler) RevokeTrustedDevice(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	deviceID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request",
+		})
+	}
+
+	if err := h.usecase.RevokeTrustedDevice(userID, uint(deviceID)); err != nil {
+		return mfaErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "revoke trusted device success",
+	})
+}
+
+func mfaErrorResponse(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, usecase.ErrLockedOut):
+		return lockedOutResponse(c)
+	case errors.Is(err, usecase.ErrInvalidMFACode), errors.Is(err, usecase.ErrMFACodeReused):
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, " + err.Error(),
+		})
+	case errors.Is(err, usecase.ErrInvalidPhone):
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		})
+	case errors.Is(err, usecase.ErrTrustedDeviceNotFound):
+		return c.Status(http.StatusNotFound).JSON(&Response{
+			Code:    http.StatusNotFound,
+			Message: err.Error(),
+		})
+	case errors.Is(err, usecase.ErrSMSThrottled):
+		return c.Status(http.StatusTooManyRequests).JSON(&Response{
+			Code:    http.StatusTooManyRequests,
+			Message: err.Error(),
+		})
+	case errors.Is(err, usecase.ErrMFAAlreadyEnabled), errors.Is(err, usecase.ErrMFANotEnrolled), errors.Is(err, usecase.ErrMFANotEnabled):
+		return c.Status(http.StatusConflict).JSON(&Response{
+			Code:    http.StatusConflict,
+			Message: err.Error(),
+		})
+	default:
+		log.Printf("mfa request failed: %v", err)
+		return c.Status(http.StatusInternalServerError).JSON(&Response{
+			Code:    http.StatusInternalServerError,
+			Message: "internal server error",
+		})
+	}
+}
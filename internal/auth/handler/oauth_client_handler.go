@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+	"github.com/revandpratama/auth4me/internal/auth/usecase"
+)
+
+type OAuthClientHandler interface {
+	RegisterClient(c *fiber.Ctx) error
+	GetRegisteredClient(c *fiber.Ctx) error
+	UpdateRegisteredClient(c *fiber.Ctx) error
+	DeleteRegisteredClient(c *fiber.Ctx) error
+	GetAllClients(c *fiber.Ctx) error
+	GetClientByClientID(c *fiber.Ctx) error
+	RotateClientSecret(c *fiber.Ctx) error
+	DeleteClient(c *fiber.Ctx) error
+}
+
+type oauthClientHandler struct {
+	usecase usecase.OAuthClientUsecase
+}
+
+func NewOAuthClientHandler(usecase usecase.OAuthClientUsecase) OAuthClientHandler {
+	return &oauthClientHandler{
+		usecase: usecase,
+	}
+}
+
+// bearerToken returns the initial or registration access token the client
+// presents, empty when there is none.
+func bearerToken(c *fiber.Ctx) string {
+	token, _ := strings.CutPrefix(c.Get("Authorization"), "Bearer ")
+	return token
+}
+
+func (h *oauthClientHandler) RegisterClient(c *fiber.Ctx) error {
+
+	c.Set("Cache-Control", "no-store")
+	c.Set("Pragma", "no-cache")
+
+	var req dto.ClientRegistrationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(&oauthErrorBody{Error: "invalid_client_metadata", ErrorDescription: "bad request body"})
+	}
+
+	client, err := h.usecase.RegisterClient(bearerToken(c), &req)
+	if err != nil {
+		return oauthProtocolError(c, err)
+	}
+
+	return c.Status(http.StatusCreated).JSON(client)
+}
+
+func (h *oauthClientHandler) GetRegisteredClient(c *fiber.Ctx) error {
+
+	c.Set("Cache-Control", "no-store")
+	c.Set("Pragma", "no-cache")
+
+	client, err := h.usecase.GetRegisteredClient(c.Params("client_id"), bearerToken(c))
+	if err != nil {
+		return oauthProtocolError(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(client)
+}
+
+func (h *oauthClientHandler) UpdateRegisteredClient(c *fiber.Ctx) error {
+
+	c.Set("Cache-Control", "no-store")
+	c.Set("Pragma", "no-cache")
+
+	var req dto.ClientRegistrationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(&oauthErrorBody{Error: "invalid_client_metadata", ErrorDescription: "bad request body"})
+	}
+
+	client, err := h.usecase.UpdateRegisteredClient(c.Params("client_id"), bearerToken(c), &req)
+	if err != nil {
+		return oauthProtocolError(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(client)
+}
+
+func (h *oauthClientHandler) DeleteRegisteredClient(c *fiber.Ctx) error {
+
+	if err := h.usecase.DeleteRegisteredClient(c.Params("client_id"), bearerToken(c)); err != nil {
+		return oauthProtocolError(c, err)
+	}
+
+	return c.SendStatus(http.StatusNoContent)
+}
+
+func (h *oauthClientHandler) GetAllClients(c *fiber.Ctx) error {
+
+	clients, err := h.usecase.GetAllClients()
+	if err != nil {
+		return oauthClientErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "get all oauth clients success",
+		Data:    clients,
+	})
+}
+
+func (h *oauthClientHandler) GetClientByClientID(c *fiber.Ctx) error {
+
+	client, err := h.usecase.GetClientByClientID(c.Params("client_id"))
+	if err != nil {
+		return oauthClientErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "get oauth client success",
+		Data:    client,
+	})
+}
+
+func (h *oauthClientHandler) RotateClientSecret(c *fiber.Ctx) error {
+
+	credentials, err := h.usecase.RotateClientSecret(c.Params("client_id"))
+	if err != nil {
+		return oauthClientErrorResponse(c, err)
+	}
+
+	c.Set("Cache-Control", "no-store")
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "oauth client secret rotated, the previous secret no longer works",
+		Data:    credentials,
+	})
+}
+
+func (h *oauthClientHandler) DeleteClient(c *fiber.Ctx) error {
+
+	if err := h.usecase.DeleteClient(c.Params("client_id")); err != nil {
+		return oauthClientErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "delete oauth client success",
+	})
+}
+
+func oauthClientErrorResponse(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, usecase.ErrClientNotFound):
+		return c.Status(http.StatusNotFound).JSON(&Response{
+			Code:    http.StatusNotFound,
+			Message: err.Error(),
+		})
+	case errors.Is(err, usecase.ErrPublicClientSecret):
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		})
+	default:
+		log.Printf("oauth client request failed: %v", err)
+		return c.Status(http.StatusInternalServerError).JSON(&Response{
+			Code:    http.StatusInternalServerError,
+			Message: "internal server error",
+		})
+	}
+}
@@ -1,16 +1,26 @@
 package handler
 
 import (
+	"errors"
+	"log"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"github.com/revandpratama/auth4me/internal/auth/dto"
 	"github.com/revandpratama/auth4me/internal/auth/usecase"
+	"github.com/revandpratama/auth4me/pkg"
 )
 
 type OAuthHandler interface {
-	GoogleLogin(c *fiber.Ctx) error
-	GoogleOAuthCallback(c *fiber.Ctx) error
+	OAuthLogin(c *fiber.Ctx) error
+	OAuthCallback(c *fiber.Ctx) error
+	LinkProvider(c *fiber.Ctx) error
+	ListLinkedProviders(c *fiber.Ctx) error
+	UnlinkProvider(c *fiber.Ctx) error
+	GetUpstreamToken(c *fiber.Ctx) error
 }
 
 type oauthHandler struct {
@@ -23,68 +33,255 @@ func NewOAuthHandler(usecase usecase.OAuthUsecase) OAuthHandler {
 	}
 }
 
-func (h *oauthHandler) GoogleLogin(c *fiber.Ctx) error {
+const oauthBindingCookie = "auth4me_oauth_binding"
 
-	url, state := h.usecase.GetOAuthURL()
-	if url == "" {
-		return c.Status(http.StatusInternalServerError).JSON(&Response{
-			Code:    http.StatusInternalServerError,
-			Message: "internal server error: failed to get oauth url",
-		})
+// OAuthLogin starts a login with the provider. With return_to the browser is
+// sent straight to the provider, otherwise the authorization URL is returned
+// for the frontend to navigate to.
+func (h *oauthHandler) OAuthLogin(c *fiber.Ctx) error {
+
+	providerName := c.Params("provider")
+	returnTo := c.Query("return_to")
+
+	browserBinding := setOAuthBindingCookie(c)
+
+	authURL, err := h.usecase.GetOAuthURL(providerName, browserBinding, returnTo, "")
+	if err != nil {
+		return oauthErrorResponse(c, err)
+	}
+
+	if returnTo != "" {
+		return c.Redirect(authURL, http.StatusFound)
 	}
 
 	return c.Status(http.StatusOK).JSON(&Response{
 		Code:    http.StatusOK,
-		Message: "google oauth login success",
+		Message: providerName + " oauth login success",
 		Data: map[string]string{
-			"url":   url,
-			"state": state,
+			"url": authURL,
 		},
 	})
 }
 
-func (h *oauthHandler) GoogleOAuthCallback(c *fiber.Ctx) error {
+// LinkProvider starts the same flow as OAuthLogin for a signed in user, whose
+// callback links the identity instead of signing in. It always answers with
+// the URL, as the request carries the access token.
+func (h *oauthHandler) LinkProvider(c *fiber.Ctx) error {
 
-	code := c.Query("code")
-	if code == "" {
-		return c.Status(http.StatusBadRequest).JSON(&Response{
-			Code:    http.StatusBadRequest,
-			Message: "bad request: code is required",
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
 		})
 	}
 
-	stateFromQuery := c.Query("state")
-	if stateFromQuery == "" {
+	providerName := c.Params("provider")
+
+	browserBinding := setOAuthBindingCookie(c)
+
+	authURL, err := h.usecase.GetOAuthURL(providerName, browserBinding, c.Query("return_to"), userID)
+	if err != nil {
+		return oauthErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: providerName + " oauth link started",
+		Data: map[string]string{
+			"url": authURL,
+		},
+	})
+}
+
+func setOAuthBindingCookie(c *fiber.Ctx) string {
+	browserBinding := uuid.NewString()
+	c.Cookie(&fiber.Cookie{
+		Name:     oauthBindingCookie,
+		Value:    browserBinding,
+		MaxAge:   int(pkg.OAuthStateTTL.Seconds()),
+		HTTPOnly: true,
+		Secure:   c.Protocol() == "https",
+		// Lax, so the cookie comes along on the provider's redirect back
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	return browserBinding
+}
+
+func (h *oauthHandler) OAuthCallback(c *fiber.Ctx) error {
+
+	providerName := c.Params("provider")
+
+	state := c.Query("state")
+	if state == "" {
 		return c.Status(http.StatusBadRequest).JSON(&Response{
 			Code:    http.StatusBadRequest,
 			Message: "bad request: state is required",
 		})
 	}
 
-	stateFromHeader := c.Get("X-OAuth-State") 
+	// the provider sends error instead of code when the user cancelled
+	code := c.Query("code")
+
+	tokens, returnTo, err := h.usecase.OAuthCallback(providerName, code, state, c.Cookies(oauthBindingCookie))
+	c.ClearCookie(oauthBindingCookie)
 
-	if stateFromHeader == "" || stateFromHeader != stateFromQuery {
-        return c.Status(http.StatusBadRequest).JSON(&Response{
-            Code: http.StatusBadRequest,
-            Message: "bad request: invalid state token",
-        })
-    }
+	if returnTo != "" {
+		return redirectWithResult(c, returnTo, providerName, tokens, err)
+	}
 
-	refreshToken, accessToken, err := h.usecase.GoogleOAuthCallback(code)
 	if err != nil {
-		return c.Status(http.StatusInternalServerError).JSON(&Response{
-			Code:    http.StatusInternalServerError,
-			Message: "internal server error",
+		return oauthErrorResponse(c, err)
+	}
+
+	if tokens == nil {
+		return c.Status(http.StatusOK).JSON(&Response{
+			Code:    http.StatusOK,
+			Message: providerName + " provider linked",
 		})
 	}
 
 	return c.Status(http.StatusOK).JSON(&Response{
 		Code:    http.StatusOK,
-		Message: "google oauth login success",
-		Data: dto.TokenResponse{
-			AccessToken:  accessToken,
-			RefreshToken: refreshToken,
-		},
+		Message: loginMessage(tokens, providerName+" oauth login success"),
+		Data:    tokens,
+	})
+
+}
+
+// redirectWithResult hands the outcome to the frontend in the URL fragment,
+// which browsers never send to servers or in the Referer header.
+func redirectWithResult(c *fiber.Ctx, returnTo string, providerName string, tokens *dto.TokenResponse, err error) error {
+
+	result := url.Values{}
+	switch {
+	case err == nil && tokens == nil:
+		result.Set("linked", providerName)
+	case err == nil:
+		result.Set("access_token", tokens.AccessToken)
+		if tokens.RefreshToken != "" {
+			result.Set("refresh_token", tokens.RefreshToken)
+		}
+		if tokens.NextStep != "" {
+			result.Set("next_step", tokens.NextStep)
+		}
+	case errors.Is(err, usecase.ErrOAuthDenied), errors.Is(err, pkg.ErrInvalidIDToken), errors.Is(err, pkg.ErrOAuthProfile),
+		errors.Is(err, pkg.ErrInvalidSAMLResponse), errors.Is(err, usecase.ErrSAMLEmailMissing):
+		log.Printf("oauth login rejected: %v", err)
+		result.Set("error", "access_denied")
+	case errors.Is(err, usecase.ErrAccountLinkRequired):
+		result.Set("error", "account_link_required")
+	case errors.Is(err, usecase.ErrProviderLinkedElsewhere), errors.Is(err, usecase.ErrProviderAlreadyLinked):
+		result.Set("error", "already_linked")
+	case errors.Is(err, usecase.ErrSignupDomainNotAllowed):
+		result.Set("error", "signup_not_allowed")
+	default:
+		log.Printf("oauth request failed: %v", err)
+		result.Set("error", "server_error")
+	}
+
+	base, _, _ := strings.Cut(returnTo, "#")
+	return c.Redirect(base+"#"+result.Encode(), http.StatusFound)
+}
+
+func (h *oauthHandler) ListLinkedProviders(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	providers, err := h.usecase.ListLinkedProviders(userID)
+	if err != nil {
+		return oauthErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "get linked providers success",
+		Data:    providers,
 	})
+}
+
+func (h *oauthHandler) UnlinkProvider(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	if err := h.usecase.UnlinkProvider(userID, c.Params("provider")); err != nil {
+		return oauthErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "unlink provider success",
+	})
+}
 
+// GetUpstreamToken serves internal services, which authenticate with a
+// service key and name the user in the path.
+func (h *oauthHandler) GetUpstreamToken(c *fiber.Ctx) error {
+
+	token, err := h.usecase.GetUpstreamToken(c.Params("id"), c.Params("provider"))
+	if err != nil {
+		return oauthErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "get upstream token success",
+		Data:    token,
+	})
+}
+
+func oauthErrorResponse(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, usecase.ErrUnknownOAuthProvider):
+		return c.Status(http.StatusNotFound).JSON(&Response{
+			Code:    http.StatusNotFound,
+			Message: err.Error(),
+		})
+	case errors.Is(err, usecase.ErrProviderNotLinked):
+		return c.Status(http.StatusNotFound).JSON(&Response{
+			Code:    http.StatusNotFound,
+			Message: err.Error(),
+		})
+	case errors.Is(err, usecase.ErrAccountLinkRequired), errors.Is(err, usecase.ErrProviderLinkedElsewhere),
+		errors.Is(err, usecase.ErrProviderAlreadyLinked), errors.Is(err, usecase.ErrLastLoginMethod),
+		errors.Is(err, usecase.ErrUpstreamReauthRequired):
+		return c.Status(http.StatusConflict).JSON(&Response{
+			Code:    http.StatusConflict,
+			Message: err.Error(),
+		})
+	case errors.Is(err, usecase.ErrSignupDomainNotAllowed):
+		return c.Status(http.StatusForbidden).JSON(&Response{
+			Code:    http.StatusForbidden,
+			Message: "forbidden, " + err.Error(),
+		})
+	case errors.Is(err, usecase.ErrInvalidOAuthState), errors.Is(err, usecase.ErrInvalidReturnTo):
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request: " + err.Error(),
+		})
+	case errors.Is(err, usecase.ErrOAuthDenied), errors.Is(err, pkg.ErrInvalidIDToken), errors.Is(err, pkg.ErrOAuthProfile):
+		log.Printf("oauth login rejected: %v", err)
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, provider identity could not be verified",
+		})
+	default:
+		log.Printf("oauth request failed: %v", err)
+		return c.Status(http.StatusInternalServerError).JSON(&Response{
+			Code:    http.StatusInternalServerError,
+			Message: "internal server error",
+		})
+	}
 }
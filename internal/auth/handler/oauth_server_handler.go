@@ -0,0 +1,362 @@
+package handler
+
+import (
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+	"github.com/revandpratama/auth4me/internal/auth/usecase"
+	"github.com/revandpratama/auth4me/pkg"
+)
+
+type OAuthServerHandler interface {
+	Discovery(c *fiber.Ctx) error
+	JWKS(c *fiber.Ctx) error
+	Authorize(c *fiber.Ctx) error
+	GetAuthorizationRequest(c *fiber.Ctx) error
+	DecideAuthorization(c *fiber.Ctx) error
+	DeviceAuthorization(c *fiber.Ctx) error
+	GetDeviceAuthorization(c *fiber.Ctx) error
+	DecideDeviceAuthorization(c *fiber.Ctx) error
+	Token(c *fiber.Ctx) error
+	UserInfo(c *fiber.Ctx) error
+}
+
+type oauthServerHandler struct {
+	usecase usecase.OAuthServerUsecase
+}
+
+func NewOAuthServerHandler(usecase usecase.OAuthServerUsecase) OAuthServerHandler {
+	return &oauthServerHandler{
+		usecase: usecase,
+	}
+}
+
+// The protocol endpoints answer in the shape OAuth clients expect rather
+// than with Response.
+type oauthErrorBody struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func (h *oauthServerHandler) Discovery(c *fiber.Ctx) error {
+	return c.Status(http.StatusOK).JSON(h.usecase.Discovery())
+}
+
+func (h *oauthServerHandler) JWKS(c *fiber.Ctx) error {
+	jwks, err := h.usecase.JWKS()
+	if err != nil {
+		log.Printf("oauth server jwks failed: %v", err)
+		return c.Status(http.StatusInternalServerError).JSON(&oauthErrorBody{Error: "server_error"})
+	}
+	return c.Status(http.StatusOK).JSON(jwks)
+}
+
+func (h *oauthServerHandler) Authorize(c *fiber.Ctx) error {
+
+	var req dto.AuthorizeRequest
+	if err := c.QueryParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(&oauthErrorBody{Error: "invalid_request"})
+	}
+
+	redirectTo, err := h.usecase.Authorize(&req)
+	if err != nil {
+		return oauthProtocolError(c, err)
+	}
+
+	return c.Redirect(redirectTo, http.StatusFound)
+}
+
+func (h *oauthServerHandler) GetAuthorizationRequest(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+	authn, _ := c.Locals("authentication").(pkg.Authentication)
+
+	request, err := h.usecase.GetAuthorizationRequest(userID, authn, c.Params("id"))
+	if err != nil {
+		return authorizationErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "authorization request found",
+		Data:    request,
+	})
+}
+
+func (h *oauthServerHandler) DecideAuthorization(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+	authn, _ := c.Locals("authentication").(pkg.Authentication)
+
+	var decision dto.AuthorizationDecisionRequest
+	if err := c.BodyParser(&decision); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request body",
+		})
+	}
+
+	result, err := h.usecase.DecideAuthorization(userID, authn, c.Params("id"), decision.Approve)
+	if err != nil {
+		return authorizationErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "authorization decided",
+		Data:    result,
+	})
+}
+
+func authorizationErrorResponse(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, usecase.ErrAuthorizationRequestNotFound):
+		return c.Status(http.StatusNotFound).JSON(&Response{
+			Code:    http.StatusNotFound,
+			Message: err.Error(),
+		})
+	case errors.Is(err, usecase.ErrReauthenticationRequired):
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, " + err.Error(),
+		})
+	default:
+		log.Printf("oauth authorization failed: %v", err)
+		return c.Status(http.StatusInternalServerError).JSON(&Response{
+			Code:    http.StatusInternalServerError,
+			Message: "internal server error",
+		})
+	}
+}
+
+func (h *oauthServerHandler) DeviceAuthorization(c *fiber.Ctx) error {
+
+	c.Set("Cache-Control", "no-store")
+
+	var req dto.DeviceAuthorizationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(&oauthErrorBody{Error: "invalid_request"})
+	}
+
+	if err := applyClientBasicAuth(c, &req.ClientID, &req.ClientSecret); err != nil {
+		return oauthProtocolError(c, err)
+	}
+
+	device, err := h.usecase.DeviceAuthorization(&req)
+	if err != nil {
+		return oauthProtocolError(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(device)
+}
+
+func (h *oauthServerHandler) GetDeviceAuthorization(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	device, err := h.usecase.GetDeviceAuthorization(userID, c.Params("userCode"))
+	if err != nil {
+		return deviceErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "device authorization found",
+		Data:    device,
+	})
+}
+
+func (h *oauthServerHandler) DecideDeviceAuthorization(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+	authn, _ := c.Locals("authentication").(pkg.Authentication)
+
+	var decision dto.DeviceDecisionRequest
+	if err := c.BodyParser(&decision); err != nil || decision.UserCode == "" {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request body",
+		})
+	}
+
+	if err := h.usecase.DecideDeviceAuthorization(userID, authn, decision.UserCode, decision.Approve); err != nil {
+		return deviceErrorResponse(c, err)
+	}
+
+	message := "device denied"
+	if decision.Approve {
+		message = "device approved"
+	}
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: message,
+	})
+}
+
+func deviceErrorResponse(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, usecase.ErrDeviceCodeNotFound):
+		return c.Status(http.StatusNotFound).JSON(&Response{
+			Code:    http.StatusNotFound,
+			Message: err.Error(),
+		})
+	case errors.Is(err, usecase.ErrDeviceThrottled):
+		return c.Status(http.StatusTooManyRequests).JSON(&Response{
+			Code:    http.StatusTooManyRequests,
+			Message: err.Error(),
+		})
+	default:
+		log.Printf("device authorization failed: %v", err)
+		return c.Status(http.StatusInternalServerError).JSON(&Response{
+			Code:    http.StatusInternalServerError,
+			Message: "internal server error",
+		})
+	}
+}
+
+// Token accepts client credentials with HTTP Basic authentication or in
+// the form, but not both.
+func (h *oauthServerHandler) Token(c *fiber.Ctx) error {
+
+	c.Set("Cache-Control", "no-store")
+	c.Set("Pragma", "no-cache")
+
+	var req dto.OAuthTokenRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(&oauthErrorBody{Error: "invalid_request"})
+	}
+
+	if err := applyClientBasicAuth(c, &req.ClientID, &req.ClientSecret); err != nil {
+		return oauthProtocolError(c, err)
+	}
+
+	tokens, err := h.usecase.Token(&req)
+	if err != nil {
+		return oauthProtocolError(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(tokens)
+}
+
+// applyClientBasicAuth takes client_secret_basic credentials into clientID
+// and clientSecret, refusing requests that also send them in the form.
+func applyClientBasicAuth(c *fiber.Ctx, clientID *string, clientSecret *string) error {
+	authHeader := c.Get("Authorization")
+	if authHeader == "" {
+		return nil
+	}
+
+	basicID, basicSecret, ok := parseClientBasicAuth(authHeader)
+	if !ok {
+		return &usecase.OAuthError{Code: "invalid_client", Description: "malformed basic authentication"}
+	}
+	if *clientSecret != "" || (*clientID != "" && *clientID != basicID) {
+		return &usecase.OAuthError{Code: "invalid_request", Description: "use a single client authentication method"}
+	}
+
+	*clientID, *clientSecret = basicID, basicSecret
+	return nil
+}
+
+// parseClientBasicAuth decodes client_secret_basic credentials, which RFC
+// 6749 form-encodes before joining them.
+func parseClientBasicAuth(header string) (string, string, bool) {
+	encoded, ok := strings.CutPrefix(header, "Basic ")
+	if !ok {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	rawID, rawSecret, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", false
+	}
+	clientID, err := url.QueryUnescape(rawID)
+	if err != nil {
+		return "", "", false
+	}
+	clientSecret, err := url.QueryUnescape(rawSecret)
+	if err != nil {
+		return "", "", false
+	}
+	return clientID, clientSecret, true
+}
+
+func (h *oauthServerHandler) UserInfo(c *fiber.Ctx) error {
+
+	accessToken, ok := strings.CutPrefix(c.Get("Authorization"), "Bearer ")
+	if !ok || accessToken == "" {
+		c.Set("WWW-Authenticate", `Bearer realm="auth4me"`)
+		return c.Status(http.StatusUnauthorized).JSON(&oauthErrorBody{Error: "invalid_token"})
+	}
+
+	claims, err := h.usecase.UserInfo(accessToken)
+	if err != nil {
+		return oauthProtocolError(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(claims)
+}
+
+// oauthProtocolError reports err with the status RFC 6749 and RFC 6750
+// give its error code.
+func oauthProtocolError(c *fiber.Ctx, err error) error {
+
+	var oauthErr *usecase.OAuthError
+	if !errors.As(err, &oauthErr) {
+		log.Printf("oauth server request failed: %v", err)
+		return c.Status(http.StatusInternalServerError).JSON(&oauthErrorBody{Error: "server_error"})
+	}
+
+	status := http.StatusBadRequest
+	switch oauthErr.Code {
+	case "invalid_client":
+		status = http.StatusUnauthorized
+		if strings.HasPrefix(c.Get("Authorization"), "Basic ") {
+			c.Set("WWW-Authenticate", `Basic realm="auth4me"`)
+		}
+	case "invalid_token":
+		status = http.StatusUnauthorized
+		c.Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	case "insufficient_scope":
+		status = http.StatusForbidden
+		c.Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+	}
+
+	return c.Status(status).JSON(&oauthErrorBody{
+		Error:            oauthErr.Code,
+		ErrorDescription: oauthErr.Description,
+	})
+}
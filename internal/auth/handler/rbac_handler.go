@@ -1,12 +1,14 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/revandpratama/auth4me/internal/auth/entity"
 	"github.com/revandpratama/auth4me/internal/auth/usecase"
+	"gorm.io/gorm"
 )
 
 type RBACHandler interface {
@@ -266,6 +268,18 @@ func (h *rbacHandler) UpdateRole(c *fiber.Ctx) error {
 	}
 
 	if err := h.rbacUsecase.UpdateRole(&role); err != nil {
+		if errors.Is(err, usecase.ErrSystemRole) {
+			return c.Status(http.StatusForbidden).JSON(&Response{
+				Code:    http.StatusForbidden,
+				Message: err.Error(),
+			})
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(http.StatusNotFound).JSON(&Response{
+				Code:    http.StatusNotFound,
+				Message: "role not found",
+			})
+		}
 		return c.Status(http.StatusInternalServerError).JSON(&Response{
 			Code:    http.StatusInternalServerError,
 			Message: "internal server error",
@@ -289,6 +303,18 @@ func (h *rbacHandler) DeleteRole(c *fiber.Ctx) error {
 	}
 
 	if err := h.rbacUsecase.DeleteRole(uint(roleID)); err != nil {
+		if errors.Is(err, usecase.ErrSystemRole) {
+			return c.Status(http.StatusForbidden).JSON(&Response{
+				Code:    http.StatusForbidden,
+				Message: err.Error(),
+			})
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(http.StatusNotFound).JSON(&Response{
+				Code:    http.StatusNotFound,
+				Message: "role not found",
+			})
+		}
 		return c.Status(http.StatusInternalServerError).JSON(&Response{
 			Code:    http.StatusInternalServerError,
 			Message: "internal server error",
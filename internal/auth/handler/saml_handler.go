@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/revandpratama/auth4me/internal/auth/usecase"
+	"github.com/revandpratama/auth4me/pkg"
+)
+
+type SAMLHandler interface {
+	Metadata(c *fiber.Ctx) error
+	SAMLLogin(c *fiber.Ctx) error
+	AssertionConsumer(c *fiber.Ctx) error
+}
+
+type samlHandler struct {
+	usecase usecase.SAMLUsecase
+}
+
+func NewSAMLHandler(usecase usecase.SAMLUsecase) SAMLHandler {
+	return &samlHandler{
+		usecase: usecase,
+	}
+}
+
+const samlBindingCookie = "auth4me_saml_binding"
+
+func (h *samlHandler) Metadata(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, "application/samlmetadata+xml")
+	return c.Status(http.StatusOK).Send(h.usecase.Metadata())
+}
+
+// SAMLLogin starts an SP-initiated login, answering like OAuthLogin.
+func (h *samlHandler) SAMLLogin(c *fiber.Ctx) error {
+
+	providerName := c.Params("provider")
+	returnTo := c.Query("return_to")
+
+	browserBinding := uuid.NewString()
+	c.Cookie(&fiber.Cookie{
+		Name:     samlBindingCookie,
+		Value:    browserBinding,
+		MaxAge:   int(pkg.OAuthStateTTL.Seconds()),
+		HTTPOnly: true,
+		// the IdP posts the response cross-site, which Lax cookies do not
+		// come along on
+		Secure:   true,
+		SameSite: fiber.CookieSameSiteNoneMode,
+	})
+
+	loginURL, err := h.usecase.GetLoginURL(providerName, browserBinding, returnTo)
+	if err != nil {
+		return samlErrorResponse(c, err)
+	}
+
+	if returnTo != "" {
+		return c.Redirect(loginURL, http.StatusFound)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: providerName + " saml login success",
+		Data: map[string]string{
+			"url": loginURL,
+		},
+	})
+}
+
+// AssertionConsumer receives the IdP's response through the HTTP-POST binding.
+func (h *samlHandler) AssertionConsumer(c *fiber.Ctx) error {
+
+	samlResponse := c.FormValue("SAMLResponse")
+	relayState := c.FormValue("RelayState")
+	if samlResponse == "" || relayState == "" {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request: SAMLResponse and RelayState are required",
+		})
+	}
+
+	tokens, returnTo, err := h.usecase.AssertionConsumer(samlResponse, relayState, c.Cookies(samlBindingCookie))
+	c.ClearCookie(samlBindingCookie)
+
+	if returnTo != "" {
+		return redirectWithResult(c, returnTo, "saml", tokens, err)
+	}
+
+	if err != nil {
+		return samlErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: loginMessage(tokens, "saml login success"),
+		Data:    tokens,
+	})
+}
+
+func samlErrorResponse(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, usecase.ErrUnknownSAMLProvider):
+		return c.Status(http.StatusNotFound).JSON(&Response{
+			Code:    http.StatusNotFound,
+			Message: err.Error(),
+		})
+	case errors.Is(err, pkg.ErrInvalidSAMLResponse), errors.Is(err, usecase.ErrSAMLEmailMissing):
+		log.Printf("saml login rejected: %v", err)
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, assertion could not be verified",
+		})
+	default:
+		return oauthErrorResponse(c, err)
+	}
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+	"github.com/revandpratama/auth4me/internal/auth/usecase"
+)
+
+type ServiceAccountHandler interface {
+	GetAllServiceAccounts(c *fiber.Ctx) error
+	GetServiceAccountByID(c *fiber.Ctx) error
+	CreateServiceAccount(c *fiber.Ctx) error
+	UpdateServiceAccount(c *fiber.Ctx) error
+	RotateServiceAccountSecret(c *fiber.Ctx) error
+	DeleteServiceAccount(c *fiber.Ctx) error
+}
+
+type serviceAccountHandler struct {
+	usecase usecase.ServiceAccountUsecase
+}
+
+func NewServiceAccountHandler(usecase usecase.ServiceAccountUsecase) ServiceAccountHandler {
+	return &serviceAccountHandler{
+		usecase: usecase,
+	}
+}
+
+func (h *serviceAccountHandler) GetAllServiceAccounts(c *fiber.Ctx) error {
+
+	accounts, err := h.usecase.GetAllServiceAccounts()
+	if err != nil {
+		return serviceAccountErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "get all service accounts success",
+		Data:    accounts,
+	})
+}
+
+func (h *serviceAccountHandler) GetServiceAccountByID(c *fiber.Ctx) error {
+
+	account, err := h.usecase.GetServiceAccountByID(c.Params("id"))
+	if err != nil {
+		return serviceAccountErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "get service account success",
+		Data:    account,
+	})
+}
+
+func (h *serviceAccountHandler) CreateServiceAccount(c *fiber.Ctx) error {
+
+	var req dto.ServiceAccountRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request body",
+		})
+	}
+
+	credentials, err := h.usecase.CreateServiceAccount(&req)
+	if err != nil {
+		return serviceAccountErrorResponse(c, err)
+	}
+
+	c.Set("Cache-Control", "no-store")
+	return c.Status(http.StatusCreated).JSON(&Response{
+		Code:    http.StatusCreated,
+		Message: "service account created, store the client secret now as it cannot be shown again",
+		Data:    credentials,
+	})
+}
+
+func (h *serviceAccountHandler) UpdateServiceAccount(c *fiber.Ctx) error {
+
+	var req dto.ServiceAccountRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request body",
+		})
+	}
+
+	account, err := h.usecase.UpdateServiceAccount(c.Params("id"), &req)
+	if err != nil {
+		return serviceAccountErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "update service account success",
+		Data:    account,
+	})
+}
+
+func (h *serviceAccountHandler) RotateServiceAccountSecret(c *fiber.Ctx) error {
+
+	credentials, err := h.usecase.RotateServiceAccountSecret(c.Params("id"))
+	if err != nil {
+		return serviceAccountErrorResponse(c, err)
+	}
+
+	c.Set("Cache-Control", "no-store")
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "service account secret rotated, the previous secret no longer works",
+		Data:    credentials,
+	})
+}
+
+func (h *serviceAccountHandler) DeleteServiceAccount(c *fiber.Ctx) error {
+
+	if err := h.usecase.DeleteServiceAccount(c.Params("id")); err != nil {
+		return serviceAccountErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "delete service account success",
+	})
+}
+
+func serviceAccountErrorResponse(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, usecase.ErrServiceAccountNotFound):
+		return c.Status(http.StatusNotFound).JSON(&Response{
+			Code:    http.StatusNotFound,
+			Message: err.Error(),
+		})
+	case errors.Is(err, usecase.ErrServiceAccountNameRequired), errors.Is(err, usecase.ErrRoleNotFound):
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		})
+	default:
+		log.Printf("service account request failed: %v", err)
+		return c.Status(http.StatusInternalServerError).JSON(&Response{
+			Code:    http.StatusInternalServerError,
+			Message: "internal server error",
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package handler
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+	"github.com/revandpratama/auth4me/internal/auth/usecase"
+	"github.com/revandpratama/auth4me/pkg"
+)
+
+type WebAuthnHandler interface {
+	BeginRegistration(c *fiber.Ctx) error
+	FinishRegistration(c *fiber.Ctx) error
+	BeginLogin(c *fiber.Ctx) error
+	FinishLogin(c *fiber.Ctx) error
+	BeginMFA(c *fiber.Ctx) error
+	FinishMFA(c *fiber.Ctx) error
+	ListCredentials(c *fiber.Ctx) error
+	DeleteCredential(c *fiber.Ctx) error
+}
+
+type webAuthnHandler struct {
+	usecase usecase.WebAuthnUsecase
+}
+
+func NewWebAuthnHandler(usecase usecase.WebAuthnUsecase) WebAuthnHandler {
+	return &webAuthnHandler{
+		usecase: usecase,
+	}
+}
+
+func (h *webAuthnHandler) BeginRegistration(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	options, err := h.usecase.BeginRegistration(userID)
+	if err != nil {
+		return webAuthnErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "webauthn registration started",
+		Data:    options,
+	})
+}
+
+// FinishRegistration expects the PublicKeyCredential returned by
+// navigator.credentials.create() as the request body.
+func (h *webAuthnHandler) FinishRegistration(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	credential, err := h.usecase.FinishRegistration(userID, c.Query("name"), c.Body())
+	if err != nil {
+		return webAuthnErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "webauthn registration success",
+		Data:    credential,
+	})
+}
+
+func (h *webAuthnHandler) BeginLogin(c *fiber.Ctx) error {
+
+	var loginRequest dto.WebAuthnLoginRequest
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&loginRequest); err != nil {
+			return c.Status(http.StatusBadRequest).JSON(&Response{
+				Code:    http.StatusBadRequest,
+				Message: "bad request body",
+			})
+		}
+	}
+
+	options, err := h.usecase.BeginLogin(loginRequest.Email)
+	if err != nil {
+		return webAuthnErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "webauthn login started",
+		Data:    options,
+	})
+}
+
+// FinishLogin expects the PublicKeyCredential returned by
+// navigator.credentials.get() as the request body and the session id from
+// BeginLogin as the session_id query parameter.
+func (h *webAuthnHandler) FinishLogin(c *fiber.Ctx) error {
+
+	sessionID := c.Query("session_id")
+	if sessionID == "" {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request: session_id is required",
+		})
+	}
+
+	tokens, err := h.usecase.FinishLogin(sessionID, c.Body())
+	if err != nil {
+		return webAuthnErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "login success",
+		Data:    tokens,
+	})
+}
+
+func (h *webAuthnHandler) BeginMFA(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	options, err := h.usecase.BeginMFA(userID)
+	if err != nil {
+		return webAuthnErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "webauthn mfa challenge created",
+		Data:    options,
+	})
+}
+
+func (h *webAuthnHandler) FinishMFA(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+	provider, _ := c.Locals("provider").(string)
+
+	prior, _ := c.Locals("authentication").(pkg.Authentication)
+
+	tokens, err := h.usecase.FinishMFA(userID, provider, prior, c.Body())
+	if err != nil {
+		return webAuthnErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "mfa verification success",
+		Data:    tokens,
+	})
+}
+
+func (h *webAuthnHandler) ListCredentials(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	credentials, err := h.usecase.ListCredentials(userID)
+	if err != nil {
+		return webAuthnErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "get webauthn credentials success",
+		Data:    credentials,
+	})
+}
+
+func (h *webAuthnHandler) DeleteCredential(c *fiber.Ctx) error {
+
+	userID, ok := c.Locals("userID").(string)
+	if !ok || userID == "" {
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, user id is nil",
+		})
+	}
+
+	credentialID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: "bad request",
+		})
+	}
+
+	if err := h.usecase.DeleteCredential(userID, uint(credentialID)); err != nil {
+		return webAuthnErrorResponse(c, err)
+	}
+
+	return c.Status(http.StatusOK).JSON(&Response{
+		Code:    http.StatusOK,
+		Message: "delete webauthn credential success",
+	})
+}
+
+func webAuthnErrorResponse(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, usecase.ErrWebAuthnSession), errors.Is(err, usecase.ErrWebAuthnVerification), errors.Is(err, usecase.ErrWebAuthnCloned):
+		log.Printf("webauthn ceremony rejected: %v", err)
+		return c.Status(http.StatusUnauthorized).JSON(&Response{
+			Code:    http.StatusUnauthorized,
+			Message: "unauthorized, webauthn verification failed",
+		})
+	case errors.Is(err, usecase.ErrWebAuthnAttestation), errors.Is(err, usecase.ErrWebAuthnSameFactor):
+		return c.Status(http.StatusBadRequest).JSON(&Response{
+			Code:    http.StatusBadRequest,
+			Message: err.Error(),
+		})
+	case errors.Is(err, usecase.ErrWebAuthnNoCredentials), errors.Is(err, usecase.ErrWebAuthnCredentialGone):
+		return c.Status(http.StatusNotFound).JSON(&Response{
+			Code:    http.StatusNotFound,
+			Message: err.Error(),
+		})
+	default:
+		log.Printf("webauthn request failed: %v", err)
+		return c.Status(http.StatusInternalServerError).JSON(&Response{
+			Code:    http.StatusInternalServerError,
+			Message: "internal server error",
+		})
+	}
+}
@@ -2,8 +2,10 @@ package repository
 
 import (
 	"errors"
+	"time"
 
 	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"github.com/revandpratama/auth4me/pkg"
 	"gorm.io/gorm"
 )
 
@@ -14,6 +16,19 @@ type AuthRepository interface {
 	CreateUser(user *entity.User) (*entity.User, error)
 	GetUserPermissionsByRoleID(id uint) ([]entity.Permission, error)
 	UpdateUser(user *entity.User) error
+	UpdatePassword(userID string, hashedPassword string, historySize int) error
+	GetPasswordHistory(userID string, limit int) ([]entity.PasswordHistory, error)
+	SetMustChangePassword(userID string, mustChange bool) error
+	ReplaceEmailOTP(otp *entity.EmailOTP) error
+	GetEmailOTP(email string) (*entity.EmailOTP, error)
+	IncrementEmailOTPAttempts(id uint) error
+	DeleteEmailOTPs(email string) error
+	UpdateMFA(userID string, enabled bool, secret string) error
+	UseTOTPStep(userID string, step int64) (bool, error)
+	UpdateSMSMFA(userID string, phoneNumber string, verified bool, enabled bool) error
+	ReencryptMFASecrets() (int, error)
+	GetRoleByName(name string) (*entity.Role, error)
+	UpdateAvatar(userID string, avatarPath string, avatarKey string) error
 }
 
 type authRepository struct {
@@ -33,6 +48,9 @@ func (r *authRepository) GetUserByEmail(email string) (*entity.User, error) {
 	if err != nil {
 		return nil, err // return actual DB error
 	}
+	if user.MFASecret, err = pkg.DecryptField(user.MFASecret); err != nil {
+		return nil, err
+	}
 	return &user, nil
 }
 func (r *authRepository) GetUserByID(id string) (*entity.User, error) {
@@ -41,6 +59,9 @@ func (r *authRepository) GetUserByID(id string) (*entity.User, error) {
 	if err != nil {
 		return nil, err
 	}
+	if user.MFASecret, err = pkg.DecryptField(user.MFASecret); err != nil {
+		return nil, err
+	}
 	return &user, nil
 }
 
@@ -57,10 +78,19 @@ func (r *authRepository) IsEmailExists(email string) (bool, error) {
 }
 
 func (r *authRepository) CreateUser(user *entity.User) (*entity.User, error) {
-    if err := r.db.Create(user).Error; err != nil {
-        return nil, err
-    }
-    return user, nil
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		if user.Password == "" {
+			return nil
+		}
+		return tx.Create(&entity.PasswordHistory{UserID: user.ID, Password: user.Password}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
 }
 
 func (r *authRepository) GetUserPermissionsByRoleID(roleID uint) ([]entity.Permission, error) {
@@ -72,6 +102,158 @@ func (r *authRepository) GetUserPermissionsByRoleID(roleID uint) ([]entity.Permi
 	}
 	return permissions, nil
 }
+
+// UpdateUser never writes the MFA secret, which the loaded user holds in
+// plaintext; it only changes through UpdateMFA.
 func (r *authRepository) UpdateUser(user *entity.User) error {
-	return r.db.Model(&entity.User{}).Where("id = ?", user.ID).Updates(user).Error
+	return r.db.Model(&entity.User{}).Where("id = ?", user.ID).Omit("MFASecret", "MFALastTOTPStep").Updates(user).Error
+}
+
+// UpdatePassword stores the new hash on the user, clears a forced change,
+// records the hash in the password history and prunes the history down to
+// the newest historySize entries.
+func (r *authRepository) UpdatePassword(userID string, hashedPassword string, historySize int) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&entity.User{}).Where("id = ?", userID).Updates(map[string]any{
+			"password":             hashedPassword,
+			"password_changed_at":  time.Now(),
+			"must_change_password": false,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		if err := tx.Create(&entity.PasswordHistory{UserID: userID, Password: hashedPassword}).Error; err != nil {
+			return err
+		}
+
+		keep := tx.Model(&entity.PasswordHistory{}).Select("id").Where("user_id = ?", userID).Order("created_at DESC, id DESC").Limit(historySize)
+		return tx.Where("user_id = ? AND id NOT IN (?)", userID, keep).Delete(&entity.PasswordHistory{}).Error
+	})
+}
+
+func (r *authRepository) GetPasswordHistory(userID string, limit int) ([]entity.PasswordHistory, error) {
+	var history []entity.PasswordHistory
+	err := r.db.Where("user_id = ?", userID).Order("created_at DESC, id DESC").Limit(limit).Find(&history).Error
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+func (r *authRepository) SetMustChangePassword(userID string, mustChange bool) error {
+	return r.db.Model(&entity.User{}).Where("id = ?", userID).Update("must_change_password", mustChange).Error
+}
+
+// ReplaceEmailOTP invalidates any code previously sent to the address so only
+// the newest one can be used.
+func (r *authRepository) ReplaceEmailOTP(otp *entity.EmailOTP) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("email = ?", otp.Email).Delete(&entity.EmailOTP{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(otp).Error
+	})
+}
+
+func (r *authRepository) GetEmailOTP(email string) (*entity.EmailOTP, error) {
+	var otp entity.EmailOTP
+	err := r.db.Where("email = ?", email).Order("created_at DESC").First(&otp).Error
+	if err != nil {
+		return nil, err
+	}
+	return &otp, nil
+}
+
+func (r *authRepository) IncrementEmailOTPAttempts(id uint) error {
+	return r.db.Model(&entity.EmailOTP{}).Where("id = ?", id).Update("attempts", gorm.Expr("attempts + 1")).Error
+}
+
+func (r *authRepository) DeleteEmailOTPs(email string) error {
+	return r.db.Where("email = ?", email).Delete(&entity.EmailOTP{}).Error
+}
+
+// UpdateMFA writes both fields explicitly, as Updates with a struct would
+// skip disabling MFA or clearing the secret. The secret is stored encrypted.
+func (r *authRepository) UpdateMFA(userID string, enabled bool, secret string) error {
+	encryptedSecret, err := pkg.EncryptField(secret)
+	if err != nil {
+		return err
+	}
+
+	return r.db.Model(&entity.User{}).Where("id = ?", userID).Updates(map[string]any{
+		"mfa_enabled": enabled,
+		"mfa_secret":  encryptedSecret,
+	}).Error
+}
+
+// UseTOTPStep records step as the last accepted TOTP time step, unless it
+// is not after the one already recorded. It is a single statement, so
+// concurrent requests cannot both use the same code.
+func (r *authRepository) UseTOTPStep(userID string, step int64) (bool, error) {
+	result := r.db.Model(&entity.User{}).
+		Where("id = ? AND mfa_last_totp_step < ?", userID, step).
+		Update("mfa_last_totp_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (r *authRepository) UpdateSMSMFA(userID string, phoneNumber string, verified bool, enabled bool) error {
+	return r.db.Model(&entity.User{}).Where("id = ?", userID).Updates(map[string]any{
+		"phone_number":    phoneNumber,
+		"phone_verified":  verified,
+		"sms_mfa_enabled": enabled,
+	}).Error
+}
+
+func (r *authRepository) UpdateAvatar(userID string, avatarPath string, avatarKey string) error {
+	return r.db.Model(&entity.User{}).Where("id = ?", userID).Updates(map[string]any{
+		"avatar_path": avatarPath,
+		"avatar_key":  avatarKey,
+	}).Error
+}
+
+func (r *authRepository) GetRoleByName(name string) (*entity.Role, error) {
+	var role entity.Role
+	err := r.db.Where("name = ?", name).First(&role).Error
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// ReencryptMFASecrets rewrites every MFA secret that is still plaintext or
+// wrapped by a retired key, returning how many were rewritten.
+func (r *authRepository) ReencryptMFASecrets() (int, error) {
+	var users []entity.User
+	err := r.db.Select("id", "mfa_secret").Where("mfa_secret <> ''").Find(&users).Error
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, user := range users {
+		if !pkg.NeedsReencryption(user.MFASecret) {
+			continue
+		}
+
+		secret, err := pkg.DecryptField(user.MFASecret)
+		if err != nil {
+			return count, err
+		}
+		encryptedSecret, err := pkg.EncryptField(secret)
+		if err != nil {
+			return count, err
+		}
+
+		err = r.db.Model(&entity.User{}).Where("id = ? AND mfa_secret = ?", user.ID, user.MFASecret).Update("mfa_secret", encryptedSecret).Error
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
 }
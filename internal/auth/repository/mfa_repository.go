@@ -0,0 +1,131 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"gorm.io/gorm"
+)
+
+type MFARepository interface {
+	ReplaceRecoveryCodes(userID string, codeHashes []string) error
+	UseRecoveryCode(userID string, codeHash string) (bool, error)
+	CountUnusedRecoveryCodes(userID string) (int64, error)
+	DeleteRecoveryCodes(userID string) error
+	ReplaceSMSOTP(otp *entity.SMSOTP) error
+	GetSMSOTP(userID string) (*entity.SMSOTP, error)
+	IncrementSMSOTPAttempts(id uint) error
+	DeleteSMSOTPs(userID string) error
+	CreateTrustedDevice(device *entity.TrustedDevice) error
+	GetTrustedDevice(userID string, tokenHash string) (*entity.TrustedDevice, error)
+	GetTrustedDevicesByUserID(userID string) ([]entity.TrustedDevice, error)
+	TouchTrustedDevice(id uint) error
+	DeleteTrustedDevice(userID string, id uint) (bool, error)
+	DeleteTrustedDevices(userID string) error
+}
+
+type mfaRepository struct {
+	db *gorm.DB
+}
+
+func NewMFARepository(db *gorm.DB) MFARepository {
+	return &mfaRepository{
+		db: db,
+	}
+}
+
+// ReplaceRecoveryCodes drops every previous code, used or not, so only the
+// newest set is valid.
+func (r *mfaRepository) ReplaceRecoveryCodes(userID string, codeHashes []string) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&entity.MFARecoveryCode{}).Error; err != nil {
+			return err
+		}
+
+		codes := make([]entity.MFARecoveryCode, 0, len(codeHashes))
+		for _, hash := range codeHashes {
+			codes = append(codes, entity.MFARecoveryCode{UserID: userID, CodeHash: hash})
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+// UseRecoveryCode marks a matching unused code as used in a single statement,
+// so concurrent requests cannot spend the same code twice.
+func (r *mfaRepository) UseRecoveryCode(userID string, codeHash string) (bool, error) {
+	result := r.db.Model(&entity.MFARecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (r *mfaRepository) CountUnusedRecoveryCodes(userID string) (int64, error) {
+	var count int64
+	err := r.db.Model(&entity.MFARecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+func (r *mfaRepository) DeleteRecoveryCodes(userID string) error {
+	return r.db.Where("user_id = ?", userID).Delete(&entity.MFARecoveryCode{}).Error
+}
+
+func (r *mfaRepository) ReplaceSMSOTP(otp *entity.SMSOTP) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", otp.UserID).Delete(&entity.SMSOTP{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(otp).Error
+	})
+}
+
+func (r *mfaRepository) GetSMSOTP(userID string) (*entity.SMSOTP, error) {
+	var otp entity.SMSOTP
+	err := r.db.Where("user_id = ?", userID).Order("created_at DESC").First(&otp).Error
+	if err != nil {
+		return nil, err
+	}
+	return &otp, nil
+}
+
+func (r *mfaRepository) IncrementSMSOTPAttempts(id uint) error {
+	return r.db.Model(&entity.SMSOTP{}).Where("id = ?", id).Update("attempts", gorm.Expr("attempts + 1")).Error
+}
+
+func (r *mfaRepository) DeleteSMSOTPs(userID string) error {
+	return r.db.Where("user_id = ?", userID).Delete(&entity.SMSOTP{}).Error
+}
+
+func (r *mfaRepository) CreateTrustedDevice(device *entity.TrustedDevice) error {
+	return r.db.Create(device).Error
+}
+
+func (r *mfaRepository) GetTrustedDevice(userID string, tokenHash string) (*entity.TrustedDevice, error) {
+	var device entity.TrustedDevice
+	err := r.db.Where("user_id = ? AND token_hash = ? AND expires_at > ?", userID, tokenHash, time.Now()).First(&device).Error
+	if err != nil {
+		return nil, err
+	}
+	return &device, nil
+}
+
+func (r *mfaRepository) GetTrustedDevicesByUserID(userID string) ([]entity.TrustedDevice, error) {
+	var devices []entity.TrustedDevice
+	err := r.db.Where("user_id = ? AND expires_at > ?", userID, time.Now()).Order("created_at DESC").Find(&devices).Error
+	return devices, err
+}
+
+func (r *mfaRepository) TouchTrustedDevice(id uint) error {
+	return r.db.Model(&entity.TrustedDevice{}).Where("id = ?", id).Update("last_used_at", time.Now()).Error
+}
+
+func (r *mfaRepository) DeleteTrustedDevice(userID string, id uint) (bool, error) {
+	result := r.db.Where("user_id = ? AND id = ?", userID, id).Delete(&entity.TrustedDevice{})
+	return result.RowsAffected > 0, result.Error
+}
+
+func (r *mfaRepository) DeleteTrustedDevices(userID string) error {
+	return r.db.Where("user_id = ?", userID).Delete(&entity.TrustedDevice{}).Error
+}
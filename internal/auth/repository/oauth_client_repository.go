@@ -0,0 +1,96 @@
+package repository
+
+import (
+	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type OAuthClientRepository interface {
+	CreateClient(client *entity.OAuthClient) error
+	GetAllClients() ([]entity.OAuthClient, error)
+	GetClientByClientID(clientID string) (*entity.OAuthClient, error)
+	UpdateClient(client *entity.OAuthClient) error
+	UpdateClientSecret(clientID string, secretHash string) error
+	DeleteClient(clientID string) (bool, error)
+	GetConsent(userID string, clientID string) (*entity.OAuthConsent, error)
+	SaveConsent(consent *entity.OAuthConsent) error
+}
+
+type oauthClientRepository struct {
+	db *gorm.DB
+}
+
+func NewOAuthClientRepository(db *gorm.DB) OAuthClientRepository {
+	return &oauthClientRepository{
+		db: db,
+	}
+}
+
+func (r *oauthClientRepository) CreateClient(client *entity.OAuthClient) error {
+	return r.db.Create(client).Error
+}
+
+func (r *oauthClientRepository) GetAllClients() ([]entity.OAuthClient, error) {
+	var clients []entity.OAuthClient
+	err := r.db.Order("created_at").Find(&clients).Error
+	if err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func (r *oauthClientRepository) GetClientByClientID(clientID string) (*entity.OAuthClient, error) {
+	var client entity.OAuthClient
+	err := r.db.Where("client_id = ?", clientID).First(&client).Error
+	if err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+func (r *oauthClientRepository) UpdateClient(client *entity.OAuthClient) error {
+	return r.db.Model(&entity.OAuthClient{}).Where("client_id = ?", client.ClientID).Updates(map[string]any{
+		"name":          client.Name,
+		"redirect_uris": client.RedirectURIs,
+		"scopes":        client.Scopes,
+		"grant_types":   client.GrantTypes,
+		"public":        client.Public,
+	}).Error
+}
+
+func (r *oauthClientRepository) UpdateClientSecret(clientID string, secretHash string) error {
+	return r.db.Model(&entity.OAuthClient{}).Where("client_id = ?", clientID).Update("client_secret_hash", secretHash).Error
+}
+
+// DeleteClient also drops the consents users gave the client.
+func (r *oauthClientRepository) DeleteClient(clientID string) (bool, error) {
+	var deleted bool
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("client_id = ?", clientID).Delete(&entity.OAuthConsent{}).Error; err != nil {
+			return err
+		}
+		result := tx.Where("client_id = ?", clientID).Delete(&entity.OAuthClient{})
+		deleted = result.RowsAffected > 0
+		return result.Error
+	})
+	return deleted, err
+}
+
+func (r *oauthClientRepository) GetConsent(userID string, clientID string) (*entity.OAuthConsent, error) {
+	var consent entity.OAuthConsent
+	err := r.db.Where("user_id = ? AND client_id = ?", userID, clientID).First(&consent).Error
+	if err != nil {
+		return nil, err
+	}
+	return &consent, nil
+}
+
+// SaveConsent replaces the scopes of an existing consent for the same user
+// and client.
+func (r *oauthClientRepository) SaveConsent(consent *entity.OAuthConsent) error {
+	return r.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "client_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"scopes", "updated_at"}),
+	}).Create(consent).Error
+}
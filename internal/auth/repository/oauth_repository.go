@@ -2,6 +2,7 @@ package repository
 
 import (
 	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"github.com/revandpratama/auth4me/pkg"
 	"gorm.io/gorm"
 )
 
@@ -9,6 +10,10 @@ type OAuthRepository interface {
 	GetProvider(userID string, providerName string) (*entity.OAuthProvider, error)
 	CreateProvider(provider *entity.OAuthProvider) error
 	UpdateProvider(provider *entity.OAuthProvider) error
+	GetProviderByProviderID(providerName string, providerID string) (*entity.OAuthProvider, error)
+	GetProvidersByUserID(userID string) ([]entity.OAuthProvider, error)
+	DeleteProvider(userID string, providerName string) (bool, error)
+	ReencryptTokens() (int, error)
 }
 
 type oauthRepository struct {
@@ -27,13 +32,121 @@ func (r *oauthRepository) GetProvider(userID string, providerName string) (*enti
 	if err != nil {
 		return nil, err
 	}
+	if err := decryptTokens(&provider); err != nil {
+		return nil, err
+	}
 	return &provider, nil
 }
 
 func (r *oauthRepository) CreateProvider(provider *entity.OAuthProvider) error {
-	return r.db.Create(provider).Error
+	stored, err := encryptTokens(provider)
+	if err != nil {
+		return err
+	}
+	if err := r.db.Create(stored).Error; err != nil {
+		return err
+	}
+	provider.ID = stored.ID
+	return nil
 }
 
+// UpdateProvider matches on the row id, as a user can have one row per
+// linked provider.
 func (r *oauthRepository) UpdateProvider(provider *entity.OAuthProvider) error {
-	return r.db.Model(&entity.OAuthProvider{}).Where("user_id = ?", provider.UserID).Updates(provider).Error
+	stored, err := encryptTokens(provider)
+	if err != nil {
+		return err
+	}
+	return r.db.Model(&entity.OAuthProvider{}).Where("id = ?", provider.ID).Updates(stored).Error
+}
+
+func (r *oauthRepository) GetProviderByProviderID(providerName string, providerID string) (*entity.OAuthProvider, error) {
+	var provider entity.OAuthProvider
+	err := r.db.Where("provider = ? AND provider_id = ?", providerName, providerID).First(&provider).Error
+	if err != nil {
+		return nil, err
+	}
+	if err := decryptTokens(&provider); err != nil {
+		return nil, err
+	}
+	return &provider, nil
+}
+
+func (r *oauthRepository) GetProvidersByUserID(userID string) ([]entity.OAuthProvider, error) {
+	var providers []entity.OAuthProvider
+	err := r.db.Where("user_id = ?", userID).Order("id").Find(&providers).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range providers {
+		if err := decryptTokens(&providers[i]); err != nil {
+			return nil, err
+		}
+	}
+	return providers, nil
+}
+
+func (r *oauthRepository) DeleteProvider(userID string, providerName string) (bool, error) {
+	result := r.db.Where("user_id = ? AND provider = ?", userID, providerName).Delete(&entity.OAuthProvider{})
+	return result.RowsAffected > 0, result.Error
+}
+
+// ReencryptTokens rewrites every stored token that is still plaintext or
+// wrapped by a retired key, returning how many rows were rewritten.
+func (r *oauthRepository) ReencryptTokens() (int, error) {
+	var providers []entity.OAuthProvider
+	if err := r.db.Find(&providers).Error; err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, provider := range providers {
+		if !pkg.NeedsReencryption(provider.AccessToken) && !pkg.NeedsReencryption(provider.RefreshToken) {
+			continue
+		}
+
+		if err := decryptTokens(&provider); err != nil {
+			return count, err
+		}
+		stored, err := encryptTokens(&provider)
+		if err != nil {
+			return count, err
+		}
+
+		err = r.db.Model(&entity.OAuthProvider{}).Where("id = ?", provider.ID).Updates(map[string]any{
+			"access_token":  stored.AccessToken,
+			"refresh_token": stored.RefreshToken,
+		}).Error
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// encryptTokens returns a copy ready to be stored, leaving the caller's
+// provider with usable plaintext tokens.
+func encryptTokens(provider *entity.OAuthProvider) (*entity.OAuthProvider, error) {
+	stored := *provider
+
+	var err error
+	if stored.AccessToken, err = pkg.EncryptField(provider.AccessToken); err != nil {
+		return nil, err
+	}
+	if stored.RefreshToken, err = pkg.EncryptField(provider.RefreshToken); err != nil {
+		return nil, err
+	}
+
+	return &stored, nil
+}
+
+func decryptTokens(provider *entity.OAuthProvider) error {
+	var err error
+	if provider.AccessToken, err = pkg.DecryptField(provider.AccessToken); err != nil {
+		return err
+	}
+	provider.RefreshToken, err = pkg.DecryptField(provider.RefreshToken)
+	return err
 }
@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"gorm.io/gorm"
+)
+
+type ServiceAccountRepository interface {
+	GetAllServiceAccounts() ([]entity.ServiceAccount, error)
+	GetServiceAccountByID(id string) (*entity.ServiceAccount, error)
+	GetServiceAccountByClientID(clientID string) (*entity.ServiceAccount, error)
+	CreateServiceAccount(account *entity.ServiceAccount) error
+	UpdateServiceAccount(account *entity.ServiceAccount) error
+	UpdateServiceAccountSecret(id string, secretHash string) error
+	UpdateServiceAccountLastUsed(id string) error
+	DeleteServiceAccount(id string) (bool, error)
+}
+
+type serviceAccountRepository struct {
+	db *gorm.DB
+}
+
+func NewServiceAccountRepository(db *gorm.DB) ServiceAccountRepository {
+	return &serviceAccountRepository{
+		db: db,
+	}
+}
+
+func (r *serviceAccountRepository) GetAllServiceAccounts() ([]entity.ServiceAccount, error) {
+	var accounts []entity.ServiceAccount
+	err := r.db.Preload("Role").Order("created_at").Find(&accounts).Error
+	if err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+func (r *serviceAccountRepository) GetServiceAccountByID(id string) (*entity.ServiceAccount, error) {
+	var account entity.ServiceAccount
+	err := r.db.Preload("Role").Where("id = ?", id).First(&account).Error
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+func (r *serviceAccountRepository) GetServiceAccountByClientID(clientID string) (*entity.ServiceAccount, error) {
+	var account entity.ServiceAccount
+	err := r.db.Where("client_id = ?", clientID).First(&account).Error
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+func (r *serviceAccountRepository) CreateServiceAccount(account *entity.ServiceAccount) error {
+	return r.db.Create(account).Error
+}
+
+func (r *serviceAccountRepository) UpdateServiceAccount(account *entity.ServiceAccount) error {
+	return r.db.Model(&entity.ServiceAccount{}).Where("id = ?", account.ID).Updates(map[string]any{
+		"name":        account.Name,
+		"description": account.Description,
+		"role_id":     account.RoleID,
+		"disabled":    account.Disabled,
+	}).Error
+}
+
+func (r *serviceAccountRepository) UpdateServiceAccountSecret(id string, secretHash string) error {
+	return r.db.Model(&entity.ServiceAccount{}).Where("id = ?", id).Updates(map[string]any{
+		"client_secret_hash": secretHash,
+		"secret_rotated_at":  time.Now(),
+	}).Error
+}
+
+func (r *serviceAccountRepository) UpdateServiceAccountLastUsed(id string) error {
+	return r.db.Model(&entity.ServiceAccount{}).Where("id = ?", id).UpdateColumn("last_used_at", time.Now()).Error
+}
+
+func (r *serviceAccountRepository) DeleteServiceAccount(id string) (bool, error) {
+	result := r.db.Where("id = ?", id).Delete(&entity.ServiceAccount{})
+	return result.RowsAffected > 0, result.Error
+}
@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"gorm.io/gorm"
+)
+
+type WebAuthnRepository interface {
+	GetCredentialsByUserID(userID string) ([]entity.WebAuthnCredential, error)
+	GetCredentialByCredentialID(credentialID []byte) (*entity.WebAuthnCredential, error)
+	CreateCredential(credential *entity.WebAuthnCredential) error
+	UpdateCredentialUsage(id uint, signCount uint32, backupState bool) error
+	DeleteCredential(userID string, id uint) (bool, error)
+}
+
+type webAuthnRepository struct {
+	db *gorm.DB
+}
+
+func NewWebAuthnRepository(db *gorm.DB) WebAuthnRepository {
+	return &webAuthnRepository{
+		db: db,
+	}
+}
+
+func (r *webAuthnRepository) GetCredentialsByUserID(userID string) ([]entity.WebAuthnCredential, error) {
+	var credentials []entity.WebAuthnCredential
+	err := r.db.Where("user_id = ?", userID).Order("created_at").Find(&credentials).Error
+	if err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+func (r *webAuthnRepository) GetCredentialByCredentialID(credentialID []byte) (*entity.WebAuthnCredential, error) {
+	var credential entity.WebAuthnCredential
+	err := r.db.Where("credential_id = ?", credentialID).First(&credential).Error
+	if err != nil {
+		return nil, err
+	}
+	return &credential, nil
+}
+
+func (r *webAuthnRepository) CreateCredential(credential *entity.WebAuthnCredential) error {
+	return r.db.Create(credential).Error
+}
+
+func (r *webAuthnRepository) UpdateCredentialUsage(id uint, signCount uint32, backupState bool) error {
+	return r.db.Model(&entity.WebAuthnCredential{}).Where("id = ?", id).Updates(map[string]any{
+		"sign_count":   signCount,
+		"backup_state": backupState,
+		"last_used_at": time.Now(),
+	}).Error
+}
+
+func (r *webAuthnRepository) DeleteCredential(userID string, id uint) (bool, error) {
+	result := r.db.Where("user_id = ? AND id = ?", userID, id).Delete(&entity.WebAuthnCredential{})
+	return result.RowsAffected > 0, result.Error
+}
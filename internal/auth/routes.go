@@ -1,21 +1,52 @@
 package auth
 
 import (
+	"errors"
+	"time"
+
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/revandpratama/auth4me/config"
 	"github.com/revandpratama/auth4me/internal/auth/handler"
 	"github.com/revandpratama/auth4me/internal/auth/repository"
 	"github.com/revandpratama/auth4me/internal/auth/usecase"
 	"github.com/revandpratama/auth4me/internal/middleware"
-	"golang.org/x/oauth2"
+	"github.com/revandpratama/auth4me/pkg"
 	"gorm.io/gorm"
 )
 
-func InitAuthHandler(db *gorm.DB) handler.AuthHandler {
+func requireRecentAuth() fiber.Handler {
+	return middleware.RequireRecentAuth(time.Second * time.Duration(config.ENV.STEP_UP_MAX_AGE_SECOND))
+}
+
+// InitAdminMiddleware lets through only users holding ADMIN_ROLE. Only the
+// system role of that name counts, since system roles cannot be renamed
+// through the API. It must run after AuthMiddleware.
+func InitAdminMiddleware(db *gorm.DB) fiber.Handler {
+	rbacRepo := repository.NewRBACRepository(db)
+	return middleware.RequireRole(func(roleID uint) (string, error) {
+		role, err := rbacRepo.GetRoleByID(roleID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if !role.System {
+			return "", nil
+		}
+		return role.Name, nil
+	}, config.ENV.ADMIN_ROLE)
+}
+
+func InitAuthHandler(db *gorm.DB, blobs pkg.BlobStore, ldap pkg.LDAPAuthenticator) handler.AuthHandler {
 	repo := repository.NewAuthRepository(db)
-	usecase := usecase.NewAuthUsecase(repo)
+	mfaRepo := repository.NewMFARepository(db)
+	oauthRepo := repository.NewOAuthRepository(db)
+	usecase := usecase.NewAuthUsecase(repo, mfaRepo, oauthRepo, pkg.NewMailer(), blobs, ldap)
 	return handler.NewAuthHandler(usecase)
 }
-func InitAuthRoutes(api fiber.Router, handler handler.AuthHandler) {
+func InitAuthRoutes(api fiber.Router, handler handler.AuthHandler, requireAdmin fiber.Handler) {
 
 	publicAuth := api.Group("/auth")
 
@@ -23,10 +54,92 @@ func InitAuthRoutes(api fiber.Router, handler handler.AuthHandler) {
 	publicAuth.Post("/register", handler.RegisterHandler)
 	publicAuth.Post("/logout", handler.LogoutHandler)
 	publicAuth.Post("/refresh-token", handler.RefreshTokenHandler)
+	publicAuth.Post("/forgot-password", handler.ForgotPasswordHandler)
+	publicAuth.Post("/reset-password", handler.ResetPasswordHandler)
+	publicAuth.Post("/magic-link", handler.MagicLinkHandler)
+	publicAuth.Post("/magic-link/verify", handler.VerifyMagicLinkHandler)
+	publicAuth.Post("/otp", handler.EmailOTPHandler)
+	publicAuth.Post("/otp/verify", handler.VerifyEmailOTPHandler)
+
+	publicAuth.Post("/change-password", middleware.RestrictedAuthMiddleware(pkg.PurposePasswordChange), handler.ChangePasswordHandler)
 
 	auth := api.Group("/auth")
 	auth.Use(middleware.AuthMiddleware())
 	auth.Get("/user", handler.GetUserHandler)
+	auth.Post("/avatar", handler.UploadAvatarHandler)
+	auth.Delete("/avatar", handler.DeleteAvatarHandler)
+	auth.Post("/users/:id/force-password-change", requireAdmin, middleware.RequireMFA(), requireRecentAuth(), handler.ForcePasswordChangeHandler)
+
+}
+
+func InitMFAHandler(db *gorm.DB) handler.MFAHandler {
+	authRepo := repository.NewAuthRepository(db)
+	mfaRepo := repository.NewMFARepository(db)
+	usecase := usecase.NewMFAUsecase(authRepo, mfaRepo, pkg.NewMailer(), pkg.NewSMSSender())
+	return handler.NewMFAHandler(usecase)
+}
+
+// InitMFAEnrolledMiddleware demands a completed second factor from users
+// who already have one. It must run after AuthMiddleware.
+func InitMFAEnrolledMiddleware(db *gorm.DB) fiber.Handler {
+	authRepo := repository.NewAuthRepository(db)
+	return middleware.RequireMFAIfEnrolled(func(userID string) (bool, error) {
+		user, err := authRepo.GetUserByID(userID)
+		if err != nil {
+			return false, err
+		}
+		return user.MFAEnabled || user.SMSMFAEnabled, nil
+	})
+}
+
+func InitMFARoutes(api fiber.Router, handler handler.MFAHandler, requireMFAIfEnrolled fiber.Handler) {
+
+	publicMFA := api.Group("/auth/mfa")
+
+	publicMFA.Post("/verify", middleware.RestrictedAuthMiddleware(pkg.PurposeMFA), handler.VerifyMFA)
+	publicMFA.Post("/sms/send", middleware.RestrictedAuthMiddleware(pkg.PurposeMFA), handler.SendSMSCode)
+
+	mfa := api.Group("/auth/mfa")
+	mfa.Use(middleware.AuthMiddleware())
+	// adding a factor next to an existing one takes that factor first
+	mfa.Post("/totp/enroll", requireMFAIfEnrolled, requireRecentAuth(), handler.EnrollTOTP)
+	mfa.Post("/totp/confirm", requireMFAIfEnrolled, requireRecentAuth(), handler.ConfirmTOTP)
+	mfa.Post("/totp/disable", middleware.RequireMFA(), requireRecentAuth(), handler.DisableTOTP)
+	mfa.Post("/recovery-codes", middleware.RequireMFA(), requireRecentAuth(), handler.RegenerateRecoveryCodes)
+	mfa.Post("/sms/enroll", requireMFAIfEnrolled, requireRecentAuth(), handler.EnrollSMS)
+	mfa.Post("/sms/confirm", requireMFAIfEnrolled, requireRecentAuth(), handler.ConfirmSMS)
+	mfa.Post("/sms/disable", middleware.RequireMFA(), requireRecentAuth(), handler.DisableSMS)
+	mfa.Get("/trusted-devices", handler.ListTrustedDevices)
+	mfa.Delete("/trusted-devices/:id", handler.RevokeTrustedDevice)
+
+}
+
+func InitWebAuthnHandler(db *gorm.DB) (handler.WebAuthnHandler, error) {
+	webAuthn, err := pkg.NewWebAuthn()
+	if err != nil {
+		return nil, err
+	}
+	authRepo := repository.NewAuthRepository(db)
+	webAuthnRepo := repository.NewWebAuthnRepository(db)
+	usecase := usecase.NewWebAuthnUsecase(webAuthn, authRepo, webAuthnRepo)
+	return handler.NewWebAuthnHandler(usecase), nil
+}
+
+func InitWebAuthnRoutes(api fiber.Router, handler handler.WebAuthnHandler) {
+
+	publicWebAuthn := api.Group("/auth/webauthn")
+
+	publicWebAuthn.Post("/login/begin", handler.BeginLogin)
+	publicWebAuthn.Post("/login/finish", handler.FinishLogin)
+	publicWebAuthn.Post("/mfa/begin", middleware.RestrictedAuthMiddleware(pkg.PurposeMFA), handler.BeginMFA)
+	publicWebAuthn.Post("/mfa/finish", middleware.RestrictedAuthMiddleware(pkg.PurposeMFA), handler.FinishMFA)
+
+	webAuthn := api.Group("/auth/webauthn")
+	webAuthn.Use(middleware.AuthMiddleware())
+	webAuthn.Post("/register/begin", requireRecentAuth(), handler.BeginRegistration)
+	webAuthn.Post("/register/finish", handler.FinishRegistration)
+	webAuthn.Get("/credentials", handler.ListCredentials)
+	webAuthn.Delete("/credentials/:id", requireRecentAuth(), handler.DeleteCredential)
 
 }
 
@@ -36,37 +149,68 @@ func InitRBACHandler(db *gorm.DB) handler.RBACHandler {
 	return handler.NewRBACHandler(usecase)
 }
 
-func InitRBACRoutes(api fiber.Router, handler handler.RBACHandler) {
+func InitRBACRoutes(api fiber.Router, handler handler.RBACHandler, requireAdmin fiber.Handler) {
 
 	rbac := api.Group("/rbac")
 
-	rbac.Use(middleware.AuthMiddleware())
+	// service accounts may read roles and permissions to authorize callers
+	rbac.Use(middleware.PrincipalAuthMiddleware())
 
 	rbac.Get("/roles", handler.GetAllRoles)
 	rbac.Get("/roles/:id", handler.GetRoleByID)
-	rbac.Post("/roles", handler.CreateRole)
-	rbac.Put("/roles/:id", handler.UpdateRole)
-	rbac.Delete("/roles/:id", handler.DeleteRole)
+	// mutations are for admins only, after a fresh second factor
+	stepUp := []fiber.Handler{requireAdmin, middleware.RequireMFA(), requireRecentAuth()}
+
+	rbac.Post("/roles", append(stepUp, handler.CreateRole)...)
+	rbac.Put("/roles/:id", append(stepUp, handler.UpdateRole)...)
+	rbac.Delete("/roles/:id", append(stepUp, handler.DeleteRole)...)
 
 	rbac.Get("/permissions", handler.GetAllPermissions)
 	rbac.Get("/permissions/:id", handler.GetPermissionByID)
-	rbac.Post("/permissions", handler.CreatePermission)
-	rbac.Put("/permissions/:id", handler.UpdatePermission)
-	rbac.Delete("/permissions/:id", handler.DeletePermission)
+	rbac.Post("/permissions", append(stepUp, handler.CreatePermission)...)
+	rbac.Put("/permissions/:id", append(stepUp, handler.UpdatePermission)...)
+	rbac.Delete("/permissions/:id", append(stepUp, handler.DeletePermission)...)
 
 	rbac.Get("/role-permissions", handler.GetAllRolePermissions)
 	rbac.Get("/role-permissions/roles/:roleID", handler.GetRolePermissionsByRoleID)
 	rbac.Get("/role-permissions/permissions/:permissionID", handler.GetRolePermissionsByPermissionID)
-	rbac.Post("/role-permissions", handler.CreateRolePermission)
-	rbac.Put("/role-permissions/:id", handler.UpdateRolePermission)
-	rbac.Delete("/role-permissions/:id", handler.DeleteRolePermission)
+	rbac.Post("/role-permissions", append(stepUp, handler.CreateRolePermission)...)
+	rbac.Put("/role-permissions/:id", append(stepUp, handler.UpdateRolePermission)...)
+	rbac.Delete("/role-permissions/:id", append(stepUp, handler.DeleteRolePermission)...)
+
+}
+
+func InitServiceAccountHandler(db *gorm.DB) handler.ServiceAccountHandler {
+	repo := repository.NewServiceAccountRepository(db)
+	rbacRepo := repository.NewRBACRepository(db)
+	usecase := usecase.NewServiceAccountUsecase(repo, rbacRepo)
+	return handler.NewServiceAccountHandler(usecase)
+}
+
+func InitServiceAccountRoutes(api fiber.Router, handler handler.ServiceAccountHandler, requireAdmin fiber.Handler) {
+
+	serviceAccounts := api.Group("/service-accounts")
+
+	serviceAccounts.Use(middleware.AuthMiddleware())
+
+	// credentials and roles are handed out only by admins, after a fresh
+	// second factor, and only admins may see which accounts exist
+	serviceAccounts.Get("/", requireAdmin, handler.GetAllServiceAccounts)
+	serviceAccounts.Get("/:id", requireAdmin, handler.GetServiceAccountByID)
+	stepUp := []fiber.Handler{requireAdmin, middleware.RequireMFA(), requireRecentAuth()}
+
+	serviceAccounts.Post("/", append(stepUp, handler.CreateServiceAccount)...)
+	serviceAccounts.Put("/:id", append(stepUp, handler.UpdateServiceAccount)...)
+	serviceAccounts.Post("/:id/secret", append(stepUp, handler.RotateServiceAccountSecret)...)
+	serviceAccounts.Delete("/:id", append(stepUp, handler.DeleteServiceAccount)...)
 
 }
 
-func InitOauthHandler(db *gorm.DB, oauthCfg *oauth2.Config) handler.OAuthHandler {
+func InitOauthHandler(db *gorm.DB, providers pkg.OAuthProviders, blobs pkg.BlobStore) handler.OAuthHandler {
 	oauthRepo := repository.NewOAuthRepository(db)
 	authRepo := repository.NewAuthRepository(db)
-	usecase := usecase.NewOAuthUsecase(oauthCfg, authRepo, oauthRepo)
+	webAuthnRepo := repository.NewWebAuthnRepository(db)
+	usecase := usecase.NewOAuthUsecase(providers, authRepo, oauthRepo, webAuthnRepo, blobs)
 	return handler.NewOAuthHandler(usecase)
 }
 
@@ -74,7 +218,102 @@ func InitOauthRoutes(api fiber.Router, handler handler.OAuthHandler) {
 
 	oauth := api.Group("/oauth")
 
-	oauth.Get("/google", handler.GoogleLogin)
-	oauth.Get("/google/callback", handler.GoogleOAuthCallback)
+	// registered first, so /identities is not taken for a provider name
+	oauth.Get("/identities", middleware.AuthMiddleware(), handler.ListLinkedProviders)
+	oauth.Delete("/identities/:provider", middleware.AuthMiddleware(), requireRecentAuth(), handler.UnlinkProvider)
+
+	oauth.Get("/:provider", handler.OAuthLogin)
+	oauth.Get("/:provider/callback", handler.OAuthCallback)
+	oauth.Post("/:provider/link", middleware.AuthMiddleware(), requireRecentAuth(), handler.LinkProvider)
+
+	internal := api.Group("/internal")
+	internal.Use(middleware.ServiceKeyMiddleware())
+	internal.Get("/users/:id/providers/:provider/token", handler.GetUpstreamToken)
+
+}
+
+func InitSAMLHandler(db *gorm.DB, providers pkg.SAMLProviders, blobs pkg.BlobStore) handler.SAMLHandler {
+	oauthRepo := repository.NewOAuthRepository(db)
+	authRepo := repository.NewAuthRepository(db)
+	webAuthnRepo := repository.NewWebAuthnRepository(db)
+	usecase := usecase.NewSAMLUsecase(providers, authRepo, oauthRepo, webAuthnRepo, blobs)
+	return handler.NewSAMLHandler(usecase)
+}
+
+func InitSAMLRoutes(api fiber.Router, handler handler.SAMLHandler) {
+
+	saml := api.Group("/saml")
+
+	saml.Get("/metadata", handler.Metadata)
+	saml.Post("/acs", handler.AssertionConsumer)
+	saml.Get("/:provider/login", handler.SAMLLogin)
+}
+
+func InitOAuthServerHandler(db *gorm.DB) (handler.OAuthServerHandler, error) {
+	// load the signing key now rather than on the first token request
+	if _, err := pkg.OAuthServerJWKS(); err != nil {
+		return nil, err
+	}
+	authRepo := repository.NewAuthRepository(db)
+	clientRepo := repository.NewOAuthClientRepository(db)
+	serviceAccountRepo := repository.NewServiceAccountRepository(db)
+	usecase := usecase.NewOAuthServerUsecase(authRepo, clientRepo, serviceAccountRepo)
+	return handler.NewOAuthServerHandler(usecase), nil
+}
+
+// InitOAuthServerRoutes mounts the protocol endpoints at the root, next to
+// the discovery document, and the consent API under api.
+func InitOAuthServerRoutes(root fiber.Router, api fiber.Router, handler handler.OAuthServerHandler) {
+
+	// clients running in the browser call these cross-origin, without cookies
+	root.Get("/.well-known/openid-configuration", cors.New(), handler.Discovery)
+
+	oauth2 := root.Group("/oauth2")
+	oauth2.Get("/authorize", handler.Authorize)
+	oauth2.Use(cors.New())
+	oauth2.Get("/jwks", handler.JWKS)
+	oauth2.Post("/device_authorization", handler.DeviceAuthorization)
+	oauth2.Post("/token", handler.Token)
+	oauth2.Get("/userinfo", handler.UserInfo)
+	oauth2.Post("/userinfo", handler.UserInfo)
+
+	requests := api.Group("/oauth2/requests")
+	requests.Use(middleware.AuthMiddleware())
+	requests.Get("/:id", handler.GetAuthorizationRequest)
+	requests.Post("/:id/decision", handler.DecideAuthorization)
+
+	device := api.Group("/oauth2/device")
+	device.Use(middleware.AuthMiddleware())
+	device.Post("/decision", handler.DecideDeviceAuthorization)
+	device.Get("/:userCode", handler.GetDeviceAuthorization)
+}
+
+func InitOAuthClientHandler(db *gorm.DB) handler.OAuthClientHandler {
+	clientRepo := repository.NewOAuthClientRepository(db)
+	usecase := usecase.NewOAuthClientUsecase(clientRepo)
+	return handler.NewOAuthClientHandler(usecase)
+}
+
+// InitOAuthClientRoutes mounts dynamic registration next to the other
+// protocol endpoints, and client management for admins under api.
+func InitOAuthClientRoutes(root fiber.Router, api fiber.Router, handler handler.OAuthClientHandler, requireAdmin fiber.Handler) {
+
+	register := root.Group("/oauth2/register")
+	register.Use(cors.New())
+	register.Post("/", handler.RegisterClient)
+	register.Get("/:client_id", handler.GetRegisteredClient)
+	register.Put("/:client_id", handler.UpdateRegisteredClient)
+	register.Delete("/:client_id", handler.DeleteRegisteredClient)
+
+	clients := api.Group("/oauth2/clients")
+
+	clients.Use(middleware.AuthMiddleware(), requireAdmin)
+
+	clients.Get("/", handler.GetAllClients)
+	clients.Get("/:client_id", handler.GetClientByClientID)
+	// secrets are handed out only after a fresh second factor
+	stepUp := []fiber.Handler{middleware.RequireMFA(), requireRecentAuth()}
 
+	clients.Post("/:client_id/secret", append(stepUp, handler.RotateClientSecret)...)
+	clients.Delete("/:client_id", append(stepUp, handler.DeleteClient)...)
 }
@@ -1,102 +1,221 @@
 package usecase
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/revandpratama/auth4me/config"
 	"github.com/revandpratama/auth4me/internal/auth/dto"
 	"github.com/revandpratama/auth4me/internal/auth/entity"
 	"github.com/revandpratama/auth4me/internal/auth/repository"
 	"github.com/revandpratama/auth4me/pkg"
+	"gorm.io/gorm"
 )
 
 type AuthUsecase interface {
-	Login(email string, password string) (string, string, error)
+	Login(email string, password string, deviceToken string) (*dto.TokenResponse, error)
 	Register(registerRequest *dto.RegisterRequest) error
-	RefreshToken(refreshToken string, accessToken string) (string, string, error)
+	RefreshToken(refreshToken string, accessToken string) (*dto.TokenResponse, error)
 	GetUserByID(id string) (*entity.User, error)
+	ForcePasswordChange(userID string) error
+	ChangePassword(userID string, changePasswordRequest *dto.ChangePasswordRequest) error
+	ForgotPassword(email string) error
+	ResetPassword(resetPasswordRequest *dto.ResetPasswordRequest) error
+	RequestMagicLink(email string, browserBinding string) error
+	VerifyMagicLink(token string, browserBinding string) (*dto.TokenResponse, error)
+	RequestEmailOTP(email string) error
+	VerifyEmailOTP(email string, code string) (*dto.TokenResponse, error)
+	UploadAvatar(userID string, data []byte) (*dto.AvatarResponse, error)
+	DeleteAvatar(userID string) error
 }
 
+var (
+	ErrPasswordMismatch = errors.New("password and confirm password does not match")
+	ErrPasswordReused   = errors.New("password has been used recently")
+	ErrInvalidPassword  = errors.New("current password is invalid")
+	ErrInvalidToken     = errors.New("token is invalid or expired")
+	ErrLockedOut        = errors.New("too many failed attempts, try again later")
+
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrEmailExists        = errors.New("email already exists")
+
+	ErrRegistrationDisabled = errors.New("registration is disabled")
+)
+
 type authUsecase struct {
 	repository repository.AuthRepository
+	mfaRepo    repository.MFARepository
+	oauthRepo  repository.OAuthRepository // directory identities of LDAP users
+	mailer     pkg.Mailer
+	blobs      pkg.BlobStore
+	ldap       pkg.LDAPAuthenticator // nil without LDAP
 }
 
-func NewAuthUsecase(repository repository.AuthRepository) AuthUsecase {
+func NewAuthUsecase(repository repository.AuthRepository, mfaRepo repository.MFARepository, oauthRepo repository.OAuthRepository, mailer pkg.Mailer, blobs pkg.BlobStore, ldap pkg.LDAPAuthenticator) AuthUsecase {
 	return &authUsecase{
 		repository: repository,
+		mfaRepo:    mfaRepo,
+		oauthRepo:  oauthRepo,
+		mailer:     mailer,
+		blobs:      blobs,
+		ldap:       ldap,
 	}
 }
 
-func (u *authUsecase) Login(email string, password string) (string, string, error) {
+// Login checks the password, locally or against the directory, and continues
+// to the second factor, unless deviceToken belongs to a device the user
+// chose to trust after MFA.
+func (u *authUsecase) Login(email string, password string, deviceToken string) (*dto.TokenResponse, error) {
+
+	if pkg.IsLockedOut(email) {
+		return nil, ErrLockedOut
+	}
+
+	if u.ldap != nil && pkg.IsLDAPDomain(email) {
+		return u.ldapLogin(email, password, deviceToken)
+	}
+	ldapFallback := u.ldap != nil && config.ENV.LDAP_FALLBACK
 
+	// unknown accounts and accounts without a password go through the same
+	// bcrypt work and failure as a wrong password, so neither timing nor the
+	// response tells them apart
 	user, err := u.repository.GetUserByEmail(email)
 	if err != nil {
-		return "", "", err
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		if ldapFallback {
+			return u.ldapLogin(email, password, deviceToken)
+		}
+		pkg.ValidateDummyPassword(password)
+		pkg.RecordFailedAttempt(email)
+		return nil, ErrInvalidCredentials
 	}
 
-	if err := pkg.ValidatePassword(user.Password, password); err != nil {
-		return "", "", err
+	if user.Password == "" {
+		if ldapFallback {
+			return u.ldapLogin(email, password, deviceToken)
+		}
+		pkg.ValidateDummyPassword(password)
+		pkg.RecordFailedAttempt(email)
+		return nil, ErrInvalidCredentials
 	}
-	mfaCompleted := false
-	if user.MFAEnabled {
-		// TODO : Validate MFA
+
+	if err := pkg.ValidatePassword(user.Password, password); err != nil {
+		pkg.RecordFailedAttempt(email)
+		return nil, ErrInvalidCredentials
 	}
+	pkg.ResetFailedAttempts(email)
 	log.Println("password validated")
-	// permissions, err := u.repository.GetUserPermissionsByRoleID(user.RoleID)
-	// if err != nil {
-	// 	return "", "", err
-	// }
-	// log.Println("permissions fetched")
 
-	token, err := pkg.GenerateToken(user, "local", mfaCompleted)
+	return u.completePasswordLogin(user, "local", deviceToken)
+}
+
+func (u *authUsecase) completePasswordLogin(user *entity.User, provider string, deviceToken string) (*dto.TokenResponse, error) {
+
+	authn := pkg.NewAuthentication(pkg.AMRPassword)
+
+	if requiresMFA(user) && u.isTrustedDevice(user.ID, deviceToken) {
+		return issueTokenPair(user, provider, authn)
+	}
+
+	return completeLogin(user, provider, authn)
+}
+
+// isTrustedDevice never fails the login; a lookup error just means the
+// second factor is asked for as usual.
+func (u *authUsecase) isTrustedDevice(userID string, deviceToken string) bool {
+
+	if deviceToken == "" {
+		return false
+	}
+
+	device, err := u.mfaRepo.GetTrustedDevice(userID, pkg.HashCode(deviceToken))
 	if err != nil {
-		return "", "", err
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("failed to look up trusted device: %v", err)
+		}
+		return false
+	}
+
+	if err := u.mfaRepo.TouchTrustedDevice(device.ID); err != nil {
+		log.Printf("failed to update trusted device: %v", err)
 	}
-	log.Println("token generated")
 
-	refreshToken := uuid.NewString()
-	pkg.SaveRefreshToken(refreshToken, pkg.TokenData{
-		UserID:       user.ID,
-		Email:        user.Email,
-		RoleID:       user.RoleID,
-		Provider:     "local",
-		MFACompleted: mfaCompleted,
-		ExpiresAt:    time.Now().Add(time.Hour * 24)},
-	)
+	return true
+}
+
+// passwordChangeRequired reports whether an admin forced a change or the
+// password is older than PASSWORD_MAX_AGE_DAY.
+func passwordChangeRequired(user *entity.User) bool {
+	if user.MustChangePassword {
+		return true
+	}
 
-	log.Println("refresh token saved")
+	if config.ENV.PASSWORD_MAX_AGE_DAY <= 0 {
+		return false
+	}
+
+	changedAt := user.PasswordChangedAt
+	if changedAt.IsZero() {
+		changedAt = user.CreatedAt
+	}
 
-	return refreshToken, token, nil
+	return time.Now().After(changedAt.AddDate(0, 0, config.ENV.PASSWORD_MAX_AGE_DAY))
 }
 
 func (u *authUsecase) Register(registerRequest *dto.RegisterRequest) error {
 
+	if !config.ENV.REGISTRATION_ENABLED {
+		return ErrRegistrationDisabled
+	}
+
+	if !pkg.IsSignupDomainAllowed(registerRequest.Email) {
+		return ErrSignupDomainNotAllowed
+	}
+
 	if registerRequest.Password != registerRequest.ConfirmPassword {
-		return errors.New("password and confirm password does not match")
+		return ErrPasswordMismatch
 	}
 
 	exists, err := u.repository.IsEmailExists(registerRequest.Email)
 	if err != nil {
 		return err
 	}
-	if exists {
-		return errors.New("email already exists")
-	}
 
 	hashedPassword, err := pkg.EncryptPassword(registerRequest.Password)
 	if err != nil {
 		return err
 	}
+
+	if exists {
+		if !config.ENV.REGISTRATION_ENUMERATION_SAFE {
+			return ErrEmailExists
+		}
+
+		// answer exactly like a successful registration and let the owner
+		// of the address know instead
+		body := fmt.Sprintf("Someone tried to create an account with this email address, but you already have one.\n\nIf it was you, sign in at %s or reset your password at %s/forgot-password.\n\nIf it was not you, you can ignore this email.", config.ENV.APP_URL, config.ENV.APP_URL)
+		u.sendMail(registerRequest.Email, "You already have an account", body)
+		return nil
+	}
 	registerRequest.Password = hashedPassword
 
+	roleID, err := roleForNewUser(u.repository, registerRequest.Email, nil)
+	if err != nil {
+		return err
+	}
+
 	newUser := entity.User{
-		Email:      registerRequest.Email,
-		Password:   registerRequest.Password,
-		FullName:   registerRequest.FullName,
-		RoleID:     registerRequest.RoleID,
-		AvatarPath: registerRequest.AvatarPath,
+		Email:             registerRequest.Email,
+		Password:          registerRequest.Password,
+		FullName:          registerRequest.FullName,
+		RoleID:            roleID,
+		PasswordChangedAt: time.Now(),
 	}
 
 	if _, err := u.repository.CreateUser(&newUser); err != nil {
@@ -106,22 +225,41 @@ func (u *authUsecase) Register(registerRequest *dto.RegisterRequest) error {
 	return nil
 }
 
-func (u *authUsecase) RefreshToken(refreshToken string, accessToken string) (string, string, error) {
+func (u *authUsecase) RefreshToken(refreshToken string, accessToken string) (*dto.TokenResponse, error) {
 
 	//Validate access token
 	claims, err := pkg.ParseExpiredToken(accessToken)
 	if err != nil {
-		return "", "", err
+		return nil, err
+	}
+
+	if claims.Purpose != "" {
+		return nil, errors.New("restricted token cannot be refreshed")
+	}
+
+	if claims.SubjectType == pkg.SubjectTypeService {
+		return nil, errors.New("service account token cannot be refreshed")
 	}
 
 	//Validate refresh token in redis
 	refreshTokenData, exists := pkg.GetRefreshToken(refreshToken)
 	if !exists || time.Now().After(refreshTokenData.ExpiresAt) {
-		return "", "", errors.New("refresh token expired")
+		return nil, errors.New("refresh token expired")
 	}
 
 	if refreshTokenData.UserID != claims.UserID {
-		return "", "", errors.New("refresh token and access token user id does not match")
+		return nil, errors.New("refresh token and access token user id does not match")
+	}
+
+	// a change forced or due since the login ends the session here instead
+	// of when the user next signs in
+	current, err := u.repository.GetUserByID(claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if mustChangeLocalPassword(current) {
+		pkg.DeleteRefreshToken(refreshToken)
+		return issueRestrictedToken(current, claims.Provider, pkg.PurposePasswordChange, claims.Authentication())
 	}
 
 	//Generate new access token
@@ -132,9 +270,9 @@ func (u *authUsecase) RefreshToken(refreshToken string, accessToken string) (str
 		RoleID: claims.RoleID,
 	}
 
-	newAccessToken, err := pkg.GenerateToken(&user, claims.Provider, claims.MFACompleted)
+	newAccessToken, err := pkg.GenerateToken(&user, claims.Provider, claims.Authentication())
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
 	//Generate new refresh token
@@ -145,6 +283,8 @@ func (u *authUsecase) RefreshToken(refreshToken string, accessToken string) (str
 		Provider:     claims.Provider,
 		SessionID:    claims.SessionID,
 		MFACompleted: claims.MFACompleted,
+		AMR:          claims.AMR,
+		AuthTime:     claims.Authentication().Time,
 		ExpiresAt:    time.Now().Add(time.Hour * 1),
 	}
 
@@ -154,9 +294,320 @@ func (u *authUsecase) RefreshToken(refreshToken string, accessToken string) (str
 
 	pkg.DeleteRefreshToken(refreshToken)
 
-	return newRefreshToken, newAccessToken, nil
+	return &dto.TokenResponse{
+		AccessToken:  newAccessToken,
+		RefreshToken: newRefreshToken,
+	}, nil
 }
 
 func (u *authUsecase) GetUserByID(id string) (*entity.User, error) {
 	return u.repository.GetUserByID(id)
 }
+
+// ForcePasswordChange flags the user and revokes their refresh tokens, so
+// every session has to sign in again and is held at the password change.
+func (u *authUsecase) ForcePasswordChange(userID string) error {
+	if _, err := u.repository.GetUserByID(userID); err != nil {
+		return err
+	}
+	if err := u.repository.SetMustChangePassword(userID, true); err != nil {
+		return err
+	}
+	pkg.DeleteUserRefreshTokens(userID)
+	pkg.RevokeUserClientGrants(userID)
+	return nil
+}
+
+func (u *authUsecase) ChangePassword(userID string, changePasswordRequest *dto.ChangePasswordRequest) error {
+
+	if changePasswordRequest.NewPassword != changePasswordRequest.ConfirmPassword {
+		return ErrPasswordMismatch
+	}
+
+	user, err := u.repository.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+
+	if err := pkg.ValidatePassword(user.Password, changePasswordRequest.CurrentPassword); err != nil {
+		return ErrInvalidPassword
+	}
+
+	return u.setPassword(user, changePasswordRequest.NewPassword)
+}
+
+func (u *authUsecase) ForgotPassword(email string) error {
+
+	user, err := u.repository.GetUserByEmail(email)
+	if err != nil {
+		// do not reveal whether the email is registered
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		return err
+	}
+
+	resetToken := uuid.NewString()
+	pkg.SavePasswordResetToken(resetToken, pkg.PasswordResetData{
+		UserID:    user.ID,
+		Email:     user.Email,
+		ExpiresAt: time.Now().Add(time.Second * time.Duration(config.ENV.PASSWORD_RESET_TTL_SECOND)),
+	})
+
+	body := fmt.Sprintf("Use the link below to reset your password:\n\n%s/reset-password?token=%s\n\nIf you did not request a password reset, you can ignore this email.", config.ENV.APP_URL, resetToken)
+	u.sendMail(user.Email, "Reset your password", body)
+
+	return nil
+}
+
+func (u *authUsecase) ResetPassword(resetPasswordRequest *dto.ResetPasswordRequest) error {
+
+	if resetPasswordRequest.NewPassword != resetPasswordRequest.ConfirmPassword {
+		return ErrPasswordMismatch
+	}
+
+	resetData, exists := pkg.ConsumePasswordResetToken(resetPasswordRequest.Token)
+	if !exists {
+		return ErrInvalidToken
+	}
+
+	user, err := u.repository.GetUserByID(resetData.UserID)
+	if err != nil {
+		return err
+	}
+
+	return u.setPassword(user, resetPasswordRequest.NewPassword)
+}
+
+// RequestMagicLink emails a single-use login link. Unknown emails only get a
+// link when magic link sign-up is allowed, and the caller cannot tell which.
+func (u *authUsecase) RequestMagicLink(email string, browserBinding string) error {
+
+	_, err := u.repository.GetUserByEmail(email)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if !magicLinkSignupAllowed(email) {
+			return nil
+		}
+	}
+
+	ttl := time.Second * time.Duration(config.ENV.MAGIC_LINK_TTL_SECOND)
+	token, err := pkg.GenerateMagicLinkToken(email, browserBinding, ttl)
+	if err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Use the link below to sign in. It expires in %d minutes and can only be used once:\n\n%s/magic-link?token=%s\n\nIf you did not request this email, you can ignore it.", int(ttl.Minutes()), config.ENV.APP_URL, token)
+
+	u.sendMail(email, "Your sign-in link", body)
+
+	return nil
+}
+
+func (u *authUsecase) VerifyMagicLink(token string, browserBinding string) (*dto.TokenResponse, error) {
+
+	claims, err := pkg.ConsumeMagicLinkToken(token, browserBinding)
+	if err != nil {
+		log.Printf("magic link rejected: %v", err)
+		return nil, ErrInvalidToken
+	}
+
+	return u.completeEmailLogin(claims.Email, pkg.PurposeMagicLink, pkg.AMREmail)
+}
+
+// completeEmailLogin finishes a login proven by a link or code sent to email.
+// Receiving it proves ownership of the address, so the account is marked
+// verified, or created when sign-up through email is allowed.
+func (u *authUsecase) completeEmailLogin(email string, provider string, method string) (*dto.TokenResponse, error) {
+
+	user, err := u.repository.GetUserByEmail(email)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		if !magicLinkSignupAllowed(email) {
+			return nil, ErrRegistrationDisabled
+		}
+
+		roleID, err := roleForNewUser(u.repository, email, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		user, err = u.repository.CreateUser(&entity.User{
+			Email:         email,
+			EmailVerified: true,
+			RoleID:        roleID,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !user.EmailVerified {
+		user.EmailVerified = true
+		if err := u.repository.UpdateUser(user); err != nil {
+			return nil, err
+		}
+	}
+
+	return completeLogin(user, provider, pkg.NewAuthentication(method))
+}
+
+// RequestEmailOTP emails a numeric one-time code, following the same sign-up
+// rules as magic links.
+func (u *authUsecase) RequestEmailOTP(email string) error {
+
+	_, err := u.repository.GetUserByEmail(email)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if !magicLinkSignupAllowed(email) {
+			return nil
+		}
+	}
+
+	code, err := pkg.GenerateNumericCode(config.ENV.EMAIL_OTP_LENGTH)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Second * time.Duration(config.ENV.EMAIL_OTP_TTL_SECOND)
+	if err := u.repository.ReplaceEmailOTP(&entity.EmailOTP{
+		Email:     email,
+		CodeHash:  pkg.HashCode(code),
+		ExpiresAt: time.Now().Add(ttl),
+	}); err != nil {
+		return err
+	}
+
+	body := fmt.Sprintf("Your sign-in code is %s. It expires in %d minutes.\n\nIf you did not request this code, you can ignore this email.", code, int(ttl.Minutes()))
+
+	u.sendMail(email, "Your sign-in code", body)
+
+	return nil
+}
+
+func (u *authUsecase) VerifyEmailOTP(email string, code string) (*dto.TokenResponse, error) {
+
+	if pkg.IsLockedOut(email) {
+		return nil, ErrLockedOut
+	}
+
+	otp, err := u.repository.GetEmailOTP(email)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+
+	if time.Now().After(otp.ExpiresAt) || otp.Attempts >= config.ENV.EMAIL_OTP_MAX_ATTEMPTS {
+		if err := u.repository.DeleteEmailOTPs(email); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidToken
+	}
+
+	if !pkg.ValidateCode(otp.CodeHash, code) {
+		pkg.RecordFailedAttempt(email)
+		if err := u.repository.IncrementEmailOTPAttempts(otp.ID); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidToken
+	}
+
+	if err := u.repository.DeleteEmailOTPs(email); err != nil {
+		return nil, err
+	}
+	pkg.ResetFailedAttempts(email)
+
+	return u.completeEmailLogin(email, "email_otp", pkg.AMROTP)
+}
+
+func magicLinkSignupAllowed(email string) bool {
+	return config.ENV.REGISTRATION_ENABLED && config.ENV.MAGIC_LINK_SIGNUP_ENABLED && pkg.IsSignupDomainAllowed(email)
+}
+
+// setPassword rejects passwords matching the current one or any of the last
+// PASSWORD_HISTORY_SIZE passwords before storing the new hash.
+func (u *authUsecase) setPassword(user *entity.User, newPassword string) error {
+
+	historySize := max(config.ENV.PASSWORD_HISTORY_SIZE, 1)
+
+	history, err := u.repository.GetPasswordHistory(user.ID, historySize)
+	if err != nil {
+		return err
+	}
+
+	usedPasswords := []string{user.Password}
+	for _, h := range history {
+		usedPasswords = append(usedPasswords, h.Password)
+	}
+
+	for _, used := range usedPasswords {
+		if used == "" {
+			continue
+		}
+		if err := pkg.ValidatePassword(used, newPassword); err == nil {
+			return ErrPasswordReused
+		}
+	}
+
+	hashedPassword, err := pkg.EncryptPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	if err := u.repository.UpdatePassword(user.ID, hashedPassword, historySize); err != nil {
+		return err
+	}
+
+	// a new password ends every remembered device, in case one of them
+	// belongs to whoever learned the old password
+	return u.mfaRepo.DeleteTrustedDevices(user.ID)
+}
+
+// sendMail delivers in the background. Requests that may or may not send an
+// email depending on whether the account exists must answer in the same time
+// either way, so they never wait for the mail server.
+func (u *authUsecase) sendMail(to string, subject string, body string) {
+	go func() {
+		if err := u.mailer.Send(to, subject, body); err != nil {
+			log.Printf("failed to send %q email: %v", subject, err)
+		}
+	}()
+}
+
+func (u *authUsecase) UploadAvatar(userID string, data []byte) (*dto.AvatarResponse, error) {
+
+	user, err := u.repository.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return storeAvatar(context.Background(), u.blobs, u.repository, user, data)
+}
+
+// DeleteAvatar clears the avatar, whether uploaded or linked to a provider
+// picture.
+func (u *authUsecase) DeleteAvatar(userID string) error {
+
+	user, err := u.repository.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+
+	if err := u.repository.UpdateAvatar(user.ID, "", ""); err != nil {
+		return err
+	}
+
+	if user.AvatarKey != "" {
+		deleteAvatarBlobs(context.Background(), u.blobs, user.AvatarKey)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package usecase
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"github.com/revandpratama/auth4me/internal/auth/repository"
+	"github.com/revandpratama/auth4me/pkg"
+)
+
+func avatarBlobKey(prefix string, size int) string {
+	return fmt.Sprintf("%s/%d.png", prefix, size)
+}
+
+// storeAvatar resizes an image, stores every size under a new key prefix so
+// cached copies of the old avatar are never served for the new one, points
+// the user at it and removes the previous upload.
+func storeAvatar(ctx context.Context, blobs pkg.BlobStore, repo repository.AuthRepository, user *entity.User, data []byte) (*dto.AvatarResponse, error) {
+
+	images, err := pkg.ProcessAvatar(data)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := fmt.Sprintf("avatars/%s/%s", user.ID, uuid.NewString())
+	response := &dto.AvatarResponse{Sizes: make(map[int]string, len(images))}
+
+	for _, size := range pkg.AvatarSizes {
+		key := avatarBlobKey(prefix, size)
+		if err := blobs.Put(ctx, key, pkg.AvatarContentType, images[size]); err != nil {
+			deleteAvatarBlobs(ctx, blobs, prefix)
+			return nil, fmt.Errorf("store avatar failed: %w", err)
+		}
+		response.Sizes[size] = blobs.URL(key)
+	}
+	response.AvatarPath = response.Sizes[pkg.AvatarSizes[0]]
+
+	if err := repo.UpdateAvatar(user.ID, response.AvatarPath, prefix); err != nil {
+		deleteAvatarBlobs(ctx, blobs, prefix)
+		return nil, err
+	}
+
+	if user.AvatarKey != "" {
+		deleteAvatarBlobs(ctx, blobs, user.AvatarKey)
+	}
+	user.AvatarPath, user.AvatarKey = response.AvatarPath, prefix
+
+	return response, nil
+}
+
+// deleteAvatarBlobs is best effort, a leftover file only costs storage.
+func deleteAvatarBlobs(ctx context.Context, blobs pkg.BlobStore, prefix string) {
+	for _, size := range pkg.AvatarSizes {
+		if err := blobs.Delete(ctx, avatarBlobKey(prefix, size)); err != nil {
+			log.Printf("delete avatar %s failed: %v", avatarBlobKey(prefix, size), err)
+		}
+	}
+}
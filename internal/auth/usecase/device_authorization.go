@@ -0,0 +1,147 @@
+package usecase
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/revandpratama/auth4me/config"
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"github.com/revandpratama/auth4me/pkg"
+)
+
+// deviceLookupLimit bounds how many user codes one user may try per
+// window, so the short codes cannot be guessed by brute force.
+const (
+	deviceLookupLimit  = 20
+	deviceLookupWindow = 10 * time.Minute
+)
+
+var (
+	ErrDeviceCodeNotFound = errors.New("user code not found or expired")
+	ErrDeviceThrottled    = errors.New("too many user codes tried, try again later")
+)
+
+// DeviceAuthorization starts the device flow for a client that cannot
+// show a browser, such as a CLI or a TV.
+func (u *oauthServerUsecase) DeviceAuthorization(req *dto.DeviceAuthorizationRequest) (*dto.DeviceAuthorizationResponse, error) {
+
+	client, err := u.authenticateClient(req.ClientID, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	if !client.AllowsGrantType(GrantTypeDeviceCode) {
+		return nil, oauthError("unauthorized_client", "client may not use the device authorization grant")
+	}
+
+	scopes := strings.Fields(req.Scope)
+	if err := checkScopes(client, scopes); err != nil {
+		return nil, err
+	}
+
+	deviceCode, err := generateRandomState()
+	if err != nil {
+		return nil, err
+	}
+
+	// retry on the rare clash with a live user code
+	var userCode string
+	for saved := false; !saved; {
+		if userCode, err = pkg.GenerateUserCode(); err != nil {
+			return nil, err
+		}
+		saved = pkg.SaveDeviceAuthorization(deviceCode, pkg.DeviceAuthorization{
+			ClientID:  client.ClientID,
+			Scopes:    scopes,
+			UserCode:  userCode,
+			Interval:  pkg.DevicePollInterval,
+			ExpiresAt: time.Now().Add(pkg.DeviceCodeTTL),
+		})
+	}
+
+	verificationURI := config.ENV.OAUTH_SERVER_DEVICE_URL
+	return &dto.DeviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: authorizationRedirect(verificationURI, url.Values{"user_code": {userCode}}),
+		ExpiresIn:               int(pkg.DeviceCodeTTL.Seconds()),
+		Interval:                int(pkg.DevicePollInterval.Seconds()),
+	}, nil
+}
+
+func (u *oauthServerUsecase) GetDeviceAuthorization(userID string, userCode string) (*dto.DeviceVerificationResponse, error) {
+
+	if !pkg.AllowAction("device_user_code:"+userID, deviceLookupLimit, deviceLookupWindow, 0) {
+		return nil, ErrDeviceThrottled
+	}
+
+	device, ok := pkg.GetDeviceAuthorization(userCode)
+	if !ok {
+		return nil, ErrDeviceCodeNotFound
+	}
+
+	client, err := u.clientRepo.GetClientByClientID(device.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dto.DeviceVerificationResponse{
+		ClientID:   client.ClientID,
+		ClientName: client.Name,
+		Scopes:     device.Scopes,
+	}, nil
+}
+
+// DecideDeviceAuthorization approves or denies a user code for the signed
+// in user. Approving is the consent; the device picks up the result on its
+// next poll.
+func (u *oauthServerUsecase) DecideDeviceAuthorization(userID string, authn pkg.Authentication, userCode string, approve bool) error {
+
+	if !pkg.AllowAction("device_user_code:"+userID, deviceLookupLimit, deviceLookupWindow, 0) {
+		return ErrDeviceThrottled
+	}
+
+	if !pkg.DecideDeviceAuthorization(userCode, userID, authn, approve) {
+		return ErrDeviceCodeNotFound
+	}
+	return nil
+}
+
+func (u *oauthServerUsecase) exchangeDeviceCode(client *entity.OAuthClient, req *dto.OAuthTokenRequest) (*dto.OAuthTokenResponse, error) {
+
+	if !client.AllowsGrantType(GrantTypeDeviceCode) {
+		return nil, oauthError("unauthorized_client", "client may not use the device authorization grant")
+	}
+	if req.DeviceCode == "" {
+		return nil, oauthError("invalid_request", "device_code is required")
+	}
+
+	device, err := pkg.PollDeviceAuthorization(req.DeviceCode, client.ClientID)
+	switch {
+	case errors.Is(err, pkg.ErrDeviceAuthorizationPending):
+		return nil, oauthError("authorization_pending", "the user has not approved the device yet")
+	case errors.Is(err, pkg.ErrDeviceSlowDown):
+		return nil, oauthError("slow_down", "polling too fast, wait 5 more seconds between requests")
+	case errors.Is(err, pkg.ErrDeviceAccessDenied):
+		return nil, oauthError("access_denied", "the user denied the device")
+	case errors.Is(err, pkg.ErrDeviceCodeExpired):
+		return nil, oauthError("expired_token", "the device code expired, start over")
+	case err != nil:
+		return nil, oauthError("invalid_grant", "device code is invalid")
+	}
+
+	grant := pkg.ClientGrant{
+		GrantID:        uuid.NewString(),
+		ClientID:       client.ClientID,
+		UserID:         device.UserID,
+		Scopes:         device.Scopes,
+		Authentication: device.Authentication,
+		ExpiresAt:      time.Now().Add(time.Duration(config.ENV.OAUTH_SERVER_REFRESH_TOKEN_TTL_DAY) * 24 * time.Hour),
+	}
+
+	return u.issueClientTokens(client, grant, "")
+}
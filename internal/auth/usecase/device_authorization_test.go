@@ -0,0 +1,64 @@
+package usecase
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+	"github.com/revandpratama/auth4me/pkg"
+)
+
+func TestDeviceCodeGrant(t *testing.T) {
+	u := newOAuthServerTestUsecase(t)
+
+	_, err := u.DeviceAuthorization(&dto.DeviceAuthorizationRequest{ClientID: "spa", Scope: "openid"})
+	wantOAuthError(t, err, "unauthorized_client")
+
+	pending, err := u.DeviceAuthorization(&dto.DeviceAuthorizationRequest{ClientID: "tv", Scope: "openid"})
+	if err != nil {
+		t.Fatalf("DeviceAuthorization: %v", err)
+	}
+	poll := func(deviceCode string) (*dto.OAuthTokenResponse, error) {
+		return u.Token(&dto.OAuthTokenRequest{GrantType: GrantTypeDeviceCode, ClientID: "tv", DeviceCode: deviceCode})
+	}
+
+	_, err = poll(pending.DeviceCode)
+	wantOAuthError(t, err, "authorization_pending")
+	_, err = poll(pending.DeviceCode)
+	wantOAuthError(t, err, "slow_down")
+
+	// approved before the first poll, the device gets its tokens once
+	approved, err := u.DeviceAuthorization(&dto.DeviceAuthorizationRequest{ClientID: "tv", Scope: "openid"})
+	if err != nil {
+		t.Fatalf("DeviceAuthorization: %v", err)
+	}
+	if err := u.DecideDeviceAuthorization("user-1", pkg.Authentication{Time: time.Now()}, approved.UserCode, true); err != nil {
+		t.Fatalf("DecideDeviceAuthorization: %v", err)
+	}
+
+	tokens, err := poll(approved.DeviceCode)
+	if err != nil || tokens.AccessToken == "" {
+		t.Fatalf("got %+v, %v, want tokens", tokens, err)
+	}
+	_, err = poll(approved.DeviceCode)
+	wantOAuthError(t, err, "invalid_grant")
+}
+
+func TestDeviceCodeGrantDenied(t *testing.T) {
+	u := newOAuthServerTestUsecase(t)
+
+	device, err := u.DeviceAuthorization(&dto.DeviceAuthorizationRequest{ClientID: "tv", Scope: "openid"})
+	if err != nil {
+		t.Fatalf("DeviceAuthorization: %v", err)
+	}
+	if err := u.DecideDeviceAuthorization("user-1", pkg.Authentication{}, device.UserCode, false); err != nil {
+		t.Fatalf("DecideDeviceAuthorization: %v", err)
+	}
+	if err := u.DecideDeviceAuthorization("user-1", pkg.Authentication{}, device.UserCode, true); !errors.Is(err, ErrDeviceCodeNotFound) {
+		t.Errorf("deciding twice: got %v, want ErrDeviceCodeNotFound", err)
+	}
+
+	_, err = u.Token(&dto.OAuthTokenRequest{GrantType: GrantTypeDeviceCode, ClientID: "tv", DeviceCode: device.DeviceCode})
+	wantOAuthError(t, err, "access_denied")
+}
@@ -0,0 +1,226 @@
+package usecase
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"github.com/revandpratama/auth4me/internal/auth/repository"
+	"gorm.io/gorm"
+)
+
+// In-memory stand-ins for the repositories. Each embeds its interface, so a
+// test calling a method not implemented here panics instead of passing.
+
+type fakeAuthRepository struct {
+	repository.AuthRepository
+	users map[string]*entity.User // by ID
+}
+
+func newFakeAuthRepository(users ...*entity.User) *fakeAuthRepository {
+	r := &fakeAuthRepository{users: map[string]*entity.User{}}
+	for _, user := range users {
+		r.users[user.ID] = user
+	}
+	return r
+}
+
+func (r *fakeAuthRepository) GetUserByID(id string) (*entity.User, error) {
+	if user, ok := r.users[id]; ok {
+		return user, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakeAuthRepository) GetUserByEmail(email string) (*entity.User, error) {
+	for _, user := range r.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakeAuthRepository) CreateUser(user *entity.User) (*entity.User, error) {
+	user.ID = fmt.Sprintf("user-%d", len(r.users)+1)
+	r.users[user.ID] = user
+	return user, nil
+}
+
+func (r *fakeAuthRepository) UpdateUser(user *entity.User) error {
+	r.users[user.ID] = user
+	return nil
+}
+
+func (r *fakeAuthRepository) UpdateMFA(userID string, enabled bool, secret string) error {
+	user := r.users[userID]
+	user.MFAEnabled, user.MFASecret = enabled, secret
+	return nil
+}
+
+// UseTOTPStep mirrors the conditional update of the real repository.
+func (r *fakeAuthRepository) UseTOTPStep(userID string, step int64) (bool, error) {
+	user := r.users[userID]
+	if user.MFALastTOTPStep >= step {
+		return false, nil
+	}
+	user.MFALastTOTPStep = step
+	return true, nil
+}
+
+func (r *fakeAuthRepository) GetRoleByName(name string) (*entity.Role, error) {
+	return &entity.Role{ID: 2, Name: name}, nil
+}
+
+type fakeOAuthRepository struct {
+	repository.OAuthRepository
+	identities []entity.OAuthProvider
+}
+
+func (r *fakeOAuthRepository) GetProvider(userID string, providerName string) (*entity.OAuthProvider, error) {
+	for i := range r.identities {
+		if r.identities[i].UserID == userID && r.identities[i].Provider == providerName {
+			return &r.identities[i], nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakeOAuthRepository) GetProviderByProviderID(providerName string, providerID string) (*entity.OAuthProvider, error) {
+	for i := range r.identities {
+		if r.identities[i].Provider == providerName && r.identities[i].ProviderID == providerID {
+			return &r.identities[i], nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakeOAuthRepository) CreateProvider(provider *entity.OAuthProvider) error {
+	r.identities = append(r.identities, *provider)
+	return nil
+}
+
+type fakeOAuthClientRepository struct {
+	repository.OAuthClientRepository
+	clients map[string]*entity.OAuthClient // by client ID
+}
+
+func newFakeOAuthClientRepository(clients ...*entity.OAuthClient) *fakeOAuthClientRepository {
+	r := &fakeOAuthClientRepository{clients: map[string]*entity.OAuthClient{}}
+	for _, client := range clients {
+		r.clients[client.ClientID] = client
+	}
+	return r
+}
+
+func (r *fakeOAuthClientRepository) CreateClient(client *entity.OAuthClient) error {
+	r.clients[client.ClientID] = client
+	return nil
+}
+
+func (r *fakeOAuthClientRepository) GetClientByClientID(clientID string) (*entity.OAuthClient, error) {
+	client, ok := r.clients[clientID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	copied := *client
+	return &copied, nil
+}
+
+func (r *fakeOAuthClientRepository) UpdateClient(client *entity.OAuthClient) error {
+	r.clients[client.ClientID] = client
+	return nil
+}
+
+func (r *fakeOAuthClientRepository) DeleteClient(clientID string) (bool, error) {
+	_, ok := r.clients[clientID]
+	delete(r.clients, clientID)
+	return ok, nil
+}
+
+type fakeMFARepository struct {
+	repository.MFARepository
+	recoveryCodes  map[string]map[string]bool // user ID -> code hash -> used
+	trustedDevices []entity.TrustedDevice
+}
+
+func newFakeMFARepository() *fakeMFARepository {
+	return &fakeMFARepository{recoveryCodes: map[string]map[string]bool{}}
+}
+
+func (r *fakeMFARepository) ReplaceRecoveryCodes(userID string, codeHashes []string) error {
+	codes := map[string]bool{}
+	for _, hash := range codeHashes {
+		codes[hash] = false
+	}
+	r.recoveryCodes[userID] = codes
+	return nil
+}
+
+func (r *fakeMFARepository) UseRecoveryCode(userID string, codeHash string) (bool, error) {
+	used, exists := r.recoveryCodes[userID][codeHash]
+	if !exists || used {
+		return false, nil
+	}
+	r.recoveryCodes[userID][codeHash] = true
+	return true, nil
+}
+
+func (r *fakeMFARepository) CountUnusedRecoveryCodes(userID string) (int64, error) {
+	var count int64
+	for _, used := range r.recoveryCodes[userID] {
+		if !used {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// fakeMailer drops every message; usecases send from goroutines, so it
+// must not touch the test.
+type fakeMailer struct{}
+
+func (fakeMailer) Send(to string, subject string, body string) error {
+	return nil
+}
+
+type fakeWebAuthnRepository struct {
+	repository.WebAuthnRepository
+	usage map[uint]uint32 // credential ID -> sign count stored
+}
+
+func (r *fakeWebAuthnRepository) UpdateCredentialUsage(id uint, signCount uint32, backupState bool) error {
+	r.usage[id] = signCount
+	return nil
+}
+
+func (r *fakeMFARepository) CreateTrustedDevice(device *entity.TrustedDevice) error {
+	device.ID = uint(len(r.trustedDevices) + 1)
+	r.trustedDevices = append(r.trustedDevices, *device)
+	return nil
+}
+
+// GetTrustedDevice mirrors the expiry filter of the real query.
+func (r *fakeMFARepository) GetTrustedDevice(userID string, tokenHash string) (*entity.TrustedDevice, error) {
+	for i := range r.trustedDevices {
+		device := &r.trustedDevices[i]
+		if device.UserID == userID && device.TokenHash == tokenHash && device.ExpiresAt.After(time.Now()) {
+			return device, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakeMFARepository) TouchTrustedDevice(id uint) error {
+	return nil
+}
+
+func (r *fakeMFARepository) DeleteTrustedDevice(userID string, id uint) (bool, error) {
+	for i, device := range r.trustedDevices {
+		if device.UserID == userID && device.ID == id {
+			r.trustedDevices = append(r.trustedDevices[:i], r.trustedDevices[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
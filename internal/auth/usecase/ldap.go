@@ -0,0 +1,149 @@
+package usecase
+
+import (
+	"errors"
+	"log"
+
+	"github.com/revandpratama/auth4me/config"
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"github.com/revandpratama/auth4me/pkg"
+	"gorm.io/gorm"
+)
+
+// ldapProviderName names the directory identities in the provider table and
+// the authentication method of LDAP logins.
+const ldapProviderName = "ldap"
+
+// ldapLogin checks the password against the directory. Password age and
+// forced changes are the directory's business, so only MFA follows.
+func (u *authUsecase) ldapLogin(email string, password string, deviceToken string) (*dto.TokenResponse, error) {
+
+	ldapUser, err := u.ldap.Authenticate(email, password)
+	if err != nil {
+		if !errors.Is(err, pkg.ErrLDAPInvalidCredentials) {
+			log.Printf("ldap authentication failed: %v", err)
+		}
+		pkg.RecordFailedAttempt(email)
+		return nil, ErrInvalidCredentials
+	}
+	pkg.ResetFailedAttempts(email)
+
+	user, err := u.provisionLDAPUser(ldapUser)
+	if err != nil {
+		return nil, err
+	}
+
+	return u.completePasswordLogin(user, ldapProviderName, deviceToken)
+}
+
+// provisionLDAPUser finds or creates the account of a directory user. The
+// account is found through its "ldap" identity, keyed on ldapUser.ID like
+// any provider identity, so a renamed email cannot lead to someone else's
+// account. An existing account is only linked under the same rules as
+// OAuth auto-linking. Its role comes from the directory groups through
+// ROLE_MAPPING_RULES, on creation or, with LDAP_SYNC_ROLES, on every login.
+// The allowed sign-up domains do not apply, the directory decides who
+// belongs.
+func (u *authUsecase) provisionLDAPUser(ldapUser *pkg.LDAPUser) (*entity.User, error) {
+
+	claims := map[string]any{"groups": ldapUser.Groups}
+
+	user, err := u.ldapLinkedUser(ldapUser)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return u.linkLDAPUser(ldapUser, claims)
+	}
+
+	changed := false
+	if !user.EmailVerified {
+		user.EmailVerified, changed = true, true
+	}
+	if ldapUser.Name != "" && user.FullName != ldapUser.Name {
+		user.FullName, changed = ldapUser.Name, true
+	}
+	if config.ENV.LDAP_SYNC_ROLES {
+		roleID, err := mappedRoleID(u.repository, ldapUser.Email, claims)
+		if err != nil {
+			return nil, err
+		}
+		if user.RoleID != roleID {
+			user.RoleID, changed = roleID, true
+		}
+	}
+
+	if changed {
+		if err := u.repository.UpdateUser(user); err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+// ldapLinkedUser returns the account the directory entry is linked to, nil
+// when there is none yet.
+func (u *authUsecase) ldapLinkedUser(ldapUser *pkg.LDAPUser) (*entity.User, error) {
+
+	identity, err := u.oauthRepo.GetProviderByProviderID(ldapProviderName, ldapUser.ID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return u.repository.GetUserByID(identity.UserID)
+}
+
+// linkLDAPUser creates the account of a directory entry seen for the first
+// time, or links the existing account with its email when auto-linking is
+// enabled and that email was verified.
+func (u *authUsecase) linkLDAPUser(ldapUser *pkg.LDAPUser, claims map[string]any) (*entity.User, error) {
+
+	user, err := u.repository.GetUserByEmail(ldapUser.Email)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+
+		roleID, err := mappedRoleID(u.repository, ldapUser.Email, claims)
+		if err != nil {
+			return nil, err
+		}
+
+		user, err = u.repository.CreateUser(&entity.User{
+			Email:         ldapUser.Email,
+			FullName:      ldapUser.Name,
+			EmailVerified: true,
+			RoleID:        roleID,
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if !config.ENV.OAUTH_AUTO_LINK_ENABLED || !user.EmailVerified {
+			log.Printf("ldap login for %s refused: the account exists and is not linked to the directory", ldapUser.Email)
+			return nil, ErrAccountLinkRequired
+		}
+		if _, err := u.oauthRepo.GetProvider(user.ID, ldapProviderName); err == nil {
+			// linked to another directory entry, which had this email before
+			log.Printf("ldap login for %s refused: the account is linked to another directory entry", ldapUser.Email)
+			return nil, ErrAccountLinkRequired
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	if err := u.oauthRepo.CreateProvider(&entity.OAuthProvider{
+		UserID:     user.ID,
+		Provider:   ldapProviderName,
+		ProviderID: ldapUser.ID,
+	}); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
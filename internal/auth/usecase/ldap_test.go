@@ -0,0 +1,86 @@
+package usecase
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/revandpratama/auth4me/config"
+	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"github.com/revandpratama/auth4me/pkg"
+)
+
+func newLDAPTestUsecase(t *testing.T, autoLink bool, users ...*entity.User) (*authUsecase, *fakeOAuthRepository) {
+	t.Helper()
+
+	saved := config.ENV
+	t.Cleanup(func() { config.ENV = saved })
+	config.ENV.OAUTH_AUTO_LINK_ENABLED = autoLink
+	config.ENV.LDAP_SYNC_ROLES = false
+	config.ENV.ROLE_MAPPING_RULES = ""
+
+	oauthRepo := &fakeOAuthRepository{}
+	return &authUsecase{repository: newFakeAuthRepository(users...), oauthRepo: oauthRepo}, oauthRepo
+}
+
+func TestProvisionLDAPUserCreatesAndLinks(t *testing.T) {
+	u, oauthRepo := newLDAPTestUsecase(t, false)
+
+	user, err := u.provisionLDAPUser(&pkg.LDAPUser{ID: "guid:01", Email: "jdoe@example.com", Name: "Jane Doe"})
+	if err != nil {
+		t.Fatalf("provisionLDAPUser: %v", err)
+	}
+	if !user.EmailVerified || user.FullName != "Jane Doe" {
+		t.Errorf("created %+v", user)
+	}
+	identity, err := oauthRepo.GetProviderByProviderID(ldapProviderName, "guid:01")
+	if err != nil || identity.UserID != user.ID {
+		t.Fatalf("identity %+v, %v, want one linked to %s", identity, err, user.ID)
+	}
+
+	// the next login finds the account through the identity, even after
+	// the directory changed the email
+	again, err := u.provisionLDAPUser(&pkg.LDAPUser{ID: "guid:01", Email: "jane.doe@example.com"})
+	if err != nil || again.ID != user.ID {
+		t.Errorf("got %v, %v, want the linked account", again, err)
+	}
+}
+
+func TestProvisionLDAPUserExistingAccount(t *testing.T) {
+	tests := []struct {
+		name     string
+		autoLink bool
+		verified bool
+		linked   string // ID of an identity the account already has
+		wantErr  error
+	}{
+		{"auto-link disabled", false, true, "", ErrAccountLinkRequired},
+		{"email not verified", true, false, "", ErrAccountLinkRequired},
+		{"linked to another entry", true, true, "guid:02", ErrAccountLinkRequired},
+		{"auto-linked", true, true, "", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			existing := &entity.User{ID: "local", Email: "jdoe@example.com", Password: "hash", EmailVerified: tt.verified}
+			u, oauthRepo := newLDAPTestUsecase(t, tt.autoLink, existing)
+			if tt.linked != "" {
+				oauthRepo.identities = append(oauthRepo.identities, entity.OAuthProvider{UserID: "local", Provider: ldapProviderName, ProviderID: tt.linked})
+			}
+
+			user, err := u.provisionLDAPUser(&pkg.LDAPUser{ID: "guid:01", Email: "jdoe@example.com"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			_, linkErr := oauthRepo.GetProviderByProviderID(ldapProviderName, "guid:01")
+			if tt.wantErr != nil {
+				if linkErr == nil {
+					t.Error("refused entry was linked anyway")
+				}
+				return
+			}
+			if user.ID != "local" || linkErr != nil {
+				t.Errorf("got %v, link %v, want the existing account linked", user, linkErr)
+			}
+		})
+	}
+}
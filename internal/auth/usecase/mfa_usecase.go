@@ -0,0 +1,499 @@
+package usecase
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/revandpratama/auth4me/config"
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"github.com/revandpratama/auth4me/internal/auth/repository"
+	"github.com/revandpratama/auth4me/pkg"
+	"gorm.io/gorm"
+)
+
+type MFAUsecase interface {
+	EnrollTOTP(userID string) (*dto.TOTPEnrollResponse, error)
+	ConfirmTOTP(userID string, code string) (*dto.RecoveryCodesResponse, error)
+	DisableTOTP(userID string, code string) error
+	VerifyMFA(userID string, provider string, prior pkg.Authentication, code string) (*dto.TokenResponse, error)
+	RegenerateRecoveryCodes(userID string) (*dto.RecoveryCodesResponse, error)
+	EnrollSMS(userID string, phoneNumber string) error
+	ConfirmSMS(userID string, code string) (*dto.RecoveryCodesResponse, error)
+	DisableSMS(userID string, code string) error
+	SendSMSCode(userID string) error
+	TrustDevice(userID string, userAgent string, ipAddress string) (string, time.Time, error)
+	ListTrustedDevices(userID string) ([]entity.TrustedDevice, error)
+	RevokeTrustedDevice(userID string, id uint) error
+}
+
+var (
+	ErrMFAAlreadyEnabled = errors.New("mfa is already enabled")
+	ErrMFANotEnrolled    = errors.New("mfa enrollment has not been started")
+	ErrMFANotEnabled     = errors.New("mfa is not enabled")
+	ErrInvalidMFACode    = errors.New("invalid mfa code")
+	ErrMFACodeReused     = errors.New("mfa code was already used, wait for the next one")
+	ErrInvalidPhone      = errors.New("phone number must be in E.164 format")
+	ErrSMSThrottled      = errors.New("too many sms codes requested, try again later")
+
+	ErrTrustedDeviceNotFound = errors.New("trusted device not found")
+)
+
+const (
+	smsCodeLength      = 6
+	smsCodeMaxAttempts = 5
+)
+
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+
+type mfaUsecase struct {
+	authRepo repository.AuthRepository
+	mfaRepo  repository.MFARepository
+	mailer   pkg.Mailer
+	sms      pkg.SMSSender
+}
+
+func NewMFAUsecase(authRepo repository.AuthRepository, mfaRepo repository.MFARepository, mailer pkg.Mailer, sms pkg.SMSSender) MFAUsecase {
+	return &mfaUsecase{
+		authRepo: authRepo,
+		mfaRepo:  mfaRepo,
+		mailer:   mailer,
+		sms:      sms,
+	}
+}
+
+// EnrollTOTP stores a new pending secret. MFA stays disabled until the user
+// proves their authenticator works through ConfirmTOTP.
+func (u *mfaUsecase) EnrollTOTP(userID string) (*dto.TOTPEnrollResponse, error) {
+
+	user, err := u.authRepo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.MFAEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	key, err := pkg.GenerateTOTPKey(user.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.authRepo.UpdateMFA(user.ID, false, key.Secret); err != nil {
+		return nil, err
+	}
+
+	return &dto.TOTPEnrollResponse{
+		Secret:     key.Secret,
+		OTPAuthURL: key.URL,
+		QRCode:     "data:image/png;base64," + base64.StdEncoding.EncodeToString(key.QRCode),
+	}, nil
+}
+
+// ConfirmTOTP enables MFA and returns the first set of recovery codes, which
+// are only ever shown here or when regenerated. Codes the user already holds
+// stay valid, and nil is returned instead.
+func (u *mfaUsecase) ConfirmTOTP(userID string, code string) (*dto.RecoveryCodesResponse, error) {
+
+	user, err := u.authRepo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.MFAEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if user.MFASecret == "" {
+		return nil, ErrMFANotEnrolled
+	}
+
+	step, valid := pkg.ValidateTOTP(user.MFASecret, code)
+	if !valid {
+		return nil, ErrInvalidMFACode
+	}
+	// the confirmation code must not pass as a second factor right after
+	if _, err := u.authRepo.UseTOTPStep(user.ID, step); err != nil {
+		return nil, err
+	}
+
+	if err := u.authRepo.UpdateMFA(user.ID, true, user.MFASecret); err != nil {
+		return nil, err
+	}
+
+	return u.firstRecoveryCodes(user.ID)
+}
+
+func (u *mfaUsecase) RegenerateRecoveryCodes(userID string) (*dto.RecoveryCodesResponse, error) {
+
+	user, err := u.authRepo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !requiresMFA(user) {
+		return nil, ErrMFANotEnabled
+	}
+
+	return u.generateRecoveryCodes(user.ID)
+}
+
+// firstRecoveryCodes generates codes only for a user who has none left;
+// replacing codes that are still valid is up to RegenerateRecoveryCodes.
+func (u *mfaUsecase) firstRecoveryCodes(userID string) (*dto.RecoveryCodesResponse, error) {
+	remaining, err := u.mfaRepo.CountUnusedRecoveryCodes(userID)
+	if err != nil {
+		return nil, err
+	}
+	if remaining > 0 {
+		return nil, nil
+	}
+	return u.generateRecoveryCodes(userID)
+}
+
+func (u *mfaUsecase) generateRecoveryCodes(userID string) (*dto.RecoveryCodesResponse, error) {
+
+	codes := make([]string, 0, config.ENV.MFA_RECOVERY_CODE_COUNT)
+	hashes := make([]string, 0, config.ENV.MFA_RECOVERY_CODE_COUNT)
+	for range config.ENV.MFA_RECOVERY_CODE_COUNT {
+		code, err := pkg.GenerateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, pkg.HashCode(pkg.NormalizeRecoveryCode(code)))
+	}
+
+	if err := u.mfaRepo.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+
+	return &dto.RecoveryCodesResponse{RecoveryCodes: codes}, nil
+}
+
+func (u *mfaUsecase) DisableTOTP(userID string, code string) error {
+
+	user, err := u.authRepo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+
+	if !user.MFAEnabled {
+		return ErrMFANotEnabled
+	}
+
+	if _, err := u.checkCode(user, code); err != nil {
+		return err
+	}
+
+	if err := u.authRepo.UpdateMFA(user.ID, false, ""); err != nil {
+		return err
+	}
+
+	if user.SMSMFAEnabled {
+		return nil
+	}
+	return u.removeFactorData(user.ID)
+}
+
+// VerifyMFA completes a login started with a first factor and upgrades it to
+// a full token pair carrying mfa=true. Called with a full token it serves as
+// step-up and refreshes the authentication time.
+func (u *mfaUsecase) VerifyMFA(userID string, provider string, prior pkg.Authentication, code string) (*dto.TokenResponse, error) {
+
+	user, err := u.authRepo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !requiresMFA(user) {
+		return nil, ErrMFANotEnabled
+	}
+
+	method, err := u.checkCode(user, code)
+	if err != nil {
+		return nil, err
+	}
+
+	return issueTokenPair(user, provider, prior.WithSecondFactor(method))
+}
+
+// checkCode accepts a TOTP code, the pending SMS code or an unused recovery
+// code and returns the amr value of the one used. It shares the login
+// lockout so guessing second factor codes is throttled like guessing
+// passwords.
+func (u *mfaUsecase) checkCode(user *entity.User, code string) (string, error) {
+
+	lockoutKey := "mfa:" + user.ID
+	if pkg.IsLockedOut(lockoutKey) {
+		return "", ErrLockedOut
+	}
+
+	if user.MFAEnabled {
+		if step, valid := pkg.ValidateTOTP(user.MFASecret, code); valid {
+			fresh, err := u.authRepo.UseTOTPStep(user.ID, step)
+			if err != nil {
+				return "", err
+			}
+			if !fresh {
+				pkg.RecordFailedAttempt(lockoutKey)
+				return "", ErrMFACodeReused
+			}
+			pkg.ResetFailedAttempts(lockoutKey)
+			return pkg.AMROTP, nil
+		}
+	}
+
+	if user.SMSMFAEnabled {
+		valid, err := u.checkSMSCode(user, code)
+		if err != nil {
+			return "", err
+		}
+		if valid {
+			pkg.ResetFailedAttempts(lockoutKey)
+			return pkg.AMRSMS, nil
+		}
+	}
+
+	used, err := u.mfaRepo.UseRecoveryCode(user.ID, pkg.HashCode(pkg.NormalizeRecoveryCode(code)))
+	if err != nil {
+		return "", err
+	}
+	if !used {
+		pkg.RecordFailedAttempt(lockoutKey)
+		return "", ErrInvalidMFACode
+	}
+	pkg.ResetFailedAttempts(lockoutKey)
+
+	u.notifyRecoveryCodeUsed(user)
+
+	return pkg.AMRRecoveryCode, nil
+}
+
+func (u *mfaUsecase) notifyRecoveryCodeUsed(user *entity.User) {
+
+	remaining, err := u.mfaRepo.CountUnusedRecoveryCodes(user.ID)
+	if err != nil {
+		log.Printf("failed to count recovery codes: %v", err)
+	}
+
+	body := fmt.Sprintf("A recovery code was just used to sign in to your account. You have %d recovery codes left.\n\nIf this was not you, reset your password and regenerate your recovery codes immediately.", remaining)
+
+	go func() {
+		if err := u.mailer.Send(user.Email, "A recovery code was used", body); err != nil {
+			log.Printf("failed to send recovery code notification: %v", err)
+		}
+	}()
+}
+
+// EnrollSMS records an unverified phone number and texts it a code. SMS MFA
+// stays disabled until the code comes back through ConfirmSMS.
+func (u *mfaUsecase) EnrollSMS(userID string, phoneNumber string) error {
+
+	user, err := u.authRepo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+
+	if user.SMSMFAEnabled {
+		return ErrMFAAlreadyEnabled
+	}
+
+	if !e164Pattern.MatchString(phoneNumber) {
+		return ErrInvalidPhone
+	}
+
+	if err := u.authRepo.UpdateSMSMFA(user.ID, phoneNumber, false, false); err != nil {
+		return err
+	}
+
+	return u.sendSMSCode(user.ID, phoneNumber)
+}
+
+// ConfirmSMS enables SMS MFA and, like ConfirmTOTP, returns recovery codes
+// only when the user holds none yet.
+func (u *mfaUsecase) ConfirmSMS(userID string, code string) (*dto.RecoveryCodesResponse, error) {
+
+	user, err := u.authRepo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.SMSMFAEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if user.PhoneNumber == "" {
+		return nil, ErrMFANotEnrolled
+	}
+
+	valid, err := u.checkSMSCode(user, code)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, ErrInvalidMFACode
+	}
+
+	if err := u.authRepo.UpdateSMSMFA(user.ID, user.PhoneNumber, true, true); err != nil {
+		return nil, err
+	}
+
+	return u.firstRecoveryCodes(user.ID)
+}
+
+func (u *mfaUsecase) DisableSMS(userID string, code string) error {
+
+	user, err := u.authRepo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+
+	if !user.SMSMFAEnabled {
+		return ErrMFANotEnabled
+	}
+
+	if _, err := u.checkCode(user, code); err != nil {
+		return err
+	}
+
+	if err := u.authRepo.UpdateSMSMFA(user.ID, "", false, false); err != nil {
+		return err
+	}
+	if err := u.mfaRepo.DeleteSMSOTPs(user.ID); err != nil {
+		return err
+	}
+
+	if user.MFAEnabled {
+		return nil
+	}
+	return u.removeFactorData(user.ID)
+}
+
+// removeFactorData drops what only makes sense while a second factor is
+// enabled, once the last one is turned off.
+func (u *mfaUsecase) removeFactorData(userID string) error {
+	if err := u.mfaRepo.DeleteRecoveryCodes(userID); err != nil {
+		return err
+	}
+	return u.mfaRepo.DeleteTrustedDevices(userID)
+}
+
+// SendSMSCode texts a login code to the verified phone number, for users
+// who chose SMS on the second factor step.
+func (u *mfaUsecase) SendSMSCode(userID string) error {
+
+	user, err := u.authRepo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+
+	if !user.SMSMFAEnabled || !user.PhoneVerified {
+		return ErrMFANotEnabled
+	}
+
+	return u.sendSMSCode(user.ID, user.PhoneNumber)
+}
+
+// sendSMSCode is throttled per phone number rather than per user, so an
+// attacker cannot run up the SMS bill by cycling accounts onto one premium
+// number.
+func (u *mfaUsecase) sendSMSCode(userID string, phoneNumber string) error {
+
+	minInterval := time.Second * time.Duration(config.ENV.SMS_MIN_INTERVAL_SECOND)
+	if !pkg.AllowAction("sms:"+phoneNumber, config.ENV.SMS_MAX_PER_HOUR, time.Hour, minInterval) {
+		return ErrSMSThrottled
+	}
+
+	code, err := pkg.GenerateNumericCode(smsCodeLength)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Second * time.Duration(config.ENV.SMS_OTP_TTL_SECOND)
+	if err := u.mfaRepo.ReplaceSMSOTP(&entity.SMSOTP{
+		UserID:      userID,
+		PhoneNumber: phoneNumber,
+		CodeHash:    pkg.HashCode(code),
+		ExpiresAt:   time.Now().Add(ttl),
+	}); err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("Your %s verification code is %s. It expires in %d minutes.", config.ENV.MFA_ISSUER, code, int(ttl.Minutes()))
+
+	return u.sms.Send(phoneNumber, message)
+}
+
+// checkSMSCode consumes the pending SMS code if it matches. Codes sent to a
+// number the user has since replaced are never accepted.
+func (u *mfaUsecase) checkSMSCode(user *entity.User, code string) (bool, error) {
+
+	otp, err := u.mfaRepo.GetSMSOTP(user.ID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if otp.PhoneNumber != user.PhoneNumber || time.Now().After(otp.ExpiresAt) || otp.Attempts >= smsCodeMaxAttempts {
+		return false, u.mfaRepo.DeleteSMSOTPs(user.ID)
+	}
+
+	if !pkg.ValidateCode(otp.CodeHash, code) {
+		return false, u.mfaRepo.IncrementSMSOTPAttempts(otp.ID)
+	}
+
+	return true, u.mfaRepo.DeleteSMSOTPs(user.ID)
+}
+
+// TrustDevice remembers the device that just passed MFA and returns the
+// token it has to present on later logins. An empty token means remembering
+// devices is disabled.
+func (u *mfaUsecase) TrustDevice(userID string, userAgent string, ipAddress string) (string, time.Time, error) {
+
+	if config.ENV.TRUSTED_DEVICE_TTL_DAY <= 0 {
+		return "", time.Time{}, nil
+	}
+
+	token, err := pkg.GenerateDeviceToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+
+	expiresAt := time.Now().AddDate(0, 0, config.ENV.TRUSTED_DEVICE_TTL_DAY)
+	if err := u.mfaRepo.CreateTrustedDevice(&entity.TrustedDevice{
+		UserID:    userID,
+		TokenHash: pkg.HashCode(token),
+		UserAgent: userAgent,
+		IPAddress: ipAddress,
+		ExpiresAt: expiresAt,
+	}); err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expiresAt, nil
+}
+
+func (u *mfaUsecase) ListTrustedDevices(userID string) ([]entity.TrustedDevice, error) {
+	return u.mfaRepo.GetTrustedDevicesByUserID(userID)
+}
+
+func (u *mfaUsecase) RevokeTrustedDevice(userID string, id uint) error {
+	deleted, err := u.mfaRepo.DeleteTrustedDevice(userID, id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrTrustedDeviceNotFound
+	}
+	return nil
+}
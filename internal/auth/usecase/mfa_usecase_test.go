@@ -0,0 +1,260 @@
+package usecase
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/revandpratama/auth4me/config"
+	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"github.com/revandpratama/auth4me/pkg"
+)
+
+const testTOTPSecret = "JBSWY3DPEHPK3PXP"
+
+func newMFATestUsecase(t *testing.T, user *entity.User) (*mfaUsecase, *fakeMFARepository) {
+	t.Helper()
+
+	saved := config.ENV
+	t.Cleanup(func() { config.ENV = saved })
+	config.ENV.LOGIN_MAX_ATTEMPTS = 3
+	config.ENV.LOGIN_LOCKOUT_SECOND = 60
+	config.ENV.MFA_RECOVERY_CODE_COUNT = 4
+	t.Cleanup(func() { pkg.ResetFailedAttempts("mfa:" + user.ID) })
+
+	mfaRepo := newFakeMFARepository()
+	return &mfaUsecase{authRepo: newFakeAuthRepository(user), mfaRepo: mfaRepo, mailer: fakeMailer{}}, mfaRepo
+}
+
+func totpCode(t *testing.T, at time.Time) string {
+	t.Helper()
+	code, err := totp.GenerateCodeCustom(testTOTPSecret, at, totp.ValidateOpts{
+		Period:    30,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestCheckCodeTOTPReplay(t *testing.T) {
+	user := &entity.User{ID: "totp-replay", MFAEnabled: true, MFASecret: testTOTPSecret}
+	u, _ := newMFATestUsecase(t, user)
+
+	code := totpCode(t, time.Now())
+	method, err := u.checkCode(user, code)
+	if err != nil || method != pkg.AMROTP {
+		t.Fatalf("fresh code: got %q, %v", method, err)
+	}
+
+	if _, err := u.checkCode(user, code); !errors.Is(err, ErrMFACodeReused) {
+		t.Errorf("same code again: got %v, want ErrMFACodeReused", err)
+	}
+	// still inside the drift window, but older than the code just used
+	if _, err := u.checkCode(user, totpCode(t, time.Now().Add(-30*time.Second))); !errors.Is(err, ErrMFACodeReused) {
+		t.Errorf("previous code: got %v, want ErrMFACodeReused", err)
+	}
+}
+
+func TestCheckCodeTOTPWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		offset  time.Duration
+		wantErr error
+	}{
+		{"previous step", -30 * time.Second, nil},
+		{"next step", 30 * time.Second, nil},
+		{"two steps back", -90 * time.Second, ErrInvalidMFACode},
+		{"two steps ahead", 90 * time.Second, ErrInvalidMFACode},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &entity.User{ID: "totp-window", MFAEnabled: true, MFASecret: testTOTPSecret}
+			u, _ := newMFATestUsecase(t, user)
+
+			if _, err := u.checkCode(user, totpCode(t, time.Now().Add(tt.offset))); !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckCodeLocksOut(t *testing.T) {
+	user := &entity.User{ID: "totp-lockout", MFAEnabled: true, MFASecret: testTOTPSecret}
+	u, _ := newMFATestUsecase(t, user)
+
+	for range config.ENV.LOGIN_MAX_ATTEMPTS {
+		if _, err := u.checkCode(user, "000000x"); !errors.Is(err, ErrInvalidMFACode) {
+			t.Fatalf("wrong code: got %v, want ErrInvalidMFACode", err)
+		}
+	}
+	if _, err := u.checkCode(user, totpCode(t, time.Now())); !errors.Is(err, ErrLockedOut) {
+		t.Errorf("valid code while locked out: got %v, want ErrLockedOut", err)
+	}
+}
+
+func TestConfirmTOTP(t *testing.T) {
+	user := &entity.User{ID: "totp-confirm", MFASecret: testTOTPSecret}
+	u, _ := newMFATestUsecase(t, user)
+
+	if _, err := u.ConfirmTOTP(user.ID, "123456x"); !errors.Is(err, ErrInvalidMFACode) {
+		t.Fatalf("wrong code: got %v, want ErrInvalidMFACode", err)
+	}
+
+	code := totpCode(t, time.Now())
+	codes, err := u.ConfirmTOTP(user.ID, code)
+	if err != nil {
+		t.Fatalf("ConfirmTOTP: %v", err)
+	}
+	if !user.MFAEnabled || codes == nil || len(codes.RecoveryCodes) != config.ENV.MFA_RECOVERY_CODE_COUNT {
+		t.Fatalf("enabled %v, codes %+v", user.MFAEnabled, codes)
+	}
+
+	// the confirmation code cannot pass as a second factor right after
+	if _, err := u.checkCode(user, code); !errors.Is(err, ErrMFACodeReused) {
+		t.Errorf("confirmation code reused: got %v, want ErrMFACodeReused", err)
+	}
+	if _, err := u.ConfirmTOTP(user.ID, code); !errors.Is(err, ErrMFAAlreadyEnabled) {
+		t.Errorf("confirming twice: got %v, want ErrMFAAlreadyEnabled", err)
+	}
+}
+
+func TestConfirmTOTPKeepsRecoveryCodes(t *testing.T) {
+	// SMS is already enabled and came with recovery codes
+	user := &entity.User{ID: "totp-second-factor", MFASecret: testTOTPSecret, SMSMFAEnabled: true}
+	u, mfaRepo := newMFATestUsecase(t, user)
+	mfaRepo.ReplaceRecoveryCodes(user.ID, []string{pkg.HashCode("abcdefghjk")})
+
+	codes, err := u.ConfirmTOTP(user.ID, totpCode(t, time.Now()))
+	if err != nil {
+		t.Fatalf("ConfirmTOTP: %v", err)
+	}
+	if codes != nil {
+		t.Errorf("new recovery codes %v replaced ones still valid", codes.RecoveryCodes)
+	}
+	if remaining, _ := mfaRepo.CountUnusedRecoveryCodes(user.ID); remaining != 1 {
+		t.Errorf("%d recovery codes left, want the existing one", remaining)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	user := &entity.User{ID: "recovery", MFAEnabled: true, MFASecret: testTOTPSecret}
+	u, mfaRepo := newMFATestUsecase(t, user)
+
+	generated, err := u.RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		t.Fatalf("RegenerateRecoveryCodes: %v", err)
+	}
+	codes := generated.RecoveryCodes
+	if len(codes) != config.ENV.MFA_RECOVERY_CODE_COUNT {
+		t.Fatalf("got %d codes, want %d", len(codes), config.ENV.MFA_RECOVERY_CODE_COUNT)
+	}
+	for hash := range mfaRepo.recoveryCodes[user.ID] {
+		for _, code := range codes {
+			if hash == code || hash == pkg.NormalizeRecoveryCode(code) {
+				t.Fatal("recovery codes stored in plain text")
+			}
+		}
+	}
+
+	// typed in upper case and without the dash
+	typed := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+	if method, err := u.checkCode(user, typed); err != nil || method != pkg.AMRRecoveryCode {
+		t.Fatalf("recovery code: got %q, %v", method, err)
+	}
+	if _, err := u.checkCode(user, codes[0]); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("recovery code used twice: got %v, want ErrInvalidMFACode", err)
+	}
+	if remaining, _ := mfaRepo.CountUnusedRecoveryCodes(user.ID); remaining != int64(len(codes)-1) {
+		t.Errorf("%d codes left, want %d", remaining, len(codes)-1)
+	}
+
+	// regenerating replaces every code, used or not
+	if _, err := u.RegenerateRecoveryCodes(user.ID); err != nil {
+		t.Fatalf("RegenerateRecoveryCodes: %v", err)
+	}
+	if _, err := u.checkCode(user, codes[1]); !errors.Is(err, ErrInvalidMFACode) {
+		t.Errorf("replaced code: got %v, want ErrInvalidMFACode", err)
+	}
+}
+
+func TestRegenerateRecoveryCodesNeedsMFA(t *testing.T) {
+	user := &entity.User{ID: "recovery-no-mfa"}
+	u, _ := newMFATestUsecase(t, user)
+
+	if _, err := u.RegenerateRecoveryCodes(user.ID); !errors.Is(err, ErrMFANotEnabled) {
+		t.Errorf("got %v, want ErrMFANotEnabled", err)
+	}
+}
+
+func TestTrustedDevices(t *testing.T) {
+	saved := config.ENV
+	t.Cleanup(func() { config.ENV = saved })
+	config.ENV.TRUSTED_DEVICE_TTL_DAY = 30
+
+	user := &entity.User{ID: "trusting", MFAEnabled: true}
+	mfaRepo := newFakeMFARepository()
+	mfa := &mfaUsecase{authRepo: newFakeAuthRepository(user), mfaRepo: mfaRepo}
+	auth := &authUsecase{mfaRepo: mfaRepo}
+
+	token, expiresAt, err := mfa.TrustDevice(user.ID, "Firefox", "203.0.113.7")
+	if err != nil || token == "" {
+		t.Fatalf("TrustDevice: %q, %v", token, err)
+	}
+	if days := time.Until(expiresAt).Hours() / 24; days < 29 || days > 30 {
+		t.Errorf("expires in %.1f days, want 30", days)
+	}
+	if mfaRepo.trustedDevices[0].TokenHash != pkg.HashCode(token) {
+		t.Error("device token is not stored hashed")
+	}
+
+	if !auth.isTrustedDevice(user.ID, token) {
+		t.Error("trusted device was not recognized")
+	}
+	for name, check := range map[string]func() bool{
+		"no token":           func() bool { return auth.isTrustedDevice(user.ID, "") },
+		"unknown token":      func() bool { return auth.isTrustedDevice(user.ID, "not-a-device") },
+		"another user":       func() bool { return auth.isTrustedDevice("someone-else", token) },
+		"hash as the cookie": func() bool { return auth.isTrustedDevice(user.ID, pkg.HashCode(token)) },
+	} {
+		if check() {
+			t.Errorf("%s: device trusted", name)
+		}
+	}
+
+	mfaRepo.trustedDevices[0].ExpiresAt = time.Now().Add(-time.Minute)
+	if auth.isTrustedDevice(user.ID, token) {
+		t.Error("expired device still trusted")
+	}
+	mfaRepo.trustedDevices[0].ExpiresAt = expiresAt
+
+	if err := mfa.RevokeTrustedDevice("someone-else", mfaRepo.trustedDevices[0].ID); !errors.Is(err, ErrTrustedDeviceNotFound) {
+		t.Errorf("revoking another user's device: got %v, want ErrTrustedDeviceNotFound", err)
+	}
+	if err := mfa.RevokeTrustedDevice(user.ID, mfaRepo.trustedDevices[0].ID); err != nil {
+		t.Fatalf("RevokeTrustedDevice: %v", err)
+	}
+	if auth.isTrustedDevice(user.ID, token) {
+		t.Error("revoked device still trusted")
+	}
+}
+
+func TestTrustDeviceDisabled(t *testing.T) {
+	saved := config.ENV
+	t.Cleanup(func() { config.ENV = saved })
+	config.ENV.TRUSTED_DEVICE_TTL_DAY = 0
+
+	mfaRepo := newFakeMFARepository()
+	mfa := &mfaUsecase{mfaRepo: mfaRepo}
+
+	token, _, err := mfa.TrustDevice("user-1", "Firefox", "203.0.113.7")
+	if err != nil || token != "" || len(mfaRepo.trustedDevices) != 0 {
+		t.Errorf("got token %q, %v, %d devices, want nothing remembered", token, err, len(mfaRepo.trustedDevices))
+	}
+}
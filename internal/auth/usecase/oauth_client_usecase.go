@@ -0,0 +1,377 @@
+package usecase
+
+import (
+	"crypto/subtle"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/revandpratama/auth4me/config"
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"github.com/revandpratama/auth4me/internal/auth/repository"
+	"github.com/revandpratama/auth4me/pkg"
+	"gorm.io/gorm"
+)
+
+// OAuthClientUsecase onboards OAuth clients: through dynamic registration
+// (RFC 7591) and its management protocol (RFC 7592), and for admins.
+type OAuthClientUsecase interface {
+	RegisterClient(initialAccessToken string, req *dto.ClientRegistrationRequest) (*dto.ClientInformationResponse, error)
+	CreateClient(req *dto.ClientRegistrationRequest) (*dto.ClientInformationResponse, error)
+	GetRegisteredClient(clientID string, registrationAccessToken string) (*dto.ClientInformationResponse, error)
+	UpdateRegisteredClient(clientID string, registrationAccessToken string, req *dto.ClientRegistrationRequest) (*dto.ClientInformationResponse, error)
+	DeleteRegisteredClient(clientID string, registrationAccessToken string) error
+	GetAllClients() ([]entity.OAuthClient, error)
+	GetClientByClientID(clientID string) (*entity.OAuthClient, error)
+	RotateClientSecret(clientID string) (*dto.OAuthClientCredentialsResponse, error)
+	DeleteClient(clientID string) error
+}
+
+const (
+	AuthMethodClientSecretBasic = "client_secret_basic"
+	AuthMethodClientSecretPost  = "client_secret_post"
+	AuthMethodNone              = "none"
+)
+
+// registrableGrantTypes leaves out client_credentials, which belongs to
+// service accounts.
+var registrableGrantTypes = []string{GrantTypeAuthorizationCode, GrantTypeRefreshToken, GrantTypeDeviceCode}
+
+// defaultClientScope is granted to clients that register without a scope.
+const defaultClientScope = "openid profile email"
+
+var (
+	ErrClientNotFound     = errors.New("oauth client not found")
+	ErrPublicClientSecret = errors.New("public clients have no secret")
+)
+
+type oauthClientUsecase struct {
+	clientRepo repository.OAuthClientRepository
+}
+
+func NewOAuthClientUsecase(clientRepo repository.OAuthClientRepository) OAuthClientUsecase {
+	return &oauthClientUsecase{
+		clientRepo: clientRepo,
+	}
+}
+
+// registrationEnabled reports whether any initial access token is
+// configured; without one, dynamic registration is closed.
+func registrationEnabled() bool {
+	return len(initialAccessTokens()) > 0
+}
+
+func initialAccessTokens() []string {
+	var tokens []string
+	for _, token := range strings.Split(config.ENV.OAUTH_SERVER_INITIAL_ACCESS_TOKENS, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+func validInitialAccessToken(presented string) bool {
+	if presented == "" {
+		return false
+	}
+	for _, token := range initialAccessTokens() {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(presented)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterClient registers a client on its own behalf. The client gets a
+// registration access token to read, update and delete its registration.
+func (u *oauthClientUsecase) RegisterClient(initialAccessToken string, req *dto.ClientRegistrationRequest) (*dto.ClientInformationResponse, error) {
+
+	if !validInitialAccessToken(initialAccessToken) {
+		return nil, oauthError("invalid_token", "a valid initial access token is required to register")
+	}
+
+	return u.createClient(req, true)
+}
+
+// CreateClient registers a client for an operator, without a registration
+// access token.
+func (u *oauthClientUsecase) CreateClient(req *dto.ClientRegistrationRequest) (*dto.ClientInformationResponse, error) {
+	return u.createClient(req, false)
+}
+
+func (u *oauthClientUsecase) createClient(req *dto.ClientRegistrationRequest, dynamic bool) (*dto.ClientInformationResponse, error) {
+
+	if req.ClientID != "" || req.ClientSecret != "" {
+		return nil, oauthError("invalid_client_metadata", "client_id and client_secret are issued by the server")
+	}
+
+	clientID, err := pkg.GenerateClientID()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &entity.OAuthClient{
+		ClientID:              clientID,
+		RegisteredDynamically: dynamic,
+	}
+	if err := applyClientMetadata(client, req); err != nil {
+		return nil, err
+	}
+
+	var clientSecret string
+	if !client.Public {
+		if clientSecret, err = pkg.GenerateClientSecret(); err != nil {
+			return nil, err
+		}
+		client.ClientSecretHash = pkg.HashClientSecret(clientSecret)
+	}
+
+	var registrationToken string
+	if dynamic {
+		if registrationToken, err = pkg.GenerateClientSecret(); err != nil {
+			return nil, err
+		}
+		client.RegistrationAccessTokenHash = pkg.HashClientSecret(registrationToken)
+	}
+
+	if err := u.clientRepo.CreateClient(client); err != nil {
+		return nil, err
+	}
+
+	info := clientInformation(client)
+	info.ClientSecret = clientSecret
+	info.RegistrationAccessToken = registrationToken
+	return info, nil
+}
+
+// applyClientMetadata validates req and copies it onto client, filling in
+// the RFC 7591 defaults.
+func applyClientMetadata(client *entity.OAuthClient, req *dto.ClientRegistrationRequest) error {
+
+	grantTypes := req.GrantTypes
+	if len(grantTypes) == 0 {
+		grantTypes = []string{GrantTypeAuthorizationCode}
+	}
+	for _, grantType := range grantTypes {
+		if !slices.Contains(registrableGrantTypes, grantType) {
+			return oauthError("invalid_client_metadata", "grant type "+grantType+" is not supported")
+		}
+	}
+	usesCode := slices.Contains(grantTypes, GrantTypeAuthorizationCode)
+
+	responseTypes := req.ResponseTypes
+	if len(responseTypes) == 0 && usesCode {
+		responseTypes = []string{"code"}
+	}
+	if usesCode != slices.Equal(responseTypes, []string{"code"}) {
+		return oauthError("invalid_client_metadata", "response_types must be code exactly when authorization_code is a grant type")
+	}
+
+	if usesCode && len(req.RedirectURIs) == 0 {
+		return oauthError("invalid_redirect_uri", "redirect_uris is required for the authorization_code grant")
+	}
+	for _, uri := range req.RedirectURIs {
+		if err := pkg.ValidateRedirectURI(uri); err != nil {
+			return oauthError("invalid_redirect_uri", "redirect uri "+uri+" must be absolute, without fragment, and https unless it is a loopback address")
+		}
+	}
+
+	authMethod := req.TokenEndpointAuthMethod
+	if authMethod == "" {
+		authMethod = AuthMethodClientSecretBasic
+	}
+	if !slices.Contains([]string{AuthMethodClientSecretBasic, AuthMethodClientSecretPost, AuthMethodNone}, authMethod) {
+		return oauthError("invalid_client_metadata", "token_endpoint_auth_method "+authMethod+" is not supported")
+	}
+
+	scope := req.Scope
+	if strings.TrimSpace(scope) == "" {
+		scope = defaultClientScope
+	}
+	for _, s := range strings.Fields(scope) {
+		if !slices.Contains(pkg.SupportedScopes, s) {
+			return oauthError("invalid_client_metadata", "scope "+s+" is not supported")
+		}
+	}
+
+	client.Name = strings.TrimSpace(req.ClientName)
+	if client.Name == "" {
+		client.Name = client.ClientID
+	}
+	client.RedirectURIs = strings.Join(req.RedirectURIs, " ")
+	client.GrantTypes = strings.Join(grantTypes, " ")
+	client.Scopes = strings.Join(strings.Fields(scope), " ")
+	client.Public = authMethod == AuthMethodNone
+	return nil
+}
+
+// clientInformation describes client in RFC 7591 terms. Confidential
+// clients are shown with client_secret_basic, though the token endpoint
+// accepts client_secret_post as well.
+func clientInformation(client *entity.OAuthClient) *dto.ClientInformationResponse {
+
+	authMethod := AuthMethodClientSecretBasic
+	if client.Public {
+		authMethod = AuthMethodNone
+	}
+
+	responseTypes := []string{}
+	if client.AllowsGrantType(GrantTypeAuthorizationCode) {
+		responseTypes = []string{"code"}
+	}
+
+	info := &dto.ClientInformationResponse{
+		ClientID:                client.ClientID,
+		ClientIDIssuedAt:        client.CreatedAt.Unix(),
+		ClientName:              client.Name,
+		RedirectURIs:            strings.Fields(client.RedirectURIs),
+		GrantTypes:              strings.Fields(client.GrantTypes),
+		ResponseTypes:           responseTypes,
+		TokenEndpointAuthMethod: authMethod,
+		Scope:                   client.Scopes,
+	}
+	if client.RegisteredDynamically {
+		info.RegistrationClientURI = pkg.OAuthServerIssuer() + "/oauth2/register/" + client.ClientID
+	}
+	return info
+}
+
+// registeredClient finds a dynamically registered client by its
+// registration access token. An unknown client and a wrong token are
+// reported alike, so neither reveals which clients exist.
+func (u *oauthClientUsecase) registeredClient(clientID string, registrationAccessToken string) (*entity.OAuthClient, error) {
+
+	client, err := u.clientRepo.GetClientByClientID(clientID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, oauthError("invalid_token", "registration access token is invalid")
+		}
+		return nil, err
+	}
+
+	if !client.RegisteredDynamically || !pkg.ValidateClientSecret(client.RegistrationAccessTokenHash, registrationAccessToken) {
+		return nil, oauthError("invalid_token", "registration access token is invalid")
+	}
+	return client, nil
+}
+
+func (u *oauthClientUsecase) GetRegisteredClient(clientID string, registrationAccessToken string) (*dto.ClientInformationResponse, error) {
+
+	client, err := u.registeredClient(clientID, registrationAccessToken)
+	if err != nil {
+		return nil, err
+	}
+	return clientInformation(client), nil
+}
+
+// UpdateRegisteredClient replaces the metadata of a client. Fields left
+// out fall back to their defaults, as RFC 7592 asks. A client cannot turn
+// public or confidential after registering.
+func (u *oauthClientUsecase) UpdateRegisteredClient(clientID string, registrationAccessToken string, req *dto.ClientRegistrationRequest) (*dto.ClientInformationResponse, error) {
+
+	client, err := u.registeredClient(clientID, registrationAccessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.ClientID != client.ClientID {
+		return nil, oauthError("invalid_request", "client_id does not match the client being updated")
+	}
+	if req.ClientSecret != "" && !pkg.ValidateClientSecret(client.ClientSecretHash, req.ClientSecret) {
+		return nil, oauthError("invalid_request", "client_secret does not match the current secret")
+	}
+
+	public := client.Public
+	if err := applyClientMetadata(client, req); err != nil {
+		return nil, err
+	}
+	if client.Public != public {
+		return nil, oauthError("invalid_client_metadata", "token_endpoint_auth_method cannot change between none and a client secret")
+	}
+
+	if err := u.clientRepo.UpdateClient(client); err != nil {
+		return nil, err
+	}
+
+	updated, err := u.clientRepo.GetClientByClientID(client.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	return clientInformation(updated), nil
+}
+
+func (u *oauthClientUsecase) DeleteRegisteredClient(clientID string, registrationAccessToken string) error {
+
+	client, err := u.registeredClient(clientID, registrationAccessToken)
+	if err != nil {
+		return err
+	}
+	return u.DeleteClient(client.ClientID)
+}
+
+func (u *oauthClientUsecase) GetAllClients() ([]entity.OAuthClient, error) {
+	return u.clientRepo.GetAllClients()
+}
+
+func (u *oauthClientUsecase) GetClientByClientID(clientID string) (*entity.OAuthClient, error) {
+
+	client, err := u.clientRepo.GetClientByClientID(clientID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrClientNotFound
+		}
+		return nil, err
+	}
+	return client, nil
+}
+
+// RotateClientSecret replaces the secret at once and revokes the refresh
+// tokens of the client, which has to authenticate again with the new
+// secret to get more. Access tokens stay valid until they expire.
+func (u *oauthClientUsecase) RotateClientSecret(clientID string) (*dto.OAuthClientCredentialsResponse, error) {
+
+	client, err := u.GetClientByClientID(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if client.Public {
+		return nil, ErrPublicClientSecret
+	}
+
+	secret, err := pkg.GenerateClientSecret()
+	if err != nil {
+		return nil, err
+	}
+	if err := u.clientRepo.UpdateClientSecret(client.ClientID, pkg.HashClientSecret(secret)); err != nil {
+		return nil, err
+	}
+	pkg.RevokeClientGrants(client.ClientID)
+
+	rotated, err := u.clientRepo.GetClientByClientID(client.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dto.OAuthClientCredentialsResponse{
+		Client:       rotated,
+		ClientSecret: secret,
+	}, nil
+}
+
+// DeleteClient removes the client with the consents given to it, and
+// revokes its refresh tokens.
+func (u *oauthClientUsecase) DeleteClient(clientID string) error {
+
+	deleted, err := u.clientRepo.DeleteClient(clientID)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrClientNotFound
+	}
+
+	pkg.RevokeClientGrants(clientID)
+	return nil
+}
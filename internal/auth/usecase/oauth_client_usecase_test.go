@@ -0,0 +1,139 @@
+package usecase
+
+import (
+	"testing"
+
+	"github.com/revandpratama/auth4me/config"
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+)
+
+func newOAuthClientTestUsecase(t *testing.T, initialAccessTokens string) (*oauthClientUsecase, *fakeOAuthClientRepository) {
+	t.Helper()
+
+	saved := config.ENV
+	t.Cleanup(func() { config.ENV = saved })
+	config.ENV.OAUTH_SERVER_ISSUER = "https://auth.example.com"
+	config.ENV.OAUTH_SERVER_INITIAL_ACCESS_TOKENS = initialAccessTokens
+
+	repo := newFakeOAuthClientRepository()
+	return &oauthClientUsecase{clientRepo: repo}, repo
+}
+
+func testRegistration() *dto.ClientRegistrationRequest {
+	return &dto.ClientRegistrationRequest{
+		ClientName:   "CLI",
+		RedirectURIs: []string{"http://127.0.0.1:8400/callback"},
+	}
+}
+
+func TestRegisterClientRequiresInitialAccessToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured string
+		presented  string
+		wantError  bool
+	}{
+		{"registration closed", "", "", true},
+		{"registration closed, any token", "", "alpha", true},
+		{"no token", "alpha, beta", "", true},
+		{"wrong token", "alpha, beta", "gamma", true},
+		{"prefix of a token", "alpha, beta", "alph", true},
+		{"first token", "alpha, beta", "alpha", false},
+		{"second token", "alpha, beta", "beta", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, repo := newOAuthClientTestUsecase(t, tt.configured)
+
+			info, err := u.RegisterClient(tt.presented, testRegistration())
+			if tt.wantError {
+				wantOAuthError(t, err, "invalid_token")
+				if len(repo.clients) != 0 {
+					t.Error("client was registered without a valid initial access token")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RegisterClient: %v", err)
+			}
+			if info.RegistrationAccessToken == "" || info.ClientSecret == "" {
+				t.Errorf("missing credentials in %+v", info)
+			}
+		})
+	}
+}
+
+func TestRegisteredClientNeedsRegistrationToken(t *testing.T) {
+	u, repo := newOAuthClientTestUsecase(t, "alpha")
+
+	info, err := u.RegisterClient("alpha", testRegistration())
+	if err != nil {
+		t.Fatalf("RegisterClient: %v", err)
+	}
+	clientID, token := info.ClientID, info.RegistrationAccessToken
+
+	// clients created by an admin have no registration to manage
+	created, err := u.CreateClient(testRegistration())
+	if err != nil {
+		t.Fatalf("CreateClient: %v", err)
+	}
+
+	for name, credentials := range map[string][2]string{
+		"no token":            {clientID, ""},
+		"wrong token":         {clientID, "not-the-token"},
+		"initial token":       {clientID, "alpha"},
+		"unknown client":      {"unknown", token},
+		"admin-created":       {created.ClientID, token},
+		"token of the client": {created.ClientID, created.ClientSecret},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := u.GetRegisteredClient(credentials[0], credentials[1])
+			wantOAuthError(t, err, "invalid_token")
+
+			update := testRegistration()
+			update.ClientID = credentials[0]
+			update.ClientName = "Renamed"
+			_, err = u.UpdateRegisteredClient(credentials[0], credentials[1], update)
+			wantOAuthError(t, err, "invalid_token")
+
+			err = u.DeleteRegisteredClient(credentials[0], credentials[1])
+			wantOAuthError(t, err, "invalid_token")
+		})
+	}
+	if _, ok := repo.clients[clientID]; !ok {
+		t.Fatal("client was deleted with a wrong registration token")
+	}
+
+	got, err := u.GetRegisteredClient(clientID, token)
+	if err != nil || got.ClientName != "CLI" || got.RegistrationClientURI != "https://auth.example.com/oauth2/register/"+clientID {
+		t.Fatalf("GetRegisteredClient: %+v, %v", got, err)
+	}
+	if got.ClientSecret != "" || got.RegistrationAccessToken != "" {
+		t.Error("credentials shown again on read")
+	}
+
+	update := testRegistration()
+	update.ClientName = "Renamed"
+	_, err = u.UpdateRegisteredClient(clientID, token, update)
+	wantOAuthError(t, err, "invalid_request") // client_id missing from the body
+
+	update.ClientID = clientID
+	updated, err := u.UpdateRegisteredClient(clientID, token, update)
+	if err != nil || updated.ClientName != "Renamed" {
+		t.Fatalf("UpdateRegisteredClient: %+v, %v", updated, err)
+	}
+
+	update.TokenEndpointAuthMethod = AuthMethodNone
+	_, err = u.UpdateRegisteredClient(clientID, token, update)
+	wantOAuthError(t, err, "invalid_client_metadata")
+
+	if err := u.DeleteRegisteredClient(clientID, token); err != nil {
+		t.Fatalf("DeleteRegisteredClient: %v", err)
+	}
+	if _, ok := repo.clients[clientID]; ok {
+		t.Error("client still registered after delete")
+	}
+	_, err = u.GetRegisteredClient(clientID, token)
+	wantOAuthError(t, err, "invalid_token")
+}
@@ -0,0 +1,644 @@
+package usecase
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/revandpratama/auth4me/config"
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"github.com/revandpratama/auth4me/internal/auth/repository"
+	"github.com/revandpratama/auth4me/pkg"
+	"gorm.io/gorm"
+)
+
+// OAuthServerUsecase lets other applications sign users in with auth4me
+// through the authorization code flow with PKCE.
+type OAuthServerUsecase interface {
+	Discovery() *dto.OpenIDConfiguration
+	JWKS() (map[string]any, error)
+	Authorize(req *dto.AuthorizeRequest) (string, error)
+	GetAuthorizationRequest(userID string, authn pkg.Authentication, requestID string) (*dto.AuthorizationRequestResponse, error)
+	DecideAuthorization(userID string, authn pkg.Authentication, requestID string, approve bool) (*dto.AuthorizationDecisionResponse, error)
+	DeviceAuthorization(req *dto.DeviceAuthorizationRequest) (*dto.DeviceAuthorizationResponse, error)
+	GetDeviceAuthorization(userID string, userCode string) (*dto.DeviceVerificationResponse, error)
+	DecideDeviceAuthorization(userID string, authn pkg.Authentication, userCode string, approve bool) error
+	Token(req *dto.OAuthTokenRequest) (*dto.OAuthTokenResponse, error)
+	UserInfo(accessToken string) (map[string]any, error)
+}
+
+const (
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeRefreshToken      = "refresh_token"
+	GrantTypeClientCredentials = "client_credentials"
+	GrantTypeDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+var (
+	ErrAuthorizationRequestNotFound = errors.New("authorization request not found or expired")
+	ErrReauthenticationRequired     = errors.New("client requires a fresh login")
+)
+
+// OAuthError is an error reported to an OAuth client with one of the
+// error codes of RFC 6749.
+type OAuthError struct {
+	Code        string
+	Description string
+}
+
+func (e *OAuthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+func oauthError(code string, description string) *OAuthError {
+	return &OAuthError{Code: code, Description: description}
+}
+
+type oauthServerUsecase struct {
+	authRepo           repository.AuthRepository
+	clientRepo         repository.OAuthClientRepository
+	serviceAccountRepo repository.ServiceAccountRepository
+}
+
+func NewOAuthServerUsecase(authRepo repository.AuthRepository, clientRepo repository.OAuthClientRepository, serviceAccountRepo repository.ServiceAccountRepository) OAuthServerUsecase {
+	return &oauthServerUsecase{
+		authRepo:           authRepo,
+		clientRepo:         clientRepo,
+		serviceAccountRepo: serviceAccountRepo,
+	}
+}
+
+func (u *oauthServerUsecase) Discovery() *dto.OpenIDConfiguration {
+	issuer := pkg.OAuthServerIssuer()
+	configuration := &dto.OpenIDConfiguration{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/oauth2/authorize",
+		TokenEndpoint:                     issuer + "/oauth2/token",
+		DeviceAuthorizationEndpoint:       issuer + "/oauth2/device_authorization",
+		UserInfoEndpoint:                  issuer + "/oauth2/userinfo",
+		JWKSURI:                           issuer + "/oauth2/jwks",
+		ScopesSupported:                   pkg.SupportedScopes,
+		ResponseTypesSupported:            []string{"code"},
+		ResponseModesSupported:            []string{"query"},
+		GrantTypesSupported:               []string{GrantTypeAuthorizationCode, GrantTypeRefreshToken, GrantTypeClientCredentials, GrantTypeDeviceCode},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{jwt.SigningMethodRS256.Alg()},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported: []string{
+			"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "acr", "amr", "azp",
+			"name", "picture", "updated_at", "email", "email_verified",
+		},
+		AuthorizationResponseIssParameter: true,
+	}
+	if registrationEnabled() {
+		configuration.RegistrationEndpoint = issuer + "/oauth2/register"
+	}
+	return configuration
+}
+
+func (u *oauthServerUsecase) JWKS() (map[string]any, error) {
+	return pkg.OAuthServerJWKS()
+}
+
+// Authorize validates an authorization request and returns where to send
+// the browser: the consent page, or the client with an error. Errors are
+// returned, not redirected, until the client and its redirect URI are
+// known to be genuine.
+func (u *oauthServerUsecase) Authorize(req *dto.AuthorizeRequest) (string, error) {
+
+	client, err := u.clientRepo.GetClientByClientID(req.ClientID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", oauthError("invalid_request", "unknown client_id")
+		}
+		return "", err
+	}
+
+	redirectURI := req.RedirectURI
+	if redirectURI == "" {
+		registered := strings.Fields(client.RedirectURIs)
+		if len(registered) != 1 {
+			return "", oauthError("invalid_request", "redirect_uri is required")
+		}
+		redirectURI = registered[0]
+	}
+	if !client.HasRedirectURI(redirectURI) {
+		return "", oauthError("invalid_request", "redirect_uri is not registered for this client")
+	}
+
+	fail := func(code string, description string) (string, error) {
+		return authorizationRedirect(redirectURI, url.Values{
+			"error":             {code},
+			"error_description": {description},
+			"state":             {req.State},
+			"iss":               {pkg.OAuthServerIssuer()},
+		}), nil
+	}
+
+	if req.ResponseType != "code" {
+		return fail("unsupported_response_type", "only the code response type is supported")
+	}
+	if !client.AllowsGrantType(GrantTypeAuthorizationCode) {
+		return fail("unauthorized_client", "client may not use the authorization code grant")
+	}
+
+	scopes := strings.Fields(req.Scope)
+	if err := checkScopes(client, scopes); err != nil {
+		return fail(err.Code, err.Description)
+	}
+
+	// PKCE is required for every client, confidential ones included
+	if req.CodeChallenge == "" {
+		return fail("invalid_request", "code_challenge is required")
+	}
+	if req.CodeChallengeMethod != "S256" {
+		return fail("invalid_request", "code_challenge_method must be S256")
+	}
+
+	// kept as a pointer, max_age=0 asks for a fresh login like prompt=login
+	var maxAge *int
+	if req.MaxAge != "" {
+		seconds, err := strconv.Atoi(req.MaxAge)
+		if err != nil || seconds < 0 {
+			return fail("invalid_request", "max_age must be a number of seconds")
+		}
+		maxAge = &seconds
+	}
+
+	prompts := strings.Fields(req.Prompt)
+	if slices.Contains(prompts, "none") {
+		// the consent page needs the user in the loop to learn who they are
+		return fail("login_required", "auth4me cannot authenticate the user without interaction")
+	}
+
+	requestID, err := generateRandomState()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	pkg.SaveAuthorizationRequest(requestID, pkg.AuthorizationRequest{
+		ClientID:      client.ClientID,
+		RedirectURI:   redirectURI,
+		Scopes:        scopes,
+		State:         req.State,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		Prompt:        req.Prompt,
+		MaxAge:        maxAge,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(pkg.AuthorizationRequestTTL),
+	})
+
+	return authorizationRedirect(config.ENV.OAUTH_SERVER_CONSENT_URL, url.Values{"request_id": {requestID}}), nil
+}
+
+func checkScopes(client *entity.OAuthClient, scopes []string) *OAuthError {
+	if len(scopes) == 0 {
+		return oauthError("invalid_scope", "scope is required")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(pkg.SupportedScopes, scope) || !client.AllowsScope(scope) {
+			return oauthError("invalid_scope", "scope "+scope+" is not allowed for this client")
+		}
+	}
+	return nil
+}
+
+// authorizationRedirect adds params to uri, keeping its own query.
+func authorizationRedirect(uri string, params url.Values) string {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+
+	query := u.Query()
+	for key, values := range params {
+		if len(values) > 0 && values[0] != "" {
+			query.Set(key, values[0])
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// needsLogin reports whether the client asked for a login more recent than
+// the one the user holds. prompt=login and max_age=0 both want a login
+// made after the request.
+func needsLogin(request *pkg.AuthorizationRequest, authn pkg.Authentication) bool {
+	// auth_time only keeps whole seconds
+	loggedInSince := !authn.Time.Before(request.CreatedAt.Truncate(time.Second))
+
+	if slices.Contains(strings.Fields(request.Prompt), "login") && !loggedInSince {
+		return true
+	}
+	if request.MaxAge != nil {
+		if *request.MaxAge == 0 {
+			return !loggedInSince
+		}
+		if time.Since(authn.Time) > time.Duration(*request.MaxAge)*time.Second {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *oauthServerUsecase) GetAuthorizationRequest(userID string, authn pkg.Authentication, requestID string) (*dto.AuthorizationRequestResponse, error) {
+
+	request, ok := pkg.GetAuthorizationRequest(requestID)
+	if !ok {
+		return nil, ErrAuthorizationRequestNotFound
+	}
+
+	client, err := u.clientRepo.GetClientByClientID(request.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	consentRequired, err := u.consentRequired(userID, request)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dto.AuthorizationRequestResponse{
+		ClientID:        client.ClientID,
+		ClientName:      client.Name,
+		Scopes:          request.Scopes,
+		ConsentRequired: consentRequired,
+		LoginRequired:   needsLogin(request, authn),
+	}, nil
+}
+
+func (u *oauthServerUsecase) consentRequired(userID string, request *pkg.AuthorizationRequest) (bool, error) {
+	if slices.Contains(strings.Fields(request.Prompt), "consent") {
+		return true, nil
+	}
+
+	consent, err := u.clientRepo.GetConsent(userID, request.ClientID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	granted := strings.Fields(consent.Scopes)
+	for _, scope := range request.Scopes {
+		if !slices.Contains(granted, scope) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DecideAuthorization answers an authorization request for the signed in
+// user and returns the client redirect carrying the code or the denial.
+func (u *oauthServerUsecase) DecideAuthorization(userID string, authn pkg.Authentication, requestID string, approve bool) (*dto.AuthorizationDecisionResponse, error) {
+
+	pending, ok := pkg.GetAuthorizationRequest(requestID)
+	if !ok {
+		return nil, ErrAuthorizationRequestNotFound
+	}
+	// checked before consuming, so the user can sign in again and retry
+	if approve && needsLogin(pending, authn) {
+		return nil, ErrReauthenticationRequired
+	}
+
+	request, ok := pkg.ConsumeAuthorizationRequest(requestID)
+	if !ok {
+		return nil, ErrAuthorizationRequestNotFound
+	}
+
+	issuer := pkg.OAuthServerIssuer()
+
+	if !approve {
+		return &dto.AuthorizationDecisionResponse{
+			RedirectTo: authorizationRedirect(request.RedirectURI, url.Values{
+				"error":             {"access_denied"},
+				"error_description": {"the user denied the request"},
+				"state":             {request.State},
+				"iss":               {issuer},
+			}),
+		}, nil
+	}
+
+	// widen an earlier consent rather than replace it
+	scopes := slices.Clone(request.Scopes)
+	consent, err := u.clientRepo.GetConsent(userID, request.ClientID)
+	if err == nil {
+		for _, scope := range strings.Fields(consent.Scopes) {
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	if err := u.clientRepo.SaveConsent(&entity.OAuthConsent{
+		UserID:   userID,
+		ClientID: request.ClientID,
+		Scopes:   strings.Join(scopes, " "),
+	}); err != nil {
+		return nil, err
+	}
+
+	code, err := generateRandomState()
+	if err != nil {
+		return nil, err
+	}
+
+	pkg.SaveAuthorizationCode(code, pkg.AuthorizationCode{
+		GrantID:        uuid.NewString(),
+		ClientID:       request.ClientID,
+		RedirectURI:    request.RedirectURI,
+		UserID:         userID,
+		Scopes:         request.Scopes,
+		Nonce:          request.Nonce,
+		CodeChallenge:  request.CodeChallenge,
+		Authentication: authn,
+		ExpiresAt:      time.Now().Add(pkg.AuthorizationCodeTTL),
+	})
+
+	return &dto.AuthorizationDecisionResponse{
+		RedirectTo: authorizationRedirect(request.RedirectURI, url.Values{
+			"code":  {code},
+			"state": {request.State},
+			"iss":   {issuer},
+		}),
+	}, nil
+}
+
+func (u *oauthServerUsecase) Token(req *dto.OAuthTokenRequest) (*dto.OAuthTokenResponse, error) {
+
+	// service accounts are not OAuth clients and authenticate separately
+	if req.GrantType == GrantTypeClientCredentials {
+		return u.clientCredentials(req)
+	}
+
+	client, err := u.authenticateClient(req.ClientID, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.GrantType {
+	case GrantTypeAuthorizationCode:
+		return u.exchangeAuthorizationCode(client, req)
+	case GrantTypeRefreshToken:
+		return u.refreshClientToken(client, req)
+	case GrantTypeDeviceCode:
+		return u.exchangeDeviceCode(client, req)
+	case "":
+		return nil, oauthError("invalid_request", "grant_type is required")
+	default:
+		return nil, oauthError("unsupported_grant_type", "grant type "+req.GrantType+" is not supported")
+	}
+}
+
+// authenticateClient requires the secret of confidential clients. Public
+// clients authenticate with nothing but their client_id and rely on PKCE.
+func (u *oauthServerUsecase) authenticateClient(clientID string, clientSecret string) (*entity.OAuthClient, error) {
+
+	if clientID == "" {
+		return nil, oauthError("invalid_client", "client authentication is required")
+	}
+
+	client, err := u.clientRepo.GetClientByClientID(clientID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, oauthError("invalid_client", "client authentication failed")
+		}
+		return nil, err
+	}
+
+	if client.Public {
+		if clientSecret != "" {
+			return nil, oauthError("invalid_client", "public clients have no secret")
+		}
+		return client, nil
+	}
+
+	if !pkg.ValidateClientSecret(client.ClientSecretHash, clientSecret) {
+		return nil, oauthError("invalid_client", "client authentication failed")
+	}
+	return client, nil
+}
+
+func (u *oauthServerUsecase) exchangeAuthorizationCode(client *entity.OAuthClient, req *dto.OAuthTokenRequest) (*dto.OAuthTokenResponse, error) {
+
+	if !client.AllowsGrantType(GrantTypeAuthorizationCode) {
+		return nil, oauthError("unauthorized_client", "client may not use the authorization code grant")
+	}
+	if req.Code == "" || req.CodeVerifier == "" {
+		return nil, oauthError("invalid_request", "code and code_verifier are required")
+	}
+
+	code, ok := pkg.ConsumeAuthorizationCode(req.Code)
+	if !ok || code.ClientID != client.ClientID {
+		return nil, oauthError("invalid_grant", "authorization code is invalid, expired or already used")
+	}
+	if req.RedirectURI != "" && req.RedirectURI != code.RedirectURI {
+		return nil, oauthError("invalid_grant", "redirect_uri does not match the authorization request")
+	}
+	if !pkg.VerifyPKCE(code.CodeChallenge, req.CodeVerifier) {
+		return nil, oauthError("invalid_grant", "code_verifier does not match the code challenge")
+	}
+
+	grant := pkg.ClientGrant{
+		GrantID:        code.GrantID,
+		ClientID:       client.ClientID,
+		UserID:         code.UserID,
+		Scopes:         code.Scopes,
+		Authentication: code.Authentication,
+		ExpiresAt:      time.Now().Add(time.Duration(config.ENV.OAUTH_SERVER_REFRESH_TOKEN_TTL_DAY) * 24 * time.Hour),
+	}
+
+	return u.issueClientTokens(client, grant, code.Nonce)
+}
+
+func (u *oauthServerUsecase) refreshClientToken(client *entity.OAuthClient, req *dto.OAuthTokenRequest) (*dto.OAuthTokenResponse, error) {
+
+	if !client.AllowsGrantType(GrantTypeRefreshToken) {
+		return nil, oauthError("unauthorized_client", "client may not use the refresh token grant")
+	}
+	if req.RefreshToken == "" {
+		return nil, oauthError("invalid_request", "refresh_token is required")
+	}
+
+	grant, ok := pkg.RotateClientRefreshToken(req.RefreshToken, client.ClientID)
+	if !ok {
+		return nil, oauthError("invalid_grant", "refresh token is invalid, expired or already used")
+	}
+
+	// a refresh may narrow the scopes, never widen them
+	if scopes := strings.Fields(req.Scope); len(scopes) > 0 {
+		for _, scope := range scopes {
+			if !slices.Contains(grant.Scopes, scope) {
+				return nil, oauthError("invalid_scope", "scope "+scope+" was not granted")
+			}
+		}
+		grant.Scopes = scopes
+	}
+
+	return u.issueClientTokens(client, *grant, "")
+}
+
+// clientCredentials issues a service account token for the
+// client_credentials grant. What the account may do comes from its role,
+// so no scopes are granted and no refresh token is issued.
+func (u *oauthServerUsecase) clientCredentials(req *dto.OAuthTokenRequest) (*dto.OAuthTokenResponse, error) {
+
+	if req.ClientID == "" {
+		return nil, oauthError("invalid_client", "client authentication is required")
+	}
+
+	account, err := u.serviceAccountRepo.GetServiceAccountByClientID(req.ClientID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, oauthError("invalid_client", "client authentication failed")
+		}
+		return nil, err
+	}
+
+	if !pkg.ValidateClientSecret(account.ClientSecretHash, req.ClientSecret) {
+		return nil, oauthError("invalid_client", "client authentication failed")
+	}
+	if account.Disabled {
+		return nil, oauthError("invalid_client", "service account is disabled")
+	}
+	if req.Scope != "" {
+		return nil, oauthError("invalid_scope", "service accounts are authorized by role, not scope")
+	}
+
+	ttl := time.Duration(config.ENV.SERVICE_ACCOUNT_TOKEN_TTL_SECOND) * time.Second
+	accessToken, err := pkg.GenerateServiceToken(account, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.serviceAccountRepo.UpdateServiceAccountLastUsed(account.ID); err != nil {
+		log.Printf("failed to update service account last use: %v", err)
+	}
+
+	return &dto.OAuthTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(ttl.Seconds()),
+	}, nil
+}
+
+func (u *oauthServerUsecase) issueClientTokens(client *entity.OAuthClient, grant pkg.ClientGrant, nonce string) (*dto.OAuthTokenResponse, error) {
+
+	user, err := u.authRepo.GetUserByID(grant.UserID)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			pkg.RevokeClientGrant(grant.GrantID)
+			return nil, oauthError("invalid_grant", "the user no longer exists")
+		}
+		return nil, err
+	}
+
+	ttl := time.Duration(config.ENV.OAUTH_SERVER_ACCESS_TOKEN_TTL_SECOND) * time.Second
+	authn := grant.Authentication
+
+	accessToken, err := pkg.GenerateClientAccessToken(&pkg.AccessTokenClaims{
+		ClientID: client.ClientID,
+		Scope:    strings.Join(grant.Scopes, " "),
+		ACR:      authn.ACR(),
+		AMR:      authn.Methods,
+		AuthTime: jwt.NewNumericDate(authn.Time),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:  user.ID,
+			Audience: jwt.ClaimStrings{client.ClientID},
+		},
+	}, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &dto.OAuthTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(ttl.Seconds()),
+		Scope:       strings.Join(grant.Scopes, " "),
+	}
+
+	if slices.Contains(grant.Scopes, pkg.ScopeOpenID) {
+		claims := userInfoClaims(user, grant.Scopes)
+		claims["aud"] = client.ClientID
+		claims["azp"] = client.ClientID
+		claims["auth_time"] = authn.Time.Unix()
+		claims["acr"] = authn.ACR()
+		claims["amr"] = authn.Methods
+		claims["at_hash"] = pkg.AccessTokenHash(accessToken)
+		if nonce != "" {
+			claims["nonce"] = nonce
+		}
+
+		if response.IDToken, err = pkg.GenerateIDToken(claims, ttl); err != nil {
+			return nil, err
+		}
+	}
+
+	if client.AllowsGrantType(GrantTypeRefreshToken) {
+		refreshToken, err := generateRandomState()
+		if err != nil {
+			return nil, err
+		}
+		pkg.SaveClientRefreshToken(refreshToken, grant)
+		response.RefreshToken = refreshToken
+	}
+
+	return response, nil
+}
+
+// userInfoClaims returns the standard claims the scopes release.
+func userInfoClaims(user *entity.User, scopes []string) jwt.MapClaims {
+	claims := jwt.MapClaims{"sub": user.ID}
+
+	if slices.Contains(scopes, pkg.ScopeProfile) {
+		claims["name"] = user.FullName
+		claims["updated_at"] = user.UpdatedAt.Unix()
+		if user.AvatarPath != "" {
+			claims["picture"] = user.AvatarPath
+		}
+	}
+
+	if slices.Contains(scopes, pkg.ScopeEmail) {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerified
+	}
+
+	return claims
+}
+
+func (u *oauthServerUsecase) UserInfo(accessToken string) (map[string]any, error) {
+
+	claims, err := pkg.ValidateClientAccessToken(accessToken)
+	if err != nil {
+		return nil, oauthError("invalid_token", "access token is invalid or expired")
+	}
+
+	scopes := claims.Scopes()
+	if !slices.Contains(scopes, pkg.ScopeOpenID) {
+		return nil, oauthError("insufficient_scope", "the openid scope is required")
+	}
+
+	user, err := u.authRepo.GetUserByID(claims.Subject)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, oauthError("invalid_token", "the user no longer exists")
+		}
+		return nil, err
+	}
+
+	return userInfoClaims(user, scopes), nil
+}
@@ -0,0 +1,303 @@
+package usecase
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/revandpratama/auth4me/config"
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"github.com/revandpratama/auth4me/pkg"
+)
+
+const testCodeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+func testCodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func newOAuthServerTestUsecase(t *testing.T) *oauthServerUsecase {
+	t.Helper()
+
+	saved := config.ENV
+	t.Cleanup(func() { config.ENV = saved })
+	config.ENV.OAUTH_SERVER_ISSUER = "https://auth.example.com"
+	config.ENV.OAUTH_SERVER_CONSENT_URL = "https://app.example.com/consent"
+	config.ENV.OAUTH_SERVER_ACCESS_TOKEN_TTL_SECOND = 300
+	config.ENV.OAUTH_SERVER_REFRESH_TOKEN_TTL_DAY = 30
+
+	return &oauthServerUsecase{
+		authRepo: newFakeAuthRepository(&entity.User{ID: "user-1", Email: "jdoe@example.com"}),
+		clientRepo: newFakeOAuthClientRepository(&entity.OAuthClient{
+			ClientID:     "spa",
+			Name:         "SPA",
+			RedirectURIs: "https://app.example.com/callback",
+			Scopes:       "openid profile",
+			GrantTypes:   GrantTypeAuthorizationCode + " " + GrantTypeRefreshToken,
+			Public:       true,
+		}, &entity.OAuthClient{
+			ClientID:   "tv",
+			Name:       "TV",
+			Scopes:     "openid",
+			GrantTypes: GrantTypeDeviceCode,
+			Public:     true,
+		}),
+	}
+}
+
+// redirectQuery returns the query of a redirect Authorize returned.
+func redirectQuery(t *testing.T, redirect string) url.Values {
+	t.Helper()
+	u, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatalf("redirect %q: %v", redirect, err)
+	}
+	return u.Query()
+}
+
+func TestAuthorizeRequiresPKCE(t *testing.T) {
+	u := newOAuthServerTestUsecase(t)
+
+	base := dto.AuthorizeRequest{
+		ResponseType:        "code",
+		ClientID:            "spa",
+		RedirectURI:         "https://app.example.com/callback",
+		Scope:               "openid",
+		State:               "xyz",
+		CodeChallenge:       testCodeChallenge(testCodeVerifier),
+		CodeChallengeMethod: "S256",
+	}
+
+	tests := []struct {
+		name      string
+		change    func(*dto.AuthorizeRequest)
+		wantError string
+	}{
+		{"no code challenge", func(r *dto.AuthorizeRequest) { r.CodeChallenge = "" }, "invalid_request"},
+		{"plain method", func(r *dto.AuthorizeRequest) { r.CodeChallengeMethod = "plain" }, "invalid_request"},
+		{"no method", func(r *dto.AuthorizeRequest) { r.CodeChallengeMethod = "" }, "invalid_request"},
+		{"negative max_age", func(r *dto.AuthorizeRequest) { r.MaxAge = "-1" }, "invalid_request"},
+		{"prompt=none", func(r *dto.AuthorizeRequest) { r.Prompt = "none" }, "login_required"},
+		{"valid", func(r *dto.AuthorizeRequest) {}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := base
+			tt.change(&req)
+
+			redirect, err := u.Authorize(&req)
+			if err != nil {
+				t.Fatalf("Authorize: %v", err)
+			}
+			query := redirectQuery(t, redirect)
+			if got := query.Get("error"); got != tt.wantError {
+				t.Fatalf("error = %q, want %q", got, tt.wantError)
+			}
+			if tt.wantError != "" {
+				if query.Get("state") != "xyz" {
+					t.Errorf("state not returned with the error")
+				}
+				return
+			}
+			if _, ok := pkg.ConsumeAuthorizationRequest(query.Get("request_id")); !ok {
+				t.Error("valid request was not stored")
+			}
+		})
+	}
+}
+
+func TestAuthorizeKeepsMaxAgeZero(t *testing.T) {
+	u := newOAuthServerTestUsecase(t)
+
+	redirect, err := u.Authorize(&dto.AuthorizeRequest{
+		ResponseType:        "code",
+		ClientID:            "spa",
+		Scope:               "openid",
+		CodeChallenge:       testCodeChallenge(testCodeVerifier),
+		CodeChallengeMethod: "S256",
+		MaxAge:              "0",
+	})
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+
+	request, ok := pkg.ConsumeAuthorizationRequest(redirectQuery(t, redirect).Get("request_id"))
+	if !ok {
+		t.Fatal("request was not stored")
+	}
+	if request.MaxAge == nil || *request.MaxAge != 0 {
+		t.Errorf("MaxAge = %v, want 0", request.MaxAge)
+	}
+}
+
+// saveTestCode stores an authorization code for user-1 at the client "spa",
+// as an approved authorization request would.
+func saveTestCode(code string, grantID string) {
+	pkg.SaveAuthorizationCode(code, pkg.AuthorizationCode{
+		GrantID:        grantID,
+		ClientID:       "spa",
+		RedirectURI:    "https://app.example.com/callback",
+		UserID:         "user-1",
+		Scopes:         []string{"openid"},
+		CodeChallenge:  testCodeChallenge(testCodeVerifier),
+		Authentication: pkg.Authentication{Time: time.Now()},
+		ExpiresAt:      time.Now().Add(pkg.AuthorizationCodeTTL),
+	})
+}
+
+func wantOAuthError(t *testing.T, err error, code string) {
+	t.Helper()
+	var oauthErr *OAuthError
+	if !errors.As(err, &oauthErr) || oauthErr.Code != code {
+		t.Fatalf("got %v, want %s", err, code)
+	}
+}
+
+func TestTokenChecksCodeVerifier(t *testing.T) {
+	u := newOAuthServerTestUsecase(t)
+
+	tests := []struct {
+		name     string
+		verifier string
+		want     string
+	}{
+		{"missing", "", "invalid_request"},
+		{"wrong", "a-different-verifier-that-is-long-enough-to-pass-0123", "invalid_grant"},
+		{"too short", "short", "invalid_grant"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			saveTestCode("verifier-"+tt.name, "grant-verifier-"+tt.name)
+			_, err := u.Token(&dto.OAuthTokenRequest{
+				GrantType:    GrantTypeAuthorizationCode,
+				ClientID:     "spa",
+				Code:         "verifier-" + tt.name,
+				CodeVerifier: tt.verifier,
+			})
+			wantOAuthError(t, err, tt.want)
+		})
+	}
+}
+
+func TestTokenCodeReuseRevokesGrant(t *testing.T) {
+	u := newOAuthServerTestUsecase(t)
+	saveTestCode("reused-code", "grant-reused")
+
+	exchange := &dto.OAuthTokenRequest{
+		GrantType:    GrantTypeAuthorizationCode,
+		ClientID:     "spa",
+		Code:         "reused-code",
+		CodeVerifier: testCodeVerifier,
+		RedirectURI:  "https://app.example.com/callback",
+	}
+	tokens, err := u.Token(exchange)
+	if err != nil {
+		t.Fatalf("first exchange: %v", err)
+	}
+	if tokens.AccessToken == "" || tokens.IDToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("incomplete tokens: %+v", tokens)
+	}
+
+	_, err = u.Token(exchange)
+	wantOAuthError(t, err, "invalid_grant")
+
+	// the refresh token issued from the code goes with it
+	_, err = u.Token(&dto.OAuthTokenRequest{GrantType: GrantTypeRefreshToken, ClientID: "spa", RefreshToken: tokens.RefreshToken})
+	wantOAuthError(t, err, "invalid_grant")
+}
+
+func TestTokenRefreshRotation(t *testing.T) {
+	u := newOAuthServerTestUsecase(t)
+	saveTestCode("rotation-code", "grant-rotation")
+
+	tokens, err := u.Token(&dto.OAuthTokenRequest{
+		GrantType:    GrantTypeAuthorizationCode,
+		ClientID:     "spa",
+		Code:         "rotation-code",
+		CodeVerifier: testCodeVerifier,
+	})
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+
+	refresh := func(token string) (*dto.OAuthTokenResponse, error) {
+		return u.Token(&dto.OAuthTokenRequest{GrantType: GrantTypeRefreshToken, ClientID: "spa", RefreshToken: token})
+	}
+
+	rotated, err := refresh(tokens.RefreshToken)
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if rotated.RefreshToken == "" || rotated.RefreshToken == tokens.RefreshToken {
+		t.Fatalf("refresh token was not rotated: %+v", rotated)
+	}
+
+	// replaying the rotated token revokes the grant, the new token too
+	_, err = refresh(tokens.RefreshToken)
+	wantOAuthError(t, err, "invalid_grant")
+	_, err = refresh(rotated.RefreshToken)
+	wantOAuthError(t, err, "invalid_grant")
+}
+
+func TestTokenRefreshCannotWidenScopes(t *testing.T) {
+	u := newOAuthServerTestUsecase(t)
+	saveTestCode("scope-code", "grant-scope")
+
+	tokens, err := u.Token(&dto.OAuthTokenRequest{
+		GrantType:    GrantTypeAuthorizationCode,
+		ClientID:     "spa",
+		Code:         "scope-code",
+		CodeVerifier: testCodeVerifier,
+	})
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+
+	_, err = u.Token(&dto.OAuthTokenRequest{GrantType: GrantTypeRefreshToken, ClientID: "spa", RefreshToken: tokens.RefreshToken, Scope: "openid profile"})
+	wantOAuthError(t, err, "invalid_scope")
+}
+
+func TestNeedsLogin(t *testing.T) {
+	created := time.Now().Add(-time.Minute)
+	before := pkg.Authentication{Time: created.Add(-10 * time.Minute).Truncate(time.Second)}
+	// auth_time loses the fraction of a second, so a login in the same
+	// second as the request still counts as made after it
+	sameSecond := pkg.Authentication{Time: created.Truncate(time.Second)}
+	after := pkg.Authentication{Time: created.Add(30 * time.Second).Truncate(time.Second)}
+
+	seconds := func(n int) *int { return &n }
+
+	tests := []struct {
+		name   string
+		prompt string
+		maxAge *int
+		authn  pkg.Authentication
+		want   bool
+	}{
+		{"nothing requested", "", nil, before, false},
+		{"prompt=login, older login", "login", nil, before, true},
+		{"prompt=login, fresh login", "login", nil, after, false},
+		{"prompt=login, login in the same second", "login", nil, sameSecond, false},
+		{"prompt=consent does not ask for a login", "consent", nil, before, false},
+		{"max_age=0, older login", "", seconds(0), before, true},
+		{"max_age=0, fresh login", "", seconds(0), after, false},
+		{"max_age exceeded", "", seconds(300), before, true},
+		{"max_age not exceeded", "", seconds(3600), before, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := &pkg.AuthorizationRequest{Prompt: tt.prompt, MaxAge: tt.maxAge, CreatedAt: created}
+			if got := needsLogin(request, tt.authn); got != tt.want {
+				t.Errorf("needsLogin() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
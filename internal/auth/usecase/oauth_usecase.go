@@ -4,11 +4,15 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
+	"github.com/revandpratama/auth4me/config"
 	"github.com/revandpratama/auth4me/internal/auth/dto"
 	"github.com/revandpratama/auth4me/internal/auth/entity"
 	"github.com/revandpratama/auth4me/internal/auth/repository"
@@ -18,30 +22,115 @@ import (
 )
 
 type OAuthUsecase interface {
-	GetOAuthURL() (string, string)
-	GoogleOAuthCallback(code string) (string, string, error)
+	GetOAuthURL(providerName string, browserBinding string, returnTo string, linkUserID string) (string, error)
+	OAuthCallback(providerName string, code string, state string, browserBinding string) (*dto.TokenResponse, string, error)
+	ListLinkedProviders(userID string) ([]entity.OAuthProvider, error)
+	UnlinkProvider(userID string, providerName string) error
+	GetUpstreamToken(userID string, providerName string) (*dto.UpstreamTokenResponse, error)
 }
 
+var (
+	ErrUnknownOAuthProvider = errors.New("unknown oauth provider")
+	ErrInvalidOAuthState    = errors.New("invalid or expired oauth state")
+	ErrInvalidReturnTo      = errors.New("return_to is not an allowed redirect")
+	ErrOAuthDenied          = errors.New("login was not completed at the provider")
+
+	ErrAccountLinkRequired     = errors.New("an account with this email already exists, sign in to it and link the provider")
+	ErrProviderLinkedElsewhere = errors.New("this identity is already linked to another account")
+	ErrProviderAlreadyLinked   = errors.New("another identity of this provider is already linked")
+	ErrProviderNotLinked       = errors.New("provider is not linked")
+	ErrLastLoginMethod         = errors.New("cannot unlink the last login method, set a password or add a passkey first")
+
+	ErrUpstreamReauthRequired = errors.New("provider token can no longer be refreshed, the user has to sign in with the provider again")
+)
+
+// upstreamTokenMargin refreshes provider tokens this long before they
+// expire, so callers do not get a token that dies in flight.
+const upstreamTokenMargin = time.Minute
+
 type oauthUsecase struct {
-	oauthCfg  *oauth2.Config
-	authRepo  repository.AuthRepository
-	oauthRepo repository.OAuthRepository
+	providers    pkg.OAuthProviders
+	authRepo     repository.AuthRepository
+	oauthRepo    repository.OAuthRepository
+	webAuthnRepo repository.WebAuthnRepository
+	blobs        pkg.BlobStore
+
+	// one refresh per user and provider at a time, as providers rotating
+	// refresh tokens invalidate the old one on first use
+	refreshLocks sync.Map
 }
 
-func NewOAuthUsecase(oauthCfg *oauth2.Config, authRepo repository.AuthRepository, oauthRepo repository.OAuthRepository) OAuthUsecase {
+func NewOAuthUsecase(providers pkg.OAuthProviders, authRepo repository.AuthRepository, oauthRepo repository.OAuthRepository, webAuthnRepo repository.WebAuthnRepository, blobs pkg.BlobStore) OAuthUsecase {
 	return &oauthUsecase{
-		oauthCfg:  oauthCfg,
-		authRepo:  authRepo,
-		oauthRepo: oauthRepo,
+		providers:    providers,
+		authRepo:     authRepo,
+		oauthRepo:    oauthRepo,
+		webAuthnRepo: webAuthnRepo,
+		blobs:        blobs,
 	}
 }
 
-func (u *oauthUsecase) GetOAuthURL() (string, string) {
+// GetOAuthURL starts an authorization code flow with PKCE. The state, nonce
+// and code verifier stay on the server, bound to browserBinding, and
+// returnTo is where the callback sends the browser afterwards. With
+// linkUserID the identity is linked to that user instead of signing in.
+func (u *oauthUsecase) GetOAuthURL(providerName string, browserBinding string, returnTo string, linkUserID string) (string, error) {
+	provider, ok := u.providers[providerName]
+	if !ok {
+		return "", ErrUnknownOAuthProvider
+	}
+
+	if returnTo != "" && !isAllowedReturnTo(returnTo) {
+		return "", ErrInvalidReturnTo
+	}
+
 	state, err := generateRandomState()
 	if err != nil {
-		return "", ""
+		return "", err
+	}
+
+	verifier := oauth2.GenerateVerifier()
+	options := []oauth2.AuthCodeOption{oauth2.AccessTypeOffline, oauth2.S256ChallengeOption(verifier)}
+
+	nonce := ""
+	if provider.IsOIDC() {
+		if nonce, err = generateRandomState(); err != nil {
+			return "", err
+		}
+		options = append(options, oauth2.SetAuthURLParam("nonce", nonce))
+	}
+
+	pkg.SaveOAuthState(state, browserBinding, pkg.OAuthState{
+		Provider:     provider.Name,
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ReturnTo:     returnTo,
+		LinkUserID:   linkUserID,
+		ExpiresAt:    time.Now().Add(pkg.OAuthStateTTL),
+	})
+
+	return provider.Config.AuthCodeURL(state, options...), nil
+}
+
+// isAllowedReturnTo only accepts absolute http(s) URLs on an origin listed
+// in OAUTH_RETURN_TO_ALLOWLIST, so the callback cannot be turned into an
+// open redirect leaking tokens.
+func isAllowedReturnTo(returnTo string) bool {
+	target, err := url.Parse(returnTo)
+	if err != nil || target.User != nil || target.Host == "" {
+		return false
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return false
+	}
+
+	origin := target.Scheme + "://" + target.Host
+	for _, allowed := range strings.Split(config.ENV.OAUTH_RETURN_TO_ALLOWLIST, ",") {
+		if strings.TrimRight(strings.TrimSpace(allowed), "/") == origin {
+			return true
+		}
 	}
-	return u.oauthCfg.AuthCodeURL(state, oauth2.AccessTypeOffline), state
+	return false
 }
 
 func generateRandomState() (string, error) {
@@ -53,115 +142,317 @@ func generateRandomState() (string, error) {
 	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func (u *oauthUsecase) GoogleOAuthCallback(code string) (string, string, error) {
+// OAuthCallback completes the flow started by GetOAuthURL. It also returns
+// the return_to saved with the state, which is empty when the state could
+// not be matched.
+func (u *oauthUsecase) OAuthCallback(providerName string, code string, state string, browserBinding string) (*dto.TokenResponse, string, error) {
+	provider, ok := u.providers[providerName]
+	if !ok {
+		return nil, "", ErrUnknownOAuthProvider
+	}
+
+	savedState, ok := pkg.ConsumeOAuthState(state, browserBinding)
+	if !ok || savedState.Provider != provider.Name {
+		return nil, "", ErrInvalidOAuthState
+	}
+
+	if code == "" {
+		return nil, savedState.ReturnTo, ErrOAuthDenied
+	}
+
+	tokens, err := u.loginWithProvider(provider, code, savedState)
+	return tokens, savedState.ReturnTo, err
+}
+
+func (u *oauthUsecase) loginWithProvider(provider *pkg.OAuthProvider, code string, savedState *pkg.OAuthState) (*dto.TokenResponse, error) {
+
 	ctx := context.Background()
-	token, err := u.oauthCfg.Exchange(ctx, code)
+	token, err := provider.Config.Exchange(ctx, code, oauth2.VerifierOption(savedState.CodeVerifier))
 	if err != nil {
-		return "", "", fmt.Errorf("exchange failed: %w", err)
+		return nil, fmt.Errorf("exchange failed: %w", err)
 	}
 
-	client := u.oauthCfg.Client(ctx, token)
-	resp, err := client.Get("https://openidconnect.googleapis.com/v1/userinfo")
+	profile, err := provider.Profile(ctx, token, savedState.Nonce)
 	if err != nil {
-		return "", "", fmt.Errorf("get user info failed: %w", err)
+		return nil, fmt.Errorf("get user info failed: %w", err)
 	}
-	defer resp.Body.Close()
 
-	var googleProfile dto.GoogleUserInfo
-	if err := json.NewDecoder(resp.Body).Decode(&googleProfile); err != nil {
-		return "", "", fmt.Errorf("decode user info failed: %w", err)
+	if savedState.LinkUserID != "" {
+		return nil, u.linkIdentity(savedState.LinkUserID, provider, profile, token)
 	}
 
+	return u.signInIdentity(provider, profile, token)
+}
+
+// signInIdentity signs in the account an identity belongs to, linking or
+// creating one for an identity seen the first time.
+func (u *oauthUsecase) signInIdentity(provider *pkg.OAuthProvider, profile *pkg.OAuthProfile, token *oauth2.Token) (*dto.TokenResponse, error) {
+
 	var userToTokenize *entity.User
 
-	existingUser, err := u.authRepo.GetUserByEmail(googleProfile.Email)
-	if err != nil {
-		// not found → create new
-		if err == gorm.ErrRecordNotFound {
-			newUser := &entity.User{
-				Email:         googleProfile.Email,
-				FullName:      googleProfile.Name,
-				AvatarPath:    googleProfile.Picture,
-				EmailVerified: googleProfile.EmailVerified,
-			}
-
-			createdUser, err := u.authRepo.CreateUser(newUser)
-			if err != nil {
-				return "", "", err
-			}
-
-			userToTokenize = createdUser
-
-			provider := &entity.OAuthProvider{
-				UserID:       createdUser.ID,
-				Provider:     "google",
-				ProviderID:   googleProfile.Sub,
-				AccessToken:  token.AccessToken,
-				RefreshToken: token.RefreshToken,
-				ExpiresAt:    token.Expiry,
-			}
-			if err := u.oauthRepo.CreateProvider(provider); err != nil {
-				return "", "", err
-			}
-		} else {
-			return "", "", err
+	// the identity is its provider and subject; the email only matters
+	// for an identity seen for the first time
+	oauthProvider, err := u.oauthRepo.GetProviderByProviderID(provider.Name, profile.ProviderID)
+	if err == nil {
+		userToTokenize, err = u.authRepo.GetUserByID(oauthProvider.UserID)
+		if err != nil {
+			return nil, err
+		}
+
+		oauthProvider.AccessToken = token.AccessToken
+		oauthProvider.RefreshToken = token.RefreshToken
+		oauthProvider.ExpiresAt = token.Expiry
+		if err := u.oauthRepo.UpdateProvider(oauthProvider); err != nil {
+			return nil, fmt.Errorf("failed to update provider tokens: %w", err)
+		}
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
+		userToTokenize, err = u.userForNewIdentity(provider, profile)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := u.oauthRepo.CreateProvider(newOAuthProvider(userToTokenize.ID, provider, profile, token)); err != nil {
+			return nil, fmt.Errorf("failed to link %s provider: %w", provider.Name, err)
 		}
 	} else {
-		userToTokenize = existingUser
-		provider, err := u.oauthRepo.GetProvider(userToTokenize.ID, "google")
+		return nil, err
+	}
+
+	if !userToTokenize.EmailVerified && profile.EmailVerified && userToTokenize.Email == profile.Email {
+		userToTokenize.EmailVerified = profile.EmailVerified
+		if err := u.authRepo.UpdateUser(userToTokenize); err != nil {
+			return nil, err
+		}
+	}
+
+	tokens, err := completeLogin(userToTokenize, provider.Name, pkg.NewAuthentication(pkg.AMRFederated))
+	if err != nil {
+		return nil, fmt.Errorf("generate token failed: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// userForNewIdentity creates an account for an identity seen the first time,
+// or picks the account with the same email when it may be linked
+// automatically: the policy allows it and both the provider and the account
+// vouch for the address. Otherwise anyone able to get an unverified address
+// into a provider profile could take the account over, so the owner has to
+// sign in and link the provider explicitly.
+func (u *oauthUsecase) userForNewIdentity(provider *pkg.OAuthProvider, profile *pkg.OAuthProfile) (*entity.User, error) {
+
+	existingUser, err := u.authRepo.GetUserByEmail(profile.Email)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+
+		roleID, err := roleForNewUser(u.authRepo, profile.Email, profile.Claims)
 		if err != nil {
-			if err == gorm.ErrRecordNotFound {
-				provider = &entity.OAuthProvider{
-					UserID:       userToTokenize.ID,
-					Provider:     "google",
-					ProviderID:   googleProfile.Sub,
-					AccessToken:  token.AccessToken,
-					RefreshToken: token.RefreshToken,
-					ExpiresAt:    token.Expiry,
-				}
-				if err := u.oauthRepo.CreateProvider(provider); err != nil {
-					return "", "", fmt.Errorf("failed to link google provider to existing user: %w", err)
-				}
-			} else {
-				return "", "", err
-			}
+			return nil, err
+		}
+
+		newUser := &entity.User{
+			Email:         profile.Email,
+			FullName:      profile.Name,
+			EmailVerified: profile.EmailVerified,
+			RoleID:        roleID,
+		}
+		if !config.ENV.AVATAR_IMPORT_ENABLED {
+			newUser.AvatarPath = profile.AvatarURL
+		}
+
+		createdUser, err := u.authRepo.CreateUser(newUser)
+		if err != nil {
+			return nil, err
+		}
+
+		if config.ENV.AVATAR_IMPORT_ENABLED && profile.AvatarURL != "" {
+			u.importAvatar(createdUser, profile.AvatarURL)
+		}
+
+		return createdUser, nil
+	}
+
+	if !config.ENV.OAUTH_AUTO_LINK_ENABLED || !profile.EmailVerified || !existingUser.EmailVerified {
+		return nil, ErrAccountLinkRequired
+	}
+
+	if _, err := u.oauthRepo.GetProvider(existingUser.ID, provider.Name); err == nil {
+		// a different identity of the same provider is already linked
+		return nil, ErrAccountLinkRequired
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	return existingUser, nil
+}
+
+// linkIdentity attaches an identity to the signed in user who started the
+// flow through LinkProvider.
+func (u *oauthUsecase) linkIdentity(userID string, provider *pkg.OAuthProvider, profile *pkg.OAuthProfile, token *oauth2.Token) error {
+
+	linked, err := u.oauthRepo.GetProviderByProviderID(provider.Name, profile.ProviderID)
+	if err == nil {
+		if linked.UserID != userID {
+			return ErrProviderLinkedElsewhere
+		}
+		linked.AccessToken = token.AccessToken
+		linked.RefreshToken = token.RefreshToken
+		linked.ExpiresAt = token.Expiry
+		return u.oauthRepo.UpdateProvider(linked)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	if _, err := u.oauthRepo.GetProvider(userID, provider.Name); err == nil {
+		return ErrProviderAlreadyLinked
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	return u.oauthRepo.CreateProvider(newOAuthProvider(userID, provider, profile, token))
+}
+
+func newOAuthProvider(userID string, provider *pkg.OAuthProvider, profile *pkg.OAuthProfile, token *oauth2.Token) *entity.OAuthProvider {
+	return &entity.OAuthProvider{
+		UserID:       userID,
+		Provider:     provider.Name,
+		ProviderID:   profile.ProviderID,
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		ExpiresAt:    token.Expiry,
+	}
+}
+
+func (u *oauthUsecase) ListLinkedProviders(userID string) ([]entity.OAuthProvider, error) {
+	return u.oauthRepo.GetProvidersByUserID(userID)
+}
+
+// UnlinkProvider refuses to remove the user's last way to sign in. Email
+// based logins do not count, as they can be disabled by configuration.
+func (u *oauthUsecase) UnlinkProvider(userID string, providerName string) error {
+
+	user, err := u.authRepo.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+
+	providers, err := u.oauthRepo.GetProvidersByUserID(userID)
+	if err != nil {
+		return err
+	}
+
+	otherProviders := 0
+	found := false
+	for _, linked := range providers {
+		if linked.Provider == providerName {
+			found = true
 		} else {
-			provider.AccessToken = token.AccessToken
-			provider.RefreshToken = token.RefreshToken
-			provider.ExpiresAt = token.Expiry
-			if err := u.oauthRepo.UpdateProvider(provider); err != nil {
-				return "", "", fmt.Errorf("failed to update provider tokens: %w", err)
-			}
+			otherProviders++
 		}
 	}
+	if !found {
+		return ErrProviderNotLinked
+	}
 
-	if !userToTokenize.EmailVerified && googleProfile.EmailVerified {
-		userToTokenize.EmailVerified = googleProfile.EmailVerified
-		if err := u.authRepo.UpdateUser(userToTokenize); err != nil {
-			return "", "", err
+	if user.Password == "" && otherProviders == 0 {
+		credentials, err := u.webAuthnRepo.GetCredentialsByUserID(userID)
+		if err != nil {
+			return err
+		}
+		if len(credentials) == 0 {
+			return ErrLastLoginMethod
 		}
 	}
 
-	mfaCompleted := false
-	if userToTokenize.MFAEnabled {
-		// TODO : Validate MFA
+	_, err = u.oauthRepo.DeleteProvider(userID, providerName)
+	return err
+}
+
+// GetUpstreamToken returns a provider access token for the user, refreshing
+// and storing it first when it is about to expire.
+func (u *oauthUsecase) GetUpstreamToken(userID string, providerName string) (*dto.UpstreamTokenResponse, error) {
+	provider, ok := u.providers[providerName]
+	if !ok {
+		return nil, ErrUnknownOAuthProvider
 	}
 
-	accessToken, err := pkg.GenerateToken(userToTokenize, "google", mfaCompleted)
+	lock, _ := u.refreshLocks.LoadOrStore(userID+":"+providerName, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	stored, err := u.oauthRepo.GetProvider(userID, providerName)
 	if err != nil {
-		return "", "", fmt.Errorf("generate token failed: %w", err)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrProviderNotLinked
+		}
+		return nil, err
 	}
 
-	// Generate Refresh Token
-	refreshToken := uuid.NewString()
-	pkg.SaveRefreshToken(refreshToken, pkg.TokenData{
-		UserID:       userToTokenize.ID,
-		Email:        userToTokenize.Email,
-		RoleID:       userToTokenize.RoleID,
-		Provider:     "google",
-		MFACompleted: mfaCompleted,
-		ExpiresAt:    time.Now().Add(time.Hour * 24)},
-	)
+	current := &oauth2.Token{
+		AccessToken:  stored.AccessToken,
+		RefreshToken: stored.RefreshToken,
+		Expiry:       stored.ExpiresAt,
+	}
+	if needsUpstreamReauth(current) {
+		return nil, ErrUpstreamReauthRequired
+	}
 
-	return refreshToken, accessToken, nil
+	// the inner source holds only the refresh token, so it always refreshes
+	// once the outer one decides the current token is too close to expiry
+	ctx := context.Background()
+	refresher := provider.Config.TokenSource(ctx, &oauth2.Token{RefreshToken: stored.RefreshToken})
+	token, err := oauth2.ReuseTokenSourceWithExpiry(current, refresher, upstreamTokenMargin).Token()
+	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant" {
+			return nil, ErrUpstreamReauthRequired
+		}
+		return nil, fmt.Errorf("refresh upstream token failed: %w", err)
+	}
+
+	if token.AccessToken != stored.AccessToken {
+		stored.AccessToken = token.AccessToken
+		if token.RefreshToken != "" {
+			stored.RefreshToken = token.RefreshToken
+		}
+		stored.ExpiresAt = token.Expiry
+		if err := u.oauthRepo.UpdateProvider(stored); err != nil {
+			return nil, fmt.Errorf("failed to store refreshed provider token: %w", err)
+		}
+	}
+
+	return &dto.UpstreamTokenResponse{
+		AccessToken: token.AccessToken,
+		TokenType:   token.Type(),
+		ExpiresAt:   token.Expiry,
+	}, nil
+}
+
+// needsUpstreamReauth reports whether token is about to expire with no
+// refresh token to renew it. Providers that send no expiry issue tokens
+// that stay valid until revoked, so those are served as they are.
+func needsUpstreamReauth(token *oauth2.Token) bool {
+	if token.RefreshToken != "" || token.Expiry.IsZero() {
+		return false
+	}
+	return !token.Expiry.After(time.Now().Add(upstreamTokenMargin))
+}
+
+// importAvatar copies the provider picture into the blob store. A picture
+// that cannot be imported leaves the new account without an avatar rather
+// than failing the sign-up.
+func (u *oauthUsecase) importAvatar(user *entity.User, avatarURL string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	data, err := pkg.FetchAvatar(ctx, avatarURL)
+	if err == nil {
+		_, err = storeAvatar(ctx, u.blobs, u.authRepo, user, data)
+	}
+	if err != nil {
+		log.Printf("import avatar for user %s failed: %v", user.ID, err)
+	}
 }
@@ -0,0 +1,30 @@
+package usecase
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestNeedsUpstreamReauth(t *testing.T) {
+	tests := []struct {
+		name  string
+		token oauth2.Token
+		want  bool
+	}{
+		{"no expiry and no refresh token", oauth2.Token{AccessToken: "a"}, false},
+		{"expiring without refresh token", oauth2.Token{AccessToken: "a", Expiry: time.Now().Add(upstreamTokenMargin / 2)}, true},
+		{"expired without refresh token", oauth2.Token{AccessToken: "a", Expiry: time.Now().Add(-time.Hour)}, true},
+		{"valid without refresh token", oauth2.Token{AccessToken: "a", Expiry: time.Now().Add(time.Hour)}, false},
+		{"expired with refresh token", oauth2.Token{AccessToken: "a", RefreshToken: "r", Expiry: time.Now().Add(-time.Hour)}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := needsUpstreamReauth(&tt.token); got != tt.want {
+				t.Errorf("needsUpstreamReauth() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
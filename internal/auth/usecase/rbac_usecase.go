@@ -1,10 +1,14 @@
 package usecase
 
 import (
+	"errors"
+
 	"github.com/revandpratama/auth4me/internal/auth/entity"
 	"github.com/revandpratama/auth4me/internal/auth/repository"
 )
 
+var ErrSystemRole = errors.New("system roles cannot be changed")
+
 type RBACUsecase interface {
 	GetAllRolePermissions() ([]entity.RolePermission, error)
 	GetRolePermissionsByRoleID(roleID uint) ([]entity.Permission, error)
@@ -50,17 +54,39 @@ func (r *rbacUsecase) GetRolePermissionsByRoleName(roleName string) ([]entity.Pe
 }
 
 func (r *rbacUsecase) CreateRole(role *entity.Role) error {
+	// system roles are only ever flagged by the migration
+	role.System = false
 	return r.repository.CreateRole(role)
 }
 
 func (r *rbacUsecase) UpdateRole(role *entity.Role) error {
+	if err := r.checkNotSystem(role.ID); err != nil {
+		return err
+	}
+	role.System = false
 	return r.repository.UpdateRole(role)
 }
 
 func (r *rbacUsecase) DeleteRole(id uint) error {
+	if err := r.checkNotSystem(id); err != nil {
+		return err
+	}
 	return r.repository.DeleteRole(id)
 }
 
+// checkNotSystem refuses changes to system roles. The admin check trusts the
+// flag together with the name, so neither may be touched through the API.
+func (r *rbacUsecase) checkNotSystem(id uint) error {
+	role, err := r.repository.GetRoleByID(id)
+	if err != nil {
+		return err
+	}
+	if role.System {
+		return ErrSystemRole
+	}
+	return nil
+}
+
 func (r *rbacUsecase) GetAllRoles() ([]entity.Role, error) {
 	return r.repository.GetAllRoles()
 }
@@ -0,0 +1,117 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+	"github.com/revandpratama/auth4me/internal/auth/repository"
+	"github.com/revandpratama/auth4me/pkg"
+	"golang.org/x/oauth2"
+)
+
+type SAMLUsecase interface {
+	Metadata() []byte
+	GetLoginURL(providerName string, browserBinding string, returnTo string) (string, error)
+	AssertionConsumer(samlResponse string, relayState string, browserBinding string) (*dto.TokenResponse, string, error)
+}
+
+var (
+	ErrUnknownSAMLProvider = errors.New("unknown saml identity provider")
+	ErrSAMLEmailMissing    = errors.New("identity provider did not release an email address")
+)
+
+// samlUsecase signs SAML identities in the same way as OAuth ones, so it
+// shares the identity handling of oauthUsecase.
+type samlUsecase struct {
+	*oauthUsecase
+	samlProviders pkg.SAMLProviders
+}
+
+func NewSAMLUsecase(samlProviders pkg.SAMLProviders, authRepo repository.AuthRepository, oauthRepo repository.OAuthRepository, webAuthnRepo repository.WebAuthnRepository, blobs pkg.BlobStore) SAMLUsecase {
+	return &samlUsecase{
+		oauthUsecase: &oauthUsecase{
+			authRepo:     authRepo,
+			oauthRepo:    oauthRepo,
+			webAuthnRepo: webAuthnRepo,
+			blobs:        blobs,
+		},
+		samlProviders: samlProviders,
+	}
+}
+
+func (u *samlUsecase) Metadata() []byte {
+	return pkg.SAMLMetadata()
+}
+
+// GetLoginURL starts an SP-initiated login. The AuthnRequest ID is kept with
+// the relay state and bound to the browser like an OAuth state, so the ACS
+// only accepts the answer to a request this browser made.
+func (u *samlUsecase) GetLoginURL(providerName string, browserBinding string, returnTo string) (string, error) {
+	provider, ok := u.samlProviders[providerName]
+	if !ok {
+		return "", ErrUnknownSAMLProvider
+	}
+
+	if returnTo != "" && !isAllowedReturnTo(returnTo) {
+		return "", ErrInvalidReturnTo
+	}
+
+	requestID, err := pkg.NewSAMLRequestID()
+	if err != nil {
+		return "", err
+	}
+
+	relayState, err := generateRandomState()
+	if err != nil {
+		return "", err
+	}
+
+	pkg.SaveOAuthState(relayState, browserBinding, pkg.OAuthState{
+		Provider:  provider.ProviderName(),
+		Nonce:     requestID,
+		ReturnTo:  returnTo,
+		ExpiresAt: time.Now().Add(pkg.OAuthStateTTL),
+	})
+
+	return provider.AuthnRequestURL(requestID, relayState)
+}
+
+// AssertionConsumer validates the response an IdP posted and signs the user
+// in. Like OAuthCallback it also returns the saved return_to.
+func (u *samlUsecase) AssertionConsumer(samlResponse string, relayState string, browserBinding string) (*dto.TokenResponse, string, error) {
+
+	savedState, ok := pkg.ConsumeOAuthState(relayState, browserBinding)
+	if !ok {
+		return nil, "", ErrInvalidOAuthState
+	}
+
+	var provider *pkg.SAMLProvider
+	for _, candidate := range u.samlProviders {
+		if candidate.ProviderName() == savedState.Provider {
+			provider = candidate
+		}
+	}
+	if provider == nil {
+		return nil, "", ErrInvalidOAuthState
+	}
+
+	assertion, err := provider.ParseResponse(samlResponse, savedState.Nonce)
+	if err != nil {
+		return nil, savedState.ReturnTo, err
+	}
+
+	profile := provider.Profile(assertion)
+	if profile.Email == "" {
+		return nil, savedState.ReturnTo, ErrSAMLEmailMissing
+	}
+
+	// SAML identities carry no tokens for the vault
+	tokens, err := u.signInIdentity(&pkg.OAuthProvider{Name: provider.ProviderName()}, profile, &oauth2.Token{})
+	if err != nil {
+		return nil, savedState.ReturnTo, fmt.Errorf("saml login failed: %w", err)
+	}
+
+	return tokens, savedState.ReturnTo, nil
+}
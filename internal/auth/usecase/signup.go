@@ -0,0 +1,43 @@
+package usecase
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/revandpratama/auth4me/internal/auth/repository"
+	"github.com/revandpratama/auth4me/pkg"
+	"gorm.io/gorm"
+)
+
+var ErrSignupDomainNotAllowed = errors.New("sign-ups from this email domain are not allowed")
+
+// roleForNewUser resolves the role every sign-up path gives a new account,
+// from ROLE_MAPPING_RULES or DEFAULT_ROLE. claims are the identity
+// provider's, when the account comes from one.
+func roleForNewUser(repo repository.AuthRepository, email string, claims map[string]any) (uint, error) {
+
+	if !pkg.IsSignupDomainAllowed(email) {
+		return 0, ErrSignupDomainNotAllowed
+	}
+
+	return mappedRoleID(repo, email, claims)
+}
+
+// mappedRoleID resolves the role ROLE_MAPPING_RULES give email and claims.
+func mappedRoleID(repo repository.AuthRepository, email string, claims map[string]any) (uint, error) {
+
+	roleName, err := pkg.MapRole(email, claims)
+	if err != nil {
+		return 0, err
+	}
+
+	role, err := repo.GetRoleByName(roleName)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, fmt.Errorf("role %q for new users does not exist", roleName)
+		}
+		return 0, err
+	}
+
+	return role.ID, nil
+}
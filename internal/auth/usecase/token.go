@@ -0,0 +1,86 @@
+package usecase
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"github.com/revandpratama/auth4me/pkg"
+)
+
+const restrictedTokenTTL = 10 * time.Minute
+
+// completeLogin is the last step shared by every first-factor login method
+// once the user has been identified. Users who have to change their password
+// or who have MFA enabled only get a restricted token until they do so.
+func completeLogin(user *entity.User, provider string, authn pkg.Authentication) (*dto.TokenResponse, error) {
+
+	if mustChangeLocalPassword(user) {
+		return issueRestrictedToken(user, provider, pkg.PurposePasswordChange, authn)
+	}
+
+	if requiresMFA(user) {
+		return issueRestrictedToken(user, provider, pkg.PurposeMFA, authn)
+	}
+
+	return issueTokenPair(user, provider, authn)
+}
+
+// requiresMFA reports whether the user has any confirmed second factor.
+func requiresMFA(user *entity.User) bool {
+	return user.MFAEnabled || user.SMSMFAEnabled
+}
+
+// mustChangeLocalPassword applies passwordChangeRequired to users with a
+// local password; passwords kept elsewhere, such as in LDAP, expire there.
+func mustChangeLocalPassword(user *entity.User) bool {
+	return user.Password != "" && passwordChangeRequired(user)
+}
+
+// issueTokenPair generates an access token and stores a matching refresh
+// token, the same way for every login method. It still holds back the pair
+// from a user who has to change their password, whichever way they got here.
+func issueTokenPair(user *entity.User, provider string, authn pkg.Authentication) (*dto.TokenResponse, error) {
+
+	if mustChangeLocalPassword(user) {
+		return issueRestrictedToken(user, provider, pkg.PurposePasswordChange, authn)
+	}
+
+	accessToken, err := pkg.GenerateToken(user, provider, authn)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken := uuid.NewString()
+	pkg.SaveRefreshToken(refreshToken, pkg.TokenData{
+		UserID:       user.ID,
+		Email:        user.Email,
+		RoleID:       user.RoleID,
+		Provider:     provider,
+		MFACompleted: authn.MFACompleted,
+		AMR:          authn.Methods,
+		AuthTime:     authn.Time,
+		ExpiresAt:    time.Now().Add(time.Hour * 24)},
+	)
+
+	return &dto.TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// issueRestrictedToken returns a response carrying only a token limited to
+// purpose; the client has to complete that step before getting a full pair.
+func issueRestrictedToken(user *entity.User, provider string, purpose string, authn pkg.Authentication) (*dto.TokenResponse, error) {
+
+	token, err := pkg.GenerateRestrictedToken(user, provider, purpose, restrictedTokenTTL, authn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dto.TokenResponse{
+		AccessToken: token,
+		NextStep:    purpose,
+	}, nil
+}
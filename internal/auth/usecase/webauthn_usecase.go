@@ -0,0 +1,389 @@
+package usecase
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/revandpratama/auth4me/internal/auth/dto"
+	"github.com/revandpratama/auth4me/internal/auth/entity"
+	"github.com/revandpratama/auth4me/internal/auth/repository"
+	"github.com/revandpratama/auth4me/pkg"
+	"gorm.io/gorm"
+)
+
+type WebAuthnUsecase interface {
+	BeginRegistration(userID string) (*protocol.CredentialCreation, error)
+	FinishRegistration(userID string, name string, body []byte) (*entity.WebAuthnCredential, error)
+	BeginLogin(email string) (*dto.WebAuthnLoginBeginResponse, error)
+	FinishLogin(sessionID string, body []byte) (*dto.TokenResponse, error)
+	BeginMFA(userID string) (*protocol.CredentialAssertion, error)
+	FinishMFA(userID string, provider string, prior pkg.Authentication, body []byte) (*dto.TokenResponse, error)
+	ListCredentials(userID string) ([]entity.WebAuthnCredential, error)
+	DeleteCredential(userID string, id uint) error
+}
+
+var (
+	ErrWebAuthnSession        = errors.New("webauthn challenge not found or expired")
+	ErrWebAuthnVerification   = errors.New("webauthn verification failed")
+	ErrWebAuthnAttestation    = errors.New("unsupported attestation format")
+	ErrWebAuthnCloned         = errors.New("authenticator sign count did not increase, it may be cloned")
+	ErrWebAuthnNoCredentials  = errors.New("no webauthn credentials registered")
+	ErrWebAuthnCredentialGone = errors.New("webauthn credential not found")
+	ErrWebAuthnSameFactor     = errors.New("a passkey login needs a different second factor")
+)
+
+// allowedAttestationFormats limits registration to authenticators returning
+// no attestation or a packed statement.
+var allowedAttestationFormats = []protocol.AttestationFormat{
+	protocol.AttestationFormatNone,
+	protocol.AttestationFormatPacked,
+}
+
+type webAuthnUsecase struct {
+	webAuthn     *webauthn.WebAuthn
+	authRepo     repository.AuthRepository
+	webAuthnRepo repository.WebAuthnRepository
+}
+
+func NewWebAuthnUsecase(webAuthn *webauthn.WebAuthn, authRepo repository.AuthRepository, webAuthnRepo repository.WebAuthnRepository) WebAuthnUsecase {
+	return &webAuthnUsecase{
+		webAuthn:     webAuthn,
+		authRepo:     authRepo,
+		webAuthnRepo: webAuthnRepo,
+	}
+}
+
+// webAuthnUser adapts entity.User to the webauthn.User interface. The user
+// handle is the user id, which lets discoverable logins find the account.
+type webAuthnUser struct {
+	user        *entity.User
+	credentials []entity.WebAuthnCredential
+}
+
+func (w *webAuthnUser) WebAuthnID() []byte {
+	return []byte(w.user.ID)
+}
+
+func (w *webAuthnUser) WebAuthnName() string {
+	return w.user.Email
+}
+
+func (w *webAuthnUser) WebAuthnDisplayName() string {
+	if w.user.FullName != "" {
+		return w.user.FullName
+	}
+	return w.user.Email
+}
+
+func (w *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(w.credentials))
+	for _, c := range w.credentials {
+		transports := []protocol.AuthenticatorTransport{}
+		for _, t := range strings.Split(c.Transports, ",") {
+			if t != "" {
+				transports = append(transports, protocol.AuthenticatorTransport(t))
+			}
+		}
+
+		credentials = append(credentials, webauthn.Credential{
+			ID:              c.CredentialID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				UserPresent:    true,
+				UserVerified:   c.UserVerified,
+				BackupEligible: c.BackupEligible,
+				BackupState:    c.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    c.AAGUID,
+				SignCount: c.SignCount,
+			},
+		})
+	}
+	return credentials
+}
+
+func (w *webAuthnUser) findCredential(credentialID []byte) *entity.WebAuthnCredential {
+	for i := range w.credentials {
+		if bytes.Equal(w.credentials[i].CredentialID, credentialID) {
+			return &w.credentials[i]
+		}
+	}
+	return nil
+}
+
+func (u *webAuthnUsecase) loadUser(userID string) (*webAuthnUser, error) {
+	user, err := u.authRepo.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := u.webAuthnRepo.GetCredentialsByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webAuthnUser{user: user, credentials: credentials}, nil
+}
+
+func (u *webAuthnUsecase) BeginRegistration(userID string) (*protocol.CredentialCreation, error) {
+
+	waUser, err := u.loadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	creation, session, err := u.webAuthn.BeginRegistration(waUser,
+		webauthn.WithExclusions(webauthn.Credentials(waUser.WebAuthnCredentials()).CredentialDescriptors()),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+		webauthn.WithAttestationFormats(allowedAttestationFormats),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg.SaveWebAuthnSession("register:"+userID, session)
+
+	return creation, nil
+}
+
+func (u *webAuthnUsecase) FinishRegistration(userID string, name string, body []byte) (*entity.WebAuthnCredential, error) {
+
+	session, exists := pkg.ConsumeWebAuthnSession("register:" + userID)
+	if !exists {
+		return nil, ErrWebAuthnSession
+	}
+
+	waUser, err := u.loadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(body)
+	if err != nil {
+		return nil, errors.Join(ErrWebAuthnVerification, err)
+	}
+
+	credential, err := u.webAuthn.CreateCredential(waUser, *session, parsed)
+	if err != nil {
+		return nil, errors.Join(ErrWebAuthnVerification, err)
+	}
+
+	if !slices.Contains(allowedAttestationFormats, protocol.AttestationFormat(credential.AttestationType)) {
+		return nil, ErrWebAuthnAttestation
+	}
+
+	transports := make([]string, 0, len(credential.Transport))
+	for _, t := range credential.Transport {
+		transports = append(transports, string(t))
+	}
+
+	if name == "" {
+		name = "Passkey"
+	}
+
+	stored := &entity.WebAuthnCredential{
+		UserID:          userID,
+		Name:            name,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		Transports:      strings.Join(transports, ","),
+		UserVerified:    credential.Flags.UserVerified,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	}
+	if err := u.webAuthnRepo.CreateCredential(stored); err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+// BeginLogin starts a passwordless login. Without an email, or for an email
+// without passkeys, the browser is asked for any discoverable credential so
+// the response does not reveal which accounts exist.
+func (u *webAuthnUsecase) BeginLogin(email string) (*dto.WebAuthnLoginBeginResponse, error) {
+
+	var (
+		assertion *protocol.CredentialAssertion
+		session   *webauthn.SessionData
+		err       error
+	)
+
+	var waUser *webAuthnUser
+	if email != "" {
+		if user, err := u.authRepo.GetUserByEmail(email); err == nil {
+			waUser, err = u.loadUser(user.ID)
+			if err != nil {
+				return nil, err
+			}
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	if waUser != nil && len(waUser.credentials) > 0 {
+		assertion, session, err = u.webAuthn.BeginLogin(waUser, webauthn.WithUserVerification(protocol.VerificationPreferred))
+	} else {
+		assertion, session, err = u.webAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationPreferred))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sessionID := uuid.NewString()
+	pkg.SaveWebAuthnSession("login:"+sessionID, session)
+
+	return &dto.WebAuthnLoginBeginResponse{
+		SessionID: sessionID,
+		Options:   assertion,
+	}, nil
+}
+
+// FinishLogin issues the usual token pair when the authenticator verified
+// the user, as the passkey then combines possession with user verification.
+// Without verification the passkey is a single factor, and users with MFA
+// still go through their second step.
+func (u *webAuthnUsecase) FinishLogin(sessionID string, body []byte) (*dto.TokenResponse, error) {
+
+	session, exists := pkg.ConsumeWebAuthnSession("login:" + sessionID)
+	if !exists {
+		return nil, ErrWebAuthnSession
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(body)
+	if err != nil {
+		return nil, errors.Join(ErrWebAuthnVerification, err)
+	}
+
+	var waUser *webAuthnUser
+	if len(session.UserID) > 0 {
+		waUser, err = u.loadUser(string(session.UserID))
+		if err != nil {
+			return nil, err
+		}
+		_, err = u.webAuthn.ValidateLogin(waUser, *session, parsed)
+	} else {
+		_, err = u.webAuthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			waUser, err = u.loadUser(string(userHandle))
+			return waUser, err
+		}, *session, parsed)
+	}
+	if err != nil {
+		return nil, errors.Join(ErrWebAuthnVerification, err)
+	}
+
+	userVerified, err := u.recordAssertion(waUser, parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	authn := pkg.NewAuthentication(pkg.AMRHardwareKey)
+	if !userVerified {
+		return completeLogin(waUser.user, "webauthn", authn)
+	}
+
+	return issueTokenPair(waUser.user, "webauthn", authn.WithSecondFactor(pkg.AMRUserVerification))
+}
+
+// BeginMFA challenges the user's passkeys as the second step of a login
+// started with another factor.
+func (u *webAuthnUsecase) BeginMFA(userID string) (*protocol.CredentialAssertion, error) {
+
+	waUser, err := u.loadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(waUser.credentials) == 0 {
+		return nil, ErrWebAuthnNoCredentials
+	}
+
+	assertion, session, err := u.webAuthn.BeginLogin(waUser)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg.SaveWebAuthnSession("mfa:"+userID, session)
+
+	return assertion, nil
+}
+
+func (u *webAuthnUsecase) FinishMFA(userID string, provider string, prior pkg.Authentication, body []byte) (*dto.TokenResponse, error) {
+
+	// a passkey without user verification cannot vouch for itself
+	if slices.Contains(prior.Methods, pkg.AMRHardwareKey) {
+		return nil, ErrWebAuthnSameFactor
+	}
+
+	session, exists := pkg.ConsumeWebAuthnSession("mfa:" + userID)
+	if !exists {
+		return nil, ErrWebAuthnSession
+	}
+
+	waUser, err := u.loadUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(body)
+	if err != nil {
+		return nil, errors.Join(ErrWebAuthnVerification, err)
+	}
+
+	if _, err := u.webAuthn.ValidateLogin(waUser, *session, parsed); err != nil {
+		return nil, errors.Join(ErrWebAuthnVerification, err)
+	}
+
+	if _, err := u.recordAssertion(waUser, parsed); err != nil {
+		return nil, err
+	}
+
+	return issueTokenPair(waUser.user, provider, prior.WithSecondFactor(pkg.AMRHardwareKey))
+}
+
+// recordAssertion rejects assertions whose sign count went backwards, which
+// points at a cloned authenticator, and stores the new counter otherwise.
+func (u *webAuthnUsecase) recordAssertion(waUser *webAuthnUser, parsed *protocol.ParsedCredentialAssertionData) (bool, error) {
+
+	stored := waUser.findCredential(parsed.RawID)
+	if stored == nil {
+		return false, ErrWebAuthnCredentialGone
+	}
+
+	authData := parsed.Response.AuthenticatorData
+	if (authData.Counter != 0 || stored.SignCount != 0) && authData.Counter <= stored.SignCount {
+		return false, ErrWebAuthnCloned
+	}
+
+	if err := u.webAuthnRepo.UpdateCredentialUsage(stored.ID, authData.Counter, authData.Flags.HasBackupState()); err != nil {
+		return false, err
+	}
+
+	return authData.Flags.HasUserVerified(), nil
+}
+
+func (u *webAuthnUsecase) ListCredentials(userID string) ([]entity.WebAuthnCredential, error) {
+	return u.webAuthnRepo.GetCredentialsByUserID(userID)
+}
+
+func (u *webAuthnUsecase) DeleteCredential(userID string, id uint) error {
+	deleted, err := u.webAuthnRepo.DeleteCredential(userID, id)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return ErrWebAuthnCredentialGone
+	}
+	return nil
+}
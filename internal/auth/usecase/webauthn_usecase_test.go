@@ -0,0 +1,68 @@
+package usecase
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/revandpratama/auth4me/internal/auth/entity"
+)
+
+func TestRecordAssertionSignCount(t *testing.T) {
+	tests := []struct {
+		name     string
+		stored   uint32
+		counter  uint32
+		wantErr  error
+		wantSave bool
+	}{
+		{"counter increased", 5, 6, nil, true},
+		{"counter repeated", 5, 5, ErrWebAuthnCloned, false},
+		{"counter went back", 5, 4, ErrWebAuthnCloned, false},
+		{"counter reset to zero", 5, 0, ErrWebAuthnCloned, false},
+		// authenticators without a counter, such as synced passkeys,
+		// always send zero
+		{"no counter", 0, 0, nil, true},
+		{"counter starts", 0, 1, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &fakeWebAuthnRepository{usage: map[uint]uint32{}}
+			u := &webAuthnUsecase{webAuthnRepo: repo}
+			waUser := &webAuthnUser{
+				user:        &entity.User{ID: "user-1"},
+				credentials: []entity.WebAuthnCredential{{ID: 7, CredentialID: []byte("credential"), SignCount: tt.stored}},
+			}
+
+			parsed := &protocol.ParsedCredentialAssertionData{}
+			parsed.RawID = []byte("credential")
+			parsed.Response.AuthenticatorData.Counter = tt.counter
+			parsed.Response.AuthenticatorData.Flags = protocol.FlagUserPresent | protocol.FlagUserVerified
+
+			verified, err := u.recordAssertion(waUser, parsed)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+			saved, ok := repo.usage[7]
+			if ok != tt.wantSave || (ok && saved != tt.counter) {
+				t.Errorf("saved counter %d (%v), want %d (%v)", saved, ok, tt.counter, tt.wantSave)
+			}
+			if err == nil && !verified {
+				t.Error("user verification flag was lost")
+			}
+		})
+	}
+}
+
+func TestRecordAssertionUnknownCredential(t *testing.T) {
+	u := &webAuthnUsecase{webAuthnRepo: &fakeWebAuthnRepository{usage: map[uint]uint32{}}}
+	waUser := &webAuthnUser{user: &entity.User{ID: "user-1"}}
+
+	parsed := &protocol.ParsedCredentialAssertionData{}
+	parsed.RawID = []byte("deleted")
+
+	if _, err := u.recordAssertion(waUser, parsed); !errors.Is(err, ErrWebAuthnCredentialGone) {
+		t.Errorf("got %v, want ErrWebAuthnCredentialGone", err)
+	}
+}
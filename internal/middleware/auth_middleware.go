@@ -1,13 +1,32 @@
 package middleware
 
 import (
+	"slices"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/revandpratama/auth4me/pkg"
 )
 
+// AuthMiddleware accepts only fully privileged access tokens of users.
 func AuthMiddleware() func(c *fiber.Ctx) error {
+	return authenticate(false)
+}
+
+// RestrictedAuthMiddleware accepts fully privileged access tokens as well as
+// restricted tokens issued for one of the given purposes.
+func RestrictedAuthMiddleware(purposes ...string) func(c *fiber.Ctx) error {
+	return authenticate(false, purposes...)
+}
+
+// PrincipalAuthMiddleware accepts the tokens of users and service accounts.
+// Handlers tell them apart by the subjectType local, and find the account
+// in serviceAccountID instead of userID.
+func PrincipalAuthMiddleware() func(c *fiber.Ctx) error {
+	return authenticate(true)
+}
+
+func authenticate(allowServiceAccounts bool, allowedPurposes ...string) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
 
 		authHeader := c.Get("Authorization")
@@ -27,12 +46,33 @@ func AuthMiddleware() func(c *fiber.Ctx) error {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "unauthorized, invalid token"})
 		}
 
+		if user.SubjectType == pkg.SubjectTypeService {
+			if !allowServiceAccounts {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": "forbidden, service accounts cannot use this endpoint"})
+			}
+
+			c.Locals("subjectType", pkg.SubjectTypeService)
+			c.Locals("serviceAccountID", user.Subject)
+			c.Locals("role", user.RoleID)
+
+			return c.Next()
+		}
+
+		if user.Purpose != "" && !slices.Contains(allowedPurposes, user.Purpose) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": "forbidden, token is restricted to " + user.Purpose})
+		}
+
+		c.Locals("subjectType", pkg.SubjectTypeUser)
 		c.Locals("userID", user.UserID)
 		c.Locals("provider", user.Provider)
 		c.Locals("email", user.Email)
 		c.Locals("role", user.RoleID)
 		c.Locals("sessionID", user.SessionID)
 		c.Locals("mfaCompleted", user.MFACompleted)
+		c.Locals("tokenPurpose", user.Purpose)
+		c.Locals("acr", user.ACR)
+		c.Locals("amr", user.AMR)
+		c.Locals("authentication", user.Authentication())
 
 		return c.Next()
 	}
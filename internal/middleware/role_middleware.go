@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"github.com/gofiber/fiber/v2"
+)
+
+// RoleName resolves the role id carried in a token to the role's name, or
+// to "" when the role no longer exists.
+type RoleName func(roleID uint) (string, error)
+
+// RequireRole must run after AuthMiddleware and only lets through users
+// holding the role called name. The role is looked up on every request, so
+// a renamed or deleted role stops working before its tokens expire.
+func RequireRole(roleName RoleName, name string) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+
+		roleID, _ := c.Locals("role").(uint)
+		held, err := roleName(roleID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "internal server error"})
+		}
+		if name == "" || held != name {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"message": "forbidden, the " + name + " role is required"})
+		}
+
+		return c.Next()
+	}
+}
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/revandpratama/auth4me/config"
+)
+
+// ServiceKeyMiddleware admits internal services presenting one of the keys
+// in SERVICE_API_KEYS through the X-Service-Key header. With no keys
+// configured every request is rejected.
+func ServiceKeyMiddleware() func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+
+		presented := c.Get("X-Service-Key")
+		if presented == "" {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "unauthorized, service key not found"})
+		}
+
+		for _, key := range strings.Split(config.ENV.SERVICE_API_KEYS, ",") {
+			key = strings.TrimSpace(key)
+			if key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(presented)) == 1 {
+				return c.Next()
+			}
+		}
+
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"message": "unauthorized, invalid service key"})
+	}
+}
@@ -0,0 +1,76 @@
+package middleware
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/revandpratama/auth4me/pkg"
+)
+
+// stepUpRequired answers the way RFC 9470 describes, so clients can tell a
+// step-up challenge apart from a plain authorization failure and retry after
+// /auth/mfa/verify with their current token.
+func stepUpRequired(c *fiber.Ctx, message string, maxAge time.Duration) error {
+	challenge := fmt.Sprintf(`Bearer error="insufficient_user_authentication", error_description=%q, acr_values=%q`, message, pkg.ACRMultiFactor)
+	body := fiber.Map{
+		"message":      "forbidden, " + message,
+		"error":        "step_up_required",
+		"required_acr": pkg.ACRMultiFactor,
+	}
+	if maxAge > 0 {
+		challenge += fmt.Sprintf(", max_age=%d", int(maxAge.Seconds()))
+		body["max_age"] = int(maxAge.Seconds())
+	}
+
+	c.Set(fiber.HeaderWWWAuthenticate, challenge)
+	return c.Status(fiber.StatusForbidden).JSON(body)
+}
+
+// RequireMFA must run after AuthMiddleware and only lets through tokens
+// issued after a completed second factor.
+func RequireMFA() func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		if mfaCompleted, _ := c.Locals("mfaCompleted").(bool); !mfaCompleted {
+			return stepUpRequired(c, "a second factor is required", 0)
+		}
+		return c.Next()
+	}
+}
+
+// HasSecondFactor reports whether the user has a second factor enabled.
+type HasSecondFactor func(userID string) (bool, error)
+
+// RequireMFAIfEnrolled must run after AuthMiddleware and acts like
+// RequireMFA for users who already have a second factor, so a stolen
+// password alone cannot change their factors. Users without one pass.
+func RequireMFAIfEnrolled(hasSecondFactor HasSecondFactor) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		if mfaCompleted, _ := c.Locals("mfaCompleted").(bool); mfaCompleted {
+			return c.Next()
+		}
+
+		userID, _ := c.Locals("userID").(string)
+		enrolled, err := hasSecondFactor(userID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"message": "internal server error"})
+		}
+		if enrolled {
+			return stepUpRequired(c, "a second factor is required", 0)
+		}
+		return c.Next()
+	}
+}
+
+// RequireRecentAuth must run after AuthMiddleware and only lets through
+// tokens whose user actively authenticated within maxAge, regardless of how
+// often the token was refreshed since.
+func RequireRecentAuth(maxAge time.Duration) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		authn, _ := c.Locals("authentication").(pkg.Authentication)
+		if authn.Time.IsZero() || time.Since(authn.Time) > maxAge {
+			return stepUpRequired(c, "a recent authentication is required", maxAge)
+		}
+		return c.Next()
+	}
+}
@@ -36,6 +36,7 @@ func main() {
 
 	apps, err := app.NewApp(
 		app.WithDB(),
+		app.WithMigration(),
 		app.WithRESTServer(),
 	)
 	if err != nil {
@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"slices"
+	"time"
+)
+
+// Authentication method references (amr), mostly from RFC 8176.
+const (
+	AMRPassword         = "pwd"
+	AMROTP              = "otp"
+	AMRSMS              = "sms"
+	AMRRecoveryCode     = "rec"
+	AMRHardwareKey      = "hwk"
+	AMRUserVerification = "uv" // PIN or biometric checked by an authenticator, not in RFC 8176
+	AMREmail            = "email"
+	AMRFederated        = "fed"
+	AMRMFA              = "mfa"
+)
+
+// Authentication context class references (acr), following NIST
+// authenticator assurance levels.
+const (
+	ACRSingleFactor = "aal1"
+	ACRMultiFactor  = "aal2"
+)
+
+// Authentication describes how and when the user proved who they are. It is
+// carried into every token issued for the login, including refreshed ones.
+type Authentication struct {
+	Methods      []string
+	Time         time.Time
+	MFACompleted bool
+}
+
+func NewAuthentication(methods ...string) Authentication {
+	return Authentication{
+		Methods: methods,
+		Time:    time.Now(),
+	}
+}
+
+// WithSecondFactor adds a freshly completed second factor, which also
+// resets the authentication time.
+func (a Authentication) WithSecondFactor(methods ...string) Authentication {
+	combined := slices.Clone(a.Methods)
+	for _, method := range append(methods, AMRMFA) {
+		if !slices.Contains(combined, method) {
+			combined = append(combined, method)
+		}
+	}
+
+	return Authentication{
+		Methods:      combined,
+		Time:         time.Now(),
+		MFACompleted: true,
+	}
+}
+
+func (a Authentication) ACR() string {
+	if a.MFACompleted {
+		return ACRMultiFactor
+	}
+	return ACRSingleFactor
+}
@@ -0,0 +1,210 @@
+package pkg
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	AuthorizationRequestTTL = 10 * time.Minute
+	AuthorizationCodeTTL    = time.Minute
+)
+
+// AuthorizationRequest is a validated authorization request from an OAuth
+// client, kept while the user signs in and decides on consent.
+type AuthorizationRequest struct {
+	ClientID      string
+	RedirectURI   string
+	Scopes        []string
+	State         string
+	Nonce         string
+	CodeChallenge string
+	Prompt        string
+	MaxAge        *int // seconds, nil when not requested
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+}
+
+// AuthorizationCode is what an issued code is exchanged for. GrantID ties
+// the code to the refresh tokens issued from it.
+type AuthorizationCode struct {
+	GrantID        string
+	ClientID       string
+	RedirectURI    string
+	UserID         string
+	Scopes         []string
+	Nonce          string
+	CodeChallenge  string
+	Authentication Authentication
+	ExpiresAt      time.Time
+	used           bool
+}
+
+// ClientGrant is what a client refresh token stands for. ExpiresAt is the
+// end of the whole grant, so rotation does not extend it.
+type ClientGrant struct {
+	GrantID        string
+	ClientID       string
+	UserID         string
+	Scopes         []string
+	Authentication Authentication
+	ExpiresAt      time.Time
+	rotated        bool
+}
+
+var authorizationRequestStore = make(map[string]AuthorizationRequest)
+var authorizationCodeStore = make(map[string]AuthorizationCode)
+var clientRefreshTokenStore = make(map[string]ClientGrant)
+var authorizationMu sync.Mutex
+
+// Expired entries are swept on every save, so requests nobody decided on,
+// codes nobody redeemed and abandoned grants do not pile up.
+
+func SaveAuthorizationRequest(id string, data AuthorizationRequest) {
+	authorizationMu.Lock()
+	defer authorizationMu.Unlock()
+	sweepExpired(authorizationRequestStore, func(r AuthorizationRequest) time.Time { return r.ExpiresAt })
+	key := "authorization_request:" + id
+	authorizationRequestStore[key] = data
+}
+
+func GetAuthorizationRequest(id string) (*AuthorizationRequest, bool) {
+	authorizationMu.Lock()
+	defer authorizationMu.Unlock()
+	key := "authorization_request:" + id
+	data, exists := authorizationRequestStore[key]
+	if !exists || time.Now().After(data.ExpiresAt) {
+		return nil, false
+	}
+	return &data, true
+}
+
+// ConsumeAuthorizationRequest removes the request, so only one decision is
+// ever made on it.
+func ConsumeAuthorizationRequest(id string) (*AuthorizationRequest, bool) {
+	authorizationMu.Lock()
+	defer authorizationMu.Unlock()
+	key := "authorization_request:" + id
+	data, exists := authorizationRequestStore[key]
+	if !exists {
+		return nil, false
+	}
+	delete(authorizationRequestStore, key)
+	if time.Now().After(data.ExpiresAt) {
+		return nil, false
+	}
+	return &data, true
+}
+
+func SaveAuthorizationCode(code string, data AuthorizationCode) {
+	authorizationMu.Lock()
+	defer authorizationMu.Unlock()
+	sweepExpired(authorizationCodeStore, func(c AuthorizationCode) time.Time { return c.ExpiresAt })
+	key := "authorization_code:" + HashClientSecret(code)
+	authorizationCodeStore[key] = data
+}
+
+// ConsumeAuthorizationCode redeems a code once. A used code is remembered
+// until it expires; presenting it again revokes every refresh token issued
+// from it, as the code has most likely been stolen.
+func ConsumeAuthorizationCode(code string) (*AuthorizationCode, bool) {
+	authorizationMu.Lock()
+	defer authorizationMu.Unlock()
+	key := "authorization_code:" + HashClientSecret(code)
+	data, exists := authorizationCodeStore[key]
+	if !exists {
+		return nil, false
+	}
+	if time.Now().After(data.ExpiresAt) {
+		delete(authorizationCodeStore, key)
+		return nil, false
+	}
+	if data.used {
+		revokeClientGrant(data.GrantID)
+		return nil, false
+	}
+	data.used = true
+	authorizationCodeStore[key] = data
+	return &data, true
+}
+
+func SaveClientRefreshToken(token string, data ClientGrant) {
+	authorizationMu.Lock()
+	defer authorizationMu.Unlock()
+	sweepExpired(clientRefreshTokenStore, func(g ClientGrant) time.Time { return g.ExpiresAt })
+	key := "client_refresh:" + HashClientSecret(token)
+	clientRefreshTokenStore[key] = data
+}
+
+// RotateClientRefreshToken redeems a refresh token held by clientID. The
+// token stays known as rotated, and presenting it again revokes the grant,
+// so a leaked refresh token is only good until either party uses it.
+func RotateClientRefreshToken(token string, clientID string) (*ClientGrant, bool) {
+	authorizationMu.Lock()
+	defer authorizationMu.Unlock()
+	key := "client_refresh:" + HashClientSecret(token)
+	data, exists := clientRefreshTokenStore[key]
+	if !exists || data.ClientID != clientID {
+		return nil, false
+	}
+	if time.Now().After(data.ExpiresAt) {
+		delete(clientRefreshTokenStore, key)
+		return nil, false
+	}
+	if data.rotated {
+		revokeClientGrant(data.GrantID)
+		return nil, false
+	}
+	data.rotated = true
+	clientRefreshTokenStore[key] = data
+	return &data, true
+}
+
+// RevokeClientGrant drops every refresh token of a grant.
+func RevokeClientGrant(grantID string) {
+	authorizationMu.Lock()
+	defer authorizationMu.Unlock()
+	revokeClientGrant(grantID)
+}
+
+// RevokeClientGrants drops every refresh token held by clientID, for when
+// the client is deleted or its secret is rotated.
+func RevokeClientGrants(clientID string) {
+	authorizationMu.Lock()
+	defer authorizationMu.Unlock()
+	for key, data := range clientRefreshTokenStore {
+		if data.ClientID == clientID {
+			delete(clientRefreshTokenStore, key)
+		}
+	}
+}
+
+// RevokeUserClientGrants drops every refresh token clients hold for userID.
+func RevokeUserClientGrants(userID string) {
+	authorizationMu.Lock()
+	defer authorizationMu.Unlock()
+	for key, data := range clientRefreshTokenStore {
+		if data.UserID == userID {
+			delete(clientRefreshTokenStore, key)
+		}
+	}
+}
+
+func revokeClientGrant(grantID string) {
+	for key, data := range clientRefreshTokenStore {
+		if data.GrantID == grantID {
+			delete(clientRefreshTokenStore, key)
+		}
+	}
+}
+
+// sweepExpired deletes the entries of store past their expiry. Callers hold
+// authorizationMu.
+func sweepExpired[T any](store map[string]T, expiresAt func(T) time.Time) {
+	now := time.Now()
+	for key, data := range store {
+		if now.After(expiresAt(data)) {
+			delete(store, key)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSaveAuthorizationRequestSweepsExpired(t *testing.T) {
+	SaveAuthorizationRequest("sweep-old", AuthorizationRequest{ExpiresAt: time.Now().Add(-time.Second)})
+	SaveAuthorizationRequest("sweep-new", AuthorizationRequest{ExpiresAt: time.Now().Add(time.Minute)})
+	t.Cleanup(func() { ConsumeAuthorizationRequest("sweep-new") })
+
+	authorizationMu.Lock()
+	defer authorizationMu.Unlock()
+	if _, ok := authorizationRequestStore["authorization_request:sweep-old"]; ok {
+		t.Error("expired request survived the next save")
+	}
+	if _, ok := authorizationRequestStore["authorization_request:sweep-new"]; !ok {
+		t.Error("pending request was swept")
+	}
+}
+
+func TestSaveAuthorizationCodeSweepsExpired(t *testing.T) {
+	SaveAuthorizationCode("sweep-code-old", AuthorizationCode{ExpiresAt: time.Now().Add(-time.Second)})
+	SaveAuthorizationCode("sweep-code-new", AuthorizationCode{ExpiresAt: time.Now().Add(time.Minute)})
+
+	authorizationMu.Lock()
+	defer authorizationMu.Unlock()
+	if _, ok := authorizationCodeStore["authorization_code:"+HashClientSecret("sweep-code-old")]; ok {
+		t.Error("expired code survived the next save")
+	}
+	delete(authorizationCodeStore, "authorization_code:"+HashClientSecret("sweep-code-new"))
+}
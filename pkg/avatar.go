@@ -0,0 +1,191 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/revandpratama/auth4me/config"
+)
+
+// AvatarSizes are the square sizes, in pixels, every avatar is stored at.
+// The first one is the default.
+var AvatarSizes = []int{256, 128, 64}
+
+const (
+	AvatarContentType = "image/png"
+	// maxAvatarPixels bounds the decoded image, so a small compressed
+	// upload cannot claim gigabytes of memory.
+	maxAvatarPixels = 4096 * 4096
+)
+
+var (
+	ErrAvatarTooLarge         = errors.New("avatar file is too large")
+	ErrUnsupportedAvatarImage = errors.New("avatar must be a JPEG, PNG or GIF image")
+)
+
+var avatarContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// ProcessAvatar sniffs and decodes an uploaded image, crops it to a centered
+// square and encodes it as PNG at each of AvatarSizes. Re-encoding also
+// drops any metadata the original carried.
+func ProcessAvatar(data []byte) (map[int][]byte, error) {
+
+	if len(data) > config.ENV.AVATAR_MAX_BYTES {
+		return nil, ErrAvatarTooLarge
+	}
+
+	// the declared content type is not trusted, only the bytes
+	if !avatarContentTypes[http.DetectContentType(data)] {
+		return nil, ErrUnsupportedAvatarImage
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedAvatarImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxAvatarPixels {
+		return nil, ErrAvatarTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedAvatarImage
+	}
+
+	square := cropSquare(img)
+
+	out := make(map[int][]byte, len(AvatarSizes))
+	for _, size := range AvatarSizes {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, resizeBox(square, size)); err != nil {
+			return nil, err
+		}
+		out[size] = buf.Bytes()
+	}
+
+	return out, nil
+}
+
+func cropSquare(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	origin := image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2)
+
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), img, origin, draw.Src)
+	return square
+}
+
+// resizeBox scales a square image to size x size, averaging the source
+// pixels each target pixel covers. Upscaling degrades to nearest neighbour.
+func resizeBox(src *image.RGBA, size int) *image.RGBA {
+	side := src.Bounds().Dx()
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+
+	for y := 0; y < size; y++ {
+		y0 := y * side / size
+		y1 := max((y+1)*side/size, y0+1)
+		for x := 0; x < size; x++ {
+			x0 := x * side / size
+			x1 := max((x+1)*side/size, x0+1)
+
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					b += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+
+			i := y*dst.Stride + x*4
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+
+	return dst
+}
+
+var avatarClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: denyInternalAddress,
+		}).DialContext,
+	},
+}
+
+// denyInternalAddress keeps picture URLs, which some providers let users
+// choose, from reaching hosts on the server's own network.
+func denyInternalAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return fmt.Errorf("avatar host %s is not public", host)
+	}
+	return nil
+}
+
+// FetchAvatar downloads a provider picture over HTTPS, reading at most
+// AVATAR_MAX_BYTES.
+func FetchAvatar(ctx context.Context, rawURL string) ([]byte, error) {
+
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" {
+		return nil, fmt.Errorf("avatar url %q is not https", rawURL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := avatarClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch avatar failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch avatar failed: %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(config.ENV.AVATAR_MAX_BYTES)+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetch avatar failed: %w", err)
+	}
+	if len(data) > config.ENV.AVATAR_MAX_BYTES {
+		return nil, ErrAvatarTooLarge
+	}
+
+	return data, nil
+}
@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/revandpratama/auth4me/config"
+)
+
+func setAvatarMaxBytes(t *testing.T, limit int) {
+	t.Helper()
+	saved := config.ENV.AVATAR_MAX_BYTES
+	t.Cleanup(func() { config.ENV.AVATAR_MAX_BYTES = saved })
+	config.ENV.AVATAR_MAX_BYTES = limit
+}
+
+func encodeTestPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 0x80, A: 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// pngHeaderOnly returns a PNG that declares width x height in its IHDR
+// chunk but carries no image data, like a decompression bomb would.
+func pngHeaderOnly(width, height uint32) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 2 // truecolor
+
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	binary.Write(&buf, binary.BigEndian, uint32(len(ihdr)))
+	chunk := append([]byte("IHDR"), ihdr...)
+	buf.Write(chunk)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+	return buf.Bytes()
+}
+
+func TestProcessAvatarSizes(t *testing.T) {
+	setAvatarMaxBytes(t, 2<<20)
+
+	// wider than tall, and smaller than the largest size, so both the
+	// crop and upscaling are exercised
+	out, err := ProcessAvatar(encodeTestPNG(t, 200, 100))
+	if err != nil {
+		t.Fatalf("ProcessAvatar: %v", err)
+	}
+
+	if len(out) != len(AvatarSizes) {
+		t.Fatalf("got %d sizes, want %d", len(out), len(AvatarSizes))
+	}
+	for _, size := range AvatarSizes {
+		img, format, err := image.Decode(bytes.NewReader(out[size]))
+		if err != nil {
+			t.Fatalf("size %d does not decode: %v", size, err)
+		}
+		if format != "png" {
+			t.Errorf("size %d is %s, want png", size, format)
+		}
+		if b := img.Bounds(); b.Dx() != size || b.Dy() != size {
+			t.Errorf("size %d is %dx%d", size, b.Dx(), b.Dy())
+		}
+	}
+}
+
+func TestProcessAvatarRejectsContentTypes(t *testing.T) {
+	setAvatarMaxBytes(t, 2<<20)
+
+	inputs := map[string][]byte{
+		"svg":  []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"></svg>`),
+		"html": []byte("<html><body>hi</body></html>"),
+		"text": []byte("just some text"),
+		"pdf":  []byte("%PDF-1.4\n"),
+	}
+	for name, data := range inputs {
+		if _, err := ProcessAvatar(data); !errors.Is(err, ErrUnsupportedAvatarImage) {
+			t.Errorf("%s: got %v, want ErrUnsupportedAvatarImage", name, err)
+		}
+	}
+
+	// a PNG signature with a broken header is not an image either
+	if _, err := ProcessAvatar([]byte("\x89PNG\r\n\x1a\ngarbage")); !errors.Is(err, ErrUnsupportedAvatarImage) {
+		t.Errorf("truncated png: got %v, want ErrUnsupportedAvatarImage", err)
+	}
+}
+
+func TestProcessAvatarRejectsPixelBombs(t *testing.T) {
+	setAvatarMaxBytes(t, 2<<20)
+
+	bomb := pngHeaderOnly(50000, 50000)
+	if len(bomb) > 100 {
+		t.Fatalf("bomb is %d bytes, it should be tiny", len(bomb))
+	}
+	if _, err := ProcessAvatar(bomb); !errors.Is(err, ErrAvatarTooLarge) {
+		t.Errorf("50000x50000: got %v, want ErrAvatarTooLarge", err)
+	}
+
+	// just over the pixel limit in one dimension
+	if _, err := ProcessAvatar(pngHeaderOnly(4097, 4096)); !errors.Is(err, ErrAvatarTooLarge) {
+		t.Errorf("4097x4096: got %v, want ErrAvatarTooLarge", err)
+	}
+}
+
+func TestProcessAvatarRejectsLargeFiles(t *testing.T) {
+	data := encodeTestPNG(t, 64, 64)
+	setAvatarMaxBytes(t, len(data)-1)
+
+	if _, err := ProcessAvatar(data); !errors.Is(err, ErrAvatarTooLarge) {
+		t.Errorf("got %v, want ErrAvatarTooLarge", err)
+	}
+}
@@ -0,0 +1,256 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/revandpratama/auth4me/config"
+)
+
+// BlobStore keeps public files such as avatars under slash separated keys.
+type BlobStore interface {
+	Put(ctx context.Context, key string, contentType string, data []byte) error
+	// Delete succeeds when the key does not exist.
+	Delete(ctx context.Context, key string) error
+	// URL is where clients fetch the blob from.
+	URL(key string) string
+}
+
+var ErrInvalidBlobKey = errors.New("invalid blob key")
+
+// NewBlobStore picks the store configured in BLOB_STORE. The local store is
+// the default and writes below BLOB_LOCAL_DIR, which the REST server serves
+// under /blobs.
+func NewBlobStore() (BlobStore, error) {
+	switch config.ENV.BLOB_STORE {
+	case "s3":
+		if config.ENV.S3_ENDPOINT == "" || config.ENV.S3_BUCKET == "" {
+			return nil, errors.New("S3_ENDPOINT and S3_BUCKET are required for the s3 blob store")
+		}
+		endpoint, err := url.Parse(strings.TrimSuffix(config.ENV.S3_ENDPOINT, "/"))
+		if err != nil || endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid S3_ENDPOINT %q", config.ENV.S3_ENDPOINT)
+		}
+		return &s3BlobStore{
+			endpoint:  endpoint,
+			region:    config.ENV.S3_REGION,
+			bucket:    config.ENV.S3_BUCKET,
+			accessKey: config.ENV.S3_ACCESS_KEY_ID,
+			secretKey: config.ENV.S3_SECRET_ACCESS_KEY,
+			publicURL: strings.TrimSuffix(config.ENV.BLOB_PUBLIC_URL, "/"),
+			client:    &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	case "", "local":
+		if err := os.MkdirAll(config.ENV.BLOB_LOCAL_DIR, 0o755); err != nil {
+			return nil, fmt.Errorf("create blob dir: %w", err)
+		}
+		return &localBlobStore{
+			dir:       config.ENV.BLOB_LOCAL_DIR,
+			publicURL: strings.TrimSuffix(config.ENV.BLOB_PUBLIC_URL, "/"),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown BLOB_STORE %q", config.ENV.BLOB_STORE)
+	}
+}
+
+type localBlobStore struct {
+	dir       string
+	publicURL string
+}
+
+func (s *localBlobStore) path(key string) (string, error) {
+	if !filepath.IsLocal(filepath.FromSlash(key)) {
+		return "", ErrInvalidBlobKey
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+func (s *localBlobStore) Put(ctx context.Context, key string, contentType string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// write next to the target and rename, so readers never see half a file
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *localBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *localBlobStore) URL(key string) string {
+	return s.publicURL + "/" + key
+}
+
+// s3BlobStore talks to the S3 REST API with path-style addressing, which
+// MinIO and the other S3-compatible servers support as well.
+type s3BlobStore struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	publicURL string
+	client    *http.Client
+}
+
+func (s *s3BlobStore) objectURL(key string) string {
+	return s.endpoint.String() + "/" + s3Escape(s.bucket) + "/" + s3Escape(key)
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, key string, contentType string, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(data))
+	req.Header.Set("Content-Type", contentType)
+	s.sign(req, data)
+
+	return s.do(req, http.StatusOK)
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, s.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	s.sign(req, nil)
+
+	return s.do(req, http.StatusNoContent, http.StatusOK, http.StatusNotFound)
+}
+
+func (s *s3BlobStore) URL(key string) string {
+	if s.publicURL != "" {
+		return s.publicURL + "/" + key
+	}
+	return s.objectURL(key)
+}
+
+func (s *s3BlobStore) do(req *http.Request, okStatus ...int) error {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("s3 %s failed: %w", req.Method, err)
+	}
+	defer resp.Body.Close()
+
+	for _, status := range okStatus {
+		if resp.StatusCode == status {
+			return nil
+		}
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3 %s failed: %s: %s", req.Method, resp.Status, strings.TrimSpace(string(body)))
+}
+
+// sign adds an AWS Signature Version 4 Authorization header.
+func (s *s3BlobStore) sign(req *http.Request, payload []byte) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := sha256.Sum256(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but unreserved characters and the
+// slashes between key segments, as SigV4 canonical URIs require.
+func s3Escape(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
@@ -0,0 +1,253 @@
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/revandpratama/auth4me/config"
+)
+
+const (
+	testS3AccessKey = "AKIDEXAMPLE"
+	testS3SecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testS3Region    = "eu-test-1"
+)
+
+type s3Object struct {
+	contentType string
+	data        []byte
+}
+
+// s3StandIn is a minimal S3 server: it checks the SigV4 signature of every
+// request and keeps objects in memory.
+type s3StandIn struct {
+	mu      sync.Mutex
+	objects map[string]s3Object
+	fail    int // status to answer with instead, when set
+}
+
+func (s *s3StandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	if err := verifySigV4(r, body); err != nil {
+		http.Error(w, "SignatureDoesNotMatch: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail != 0 {
+		http.Error(w, "InternalError", s.fail)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		s.objects[r.URL.Path] = s3Object{contentType: r.Header.Get("Content-Type"), data: body}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		if _, ok := s.objects[r.URL.Path]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(s.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// verifySigV4 recomputes the signature from the request as the server
+// received it.
+func verifySigV4(r *http.Request, body []byte) error {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return errors.New("missing authorization")
+	}
+	fields := map[string]string{}
+	for _, part := range strings.Split(auth, ", ") {
+		name, value, _ := strings.Cut(part, "=")
+		fields[name] = value
+	}
+
+	credential := strings.SplitN(fields["Credential"], "/", 2)
+	if len(credential) != 2 || credential[0] != testS3AccessKey {
+		return errors.New("unknown access key")
+	}
+	scope := credential[1]
+	date, _, _ := strings.Cut(scope, "/")
+	if scope != date+"/"+testS3Region+"/s3/aws4_request" {
+		return fmt.Errorf("unexpected scope %q", scope)
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	signedAt, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || time.Since(signedAt).Abs() > 15*time.Minute {
+		return errors.New("bad x-amz-date")
+	}
+
+	payloadHash := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(payloadHash[:]) {
+		return errors.New("payload hash mismatch")
+	}
+
+	names := strings.Split(fields["SignedHeaders"], ";")
+	if !sort.StringsAreSorted(names) {
+		return errors.New("signed headers are not sorted")
+	}
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		r.URL.RawQuery,
+		canonicalHeaders.String(),
+		fields["SignedHeaders"],
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+testS3SecretKey), date)
+	key = hmacSHA256(key, testS3Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	if hex.EncodeToString(hmacSHA256(key, stringToSign)) != fields["Signature"] {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+func newTestS3Store(t *testing.T, secretKey string) (*s3BlobStore, *s3StandIn) {
+	t.Helper()
+
+	standIn := &s3StandIn{objects: map[string]s3Object{}}
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+
+	endpoint, _ := url.Parse(server.URL)
+	return &s3BlobStore{
+		endpoint:  endpoint,
+		region:    testS3Region,
+		bucket:    "avatars",
+		accessKey: testS3AccessKey,
+		secretKey: secretKey,
+		client:    server.Client(),
+	}, standIn
+}
+
+func TestS3BlobStorePutAndDelete(t *testing.T) {
+	store, standIn := newTestS3Store(t, testS3SecretKey)
+	ctx := context.Background()
+
+	if err := store.Put(ctx, "users/42/256.png", "image/png", []byte("png bytes")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	object, ok := standIn.objects["/avatars/users/42/256.png"]
+	if !ok {
+		t.Fatalf("object not stored, have %v", standIn.objects)
+	}
+	if object.contentType != "image/png" || string(object.data) != "png bytes" {
+		t.Errorf("stored %q %q", object.contentType, object.data)
+	}
+
+	if err := store.Delete(ctx, "users/42/256.png"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if len(standIn.objects) != 0 {
+		t.Errorf("object still stored after Delete")
+	}
+
+	// deleting what is already gone succeeds
+	if err := store.Delete(ctx, "users/42/256.png"); err != nil {
+		t.Errorf("Delete of a missing key: %v", err)
+	}
+}
+
+func TestS3BlobStoreEscapesKeys(t *testing.T) {
+	store, standIn := newTestS3Store(t, testS3SecretKey)
+
+	if err := store.Put(context.Background(), "users/a b+c/ü.png", "image/png", []byte("x")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if _, ok := standIn.objects["/avatars/users/a b+c/ü.png"]; !ok {
+		t.Errorf("object not stored under the unescaped key, have %v", standIn.objects)
+	}
+}
+
+func TestS3BlobStoreReportsErrors(t *testing.T) {
+	store, _ := newTestS3Store(t, "not the secret")
+	if err := store.Put(context.Background(), "k.png", "image/png", []byte("x")); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Put with a wrong secret: got %v, want a 403 error", err)
+	}
+
+	store, standIn := newTestS3Store(t, testS3SecretKey)
+	standIn.fail = http.StatusServiceUnavailable
+	if err := store.Delete(context.Background(), "k.png"); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Delete on a failing server: got %v, want a 503 error", err)
+	}
+}
+
+func TestS3BlobStoreURL(t *testing.T) {
+	store, _ := newTestS3Store(t, testS3SecretKey)
+
+	if got, want := store.URL("users/a b.png"), store.endpoint.String()+"/avatars/users/a%20b.png"; got != want {
+		t.Errorf("URL without a public URL = %q, want %q", got, want)
+	}
+
+	store.publicURL = "https://cdn.example.com/avatars"
+	if got, want := store.URL("users/1.png"), "https://cdn.example.com/avatars/users/1.png"; got != want {
+		t.Errorf("URL with a public URL = %q, want %q", got, want)
+	}
+}
+
+func TestNewBlobStoreS3RequiresEndpointAndBucket(t *testing.T) {
+	saved := config.ENV
+	t.Cleanup(func() { config.ENV = saved })
+
+	config.ENV.BLOB_STORE = "s3"
+	config.ENV.S3_ENDPOINT = "http://localhost:9000"
+	config.ENV.S3_BUCKET = ""
+	if _, err := NewBlobStore(); err == nil {
+		t.Error("NewBlobStore without a bucket succeeded")
+	}
+
+	config.ENV.S3_BUCKET = "avatars"
+	store, err := NewBlobStore()
+	if err != nil {
+		t.Fatalf("NewBlobStore: %v", err)
+	}
+	if _, ok := store.(*s3BlobStore); !ok {
+		t.Errorf("NewBlobStore returned %T, want *s3BlobStore", store)
+	}
+}
+
+func TestLocalBlobStoreRejectsEscapingKeys(t *testing.T) {
+	store := &localBlobStore{dir: t.TempDir()}
+
+	for _, key := range []string{"../outside.png", "/etc/passwd", "a/../../b"} {
+		if err := store.Put(context.Background(), key, "image/png", []byte("x")); !errors.Is(err, ErrInvalidBlobKey) {
+			t.Errorf("Put(%q) = %v, want ErrInvalidBlobKey", key, err)
+		}
+	}
+}
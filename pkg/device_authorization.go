@@ -0,0 +1,174 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DeviceCodeTTL = 10 * time.Minute
+	// DevicePollInterval is the minimum wait between token polls, raised by
+	// deviceSlowDownStep every time a device polls too fast (RFC 8628 3.5).
+	DevicePollInterval = 5 * time.Second
+	deviceSlowDownStep = 5 * time.Second
+)
+
+// User codes avoid vowels, so no words can be spelled, and characters that
+// are easy to confuse on a TV screen.
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+var (
+	ErrDeviceAuthorizationPending = errors.New("authorization pending")
+	ErrDeviceSlowDown             = errors.New("polling too fast")
+	ErrDeviceAccessDenied         = errors.New("user denied the device")
+	ErrDeviceCodeExpired          = errors.New("device code expired")
+	ErrDeviceCodeInvalid          = errors.New("device code invalid")
+)
+
+// DeviceAuthorization is a device login waiting for a signed in user to
+// approve its user code.
+type DeviceAuthorization struct {
+	ClientID       string
+	Scopes         []string
+	UserCode       string
+	Approved       bool
+	Denied         bool
+	UserID         string
+	Authentication Authentication
+	Interval       time.Duration
+	LastPolledAt   time.Time
+	ExpiresAt      time.Time
+}
+
+var deviceAuthorizationStore = make(map[string]*DeviceAuthorization)
+var deviceUserCodes = make(map[string]string) // user code -> store key
+var deviceMu sync.Mutex
+
+// GenerateUserCode returns a code formatted as XXXX-XXXX.
+func GenerateUserCode() (string, error) {
+	b := make([]byte, 8)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(b[:4]) + "-" + string(b[4:]), nil
+}
+
+// NormalizeUserCode accepts user codes typed in lower case, with or without
+// the dash and spaces.
+func NormalizeUserCode(userCode string) string {
+	userCode = strings.ToUpper(userCode)
+	userCode = strings.ReplaceAll(userCode, "-", "")
+	return strings.ReplaceAll(userCode, " ", "")
+}
+
+// SaveDeviceAuthorization reports false when the user code is already in
+// use, so the caller can draw another one.
+func SaveDeviceAuthorization(deviceCode string, data DeviceAuthorization) bool {
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+
+	// expired device codes are swept here, devices that give up polling
+	// would otherwise stay forever
+	now := time.Now()
+	for userCode, key := range deviceUserCodes {
+		if existing := deviceAuthorizationStore[key]; existing == nil || now.After(existing.ExpiresAt) {
+			delete(deviceAuthorizationStore, key)
+			delete(deviceUserCodes, userCode)
+		}
+	}
+
+	userCode := NormalizeUserCode(data.UserCode)
+	if _, exists := deviceUserCodes[userCode]; exists {
+		return false
+	}
+
+	key := "device_code:" + HashClientSecret(deviceCode)
+	deviceAuthorizationStore[key] = &data
+	deviceUserCodes[userCode] = key
+	return true
+}
+
+// GetDeviceAuthorization looks up a pending authorization by user code.
+func GetDeviceAuthorization(userCode string) (*DeviceAuthorization, bool) {
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+
+	data := deviceAuthorizationStore[deviceUserCodes[NormalizeUserCode(userCode)]]
+	if data == nil || data.Approved || data.Denied || time.Now().After(data.ExpiresAt) {
+		return nil, false
+	}
+	copied := *data
+	return &copied, true
+}
+
+// DecideDeviceAuthorization records the decision of userID on a pending
+// user code. A code can only be decided once.
+func DecideDeviceAuthorization(userCode string, userID string, authn Authentication, approve bool) bool {
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+
+	data := deviceAuthorizationStore[deviceUserCodes[NormalizeUserCode(userCode)]]
+	if data == nil || data.Approved || data.Denied || time.Now().After(data.ExpiresAt) {
+		return false
+	}
+
+	if approve {
+		data.Approved = true
+		data.UserID = userID
+		data.Authentication = authn
+	} else {
+		data.Denied = true
+	}
+	return true
+}
+
+// PollDeviceAuthorization answers a token poll from clientID. It returns the
+// approved authorization once, and otherwise one of the Err values telling
+// the device how to go on.
+func PollDeviceAuthorization(deviceCode string, clientID string) (*DeviceAuthorization, error) {
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+
+	key := "device_code:" + HashClientSecret(deviceCode)
+	data := deviceAuthorizationStore[key]
+	if data == nil || data.ClientID != clientID {
+		return nil, ErrDeviceCodeInvalid
+	}
+
+	now := time.Now()
+	if now.After(data.ExpiresAt) {
+		deleteDeviceAuthorization(key, data)
+		return nil, ErrDeviceCodeExpired
+	}
+
+	if !data.LastPolledAt.IsZero() && now.Sub(data.LastPolledAt) < data.Interval {
+		data.Interval += deviceSlowDownStep
+		data.LastPolledAt = now
+		return nil, ErrDeviceSlowDown
+	}
+	data.LastPolledAt = now
+
+	switch {
+	case data.Denied:
+		deleteDeviceAuthorization(key, data)
+		return nil, ErrDeviceAccessDenied
+	case data.Approved:
+		deleteDeviceAuthorization(key, data)
+		return data, nil
+	default:
+		return nil, ErrDeviceAuthorizationPending
+	}
+}
+
+func deleteDeviceAuthorization(key string, data *DeviceAuthorization) {
+	delete(deviceAuthorizationStore, key)
+	delete(deviceUserCodes, NormalizeUserCode(data.UserCode))
+}
@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func saveTestDeviceAuthorization(t *testing.T, deviceCode string, userCode string) {
+	t.Helper()
+	if !SaveDeviceAuthorization(deviceCode, DeviceAuthorization{
+		ClientID:  "tv",
+		UserCode:  userCode,
+		Interval:  DevicePollInterval,
+		ExpiresAt: time.Now().Add(DeviceCodeTTL),
+	}) {
+		t.Fatalf("user code %s already in use", userCode)
+	}
+}
+
+// waitPollInterval moves the last poll back, as if the device had waited
+// for its interval.
+func waitPollInterval(deviceCode string) {
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+	data := deviceAuthorizationStore["device_code:"+HashClientSecret(deviceCode)]
+	data.LastPolledAt = data.LastPolledAt.Add(-data.Interval)
+}
+
+func TestPollDeviceAuthorizationSequence(t *testing.T) {
+	saveTestDeviceAuthorization(t, "poll-device", "BCDF-GHJK")
+
+	if _, err := PollDeviceAuthorization("poll-device", "other-client"); !errors.Is(err, ErrDeviceCodeInvalid) {
+		t.Fatalf("other client: got %v, want ErrDeviceCodeInvalid", err)
+	}
+	if _, err := PollDeviceAuthorization("poll-device", "tv"); !errors.Is(err, ErrDeviceAuthorizationPending) {
+		t.Fatalf("first poll: got %v, want ErrDeviceAuthorizationPending", err)
+	}
+
+	// polling again at once slows the device down, and keeps doing so
+	// until it waits for the raised interval
+	if _, err := PollDeviceAuthorization("poll-device", "tv"); !errors.Is(err, ErrDeviceSlowDown) {
+		t.Fatalf("fast poll: got %v, want ErrDeviceSlowDown", err)
+	}
+	if _, err := PollDeviceAuthorization("poll-device", "tv"); !errors.Is(err, ErrDeviceSlowDown) {
+		t.Fatalf("second fast poll: got %v, want ErrDeviceSlowDown", err)
+	}
+	deviceMu.Lock()
+	interval := deviceAuthorizationStore["device_code:"+HashClientSecret("poll-device")].Interval
+	deviceMu.Unlock()
+	if want := DevicePollInterval + 2*deviceSlowDownStep; interval != want {
+		t.Errorf("interval = %v, want %v", interval, want)
+	}
+
+	waitPollInterval("poll-device")
+	if _, err := PollDeviceAuthorization("poll-device", "tv"); !errors.Is(err, ErrDeviceAuthorizationPending) {
+		t.Fatalf("poll after waiting: got %v, want ErrDeviceAuthorizationPending", err)
+	}
+
+	if !DecideDeviceAuthorization("bcdf ghjk", "user-1", Authentication{Time: time.Now()}, true) {
+		t.Fatal("approving the user code failed")
+	}
+	if DecideDeviceAuthorization("BCDF-GHJK", "user-2", Authentication{}, true) {
+		t.Error("a user code was decided twice")
+	}
+
+	waitPollInterval("poll-device")
+	data, err := PollDeviceAuthorization("poll-device", "tv")
+	if err != nil || data.UserID != "user-1" {
+		t.Fatalf("poll after approval: got %+v, %v", data, err)
+	}
+	if _, err := PollDeviceAuthorization("poll-device", "tv"); !errors.Is(err, ErrDeviceCodeInvalid) {
+		t.Errorf("approval returned twice: got %v, want ErrDeviceCodeInvalid", err)
+	}
+}
+
+func TestPollDeviceAuthorizationDenied(t *testing.T) {
+	saveTestDeviceAuthorization(t, "deny-device", "LMNP-QRST")
+
+	if !DecideDeviceAuthorization("LMNP-QRST", "user-1", Authentication{}, false) {
+		t.Fatal("denying the user code failed")
+	}
+	if _, err := PollDeviceAuthorization("deny-device", "tv"); !errors.Is(err, ErrDeviceAccessDenied) {
+		t.Errorf("got %v, want ErrDeviceAccessDenied", err)
+	}
+}
+
+func TestSaveDeviceAuthorizationUserCodes(t *testing.T) {
+	saveTestDeviceAuthorization(t, "taken-device", "VWXZ-BCDF")
+	t.Cleanup(func() { DecideDeviceAuthorization("VWXZ-BCDF", "", Authentication{}, false) })
+
+	if SaveDeviceAuthorization("other-device", DeviceAuthorization{UserCode: "vwxz bcdf", ExpiresAt: time.Now().Add(DeviceCodeTTL)}) {
+		t.Error("a pending user code was handed out twice")
+	}
+
+	// an expired authorization is swept by the next save and frees its code
+	SaveDeviceAuthorization("expired-device", DeviceAuthorization{UserCode: "GHJK-LMNP", ExpiresAt: time.Now().Add(-time.Second)})
+	saveTestDeviceAuthorization(t, "fresh-device", "GHJK-LMNP")
+	t.Cleanup(func() { DecideDeviceAuthorization("GHJK-LMNP", "", Authentication{}, false) })
+
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+	if _, ok := deviceAuthorizationStore["device_code:"+HashClientSecret("expired-device")]; ok {
+		t.Error("expired authorization survived the next save")
+	}
+}
@@ -0,0 +1,196 @@
+package pkg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/revandpratama/auth4me/config"
+)
+
+// Encrypted fields are stored as enc:v1:<key id>:<wrapped data key>:<data>.
+// Every value gets its own AES-256-GCM data key, wrapped by the master key
+// named in the value, so rotating the master key only rewraps data keys.
+const encryptedFieldPrefix = "enc:v1:"
+
+var (
+	ErrUnknownEncryptionKey = errors.New("unknown encryption key id")
+	ErrMalformedCiphertext  = errors.New("malformed encrypted field")
+)
+
+type masterKeys struct {
+	activeID string
+	keys     map[string][]byte
+}
+
+var loadMasterKeys = sync.OnceValues(func() (*masterKeys, error) {
+
+	mk := &masterKeys{
+		activeID: config.ENV.ENCRYPTION_ACTIVE_KEY_ID,
+		keys:     map[string][]byte{},
+	}
+	if config.ENV.ENCRYPTION_KEYS == "" {
+		return mk, nil
+	}
+
+	for entry := range strings.SplitSeq(config.ENV.ENCRYPTION_KEYS, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid ENCRYPTION_KEYS entry %q", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %q must be 32 bytes of base64", id)
+		}
+		mk.keys[id] = key
+	}
+
+	if _, ok := mk.keys[mk.activeID]; !ok {
+		return nil, fmt.Errorf("ENCRYPTION_ACTIVE_KEY_ID %q is not in ENCRYPTION_KEYS", mk.activeID)
+	}
+
+	return mk, nil
+})
+
+// EncryptField encrypts a column value with a fresh data key. Without any
+// configured master key values are stored as they are.
+func EncryptField(plaintext string) (string, error) {
+
+	if plaintext == "" {
+		return "", nil
+	}
+
+	mk, err := loadMasterKeys()
+	if err != nil {
+		return "", err
+	}
+	if len(mk.keys) == 0 {
+		return plaintext, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	wrappedKey, err := seal(mk.keys[mk.activeID], dataKey, []byte(mk.activeID))
+	if err != nil {
+		return "", err
+	}
+
+	data, err := seal(dataKey, []byte(plaintext), nil)
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedFieldPrefix + mk.activeID + ":" +
+		base64.RawStdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(data), nil
+}
+
+// DecryptField reverses EncryptField. Values written before encryption was
+// enabled are returned unchanged.
+func DecryptField(value string) (string, error) {
+
+	if !strings.HasPrefix(value, encryptedFieldPrefix) {
+		return value, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, encryptedFieldPrefix), ":")
+	if len(parts) != 3 {
+		return "", ErrMalformedCiphertext
+	}
+	keyID := parts[0]
+
+	mk, err := loadMasterKeys()
+	if err != nil {
+		return "", err
+	}
+	masterKey, ok := mk.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrUnknownEncryptionKey, keyID)
+	}
+
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrMalformedCiphertext
+	}
+	data, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrMalformedCiphertext
+	}
+
+	dataKey, err := open(masterKey, wrappedKey, []byte(keyID))
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(dataKey, data, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// NeedsReencryption reports whether a stored value is still plaintext or
+// wrapped by a key other than the active one.
+func NeedsReencryption(value string) bool {
+
+	if value == "" {
+		return false
+	}
+
+	mk, err := loadMasterKeys()
+	if err != nil || len(mk.keys) == 0 {
+		return false
+	}
+
+	if !strings.HasPrefix(value, encryptedFieldPrefix) {
+		return true
+	}
+
+	keyID, _, _ := strings.Cut(strings.TrimPrefix(value, encryptedFieldPrefix), ":")
+	return keyID != mk.activeID
+}
+
+func seal(key []byte, plaintext []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(key []byte, sealed []byte, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, ErrMalformedCiphertext
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
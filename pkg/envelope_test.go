@@ -0,0 +1,137 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// useTestMasterKeys replaces the configured master keys for one test.
+func useTestMasterKeys(t *testing.T, activeID string, keys map[string][]byte) {
+	t.Helper()
+	saved := loadMasterKeys
+	t.Cleanup(func() { loadMasterKeys = saved })
+	loadMasterKeys = func() (*masterKeys, error) {
+		return &masterKeys{activeID: activeID, keys: keys}, nil
+	}
+}
+
+var (
+	testMasterKeyA = bytes.Repeat([]byte{0xa1}, 32)
+	testMasterKeyB = bytes.Repeat([]byte{0xb2}, 32)
+)
+
+func TestEncryptFieldRoundTrip(t *testing.T) {
+	useTestMasterKeys(t, "a", map[string][]byte{"a": testMasterKeyA})
+
+	first, err := EncryptField("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatalf("EncryptField: %v", err)
+	}
+	if !strings.HasPrefix(first, "enc:v1:a:") || strings.Contains(first, "JBSWY3DPEHPK3PXP") {
+		t.Fatalf("unexpected ciphertext %q", first)
+	}
+
+	// every value has its own data key and nonce
+	second, _ := EncryptField("JBSWY3DPEHPK3PXP")
+	if first == second {
+		t.Error("same plaintext encrypted twice to the same value")
+	}
+
+	for _, value := range []string{first, second} {
+		if plaintext, err := DecryptField(value); err != nil || plaintext != "JBSWY3DPEHPK3PXP" {
+			t.Errorf("DecryptField: %q, %v", plaintext, err)
+		}
+	}
+
+	if empty, err := EncryptField(""); err != nil || empty != "" {
+		t.Errorf("empty value encrypted to %q, %v", empty, err)
+	}
+}
+
+func TestEncryptFieldWithoutKeys(t *testing.T) {
+	useTestMasterKeys(t, "", map[string][]byte{})
+
+	stored, err := EncryptField("secret")
+	if err != nil || stored != "secret" {
+		t.Errorf("got %q, %v, want the value unchanged", stored, err)
+	}
+	if NeedsReencryption("secret") {
+		t.Error("plaintext flagged for re-encryption without any key")
+	}
+}
+
+func TestEncryptFieldKeyRotation(t *testing.T) {
+	useTestMasterKeys(t, "a", map[string][]byte{"a": testMasterKeyA})
+	underA, err := EncryptField("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if NeedsReencryption(underA) {
+		t.Error("value under the active key flagged for re-encryption")
+	}
+	if !NeedsReencryption("legacy plaintext") {
+		t.Error("plaintext not flagged for re-encryption")
+	}
+
+	// b becomes active, a stays to read older values
+	useTestMasterKeys(t, "b", map[string][]byte{"a": testMasterKeyA, "b": testMasterKeyB})
+	if !NeedsReencryption(underA) {
+		t.Error("value under the retired key not flagged for re-encryption")
+	}
+	plaintext, err := DecryptField(underA)
+	if err != nil || plaintext != "token" {
+		t.Fatalf("reading under the retired key: %q, %v", plaintext, err)
+	}
+	underB, err := EncryptField(plaintext)
+	if err != nil || !strings.HasPrefix(underB, "enc:v1:b:") || NeedsReencryption(underB) {
+		t.Fatalf("re-encrypted to %q, %v", underB, err)
+	}
+
+	// once a is removed, only values re-encrypted under b can be read
+	useTestMasterKeys(t, "b", map[string][]byte{"b": testMasterKeyB})
+	if _, err := DecryptField(underA); !errors.Is(err, ErrUnknownEncryptionKey) {
+		t.Errorf("value under a removed key: got %v, want ErrUnknownEncryptionKey", err)
+	}
+	if plaintext, err := DecryptField(underB); err != nil || plaintext != "token" {
+		t.Errorf("DecryptField: %q, %v", plaintext, err)
+	}
+}
+
+func TestDecryptFieldRejectsTampering(t *testing.T) {
+	useTestMasterKeys(t, "a", map[string][]byte{"a": testMasterKeyA, "b": testMasterKeyA})
+
+	value, err := EncryptField("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(strings.TrimPrefix(value, encryptedFieldPrefix), ":")
+
+	flip := func(encoded string) string {
+		b := []byte(encoded)
+		if b[len(b)/2] == 'A' {
+			b[len(b)/2] = 'B'
+		} else {
+			b[len(b)/2] = 'A'
+		}
+		return string(b)
+	}
+
+	cases := map[string]string{
+		// same key bytes under another id: the id is bound to the wrapped key
+		"key id swapped":      encryptedFieldPrefix + "b:" + parts[1] + ":" + parts[2],
+		"wrapped key changed": encryptedFieldPrefix + "a:" + flip(parts[1]) + ":" + parts[2],
+		"data changed":        encryptedFieldPrefix + "a:" + parts[1] + ":" + flip(parts[2]),
+		"part missing":        encryptedFieldPrefix + "a:" + parts[1],
+		"not base64":          encryptedFieldPrefix + "a:" + parts[1] + ":%%%",
+		"truncated":           encryptedFieldPrefix + "a:" + parts[1] + ":AAAA",
+	}
+	for name, tampered := range cases {
+		t.Run(name, func(t *testing.T) {
+			if plaintext, err := DecryptField(tampered); err == nil {
+				t.Errorf("tampered value decrypted to %q", plaintext)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package pkg
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrInvalidIDToken = errors.New("invalid id token")
+
+// IDTokenClaims holds the OpenID Connect claims auth4me reads from an ID
+// token.
+type IDTokenClaims struct {
+	Nonce           string    `json:"nonce"`
+	AuthorizedParty string    `json:"azp"`
+	Email           string    `json:"email"`
+	EmailVerified   claimBool `json:"email_verified"`
+	Name            string    `json:"name"`
+	Picture         string    `json:"picture"`
+	TenantID        string    `json:"tid"` // Microsoft only
+	jwt.RegisteredClaims
+
+	// Raw has every claim of the token, for role mapping rules.
+	Raw map[string]any `json:"-"`
+}
+
+// claimBool also accepts "true" and "false" strings, which some providers
+// send for email_verified.
+type claimBool bool
+
+func (b *claimBool) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case bool:
+		*b = claimBool(v)
+	case string:
+		*b = claimBool(strings.EqualFold(v, "true"))
+	}
+	return nil
+}
+
+var idTokenSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// VerifyIDToken checks the signature of an ID token against the provider's
+// JWKS and validates iss, aud, azp, exp and the nonce sent with the
+// authorization request.
+func (p *OAuthProvider) VerifyIDToken(ctx context.Context, rawIDToken string, nonce string) (*IDTokenClaims, error) {
+
+	claims := &IDTokenClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return JWKSKey(ctx, p.JWKSURL, kid)
+	},
+		jwt.WithValidMethods(idTokenSigningMethods),
+		jwt.WithAudience(p.Config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+
+	// multi-tenant Microsoft apps get a per tenant issuer
+	issuer := strings.ReplaceAll(p.Issuer, "{tenantid}", claims.TenantID)
+	if claims.Issuer != issuer && !slices.Contains(p.issuerAliases, claims.Issuer) {
+		return nil, fmt.Errorf("%w: unexpected issuer %s", ErrInvalidIDToken, claims.Issuer)
+	}
+
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.Config.ClientID {
+		return nil, fmt.Errorf("%w: unexpected authorized party %s", ErrInvalidIDToken, claims.AuthorizedParty)
+	}
+	if claims.AuthorizedParty != "" && !slices.Contains(claims.Audience, claims.AuthorizedParty) {
+		return nil, fmt.Errorf("%w: authorized party is not an audience", ErrInvalidIDToken)
+	}
+
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing sub", ErrInvalidIDToken)
+	}
+
+	// the signature was verified above
+	raw := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(rawIDToken, raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	claims.Raw = raw
+
+	return claims, nil
+}
@@ -0,0 +1,156 @@
+package pkg
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	jwksCacheTTL = time.Hour
+	// an unknown key id triggers a refetch at most this often, so tokens
+	// with made up key ids cannot hammer the provider
+	jwksMinRefreshInterval = time.Minute
+)
+
+var ErrJWKNotFound = errors.New("signing key not found in jwks")
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type cachedJWKS struct {
+	keys      map[string]any
+	fetchedAt time.Time
+}
+
+var jwksStore = make(map[string]*cachedJWKS)
+var jwksMu sync.Mutex
+
+// JWKSKey returns the public key with kid from the key set at jwksURL,
+// fetching the set when it is not cached, stale or missing the key.
+func JWKSKey(ctx context.Context, jwksURL string, kid string) (any, error) {
+	jwksMu.Lock()
+	defer jwksMu.Unlock()
+
+	cached, exists := jwksStore[jwksURL]
+	if exists && time.Since(cached.fetchedAt) < jwksCacheTTL {
+		if key, ok := lookupJWK(cached.keys, kid); ok {
+			return key, nil
+		}
+		if time.Since(cached.fetchedAt) < jwksMinRefreshInterval {
+			return nil, ErrJWKNotFound
+		}
+	}
+
+	keys, err := fetchJWKS(ctx, jwksURL)
+	if err != nil {
+		return nil, err
+	}
+	jwksStore[jwksURL] = &cachedJWKS{keys: keys, fetchedAt: time.Now()}
+
+	key, ok := lookupJWK(keys, kid)
+	if !ok {
+		return nil, ErrJWKNotFound
+	}
+	return key, nil
+}
+
+// lookupJWK accepts a token without kid only when the set has a single key.
+func lookupJWK(keys map[string]any, kid string) (any, bool) {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, true
+		}
+	}
+	key, ok := keys[kid]
+	return key, ok
+}
+
+func fetchJWKS(ctx context.Context, jwksURL string) (map[string]any, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ctx, http.DefaultClient, jwksURL, &set); err != nil {
+		return nil, fmt.Errorf("fetch jwks failed: %w", err)
+	}
+
+	keys := make(map[string]any, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// keys of types we do not verify with are skipped
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeJWKInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeJWKInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
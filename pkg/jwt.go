@@ -18,10 +18,45 @@ type CustomClaims struct {
 	Provider     string              `json:"provider,omitempty"` // Optional if OAuth
 	SessionID    string              `json:"sid,omitempty"`      // Optional, for token tracking
 	MFACompleted bool                `json:"mfa,omitempty"`
+	Purpose      string              `json:"purpose,omitempty"`  // Set on restricted tokens only
+	ACR          string              `json:"acr,omitempty"`
+	AMR          []string            `json:"amr,omitempty"`
+	AuthTime     *jwt.NumericDate    `json:"auth_time,omitempty"`
+	SubjectType  string              `json:"sub_type,omitempty"` // empty on tokens issued to users
 	jwt.RegisteredClaims
 }
 
-func GenerateToken(user *entity.User, provider string, mfaCompleted bool) (string, error) {
+// Authentication restores the authentication context the token was issued
+// for, so it can be carried into a refreshed or upgraded token.
+func (c *CustomClaims) Authentication() Authentication {
+	authn := Authentication{
+		Methods:      c.AMR,
+		MFACompleted: c.MFACompleted,
+	}
+	if c.AuthTime != nil {
+		authn.Time = c.AuthTime.Time
+	}
+	return authn
+}
+
+const (
+	// PurposePasswordChange marks a token that may only be used to set a new
+	// password, issued when a password has expired or a change was forced.
+	PurposePasswordChange = "password_change"
+	// PurposeMFA marks a token issued after the first factor that may only
+	// be exchanged for a full token pair by completing the second factor.
+	PurposeMFA = "mfa"
+)
+
+// Subject types of access tokens. User tokens leave sub_type empty; service
+// account tokens carry the account id as sub and no user, session or
+// authentication context.
+const (
+	SubjectTypeUser    = "user"
+	SubjectTypeService = "service"
+)
+
+func GenerateToken(user *entity.User, provider string, authn Authentication) (string, error) {
 
 	expirationSecond, err := strconv.Atoi(config.ENV.JWT_EXPIRATION_SECOND)
 	if err != nil || expirationSecond == 0 {
@@ -34,8 +69,11 @@ func GenerateToken(user *entity.User, provider string, mfaCompleted bool) (strin
 		Email:        user.Email,
 		RoleID:       user.RoleID,
 		UserID:       user.ID,
-		MFACompleted: mfaCompleted,
+		MFACompleted: authn.MFACompleted,
 		Provider:     provider,
+		ACR:          authn.ACR(),
+		AMR:          authn.Methods,
+		AuthTime:     jwt.NewNumericDate(authn.Time),
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -55,6 +93,58 @@ func GenerateToken(user *entity.User, provider string, mfaCompleted bool) (strin
 	return tokenString, nil
 }
 
+// GenerateRestrictedToken issues a short-lived token that only endpoints
+// accepting the given purpose will honor. It records the factors passed so
+// far, so the step it unlocks can build on them.
+func GenerateRestrictedToken(user *entity.User, provider string, purpose string, ttl time.Duration, authn Authentication) (string, error) {
+
+	claims := &CustomClaims{
+		Email:    user.Email,
+		RoleID:   user.RoleID,
+		UserID:   user.ID,
+		Provider: provider,
+		Purpose:  purpose,
+		AMR:      authn.Methods,
+		AuthTime: jwt.NewNumericDate(authn.Time),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			NotBefore: jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	tokenString, err := token.SignedString([]byte(config.ENV.JWT_SECRET))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Bearer %s", tokenString), nil
+}
+
+// GenerateServiceToken issues an access token to a service account through
+// the client_credentials grant. It has no refresh token; the account asks
+// for a new one with its credentials instead.
+func GenerateServiceToken(account *entity.ServiceAccount, ttl time.Duration) (string, error) {
+
+	now := time.Now()
+	claims := &CustomClaims{
+		RoleID:      account.RoleID,
+		SubjectType: SubjectTypeService,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   account.ID,
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	return token.SignedString([]byte(config.ENV.JWT_SECRET))
+}
+
 func ValidateToken(tokenString string) (*CustomClaims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(t *jwt.Token) (any, error) {
 		return []byte(config.ENV.JWT_SECRET), nil
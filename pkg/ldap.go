@@ -0,0 +1,661 @@
+package pkg
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/revandpratama/auth4me/config"
+	"github.com/rs/zerolog/log"
+)
+
+// A small LDAP v3 client: simple bind, subtree search and StartTLS, which
+// is all a bind-based authenticator needs.
+
+var (
+	ErrLDAPInvalidCredentials = errors.New("invalid ldap credentials")
+	ErrLDAPProtocol           = errors.New("ldap protocol error")
+	// ErrLDAPEmailMismatch means the entry found for the login email holds
+	// a different address, as filters matching userPrincipalName allow.
+	ErrLDAPEmailMismatch = errors.New("directory email does not match the login email")
+)
+
+const (
+	ldapResultSuccess            = 0
+	ldapResultSizeLimitExceeded  = 4
+	ldapResultInvalidCredentials = 49
+
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+	// maxLDAPMessageSize bounds a single response read from the server.
+	maxLDAPMessageSize = 1 << 20
+)
+
+// LDAPUser is the directory entry a login was checked against.
+type LDAPUser struct {
+	// ID identifies the entry across renames: objectGUID on Active
+	// Directory, entryUUID elsewhere, the DN when the server has neither.
+	ID    string
+	DN    string
+	Email string
+	Name  string
+	// Groups holds the group DNs and, for convenience in role rules,
+	// their common names.
+	Groups []string
+}
+
+type LDAPAuthenticator interface {
+	// Authenticate looks the user up by email with the service account and
+	// binds as the entry found with password.
+	Authenticate(email string, password string) (*LDAPUser, error)
+}
+
+// NewLDAPAuthenticator returns nil when LDAP_URL is not configured.
+func NewLDAPAuthenticator() (LDAPAuthenticator, error) {
+
+	if config.ENV.LDAP_URL == "" {
+		return nil, nil
+	}
+
+	server, err := url.Parse(config.ENV.LDAP_URL)
+	if err != nil || (server.Scheme != "ldap" && server.Scheme != "ldaps") || server.Hostname() == "" {
+		return nil, fmt.Errorf("invalid LDAP_URL %q", config.ENV.LDAP_URL)
+	}
+
+	address := server.Host
+	if server.Port() == "" {
+		port := "389"
+		if server.Scheme == "ldaps" {
+			port = "636"
+		}
+		address = net.JoinHostPort(server.Hostname(), port)
+	}
+
+	tlsConfig := &tls.Config{ServerName: server.Hostname(), MinVersion: tls.VersionTLS12}
+	if config.ENV.LDAP_CA_FILE != "" {
+		pem, err := os.ReadFile(config.ENV.LDAP_CA_FILE)
+		if err != nil {
+			return nil, fmt.Errorf("read LDAP_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("LDAP_CA_FILE has no certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// the filter is checked once here, with a harmless value
+	if _, err := parseLDAPFilter(strings.ReplaceAll(config.ENV.LDAP_USER_FILTER, "{email}", "x")); err != nil {
+		return nil, fmt.Errorf("invalid LDAP_USER_FILTER: %w", err)
+	}
+
+	if server.Scheme == "ldap" && !config.ENV.LDAP_START_TLS {
+		log.Warn().Msg("LDAP_URL is plain ldap without LDAP_START_TLS, passwords are sent unencrypted")
+	}
+
+	return &ldapAuthenticator{
+		address:   address,
+		useTLS:    server.Scheme == "ldaps",
+		startTLS:  config.ENV.LDAP_START_TLS,
+		tlsConfig: tlsConfig,
+		timeout:   time.Second * time.Duration(config.ENV.LDAP_TIMEOUT_SECOND),
+	}, nil
+}
+
+// IsLDAPDomain reports whether logins with email are checked against the
+// directory only, per LDAP_DOMAINS.
+func IsLDAPDomain(email string) bool {
+	domain := EmailDomain(email)
+	for candidate := range strings.SplitSeq(config.ENV.LDAP_DOMAINS, ",") {
+		if strings.ToLower(strings.TrimSpace(candidate)) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+type ldapAuthenticator struct {
+	address   string
+	useTLS    bool
+	startTLS  bool
+	tlsConfig *tls.Config
+	timeout   time.Duration
+}
+
+func (a *ldapAuthenticator) Authenticate(email string, password string) (*LDAPUser, error) {
+
+	// a simple bind without a password is an anonymous bind, which
+	// servers accept
+	if password == "" {
+		return nil, ErrLDAPInvalidCredentials
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+
+	if config.ENV.LDAP_BIND_DN != "" {
+		if err := conn.bind(config.ENV.LDAP_BIND_DN, config.ENV.LDAP_BIND_PASSWORD); err != nil {
+			return nil, fmt.Errorf("ldap service bind failed: %v", err)
+		}
+	}
+
+	filter, err := parseLDAPFilter(strings.ReplaceAll(config.ENV.LDAP_USER_FILTER, "{email}", escapeLDAPFilterValue(email)))
+	if err != nil {
+		return nil, err
+	}
+
+	emailAttr := config.ENV.LDAP_EMAIL_ATTRIBUTE
+	nameAttr := config.ENV.LDAP_NAME_ATTRIBUTE
+	groupAttr := config.ENV.LDAP_GROUP_ATTRIBUTE
+
+	entries, err := conn.search(config.ENV.LDAP_BASE_DN, filter, []string{emailAttr, nameAttr, groupAttr, "objectGUID", "entryUUID"})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		// unknown, or ambiguous and so not safe to pick one
+		return nil, ErrLDAPInvalidCredentials
+	}
+	entry := entries[0]
+	if entry.dn == "" {
+		return nil, ErrLDAPInvalidCredentials
+	}
+
+	if err := conn.bind(entry.dn, password); err != nil {
+		return nil, err
+	}
+
+	// the account is keyed on the email, so it has to be the one the
+	// directory holds for the entry
+	if mail := entry.first(emailAttr); mail != "" && !strings.EqualFold(mail, email) {
+		return nil, ErrLDAPEmailMismatch
+	}
+
+	user := &LDAPUser{ID: "dn:" + strings.ToLower(entry.dn), DN: entry.dn, Email: email}
+	if guid := entry.first("objectGUID"); guid != "" {
+		user.ID = "guid:" + hex.EncodeToString([]byte(guid))
+	} else if uuid := entry.first("entryUUID"); uuid != "" {
+		user.ID = "uuid:" + strings.ToLower(uuid)
+	}
+	user.Name = entry.first(nameAttr)
+	for _, group := range entry.attributes[strings.ToLower(groupAttr)] {
+		user.Groups = append(user.Groups, group)
+		if cn := groupCommonName(group); cn != "" {
+			user.Groups = append(user.Groups, cn)
+		}
+	}
+
+	return user, nil
+}
+
+func groupCommonName(dn string) string {
+	first, _, _ := strings.Cut(dn, ",")
+	attr, value, ok := strings.Cut(first, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(attr), "cn") {
+		return ""
+	}
+	return strings.TrimSpace(value)
+}
+
+type ldapConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	messageID int64
+}
+
+type ldapEntry struct {
+	dn         string
+	attributes map[string][]string // by lowercased attribute name
+}
+
+func (e *ldapEntry) first(attr string) string {
+	values := e.attributes[strings.ToLower(attr)]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (a *ldapAuthenticator) dial() (*ldapConn, error) {
+
+	dialer := &net.Dialer{Timeout: a.timeout}
+
+	var conn net.Conn
+	var err error
+	if a.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", a.address, a.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", a.address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap connect failed: %w", err)
+	}
+	// one deadline for the whole exchange
+	conn.SetDeadline(time.Now().Add(a.timeout))
+
+	c := &ldapConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if a.startTLS && !a.useTLS {
+		response, err := c.roundTrip(berConstructed(0x77, berPrimitive(0x80, []byte(ldapStartTLSOID))), 0x78)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := ldapResultError(response); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap starttls failed: %w", err)
+		}
+
+		tlsConn := tls.Client(conn, a.tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap starttls failed: %w", err)
+		}
+		c.conn = tlsConn
+		c.reader = bufio.NewReader(tlsConn)
+	}
+
+	return c, nil
+}
+
+func (c *ldapConn) close() {
+	// unbind is a courtesy, the connection goes either way
+	c.messageID++
+	c.conn.Write(berConstructed(0x30, berInteger(0x02, c.messageID), berPrimitive(0x42, nil)))
+	c.conn.Close()
+}
+
+func (c *ldapConn) bind(dn string, password string) error {
+	request := berConstructed(0x60,
+		berInteger(0x02, 3),
+		berPrimitive(0x04, []byte(dn)),
+		berPrimitive(0x80, []byte(password)),
+	)
+	response, err := c.roundTrip(request, 0x61)
+	if err != nil {
+		return err
+	}
+	return ldapResultError(response)
+}
+
+func (c *ldapConn) search(baseDN string, filter []byte, attributes []string) ([]*ldapEntry, error) {
+
+	var attrList [][]byte
+	for _, attr := range attributes {
+		attrList = append(attrList, berPrimitive(0x04, []byte(attr)))
+	}
+
+	request := berConstructed(0x63,
+		berPrimitive(0x04, []byte(baseDN)),
+		berInteger(0x0a, 2), // whole subtree
+		berInteger(0x0a, 0), // never dereference aliases
+		berInteger(0x02, 2), // two entries are enough to know it is ambiguous
+		berInteger(0x02, 0),
+		berPrimitive(0x01, []byte{0x00}),
+		filter,
+		berConstructed(0x30, attrList...),
+	)
+
+	id, err := c.send(request)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*ldapEntry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+
+		switch op.tag {
+		case 0x64: // SearchResultEntry
+			entry, err := parseLDAPEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case 0x73: // SearchResultReference, not followed
+		case 0x65: // SearchResultDone
+			if code, _ := ldapResultCode(op); code == ldapResultSizeLimitExceeded {
+				return entries, nil
+			}
+			if err := ldapResultError(op); err != nil {
+				return nil, fmt.Errorf("ldap search failed: %w", err)
+			}
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("%w: unexpected response 0x%x", ErrLDAPProtocol, op.tag)
+		}
+	}
+}
+
+func parseLDAPEntry(op *berElement) (*ldapEntry, error) {
+	if len(op.children) < 2 {
+		return nil, fmt.Errorf("%w: malformed entry", ErrLDAPProtocol)
+	}
+	entry := &ldapEntry{dn: string(op.children[0].data), attributes: map[string][]string{}}
+	for _, attribute := range op.children[1].children {
+		if len(attribute.children) < 2 {
+			continue
+		}
+		name := strings.ToLower(string(attribute.children[0].data))
+		for _, value := range attribute.children[1].children {
+			entry.attributes[name] = append(entry.attributes[name], string(value.data))
+		}
+	}
+	return entry, nil
+}
+
+func (c *ldapConn) roundTrip(request []byte, responseTag byte) (*berElement, error) {
+	id, err := c.send(request)
+	if err != nil {
+		return nil, err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return nil, err
+	}
+	if op.tag != responseTag {
+		return nil, fmt.Errorf("%w: unexpected response 0x%x", ErrLDAPProtocol, op.tag)
+	}
+	return op, nil
+}
+
+func (c *ldapConn) send(protocolOp []byte) (int64, error) {
+	c.messageID++
+	message := berConstructed(0x30, berInteger(0x02, c.messageID), protocolOp)
+	if _, err := c.conn.Write(message); err != nil {
+		return 0, fmt.Errorf("ldap write failed: %w", err)
+	}
+	return c.messageID, nil
+}
+
+// receive reads the next message, which must answer id, and returns its
+// protocol operation.
+func (c *ldapConn) receive(id int64) (*berElement, error) {
+	message, err := readBER(c.reader)
+	if err != nil {
+		return nil, err
+	}
+	if message.tag != 0x30 || len(message.children) < 2 || message.children[0].tag != 0x02 {
+		return nil, fmt.Errorf("%w: malformed message", ErrLDAPProtocol)
+	}
+	if berToInt(message.children[0].data) != id {
+		// notices of disconnection come with id 0
+		return nil, fmt.Errorf("%w: unexpected message id", ErrLDAPProtocol)
+	}
+	return message.children[1], nil
+}
+
+func ldapResultCode(op *berElement) (int64, string) {
+	if len(op.children) < 3 {
+		return -1, ""
+	}
+	return berToInt(op.children[0].data), string(op.children[2].data)
+}
+
+func ldapResultError(op *berElement) error {
+	code, message := ldapResultCode(op)
+	switch code {
+	case ldapResultSuccess:
+		return nil
+	case ldapResultInvalidCredentials:
+		return ErrLDAPInvalidCredentials
+	default:
+		return fmt.Errorf("%w: result %d %s", ErrLDAPProtocol, code, message)
+	}
+}
+
+// escapeLDAPFilterValue escapes a value for a filter, per RFC 4515.
+func escapeLDAPFilterValue(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseLDAPFilter encodes a filter string. It supports &, |, !, equality
+// and presence, which user lookups need.
+func parseLDAPFilter(filter string) ([]byte, error) {
+	encoded, rest, err := parseLDAPFilterAt(strings.TrimSpace(filter), 0)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q after filter", rest)
+	}
+	return encoded, nil
+}
+
+func parseLDAPFilterAt(s string, depth int) ([]byte, string, error) {
+
+	if depth > 16 {
+		return nil, "", errors.New("filter nested too deep")
+	}
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", fmt.Errorf("expected ( at %q", s)
+	}
+	s = s[1:]
+
+	switch {
+	case strings.HasPrefix(s, "&"), strings.HasPrefix(s, "|"):
+		tag := byte(0xa0)
+		if s[0] == '|' {
+			tag = 0xa1
+		}
+		s = s[1:]
+		var parts [][]byte
+		for strings.HasPrefix(s, "(") {
+			part, rest, err := parseLDAPFilterAt(s, depth+1)
+			if err != nil {
+				return nil, "", err
+			}
+			parts = append(parts, part)
+			s = rest
+		}
+		if len(parts) == 0 || !strings.HasPrefix(s, ")") {
+			return nil, "", errors.New("malformed filter list")
+		}
+		return berConstructed(tag, parts...), s[1:], nil
+
+	case strings.HasPrefix(s, "!"):
+		part, rest, err := parseLDAPFilterAt(s[1:], depth+1)
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", errors.New("malformed not filter")
+		}
+		return berConstructed(0xa2, part), rest[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", errors.New("unterminated filter")
+	}
+	item, rest := s[:end], s[end+1:]
+
+	attr, value, ok := strings.Cut(item, "=")
+	if !ok || attr == "" || strings.ContainsAny(attr, "<>~") {
+		return nil, "", fmt.Errorf("unsupported filter item %q", item)
+	}
+	if value == "*" {
+		return berPrimitive(0x87, []byte(attr)), rest, nil
+	}
+	if strings.Contains(value, "*") {
+		return nil, "", fmt.Errorf("substring filters are not supported: %q", item)
+	}
+
+	decoded, err := unescapeLDAPFilterValue(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return berConstructed(0xa3, berPrimitive(0x04, []byte(attr)), berPrimitive(0x04, decoded)), rest, nil
+}
+
+func unescapeLDAPFilterValue(value string) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			out = append(out, value[i])
+			continue
+		}
+		if i+2 >= len(value) {
+			return nil, fmt.Errorf("bad escape in %q", value)
+		}
+		b, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return nil, fmt.Errorf("bad escape in %q", value)
+		}
+		out = append(out, b...)
+		i += 2
+	}
+	return out, nil
+}
+
+// berElement is a decoded BER value; constructed values have children.
+type berElement struct {
+	tag      byte
+	data     []byte
+	children []*berElement
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berPrimitive(tag byte, data []byte) []byte {
+	out := append([]byte{tag}, berLength(len(data))...)
+	return append(out, data...)
+}
+
+func berConstructed(tag byte, parts ...[]byte) []byte {
+	var content []byte
+	for _, part := range parts {
+		content = append(content, part...)
+	}
+	return berPrimitive(tag, content)
+}
+
+func berInteger(tag byte, n int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		n >>= 8
+		if n == 0 && b[0]&0x80 == 0 {
+			break
+		}
+	}
+	return berPrimitive(tag, b)
+}
+
+func berToInt(data []byte) int64 {
+	var n int64
+	for i, b := range data {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int64(b)
+	}
+	return n
+}
+
+func readBER(r io.Reader) (*berElement, error) {
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("ldap read failed: %w", err)
+	}
+
+	length := int(header[1])
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 4 {
+			return nil, fmt.Errorf("%w: unsupported length", ErrLDAPProtocol)
+		}
+		lengthBytes := make([]byte, size)
+		if _, err := io.ReadFull(r, lengthBytes); err != nil {
+			return nil, fmt.Errorf("ldap read failed: %w", err)
+		}
+		length = 0
+		for _, b := range lengthBytes {
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxLDAPMessageSize {
+		return nil, fmt.Errorf("%w: message too large", ErrLDAPProtocol)
+	}
+
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, fmt.Errorf("ldap read failed: %w", err)
+	}
+
+	return parseBER(header[0], content, 0)
+}
+
+func parseBER(tag byte, content []byte, depth int) (*berElement, error) {
+
+	element := &berElement{tag: tag, data: content}
+	if tag&0x20 == 0 {
+		return element, nil
+	}
+	if depth > 16 {
+		return nil, fmt.Errorf("%w: nested too deep", ErrLDAPProtocol)
+	}
+
+	for len(content) > 0 {
+		if len(content) < 2 {
+			return nil, fmt.Errorf("%w: truncated element", ErrLDAPProtocol)
+		}
+		childTag, length, offset := content[0], int(content[1]), 2
+		if length&0x80 != 0 {
+			size := length & 0x7f
+			if size == 0 || size > 4 || len(content) < 2+size {
+				return nil, fmt.Errorf("%w: bad length", ErrLDAPProtocol)
+			}
+			length = 0
+			for _, b := range content[2 : 2+size] {
+				length = length<<8 | int(b)
+			}
+			offset += size
+		}
+		if length < 0 || len(content)-offset < length {
+			return nil, fmt.Errorf("%w: truncated element", ErrLDAPProtocol)
+		}
+
+		child, err := parseBER(childTag, content[offset:offset+length], depth+1)
+		if err != nil {
+			return nil, err
+		}
+		element.children = append(element.children, child)
+		content = content[offset+length:]
+	}
+
+	return element, nil
+}
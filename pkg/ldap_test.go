@@ -0,0 +1,436 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/revandpratama/auth4me/config"
+)
+
+const (
+	testLDAPBindDN       = "cn=reader,dc=example,dc=com"
+	testLDAPBindPassword = "reader-secret"
+)
+
+type ldapTestEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// ldapStandIn is a minimal LDAP server: it answers simple binds and subtree
+// searches with equality, presence, and, or and not filters.
+type ldapStandIn struct {
+	entries []ldapTestEntry
+
+	mu          sync.Mutex
+	connections int
+	binds       []string
+	filters     [][]byte
+}
+
+func newLDAPStandIn(t *testing.T, entries ...ldapTestEntry) (*ldapStandIn, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &ldapStandIn{entries: entries}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server, listener.Addr().String()
+}
+
+func (s *ldapStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+
+	s.mu.Lock()
+	s.connections++
+	s.mu.Unlock()
+
+	reader := bufio.NewReader(conn)
+	for {
+		message, err := readBER(reader)
+		if err != nil || len(message.children) < 2 {
+			return
+		}
+		id := berToInt(message.children[0].data)
+		op := message.children[1]
+
+		switch op.tag {
+		case 0x60: // BindRequest
+			conn.Write(ldapTestMessage(id, ldapTestResult(0x61, s.bind(op))))
+		case 0x63: // SearchRequest
+			for _, response := range s.search(op) {
+				conn.Write(ldapTestMessage(id, response))
+			}
+		default: // UnbindRequest, or anything else
+			return
+		}
+	}
+}
+
+func (s *ldapStandIn) bind(op *berElement) int64 {
+	dn, password := string(op.children[1].data), string(op.children[2].data)
+
+	s.mu.Lock()
+	s.binds = append(s.binds, dn)
+	s.mu.Unlock()
+
+	if dn == testLDAPBindDN && password == testLDAPBindPassword {
+		return ldapResultSuccess
+	}
+	for _, entry := range s.entries {
+		if entry.dn == dn && entry.password == password && password != "" {
+			return ldapResultSuccess
+		}
+	}
+	return ldapResultInvalidCredentials
+}
+
+func (s *ldapStandIn) search(op *berElement) [][]byte {
+	filter := op.children[6]
+
+	s.mu.Lock()
+	s.filters = append(s.filters, filter.data)
+	s.mu.Unlock()
+
+	var responses [][]byte
+	for _, entry := range s.entries {
+		if !matchLDAPTestFilter(filter, entry) {
+			continue
+		}
+		var attributes [][]byte
+		for name, values := range entry.attributes {
+			var encoded [][]byte
+			for _, value := range values {
+				encoded = append(encoded, berPrimitive(0x04, []byte(value)))
+			}
+			attributes = append(attributes, berConstructed(0x30, berPrimitive(0x04, []byte(name)), berConstructed(0x31, encoded...)))
+		}
+		responses = append(responses, berConstructed(0x64, berPrimitive(0x04, []byte(entry.dn)), berConstructed(0x30, attributes...)))
+	}
+	return append(responses, ldapTestResult(0x65, ldapResultSuccess))
+}
+
+func matchLDAPTestFilter(filter *berElement, entry ldapTestEntry) bool {
+	switch filter.tag {
+	case 0xa0:
+		for _, part := range filter.children {
+			if !matchLDAPTestFilter(part, entry) {
+				return false
+			}
+		}
+		return true
+	case 0xa1:
+		for _, part := range filter.children {
+			if matchLDAPTestFilter(part, entry) {
+				return true
+			}
+		}
+		return false
+	case 0xa2:
+		return !matchLDAPTestFilter(filter.children[0], entry)
+	case 0xa3:
+		for _, value := range entry.attributes[string(filter.children[0].data)] {
+			if strings.EqualFold(value, string(filter.children[1].data)) {
+				return true
+			}
+		}
+		return false
+	case 0x87:
+		return len(entry.attributes[string(filter.data)]) > 0
+	}
+	return false
+}
+
+func ldapTestMessage(id int64, op []byte) []byte {
+	return berConstructed(0x30, berInteger(0x02, id), op)
+}
+
+func ldapTestResult(tag byte, code int64) []byte {
+	return berConstructed(tag, berInteger(0x0a, code), berPrimitive(0x04, nil), berPrimitive(0x04, nil))
+}
+
+var testLDAPUser = ldapTestEntry{
+	dn:       "uid=jdoe,ou=people,dc=example,dc=com",
+	password: "correct horse",
+	attributes: map[string][]string{
+		"mail":        {"jdoe@example.com"},
+		"displayName": {"Jane Doe"},
+		"memberOf":    {"cn=admins,ou=groups,dc=example,dc=com", "ou=contractors,dc=example,dc=com"},
+	},
+}
+
+func newTestLDAPAuthenticator(t *testing.T, entries ...ldapTestEntry) (LDAPAuthenticator, *ldapStandIn) {
+	t.Helper()
+
+	saved := config.ENV
+	t.Cleanup(func() { config.ENV = saved })
+	config.ENV.LDAP_BIND_DN = testLDAPBindDN
+	config.ENV.LDAP_BIND_PASSWORD = testLDAPBindPassword
+	config.ENV.LDAP_BASE_DN = "dc=example,dc=com"
+	config.ENV.LDAP_USER_FILTER = "(&(mail=*)(mail={email}))"
+	config.ENV.LDAP_EMAIL_ATTRIBUTE = "mail"
+	config.ENV.LDAP_NAME_ATTRIBUTE = "displayName"
+	config.ENV.LDAP_GROUP_ATTRIBUTE = "memberOf"
+
+	server, address := newLDAPStandIn(t, entries...)
+	return &ldapAuthenticator{address: address, timeout: 5 * time.Second}, server
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	authenticator, server := newTestLDAPAuthenticator(t, testLDAPUser)
+
+	user, err := authenticator.Authenticate("JDoe@example.com", "correct horse")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if user.DN != testLDAPUser.dn || user.Name != "Jane Doe" {
+		t.Errorf("got DN %q, name %q", user.DN, user.Name)
+	}
+	if user.ID != "dn:"+testLDAPUser.dn {
+		t.Errorf("ID = %q, want the DN without objectGUID or entryUUID", user.ID)
+	}
+	// a difference in case only keeps the address the user typed
+	if user.Email != "JDoe@example.com" {
+		t.Errorf("Email = %q", user.Email)
+	}
+	wantGroups := []string{"cn=admins,ou=groups,dc=example,dc=com", "admins", "ou=contractors,dc=example,dc=com"}
+	if strings.Join(user.Groups, "|") != strings.Join(wantGroups, "|") {
+		t.Errorf("Groups = %v, want %v", user.Groups, wantGroups)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if got := strings.Join(server.binds, "|"); got != testLDAPBindDN+"|"+testLDAPUser.dn {
+		t.Errorf("binds = %s, want the service account then the user", got)
+	}
+}
+
+func TestLDAPAuthenticateStableID(t *testing.T) {
+	authenticator, _ := newTestLDAPAuthenticator(t, ldapTestEntry{
+		dn:       "cn=Jane Doe,ou=people,dc=example,dc=com",
+		password: "pw",
+		attributes: map[string][]string{
+			"mail":       {"jane@example.com"},
+			"objectGUID": {"\x01\x02\xfe"},
+		},
+	}, ldapTestEntry{
+		dn:       "uid=john,ou=people,dc=example,dc=com",
+		password: "pw",
+		attributes: map[string][]string{
+			"mail":      {"john@example.com"},
+			"entryUUID": {"6F1C2E3A-0000-4000-8000-000000000001"},
+		},
+	})
+
+	cases := map[string]string{
+		"jane@example.com": "guid:0102fe",
+		"john@example.com": "uuid:6f1c2e3a-0000-4000-8000-000000000001",
+	}
+	for email, want := range cases {
+		user, err := authenticator.Authenticate(email, "pw")
+		if err != nil {
+			t.Fatalf("Authenticate(%s): %v", email, err)
+		}
+		if user.ID != want {
+			t.Errorf("%s: ID = %q, want %q", email, user.ID, want)
+		}
+	}
+}
+
+func TestLDAPAuthenticateRejectsOtherMail(t *testing.T) {
+	// the filter also matches userPrincipalName, which can differ from mail
+	authenticator, _ := newTestLDAPAuthenticator(t, ldapTestEntry{
+		dn:       "uid=jdoe,ou=people,dc=example,dc=com",
+		password: "pw",
+		attributes: map[string][]string{
+			"mail":              {"someone.else@example.com"},
+			"userPrincipalName": {"jdoe@example.com"},
+		},
+	})
+	config.ENV.LDAP_USER_FILTER = "(|(mail={email})(userPrincipalName={email}))"
+
+	if _, err := authenticator.Authenticate("jdoe@example.com", "pw"); !errors.Is(err, ErrLDAPEmailMismatch) {
+		t.Errorf("got %v, want ErrLDAPEmailMismatch", err)
+	}
+}
+
+func TestLDAPAuthenticateFailures(t *testing.T) {
+	authenticator, _ := newTestLDAPAuthenticator(t, testLDAPUser, ldapTestEntry{
+		dn:         "uid=shared,ou=people,dc=example,dc=com",
+		password:   "pw",
+		attributes: map[string][]string{"mail": {"shared@example.com"}},
+	}, ldapTestEntry{
+		dn:         "uid=shared2,ou=people,dc=example,dc=com",
+		password:   "pw",
+		attributes: map[string][]string{"mail": {"shared@example.com"}},
+	})
+
+	cases := map[string][2]string{
+		"wrong password": {"jdoe@example.com", "wrong"},
+		"unknown user":   {"nobody@example.com", "correct horse"},
+		"ambiguous":      {"shared@example.com", "pw"},
+		// escaped, so it is looked up as a literal address
+		"filter injection": {"*)(mail=*", "correct horse"},
+	}
+	for name, credentials := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := authenticator.Authenticate(credentials[0], credentials[1]); !errors.Is(err, ErrLDAPInvalidCredentials) {
+				t.Errorf("got %v, want ErrLDAPInvalidCredentials", err)
+			}
+		})
+	}
+}
+
+func TestLDAPAuthenticateServiceBindFailure(t *testing.T) {
+	authenticator, _ := newTestLDAPAuthenticator(t, testLDAPUser)
+	config.ENV.LDAP_BIND_PASSWORD = "not the secret"
+
+	_, err := authenticator.Authenticate("jdoe@example.com", "correct horse")
+	if err == nil || errors.Is(err, ErrLDAPInvalidCredentials) {
+		t.Errorf("got %v, want a service bind error distinct from invalid credentials", err)
+	}
+}
+
+func TestLDAPAuthenticateRefusesEmptyPassword(t *testing.T) {
+	authenticator, server := newTestLDAPAuthenticator(t, testLDAPUser)
+
+	if _, err := authenticator.Authenticate("jdoe@example.com", ""); !errors.Is(err, ErrLDAPInvalidCredentials) {
+		t.Errorf("got %v, want ErrLDAPInvalidCredentials", err)
+	}
+	// an empty password would be an anonymous bind, which succeeds, so
+	// the server must not be asked at all
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.connections != 0 {
+		t.Errorf("server was contacted %d times", server.connections)
+	}
+}
+
+func TestLDAPSearchFilterIsEscaped(t *testing.T) {
+	authenticator, server := newTestLDAPAuthenticator(t, testLDAPUser)
+
+	authenticator.Authenticate(`*)(uid=\`, "x")
+
+	want, _ := parseLDAPFilter(`(&(mail=*)(mail=\2a\29\28uid=\5c))`)
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.filters) != 1 || !bytes.Equal(berPrimitive(0xa0, server.filters[0]), want) {
+		t.Errorf("server got filter %x, want %x", server.filters, want)
+	}
+}
+
+func TestEscapeLDAPFilterValue(t *testing.T) {
+	cases := map[string]string{
+		"jdoe@example.com": "jdoe@example.com",
+		"a*b":              `a\2ab`,
+		"(cn=x)":           `\28cn=x\29`,
+		`back\slash`:       `back\5cslash`,
+		"nul\x00byte":      `nul\00byte`,
+		"ünïcode":          "ünïcode",
+	}
+	for value, want := range cases {
+		escaped := escapeLDAPFilterValue(value)
+		if escaped != want {
+			t.Errorf("escapeLDAPFilterValue(%q) = %q, want %q", value, escaped, want)
+			continue
+		}
+
+		// the escaped value decodes back to the original
+		encoded, err := parseLDAPFilter("(mail=" + escaped + ")")
+		if err != nil {
+			t.Errorf("%q: %v", value, err)
+			continue
+		}
+		want := berConstructed(0xa3, berPrimitive(0x04, []byte("mail")), berPrimitive(0x04, []byte(value)))
+		if !bytes.Equal(encoded, want) {
+			t.Errorf("%q encodes to %x, want %x", value, encoded, want)
+		}
+	}
+}
+
+func TestParseLDAPFilter(t *testing.T) {
+	encoded, err := parseLDAPFilter("(|(mail=a@example.com)(!(uid=*)))")
+	if err != nil {
+		t.Fatalf("parseLDAPFilter: %v", err)
+	}
+	want := berConstructed(0xa1,
+		berConstructed(0xa3, berPrimitive(0x04, []byte("mail")), berPrimitive(0x04, []byte("a@example.com"))),
+		berConstructed(0xa2, berPrimitive(0x87, []byte("uid"))),
+	)
+	if !bytes.Equal(encoded, want) {
+		t.Errorf("got %x, want %x", encoded, want)
+	}
+
+	for _, filter := range []string{
+		"mail=a",          // no parentheses
+		"(mail=a",         // unterminated
+		"(mail=a)(uid=b)", // trailing filter
+		"(mail=a*)",       // substring
+		"(mail>=a)",       // ordering
+		`(mail=\zz)`,      // bad escape
+		`(mail=a\2)`,      // short escape
+		"(&)",             // empty list
+		"(" + strings.Repeat("(!", 20) + "(a=b)" + strings.Repeat(")", 21),
+	} {
+		if _, err := parseLDAPFilter(filter); err == nil {
+			t.Errorf("parseLDAPFilter(%q) succeeded", filter)
+		}
+	}
+}
+
+func TestLDAPGroupRoleMapping(t *testing.T) {
+	authenticator, _ := newTestLDAPAuthenticator(t, testLDAPUser, ldapTestEntry{
+		dn:         "uid=guest,ou=people,dc=example,dc=com",
+		password:   "guest",
+		attributes: map[string][]string{"mail": {"guest@example.com"}},
+	})
+	config.ENV.DEFAULT_ROLE = "user"
+
+	savedRules := loadRoleRules
+	t.Cleanup(func() { loadRoleRules = savedRules })
+	loadRoleRules = func() ([]RoleRule, error) {
+		return ParseRoleRules("group=ou=contractors,dc=example,dc=com:contractor;group=admins:admin")
+	}
+
+	// the first matching rule wins, and a group matches by DN or by
+	// common name
+	jdoe, err := authenticator.Authenticate("jdoe@example.com", "correct horse")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if role, _ := MapRole(jdoe.Email, map[string]any{"groups": jdoe.Groups}); role != "contractor" {
+		t.Errorf("jdoe role = %q, want contractor", role)
+	}
+
+	loadRoleRules = func() ([]RoleRule, error) { return ParseRoleRules("group=admins:admin") }
+	if role, _ := MapRole(jdoe.Email, map[string]any{"groups": jdoe.Groups}); role != "admin" {
+		t.Errorf("jdoe role = %q, want admin", role)
+	}
+
+	guest, err := authenticator.Authenticate("guest@example.com", "guest")
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if role, _ := MapRole(guest.Email, map[string]any{"groups": guest.Groups}); role != "user" {
+		t.Errorf("guest role = %q, want the default role", role)
+	}
+}
@@ -0,0 +1,58 @@
+package pkg
+
+import (
+	"sync"
+	"time"
+
+	"github.com/revandpratama/auth4me/config"
+)
+
+type loginAttempts struct {
+	failures    int
+	lockedUntil time.Time
+	lastFailure time.Time
+}
+
+var loginAttemptStore = make(map[string]*loginAttempts)
+var lockoutMu sync.Mutex
+
+// IsLockedOut reports whether key (usually an email) has exceeded
+// LOGIN_MAX_ATTEMPTS and is still inside its lockout window.
+func IsLockedOut(key string) bool {
+	lockoutMu.Lock()
+	defer lockoutMu.Unlock()
+	attempts, exists := loginAttemptStore[key]
+	if !exists {
+		return false
+	}
+	return time.Now().Before(attempts.lockedUntil)
+}
+
+// RecordFailedAttempt counts a failed login for key and locks it once the
+// limit is reached. Failures older than the lockout window are forgotten.
+func RecordFailedAttempt(key string) {
+	lockoutMu.Lock()
+	defer lockoutMu.Unlock()
+
+	window := time.Second * time.Duration(config.ENV.LOGIN_LOCKOUT_SECOND)
+	now := time.Now()
+
+	attempts, exists := loginAttemptStore[key]
+	if !exists || now.Sub(attempts.lastFailure) > window {
+		attempts = &loginAttempts{}
+		loginAttemptStore[key] = attempts
+	}
+
+	attempts.failures++
+	attempts.lastFailure = now
+	if config.ENV.LOGIN_MAX_ATTEMPTS > 0 && attempts.failures >= config.ENV.LOGIN_MAX_ATTEMPTS {
+		attempts.lockedUntil = now.Add(window)
+		attempts.failures = 0
+	}
+}
+
+func ResetFailedAttempts(key string) {
+	lockoutMu.Lock()
+	defer lockoutMu.Unlock()
+	delete(loginAttemptStore, key)
+}
@@ -0,0 +1,94 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/revandpratama/auth4me/config"
+)
+
+// PurposeMagicLink marks a signed magic link token so it can never be
+// mistaken for an access token.
+const PurposeMagicLink = "magic_link"
+
+type MagicLinkClaims struct {
+	Email          string `json:"email"`
+	BrowserBinding string `json:"bnd,omitempty"` // sha256 of the browser cookie, when bound
+	Purpose        string `json:"purpose"`
+	jwt.RegisteredClaims
+}
+
+var usedMagicLinks = make(map[string]time.Time)
+var magicLinkMu sync.Mutex
+
+// GenerateMagicLinkToken signs a single-use login token for email. When
+// browserBinding is not empty the token is only accepted together with it.
+func GenerateMagicLinkToken(email string, browserBinding string, ttl time.Duration) (string, error) {
+
+	claims := &MagicLinkClaims{
+		Email:   email,
+		Purpose: PurposeMagicLink,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.NewString(),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			NotBefore: jwt.NewNumericDate(time.Now()),
+		},
+	}
+	if browserBinding != "" {
+		claims.BrowserBinding = hashBinding(browserBinding)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	return token.SignedString([]byte(config.ENV.JWT_SECRET))
+}
+
+// ConsumeMagicLinkToken validates the token and the optional browser binding
+// and marks the token as used.
+func ConsumeMagicLinkToken(tokenString string, browserBinding string) (*MagicLinkClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &MagicLinkClaims{}, func(t *jwt.Token) (any, error) {
+		return []byte(config.ENV.JWT_SECRET), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*MagicLinkClaims)
+	if !ok || !token.Valid || claims.Purpose != PurposeMagicLink || claims.ID == "" {
+		return nil, errors.New("invalid magic link token")
+	}
+
+	if claims.BrowserBinding != "" {
+		if browserBinding == "" || subtle.ConstantTimeCompare([]byte(claims.BrowserBinding), []byte(hashBinding(browserBinding))) != 1 {
+			return nil, errors.New("magic link was requested from another browser")
+		}
+	}
+
+	magicLinkMu.Lock()
+	defer magicLinkMu.Unlock()
+
+	now := time.Now()
+	for id, expiresAt := range usedMagicLinks {
+		if now.After(expiresAt) {
+			delete(usedMagicLinks, id)
+		}
+	}
+	if _, used := usedMagicLinks[claims.ID]; used {
+		return nil, errors.New("magic link already used")
+	}
+	usedMagicLinks[claims.ID] = claims.ExpiresAt.Time
+
+	return claims, nil
+}
+
+func hashBinding(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
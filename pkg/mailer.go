@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"fmt"
+	"net/smtp"
+	"strings"
+
+	"github.com/revandpratama/auth4me/config"
+	"github.com/rs/zerolog/log"
+)
+
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// NewMailer returns an SMTP mailer when SMTP_HOST is configured, otherwise a
+// mailer that only logs the message, which is handy for local development.
+func NewMailer() Mailer {
+	if config.ENV.SMTP_HOST == "" {
+		return &logMailer{}
+	}
+
+	return &smtpMailer{
+		host:     config.ENV.SMTP_HOST,
+		port:     config.ENV.SMTP_PORT,
+		username: config.ENV.SMTP_USERNAME,
+		password: config.ENV.SMTP_PASSWORD,
+		from:     config.ENV.SMTP_FROM,
+	}
+}
+
+type smtpMailer struct {
+	host     string
+	port     string
+	username string
+	password string
+	from     string
+}
+
+func (m *smtpMailer) Send(to string, subject string, body string) error {
+	var auth smtp.Auth
+	if m.username != "" {
+		auth = smtp.PlainAuth("", m.username, m.password, m.host)
+	}
+
+	msg := strings.Join([]string{
+		fmt.Sprintf("From: %s", m.from),
+		fmt.Sprintf("To: %s", to),
+		fmt.Sprintf("Subject: %s", subject),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=\"utf-8\"",
+		"",
+		body,
+	}, "\r\n")
+
+	if err := smtp.SendMail(fmt.Sprintf("%s:%s", m.host, m.port), auth, m.from, []string{to}, []byte(msg)); err != nil {
+		return fmt.Errorf("send mail failed: %w", err)
+	}
+
+	return nil
+}
+
+type logMailer struct{}
+
+func (m *logMailer) Send(to string, subject string, body string) error {
+	log.Info().Str("to", to).Str("subject", subject).Msg(body)
+	return nil
+}
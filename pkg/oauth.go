@@ -0,0 +1,414 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/revandpratama/auth4me/config"
+	"golang.org/x/oauth2"
+)
+
+var ErrOAuthProfile = errors.New("provider returned an unusable profile")
+
+// OAuthProfile is what every provider's user info is mapped into before it
+// is stored as an entity.OAuthProvider.
+type OAuthProfile struct {
+	ProviderID    string
+	Email         string
+	EmailVerified bool
+	Name          string
+	AvatarURL     string
+	// Claims of the ID token, nil for providers that are not OIDC.
+	Claims map[string]any
+}
+
+// OAuthProvider is one entry of the registry: the oauth2 settings to run the
+// authorization code flow and a mapper fetching the signed in profile.
+type OAuthProvider struct {
+	Name        string
+	Config      *oauth2.Config
+	UserInfoURL string
+	// Issuer and JWKSURL are only set for OpenID Connect providers, whose
+	// profile comes from the verified ID token.
+	Issuer  string
+	JWKSURL string
+
+	fetchProfile func(ctx context.Context, client *http.Client, userInfoURL string) (*OAuthProfile, error)
+	// set for providers that may assert addresses nobody verified
+	ignoreEmailVerified bool
+	// other spellings of Issuer the provider puts in ID tokens
+	issuerAliases []string
+}
+
+func (p *OAuthProvider) IsOIDC() bool {
+	return p.Issuer != ""
+}
+
+// Profile maps the signed in user. For OpenID Connect providers it comes
+// from the ID token in token, verified against nonce, and the user info
+// endpoint only fills in claims the ID token left out. Other providers are
+// asked through their user info endpoint.
+func (p *OAuthProvider) Profile(ctx context.Context, token *oauth2.Token, nonce string) (*OAuthProfile, error) {
+
+	var profile *OAuthProfile
+	if p.IsOIDC() {
+		rawIDToken, _ := token.Extra("id_token").(string)
+		if rawIDToken == "" {
+			return nil, fmt.Errorf("%w: missing from token response", ErrInvalidIDToken)
+		}
+
+		claims, err := p.VerifyIDToken(ctx, rawIDToken, nonce)
+		if err != nil {
+			return nil, err
+		}
+
+		profile = &OAuthProfile{
+			ProviderID:    claims.Subject,
+			Email:         claims.Email,
+			EmailVerified: bool(claims.EmailVerified),
+			Name:          claims.Name,
+			AvatarURL:     claims.Picture,
+			Claims:        claims.Raw,
+		}
+
+		if (profile.Email == "" || profile.Name == "") && p.UserInfoURL != "" {
+			p.enrichProfile(ctx, token, profile)
+		}
+	} else {
+		var err error
+		profile, err = p.fetchProfile(ctx, p.Config.Client(ctx, token), p.UserInfoURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if p.ignoreEmailVerified {
+		profile.EmailVerified = false
+	}
+	if profile.ProviderID == "" || profile.Email == "" {
+		return nil, ErrOAuthProfile
+	}
+	return profile, nil
+}
+
+// enrichProfile fills empty fields from the user info endpoint. It is best
+// effort, and ignores answers about any other subject.
+func (p *OAuthProvider) enrichProfile(ctx context.Context, token *oauth2.Token, profile *OAuthProfile) {
+
+	info, err := p.fetchProfile(ctx, p.Config.Client(ctx, token), p.UserInfoURL)
+	if err != nil || info.ProviderID != profile.ProviderID {
+		return
+	}
+
+	if profile.Email == "" {
+		profile.Email = info.Email
+		profile.EmailVerified = info.EmailVerified
+	}
+	if profile.Name == "" {
+		profile.Name = info.Name
+	}
+	if profile.AvatarURL == "" {
+		profile.AvatarURL = info.AvatarURL
+	}
+}
+
+type OAuthProviders map[string]*OAuthProvider
+
+// LoadOAuthProviders builds the registry from config, skipping providers
+// without a client id. The generic OIDC provider is discovered from its
+// issuer, so this may call out to the network.
+func LoadOAuthProviders() (OAuthProviders, error) {
+
+	providers := OAuthProviders{}
+
+	if config.ENV.GOOGLE_CLIENT_ID != "" {
+		providers["google"] = &OAuthProvider{
+			Name: "google",
+			Config: &oauth2.Config{
+				ClientID:     config.ENV.GOOGLE_CLIENT_ID,
+				ClientSecret: config.ENV.GOOGLE_CLIENT_SECRET,
+				Scopes:       []string{"openid", "email", "profile"},
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  "https://accounts.google.com/o/oauth2/auth",
+					TokenURL: "https://oauth2.googleapis.com/token",
+				},
+				RedirectURL: config.ENV.GOOGLE_REDIRECT_URL,
+			},
+			UserInfoURL:   "https://openidconnect.googleapis.com/v1/userinfo",
+			Issuer:        "https://accounts.google.com",
+			issuerAliases: []string{"accounts.google.com"},
+			JWKSURL:       "https://www.googleapis.com/oauth2/v3/certs",
+			fetchProfile:  fetchOIDCProfile,
+		}
+	}
+
+	if config.ENV.GITHUB_CLIENT_ID != "" {
+		providers["github"] = &OAuthProvider{
+			Name: "github",
+			Config: &oauth2.Config{
+				ClientID:     config.ENV.GITHUB_CLIENT_ID,
+				ClientSecret: config.ENV.GITHUB_CLIENT_SECRET,
+				Scopes:       []string{"read:user", "user:email"},
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  "https://github.com/login/oauth/authorize",
+					TokenURL: "https://github.com/login/oauth/access_token",
+				},
+				RedirectURL: config.ENV.GITHUB_REDIRECT_URL,
+			},
+			UserInfoURL:  "https://api.github.com/user",
+			fetchProfile: fetchGitHubProfile,
+		}
+	}
+
+	if config.ENV.MICROSOFT_CLIENT_ID != "" {
+		tenantURL := "https://login.microsoftonline.com/" + config.ENV.MICROSOFT_TENANT
+		issuer := tenantURL + "/v2.0"
+		switch config.ENV.MICROSOFT_TENANT {
+		case "common", "organizations", "consumers":
+			issuer = "https://login.microsoftonline.com/{tenantid}/v2.0"
+		}
+		providers["microsoft"] = &OAuthProvider{
+			Name: "microsoft",
+			Config: &oauth2.Config{
+				ClientID:     config.ENV.MICROSOFT_CLIENT_ID,
+				ClientSecret: config.ENV.MICROSOFT_CLIENT_SECRET,
+				Scopes:       []string{"openid", "email", "profile", "offline_access"},
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  tenantURL + "/oauth2/v2.0/authorize",
+					TokenURL: tenantURL + "/oauth2/v2.0/token",
+				},
+				RedirectURL: config.ENV.MICROSOFT_REDIRECT_URL,
+			},
+			UserInfoURL:         "https://graph.microsoft.com/oidc/userinfo",
+			Issuer:              issuer,
+			JWKSURL:             tenantURL + "/discovery/v2.0/keys",
+			fetchProfile:        fetchMicrosoftProfile,
+			ignoreEmailVerified: true,
+		}
+	}
+
+	if config.ENV.GITLAB_CLIENT_ID != "" {
+		gitlabURL := strings.TrimRight(config.ENV.GITLAB_URL, "/")
+		providers["gitlab"] = &OAuthProvider{
+			Name: "gitlab",
+			Config: &oauth2.Config{
+				ClientID:     config.ENV.GITLAB_CLIENT_ID,
+				ClientSecret: config.ENV.GITLAB_CLIENT_SECRET,
+				Scopes:       []string{"openid", "email", "profile"},
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  gitlabURL + "/oauth/authorize",
+					TokenURL: gitlabURL + "/oauth/token",
+				},
+				RedirectURL: config.ENV.GITLAB_REDIRECT_URL,
+			},
+			UserInfoURL:  gitlabURL + "/oauth/userinfo",
+			Issuer:       gitlabURL,
+			JWKSURL:      gitlabURL + "/oauth/discovery/keys",
+			fetchProfile: fetchOIDCProfile,
+		}
+	}
+
+	if config.ENV.DISCORD_CLIENT_ID != "" {
+		providers["discord"] = &OAuthProvider{
+			Name: "discord",
+			Config: &oauth2.Config{
+				ClientID:     config.ENV.DISCORD_CLIENT_ID,
+				ClientSecret: config.ENV.DISCORD_CLIENT_SECRET,
+				Scopes:       []string{"identify", "email"},
+				Endpoint: oauth2.Endpoint{
+					AuthURL:  "https://discord.com/oauth2/authorize",
+					TokenURL: "https://discord.com/api/oauth2/token",
+				},
+				RedirectURL: config.ENV.DISCORD_REDIRECT_URL,
+			},
+			UserInfoURL:  "https://discord.com/api/users/@me",
+			fetchProfile: fetchDiscordProfile,
+		}
+	}
+
+	if config.ENV.OIDC_CLIENT_ID != "" {
+		provider, err := discoverOIDCProvider(config.ENV.OIDC_PROVIDER_NAME, config.ENV.OIDC_ISSUER)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := providers[provider.Name]; exists {
+			return nil, fmt.Errorf("oauth provider %q is already configured", provider.Name)
+		}
+		providers[provider.Name] = provider
+	}
+
+	return providers, nil
+}
+
+type oidcDiscoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func discoverOIDCProvider(name string, issuer string) (*OAuthProvider, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var document oidcDiscoveryDocument
+	discoveryURL := strings.TrimRight(issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(ctx, http.DefaultClient, discoveryURL, &document); err != nil {
+		return nil, fmt.Errorf("oidc discovery for %s failed: %w", issuer, err)
+	}
+
+	if document.Issuer != issuer {
+		return nil, fmt.Errorf("oidc discovery for %s returned issuer %s", issuer, document.Issuer)
+	}
+	if document.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc discovery for %s returned no jwks_uri", issuer)
+	}
+
+	return &OAuthProvider{
+		Name: name,
+		Config: &oauth2.Config{
+			ClientID:     config.ENV.OIDC_CLIENT_ID,
+			ClientSecret: config.ENV.OIDC_CLIENT_SECRET,
+			Scopes:       []string{"openid", "email", "profile"},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  document.AuthorizationEndpoint,
+				TokenURL: document.TokenEndpoint,
+			},
+			RedirectURL: config.ENV.OIDC_REDIRECT_URL,
+		},
+		UserInfoURL:  document.UserInfoEndpoint,
+		Issuer:       document.Issuer,
+		JWKSURL:      document.JWKSURI,
+		fetchProfile: fetchOIDCProfile,
+	}, nil
+}
+
+func fetchOIDCProfile(ctx context.Context, client *http.Client, userInfoURL string) (*OAuthProfile, error) {
+	var info struct {
+		Sub           string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+		Picture       string `json:"picture"`
+	}
+	if err := getJSON(ctx, client, userInfoURL, &info); err != nil {
+		return nil, err
+	}
+
+	return &OAuthProfile{
+		ProviderID:    info.Sub,
+		Email:         info.Email,
+		EmailVerified: info.EmailVerified,
+		Name:          info.Name,
+		AvatarURL:     info.Picture,
+	}, nil
+}
+
+// fetchMicrosoftProfile drops the picture, a Graph URL that needs the
+// access token. Emails are never trusted as verified, as Microsoft accounts
+// can carry an address their owner never proved.
+func fetchMicrosoftProfile(ctx context.Context, client *http.Client, userInfoURL string) (*OAuthProfile, error) {
+	profile, err := fetchOIDCProfile(ctx, client, userInfoURL)
+	if err != nil {
+		return nil, err
+	}
+	profile.AvatarURL = ""
+	return profile, nil
+}
+
+// fetchGitHubProfile looks the email up separately, as the profile only
+// shows it when the user made it public and never says if it is verified.
+func fetchGitHubProfile(ctx context.Context, client *http.Client, userInfoURL string) (*OAuthProfile, error) {
+	var user struct {
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := getJSON(ctx, client, userInfoURL, &user); err != nil {
+		return nil, err
+	}
+
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err := getJSON(ctx, client, userInfoURL+"/emails", &emails); err != nil {
+		return nil, err
+	}
+
+	profile := &OAuthProfile{
+		ProviderID: strconv.FormatInt(user.ID, 10),
+		Name:       user.Name,
+		AvatarURL:  user.AvatarURL,
+	}
+	if profile.Name == "" {
+		profile.Name = user.Login
+	}
+	for _, email := range emails {
+		if email.Primary {
+			profile.Email = email.Email
+			profile.EmailVerified = email.Verified
+		}
+	}
+
+	return profile, nil
+}
+
+func fetchDiscordProfile(ctx context.Context, client *http.Client, userInfoURL string) (*OAuthProfile, error) {
+	var user struct {
+		ID         string `json:"id"`
+		Username   string `json:"username"`
+		GlobalName string `json:"global_name"`
+		Avatar     string `json:"avatar"`
+		Email      string `json:"email"`
+		Verified   bool   `json:"verified"`
+	}
+	if err := getJSON(ctx, client, userInfoURL, &user); err != nil {
+		return nil, err
+	}
+
+	profile := &OAuthProfile{
+		ProviderID:    user.ID,
+		Email:         user.Email,
+		EmailVerified: user.Verified,
+		Name:          user.GlobalName,
+	}
+	if profile.Name == "" {
+		profile.Name = user.Username
+	}
+	if user.Avatar != "" {
+		profile.AvatarURL = fmt.Sprintf("https://cdn.discordapp.com/avatars/%s/%s.png", user.ID, user.Avatar)
+	}
+
+	return profile, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, target any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s responded %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(target)
+}
@@ -0,0 +1,296 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/revandpratama/auth4me/config"
+	"github.com/rs/zerolog/log"
+)
+
+// Scopes auth4me grants to OAuth clients.
+const (
+	ScopeOpenID        = "openid"
+	ScopeProfile       = "profile"
+	ScopeEmail         = "email"
+	ScopeOfflineAccess = "offline_access"
+)
+
+var SupportedScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail, ScopeOfflineAccess}
+
+// accessTokenType is the typ header of RFC 9068 access tokens. It keeps an
+// ID token from being replayed as an access token.
+const accessTokenType = "at+jwt"
+
+var (
+	ErrInvalidAccessToken = errors.New("invalid access token")
+	ErrInvalidRedirectURI = errors.New("invalid redirect uri")
+)
+
+// AccessTokenClaims are carried by access tokens issued to OAuth clients.
+// They are signed with the server RSA key rather than JWT_SECRET, so
+// ValidateToken never accepts them for auth4me's own API.
+type AccessTokenClaims struct {
+	ClientID string           `json:"client_id"`
+	Scope    string           `json:"scope,omitempty"`
+	ACR      string           `json:"acr,omitempty"`
+	AMR      []string         `json:"amr,omitempty"`
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func (c *AccessTokenClaims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+type serverSigningKey struct {
+	key *rsa.PrivateKey
+	kid string
+}
+
+var oauthServerKey = sync.OnceValues(func() (*serverSigningKey, error) {
+
+	var key *rsa.PrivateKey
+	if path := config.ENV.OAUTH_SERVER_SIGNING_KEY_FILE; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read OAUTH_SERVER_SIGNING_KEY_FILE: %w", err)
+		}
+		if key, err = parseRSAPrivateKey(data); err != nil {
+			return nil, fmt.Errorf("OAUTH_SERVER_SIGNING_KEY_FILE: %w", err)
+		}
+	} else {
+		log.Warn().Msg("OAUTH_SERVER_SIGNING_KEY_FILE is not set, tokens issued to oauth clients will not survive a restart")
+		generated, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		key = generated
+	}
+
+	if key.N.BitLen() < 2048 {
+		return nil, errors.New("oauth server signing key must be at least 2048 bits")
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+
+	return &serverSigningKey{
+		key: key,
+		kid: base64.RawURLEncoding.EncodeToString(sum[:16]),
+	}, nil
+})
+
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no pem block found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("not a pkcs1 or pkcs8 private key")
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("key is not an rsa key")
+	}
+	return key, nil
+}
+
+// OAuthServerJWKS returns the public key set clients verify tokens with.
+// Calling it at startup also surfaces a broken signing key early.
+func OAuthServerJWKS() (map[string]any, error) {
+	signing, err := oauthServerKey()
+	if err != nil {
+		return nil, err
+	}
+
+	pub := signing.key.PublicKey
+	return map[string]any{
+		"keys": []map[string]any{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": jwt.SigningMethodRS256.Alg(),
+			"kid": signing.kid,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	}, nil
+}
+
+func OAuthServerIssuer() string {
+	return strings.TrimSuffix(config.ENV.OAUTH_SERVER_ISSUER, "/")
+}
+
+func signServerToken(claims jwt.Claims, typ string) (string, error) {
+	signing, err := oauthServerKey()
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = signing.kid
+	token.Header["typ"] = typ
+
+	return token.SignedString(signing.key)
+}
+
+// GenerateClientAccessToken signs an access token for an OAuth client. The
+// caller fills in subject, audience and scope.
+func GenerateClientAccessToken(claims *AccessTokenClaims, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims.Issuer = OAuthServerIssuer()
+	claims.ID = uuid.NewString()
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.NotBefore = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+
+	return signServerToken(claims, accessTokenType)
+}
+
+// ValidateClientAccessToken accepts only access tokens this server issued
+// to an OAuth client.
+func ValidateClientAccessToken(tokenString string) (*AccessTokenClaims, error) {
+	signing, err := oauthServerKey()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := jwt.ParseWithClaims(tokenString, &AccessTokenClaims{}, func(t *jwt.Token) (any, error) {
+		if typ, _ := t.Header["typ"].(string); typ != accessTokenType {
+			return nil, ErrInvalidAccessToken
+		}
+		return &signing.key.PublicKey, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}),
+		jwt.WithIssuer(OAuthServerIssuer()),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, ErrInvalidAccessToken
+	}
+
+	claims, ok := token.Claims.(*AccessTokenClaims)
+	if !ok || !token.Valid || claims.Subject == "" {
+		return nil, ErrInvalidAccessToken
+	}
+
+	return claims, nil
+}
+
+// GenerateIDToken signs an OpenID Connect ID token. The caller sets the
+// subject, audience and user claims; issuer and lifetime are set here.
+func GenerateIDToken(claims jwt.MapClaims, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims["iss"] = OAuthServerIssuer()
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(ttl).Unix()
+
+	return signServerToken(claims, "JWT")
+}
+
+// AccessTokenHash is the at_hash claim binding an ID token to the access
+// token issued with it.
+func AccessTokenHash(accessToken string) string {
+	sum := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(sum[:len(sum)/2])
+}
+
+// VerifyPKCE checks an RFC 7636 code verifier against its S256 challenge.
+func VerifyPKCE(challenge string, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	for _, r := range verifier {
+		if !(r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("-._~", r)) {
+			return false
+		}
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// GenerateClientID returns a new public OAuth client identifier.
+func GenerateClientID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GenerateClientSecret returns a new client secret. Only its
+// HashClientSecret is stored.
+func GenerateClientSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashClientSecret uses a plain hash, unlike HashCode: secrets are long and
+// random, and their hashes must outlive a JWT_SECRET rotation.
+func HashClientSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func ValidateClientSecret(secretHash string, secret string) bool {
+	if secretHash == "" || secret == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(secretHash), []byte(HashClientSecret(secret))) == 1
+}
+
+// ValidateRedirectURI accepts absolute URIs without a fragment. Plain http
+// is only allowed for loopback addresses, as used by native apps; other
+// schemes are taken as private-use schemes of native apps.
+func ValidateRedirectURI(rawURI string) error {
+	u, err := url.Parse(rawURI)
+	if err != nil || !u.IsAbs() || u.Fragment != "" || strings.Contains(rawURI, "#") {
+		return ErrInvalidRedirectURI
+	}
+
+	switch u.Scheme {
+	case "https":
+		if u.Host == "" {
+			return ErrInvalidRedirectURI
+		}
+	case "http":
+		host := u.Hostname()
+		if host != "localhost" && host != "127.0.0.1" && host != "::1" {
+			return ErrInvalidRedirectURI
+		}
+	case "javascript", "data", "file", "vbscript":
+		return ErrInvalidRedirectURI
+	}
+
+	return nil
+}
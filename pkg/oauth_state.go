@@ -0,0 +1,56 @@
+package pkg
+
+import (
+	"crypto/subtle"
+	"sync"
+	"time"
+)
+
+const OAuthStateTTL = 10 * time.Minute
+
+// OAuthState is what the server remembers about an authorization request
+// until the provider redirects back with its state.
+type OAuthState struct {
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	ReturnTo     string
+	LinkUserID   string // set when a signed in user is linking the provider
+	Binding      string // sha256 of the browser cookie that started the request
+	ExpiresAt    time.Time
+}
+
+var oauthStateStore = make(map[string]OAuthState)
+var oauthStateMu sync.Mutex
+
+// SaveOAuthState binds state to browserBinding, a value only the browser
+// that started the request holds in a cookie.
+func SaveOAuthState(state string, browserBinding string, data OAuthState) {
+	oauthStateMu.Lock()
+	defer oauthStateMu.Unlock()
+	key := "oauth_state:" + state
+	data.Binding = hashBinding(browserBinding)
+	oauthStateStore[key] = data
+}
+
+// ConsumeOAuthState returns the data bound to state and removes it, so a
+// callback can only be completed once. A callback arriving in any browser
+// but the one that started the request is rejected, which stops an
+// attacker from logging a victim into the attacker's account.
+func ConsumeOAuthState(state string, browserBinding string) (*OAuthState, bool) {
+	oauthStateMu.Lock()
+	defer oauthStateMu.Unlock()
+	key := "oauth_state:" + state
+	data, exists := oauthStateStore[key]
+	if !exists {
+		return nil, false
+	}
+	delete(oauthStateStore, key)
+	if time.Now().After(data.ExpiresAt) {
+		return nil, false
+	}
+	if browserBinding == "" || subtle.ConstantTimeCompare([]byte(data.Binding), []byte(hashBinding(browserBinding))) != 1 {
+		return nil, false
+	}
+	return &data, true
+}
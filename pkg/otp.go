@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/revandpratama/auth4me/config"
+)
+
+// GenerateNumericCode returns a uniformly random code of the given length.
+func GenerateNumericCode(length int) (string, error) {
+	code := ""
+	for range length {
+		n, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		code += fmt.Sprint(n.Int64())
+	}
+	return code, nil
+}
+
+// HashCode keys the hash with JWT_SECRET, as a plain hash of a short numeric
+// code could be reversed by trying every value.
+func HashCode(code string) string {
+	mac := hmac.New(sha256.New, []byte(config.ENV.JWT_SECRET))
+	mac.Write([]byte(code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func ValidateCode(codeHash string, code string) bool {
+	return hmac.Equal([]byte(codeHash), []byte(HashCode(code)))
+}
+
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// GenerateRecoveryCode returns a code formatted as xxxxx-xxxxx, avoiding
+// characters that are easy to misread.
+func GenerateRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(recoveryCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = recoveryCodeAlphabet[n.Int64()]
+	}
+	return string(b[:5]) + "-" + string(b[5:]), nil
+}
+
+// NormalizeRecoveryCode makes user input comparable to a generated code.
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, " ", "")
+	return strings.ReplaceAll(code, "-", "")
+}
+
+// GenerateDeviceToken returns an opaque token remembering a trusted device.
+// Only its HashCode is stored server-side.
+func GenerateDeviceToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
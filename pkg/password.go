@@ -1,6 +1,10 @@
 package pkg
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
 
 func EncryptPassword(password string) (string, error) {
 
@@ -14,3 +18,16 @@ func ValidatePassword(hashedPassword, password string) error {
 
 	return err
 }
+
+var dummyHash []byte
+var dummyHashOnce sync.Once
+
+// ValidateDummyPassword spends the same time as ValidatePassword against a
+// real hash. Use it when there is no hash to compare with, so response times
+// do not reveal whether an account exists.
+func ValidateDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("auth4me-dummy-password"), bcrypt.DefaultCost)
+	})
+	_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
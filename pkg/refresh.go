@@ -6,16 +6,22 @@ import (
 )
 
 type TokenData struct {
-	UserID       string `json:"user_id"`
-	Email        string `json:"email"`
-	RoleID       uint   `json:"role_id"`
-	Provider     string `json:"provider,omitempty"`
-	SessionID    string `json:"sid,omitempty"`
-	MFACompleted bool   `json:"mfa,omitempty"`
+	UserID       string    `json:"user_id"`
+	Email        string    `json:"email"`
+	RoleID       uint      `json:"role_id"`
+	Provider     string    `json:"provider,omitempty"`
+	SessionID    string    `json:"sid,omitempty"`
+	MFACompleted bool      `json:"mfa,omitempty"`
+	AMR          []string  `json:"amr,omitempty"`
+	AuthTime     time.Time `json:"auth_time"`
 	ExpiresAt    time.Time
 }
 
 var refreshTokenStore = make(map[string]TokenData)
+
+// refreshTokensByUser indexes the store keys by user, so every token of a
+// user can be revoked at once.
+var refreshTokensByUser = make(map[string]map[string]struct{})
 var mu sync.RWMutex
 
 func SaveRefreshToken(token string, data TokenData) {
@@ -23,6 +29,10 @@ func SaveRefreshToken(token string, data TokenData) {
 	defer mu.Unlock()
 	key := "refresh:" + token
 	refreshTokenStore[key] = data
+	if refreshTokensByUser[data.UserID] == nil {
+		refreshTokensByUser[data.UserID] = make(map[string]struct{})
+	}
+	refreshTokensByUser[data.UserID][key] = struct{}{}
 }
 
 func GetRefreshToken(token string) (*TokenData, bool) {
@@ -40,5 +50,24 @@ func DeleteRefreshToken(token string) {
 	mu.Lock()
 	defer mu.Unlock()
 	key := "refresh:" + token
+	data, exists := refreshTokenStore[key]
+	if !exists {
+		return
+	}
 	delete(refreshTokenStore, key)
+	delete(refreshTokensByUser[data.UserID], key)
+	if len(refreshTokensByUser[data.UserID]) == 0 {
+		delete(refreshTokensByUser, data.UserID)
+	}
+}
+
+// DeleteUserRefreshTokens revokes every refresh token of a user, ending all
+// of their sessions once the current access tokens expire.
+func DeleteUserRefreshTokens(userID string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for key := range refreshTokensByUser[userID] {
+		delete(refreshTokenStore, key)
+	}
+	delete(refreshTokensByUser, userID)
 }
@@ -0,0 +1,44 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeleteUserRefreshTokensRevokesOnlyThatUser(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour)
+	SaveRefreshToken("revoke-a1", TokenData{UserID: "user-a", ExpiresAt: expiresAt})
+	SaveRefreshToken("revoke-a2", TokenData{UserID: "user-a", ExpiresAt: expiresAt})
+	SaveRefreshToken("revoke-b1", TokenData{UserID: "user-b", ExpiresAt: expiresAt})
+	t.Cleanup(func() { DeleteRefreshToken("revoke-b1") })
+
+	DeleteUserRefreshTokens("user-a")
+
+	for _, token := range []string{"revoke-a1", "revoke-a2"} {
+		if _, ok := GetRefreshToken(token); ok {
+			t.Errorf("%s survived revoking its user", token)
+		}
+	}
+	if _, ok := GetRefreshToken("revoke-b1"); !ok {
+		t.Error("another user's token was revoked")
+	}
+}
+
+func TestDeleteRefreshTokenKeepsIndexInStep(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour)
+	SaveRefreshToken("rotate-old", TokenData{UserID: "user-c", ExpiresAt: expiresAt})
+	SaveRefreshToken("rotate-new", TokenData{UserID: "user-c", ExpiresAt: expiresAt})
+
+	DeleteRefreshToken("rotate-old")
+	DeleteUserRefreshTokens("user-c")
+
+	if _, ok := GetRefreshToken("rotate-new"); ok {
+		t.Error("rotated token survived revoking its user")
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+	if _, ok := refreshTokensByUser["user-c"]; ok {
+		t.Error("index still holds a revoked user")
+	}
+}
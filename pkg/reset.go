@@ -0,0 +1,39 @@
+package pkg
+
+import (
+	"sync"
+	"time"
+)
+
+type PasswordResetData struct {
+	UserID    string `json:"user_id"`
+	Email     string `json:"email"`
+	ExpiresAt time.Time
+}
+
+var passwordResetStore = make(map[string]PasswordResetData)
+var resetMu sync.Mutex
+
+func SavePasswordResetToken(token string, data PasswordResetData) {
+	resetMu.Lock()
+	defer resetMu.Unlock()
+	key := "reset:" + token
+	passwordResetStore[key] = data
+}
+
+// ConsumePasswordResetToken returns the data bound to token and removes it, so
+// a reset link can only be used once.
+func ConsumePasswordResetToken(token string) (*PasswordResetData, bool) {
+	resetMu.Lock()
+	defer resetMu.Unlock()
+	key := "reset:" + token
+	data, exists := passwordResetStore[key]
+	if !exists {
+		return nil, false
+	}
+	delete(passwordResetStore, key)
+	if time.Now().After(data.ExpiresAt) {
+		return nil, false
+	}
+	return &data, true
+}
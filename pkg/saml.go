@@ -0,0 +1,560 @@
+package pkg
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/revandpratama/auth4me/config"
+)
+
+const (
+	nsSAMLMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	nsSAMLAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	nsSAMLProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+
+	samlBindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlBindingPOST     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlStatusSuccess   = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearer          = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	samlNameIDEmail     = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	samlNameIDPersist   = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	samlNameIDTransient = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+
+	// samlClockSkew tolerates clocks of the IdP and this server disagreeing.
+	samlClockSkew = 3 * time.Minute
+	// maxSAMLResponseSize bounds the decoded response the ACS accepts.
+	maxSAMLResponseSize = 512 << 10
+)
+
+var ErrInvalidSAMLResponse = errors.New("invalid saml response")
+
+// samlAttributeCandidates are the attribute names IdPs commonly release,
+// tried in order when SAML_ATTRIBUTE_MAP does not name one.
+var samlAttributeCandidates = map[string][]string{
+	"email": {
+		"email", "mail", "emailAddress",
+		"urn:oid:0.9.2342.19200300.100.1.3",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+	},
+	"name": {
+		"name", "displayName",
+		"urn:oid:2.16.840.1.113730.3.1.241",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/name",
+	},
+	"groups": {
+		"groups", "memberOf",
+		"urn:oid:1.3.6.1.4.1.5923.1.5.1.1",
+		"http://schemas.microsoft.com/ws/2008/06/identity/claims/groups",
+	},
+}
+
+// SAMLProvider is an identity provider this server accepts assertions from,
+// read from its metadata.
+type SAMLProvider struct {
+	// Name is the metadata file name and, prefixed with "saml:", the
+	// provider name identities are stored under.
+	Name     string
+	EntityID string
+	SSOURL   string
+	Certs    []*x509.Certificate
+	// Domains are the email domains the IdP is authoritative for. Emails
+	// it asserts in other domains are treated as unverified.
+	Domains []string
+}
+
+type SAMLProviders map[string]*SAMLProvider
+
+// ProviderName is the name identities of this IdP are stored under.
+func (p *SAMLProvider) ProviderName() string {
+	return "saml:" + p.Name
+}
+
+// LoadSAMLProviders reads the metadata of every IdP from the .xml files in
+// SAML_IDP_METADATA_DIR. SAML is disabled when the directory is not set.
+func LoadSAMLProviders() (SAMLProviders, error) {
+
+	providers := SAMLProviders{}
+	if config.ENV.SAML_IDP_METADATA_DIR == "" {
+		return providers, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(config.ENV.SAML_IDP_METADATA_DIR, "*.xml"))
+	if err != nil {
+		return nil, err
+	}
+
+	domains := parseSAMLDomains(config.ENV.SAML_IDP_DOMAINS)
+
+	for _, file := range files {
+		name := strings.ToLower(strings.TrimSuffix(filepath.Base(file), ".xml"))
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		provider, err := parseIdPMetadata(data)
+		if err != nil {
+			return nil, fmt.Errorf("saml idp %s: %w", name, err)
+		}
+		provider.Name = name
+		provider.Domains = domains[name]
+
+		providers[name] = provider
+	}
+
+	return providers, nil
+}
+
+// parseSAMLDomains reads "idp=domain,domain;idp=domain".
+func parseSAMLDomains(spec string) map[string][]string {
+	domains := map[string][]string{}
+	for entry := range strings.SplitSeq(spec, ";") {
+		name, list, ok := strings.Cut(entry, "=")
+		if !ok {
+			continue
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		for domain := range strings.SplitSeq(list, ",") {
+			if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+				domains[name] = append(domains[name], domain)
+			}
+		}
+	}
+	return domains
+}
+
+func parseIdPMetadata(data []byte) (*SAMLProvider, error) {
+
+	root, err := parseXML(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// metadata may hold a single entity or a list of them
+	var descriptor *xmlElement
+	root.walk(func(el *xmlElement) {
+		if descriptor == nil && el.is(nsSAMLMetadata, "EntityDescriptor") && el.child(nsSAMLMetadata, "IDPSSODescriptor") != nil {
+			descriptor = el
+		}
+	})
+	if descriptor == nil {
+		return nil, errors.New("metadata has no IDPSSODescriptor")
+	}
+
+	provider := &SAMLProvider{EntityID: descriptor.attr("entityID")}
+	idp := descriptor.child(nsSAMLMetadata, "IDPSSODescriptor")
+
+	for _, sso := range idp.childElements(nsSAMLMetadata, "SingleSignOnService") {
+		if sso.attr("Binding") == samlBindingRedirect {
+			provider.SSOURL = sso.attr("Location")
+			break
+		}
+	}
+
+	for _, key := range idp.childElements(nsSAMLMetadata, "KeyDescriptor") {
+		if use := key.attr("use"); use != "" && use != "signing" {
+			continue
+		}
+		key.walk(func(el *xmlElement) {
+			if !el.is(nsDSig, "X509Certificate") {
+				return
+			}
+			der, err := decodeXMLBase64(el.text())
+			if err != nil {
+				return
+			}
+			if cert, err := x509.ParseCertificate(der); err == nil {
+				provider.Certs = append(provider.Certs, cert)
+			}
+		})
+	}
+
+	switch {
+	case provider.EntityID == "":
+		return nil, errors.New("metadata has no entityID")
+	case provider.SSOURL == "":
+		return nil, errors.New("metadata has no HTTP-Redirect SingleSignOnService")
+	case len(provider.Certs) == 0:
+		return nil, errors.New("metadata has no signing certificate")
+	}
+
+	return provider, nil
+}
+
+// SAMLEntityID identifies this server to IdPs.
+func SAMLEntityID() string {
+	if config.ENV.SAML_SP_ENTITY_ID != "" {
+		return config.ENV.SAML_SP_ENTITY_ID
+	}
+	return SAMLBaseURL() + "/metadata"
+}
+
+func SAMLBaseURL() string {
+	return strings.TrimSuffix(config.ENV.SAML_SP_BASE_URL, "/")
+}
+
+// SAMLACSURL is the assertion consumer service IdPs post responses to.
+func SAMLACSURL() string {
+	return SAMLBaseURL() + "/acs"
+}
+
+// SAMLMetadata describes this service provider for IdP administrators.
+func SAMLMetadata() []byte {
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	fmt.Fprintf(&b, `<md:EntityDescriptor xmlns:md="%s" entityID="%s">`, nsSAMLMetadata, xmlEscape(SAMLEntityID()))
+	fmt.Fprintf(&b, `<md:SPSSODescriptor AuthnRequestsSigned="false" WantAssertionsSigned="true" protocolSupportEnumeration="%s">`, nsSAMLProtocol)
+	fmt.Fprintf(&b, `<md:NameIDFormat>%s</md:NameIDFormat>`, samlNameIDPersist)
+	fmt.Fprintf(&b, `<md:NameIDFormat>%s</md:NameIDFormat>`, samlNameIDEmail)
+	fmt.Fprintf(&b, `<md:AssertionConsumerService Binding="%s" Location="%s" index="0" isDefault="true"/>`, samlBindingPOST, xmlEscape(SAMLACSURL()))
+	b.WriteString(`</md:SPSSODescriptor></md:EntityDescriptor>`)
+	return b.Bytes()
+}
+
+// NewSAMLRequestID returns an ID for an AuthnRequest. XML IDs may not start
+// with a digit.
+func NewSAMLRequestID() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "_" + hex.EncodeToString(b), nil
+}
+
+// AuthnRequestURL is the IdP URL that starts a login through the
+// HTTP-Redirect binding.
+func (p *SAMLProvider) AuthnRequestURL(requestID string, relayState string) (string, error) {
+
+	request := fmt.Sprintf(`<samlp:AuthnRequest xmlns:samlp="%s" xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s" Destination="%s" AssertionConsumerServiceURL="%s" ProtocolBinding="%s">`+
+		`<saml:Issuer>%s</saml:Issuer><samlp:NameIDPolicy AllowCreate="true"/></samlp:AuthnRequest>`,
+		nsSAMLProtocol, nsSAMLAssertion, requestID, time.Now().UTC().Format(time.RFC3339),
+		xmlEscape(p.SSOURL), xmlEscape(SAMLACSURL()), samlBindingPOST, xmlEscape(SAMLEntityID()))
+
+	var deflated bytes.Buffer
+	writer, err := flate.NewWriter(&deflated, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := writer.Write([]byte(request)); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+
+	target, err := url.Parse(p.SSOURL)
+	if err != nil {
+		return "", err
+	}
+	query := target.Query()
+	query.Set("SAMLRequest", base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	query.Set("RelayState", relayState)
+	target.RawQuery = query.Encode()
+
+	return target.String(), nil
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// SAMLAssertion is what a validated response says about the user.
+type SAMLAssertion struct {
+	NameID       string
+	NameIDFormat string
+	Attributes   map[string][]string
+}
+
+// ParseResponse validates a base64 encoded Response posted to the ACS as
+// the answer to requestID: signature, issuer, destination, audience,
+// validity window, subject confirmation and replay.
+func (p *SAMLProvider) ParseResponse(encoded string, requestID string) (*SAMLAssertion, error) {
+
+	data, err := decodeXMLBase64(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad encoding", ErrInvalidSAMLResponse)
+	}
+	if len(data) > maxSAMLResponseSize {
+		return nil, fmt.Errorf("%w: too large", ErrInvalidSAMLResponse)
+	}
+
+	response, err := parseXML(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSAMLResponse, err)
+	}
+	if !response.is(nsSAMLProtocol, "Response") {
+		return nil, fmt.Errorf("%w: not a Response", ErrInvalidSAMLResponse)
+	}
+
+	var encrypted bool
+	response.walk(func(el *xmlElement) {
+		encrypted = encrypted || el.is(nsSAMLAssertion, "EncryptedAssertion")
+	})
+	if encrypted {
+		return nil, fmt.Errorf("%w: encrypted assertions are not supported", ErrInvalidSAMLResponse)
+	}
+
+	// either signature covers the assertion; everything below is read from
+	// the elements goxmldsig verified
+	signedResponse, responseErr := verifyEnvelopedSignature(response, p.Certs)
+	if responseErr != nil && !errors.Is(responseErr, ErrXMLNotSigned) {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSAMLResponse, responseErr)
+	}
+	if responseErr == nil {
+		response = signedResponse
+	}
+
+	if response.attr("InResponseTo") != requestID {
+		return nil, fmt.Errorf("%w: not an answer to the pending request", ErrInvalidSAMLResponse)
+	}
+	if destination := response.attr("Destination"); destination != "" && destination != SAMLACSURL() {
+		return nil, fmt.Errorf("%w: wrong destination", ErrInvalidSAMLResponse)
+	}
+	if issuer := response.child(nsSAMLAssertion, "Issuer"); issuer != nil && issuer.text() != p.EntityID {
+		return nil, fmt.Errorf("%w: wrong issuer", ErrInvalidSAMLResponse)
+	}
+
+	statusCode := ""
+	if status := response.child(nsSAMLProtocol, "Status"); status != nil {
+		if code := status.child(nsSAMLProtocol, "StatusCode"); code != nil {
+			statusCode = code.attr("Value")
+		}
+	}
+	if statusCode != samlStatusSuccess {
+		return nil, fmt.Errorf("%w: status %s", ErrInvalidSAMLResponse, statusCode)
+	}
+
+	assertions := response.childElements(nsSAMLAssertion, "Assertion")
+	if len(assertions) != 1 {
+		return nil, fmt.Errorf("%w: expected exactly one assertion", ErrInvalidSAMLResponse)
+	}
+	assertion := assertions[0]
+
+	signedAssertion, assertionErr := verifyEnvelopedSignature(assertion, p.Certs)
+	if assertionErr != nil && !errors.Is(assertionErr, ErrXMLNotSigned) {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSAMLResponse, assertionErr)
+	}
+	if responseErr != nil && assertionErr != nil {
+		return nil, fmt.Errorf("%w: assertion is not signed", ErrInvalidSAMLResponse)
+	}
+	if assertionErr == nil {
+		assertion = signedAssertion
+	}
+
+	if issuer := assertion.child(nsSAMLAssertion, "Issuer"); issuer == nil || issuer.text() != p.EntityID {
+		return nil, fmt.Errorf("%w: wrong assertion issuer", ErrInvalidSAMLResponse)
+	}
+
+	now := time.Now()
+	expiresAt, err := checkSAMLConditions(assertion, now)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := assertion.child(nsSAMLAssertion, "Subject")
+	if subject == nil {
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidSAMLResponse)
+	}
+	if err := checkSAMLSubjectConfirmation(subject, requestID, now); err != nil {
+		return nil, err
+	}
+
+	nameID := subject.child(nsSAMLAssertion, "NameID")
+	if nameID == nil || nameID.text() == "" {
+		return nil, fmt.Errorf("%w: missing NameID", ErrInvalidSAMLResponse)
+	}
+	if nameID.attr("Format") == samlNameIDTransient {
+		return nil, fmt.Errorf("%w: transient NameIDs cannot identify an account", ErrInvalidSAMLResponse)
+	}
+
+	if assertion.child(nsSAMLAssertion, "AuthnStatement") == nil {
+		return nil, fmt.Errorf("%w: missing AuthnStatement", ErrInvalidSAMLResponse)
+	}
+
+	if !rememberSAMLAssertion(p.EntityID+"|"+assertion.attr("ID"), expiresAt) {
+		return nil, fmt.Errorf("%w: assertion was already used", ErrInvalidSAMLResponse)
+	}
+
+	result := &SAMLAssertion{
+		NameID:       nameID.text(),
+		NameIDFormat: nameID.attr("Format"),
+		Attributes:   map[string][]string{},
+	}
+	for _, statement := range assertion.childElements(nsSAMLAssertion, "AttributeStatement") {
+		for _, attribute := range statement.childElements(nsSAMLAssertion, "Attribute") {
+			name := attribute.attr("Name")
+			for _, value := range attribute.childElements(nsSAMLAssertion, "AttributeValue") {
+				result.Attributes[name] = append(result.Attributes[name], value.text())
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// checkSAMLConditions enforces the validity window and audience, and
+// returns until when the assertion must be remembered against replay.
+func checkSAMLConditions(assertion *xmlElement, now time.Time) (time.Time, error) {
+
+	conditions := assertion.child(nsSAMLAssertion, "Conditions")
+	if conditions == nil {
+		return time.Time{}, fmt.Errorf("%w: missing conditions", ErrInvalidSAMLResponse)
+	}
+
+	if notBefore, err := parseSAMLTime(conditions.attr("NotBefore")); err != nil {
+		return time.Time{}, err
+	} else if !notBefore.IsZero() && now.Add(samlClockSkew).Before(notBefore) {
+		return time.Time{}, fmt.Errorf("%w: assertion is not valid yet", ErrInvalidSAMLResponse)
+	}
+
+	notOnOrAfter, err := parseSAMLTime(conditions.attr("NotOnOrAfter"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if notOnOrAfter.IsZero() {
+		return time.Time{}, fmt.Errorf("%w: assertion has no expiry", ErrInvalidSAMLResponse)
+	}
+	if !now.Add(-samlClockSkew).Before(notOnOrAfter) {
+		return time.Time{}, fmt.Errorf("%w: assertion has expired", ErrInvalidSAMLResponse)
+	}
+
+	// every restriction present has to be satisfied
+	restrictions := conditions.childElements(nsSAMLAssertion, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return time.Time{}, fmt.Errorf("%w: missing audience", ErrInvalidSAMLResponse)
+	}
+	for _, restriction := range restrictions {
+		matched := slices.ContainsFunc(restriction.childElements(nsSAMLAssertion, "Audience"), func(audience *xmlElement) bool {
+			return audience.text() == SAMLEntityID()
+		})
+		if !matched {
+			return time.Time{}, fmt.Errorf("%w: wrong audience", ErrInvalidSAMLResponse)
+		}
+	}
+
+	return notOnOrAfter.Add(samlClockSkew), nil
+}
+
+// checkSAMLSubjectConfirmation requires a bearer confirmation addressed to
+// the ACS for this request.
+func checkSAMLSubjectConfirmation(subject *xmlElement, requestID string, now time.Time) error {
+	for _, confirmation := range subject.childElements(nsSAMLAssertion, "SubjectConfirmation") {
+		if confirmation.attr("Method") != samlBearer {
+			continue
+		}
+		data := confirmation.child(nsSAMLAssertion, "SubjectConfirmationData")
+		if data == nil || data.attr("Recipient") != SAMLACSURL() {
+			continue
+		}
+		if inResponseTo := data.attr("InResponseTo"); inResponseTo != "" && inResponseTo != requestID {
+			continue
+		}
+		notOnOrAfter, err := parseSAMLTime(data.attr("NotOnOrAfter"))
+		if err != nil || notOnOrAfter.IsZero() || !now.Add(-samlClockSkew).Before(notOnOrAfter) {
+			continue
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: no valid bearer subject confirmation", ErrInvalidSAMLResponse)
+}
+
+func parseSAMLTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: bad timestamp %q", ErrInvalidSAMLResponse, value)
+	}
+	return t, nil
+}
+
+var samlReplayCache = make(map[string]time.Time)
+var samlReplayMu sync.Mutex
+
+// rememberSAMLAssertion records an assertion ID until it expires and
+// reports false when it was already recorded.
+func rememberSAMLAssertion(id string, expiresAt time.Time) bool {
+	samlReplayMu.Lock()
+	defer samlReplayMu.Unlock()
+
+	now := time.Now()
+	for key, expiry := range samlReplayCache {
+		if now.After(expiry) {
+			delete(samlReplayCache, key)
+		}
+	}
+
+	key := "saml_assertion:" + id
+	if _, seen := samlReplayCache[key]; seen {
+		return false
+	}
+	samlReplayCache[key] = expiresAt
+	return true
+}
+
+// Profile maps the assertion to the profile every sign-in path uses. The
+// attribute names come from SAML_ATTRIBUTE_MAP, falling back to the common
+// ones, and the NameID stands in for the email when its format is one.
+func (p *SAMLProvider) Profile(assertion *SAMLAssertion) *OAuthProfile {
+
+	configured := map[string]string{}
+	for entry := range strings.SplitSeq(config.ENV.SAML_ATTRIBUTE_MAP, ",") {
+		if field, attribute, ok := strings.Cut(entry, "="); ok {
+			configured[strings.TrimSpace(field)] = strings.TrimSpace(attribute)
+		}
+	}
+	lookup := func(field string) []string {
+		if attribute, ok := configured[field]; ok {
+			return assertion.Attributes[attribute]
+		}
+		for _, attribute := range samlAttributeCandidates[field] {
+			if values := assertion.Attributes[attribute]; len(values) > 0 {
+				return values
+			}
+		}
+		return nil
+	}
+	first := func(values []string) string {
+		if len(values) == 0 {
+			return ""
+		}
+		return values[0]
+	}
+
+	email := strings.ToLower(first(lookup("email")))
+	if email == "" && assertion.NameIDFormat == samlNameIDEmail {
+		email = strings.ToLower(assertion.NameID)
+	}
+
+	claims := make(map[string]any, len(assertion.Attributes)+1)
+	for name, values := range assertion.Attributes {
+		claims[name] = values
+	}
+	claims["groups"] = lookup("groups")
+
+	return &OAuthProfile{
+		ProviderID:    assertion.NameID,
+		Email:         email,
+		EmailVerified: email != "" && slices.Contains(p.Domains, EmailDomain(email)),
+		Name:          first(lookup("name")),
+		Claims:        claims,
+	}
+}
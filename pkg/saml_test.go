@@ -0,0 +1,263 @@
+package pkg
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/revandpratama/auth4me/config"
+)
+
+const testIdPEntityID = "https://idp.example.com/metadata"
+
+func setSAMLConfig(t *testing.T) {
+	t.Helper()
+	saved := config.ENV
+	t.Cleanup(func() { config.ENV = saved })
+	config.ENV.SAML_SP_BASE_URL = "https://sp.example.com/api/saml"
+	config.ENV.SAML_SP_ENTITY_ID = ""
+}
+
+// testResponse describes a Response from the IdP; zero fields get values
+// that make it valid.
+type testResponse struct {
+	RequestID    string
+	AssertionID  string
+	Audience     string
+	Recipient    string
+	NameID       string
+	NotOnOrAfter time.Time
+}
+
+func (r testResponse) assertion() string {
+	now := time.Now().UTC()
+	if r.Audience == "" {
+		r.Audience = SAMLEntityID()
+	}
+	if r.Recipient == "" {
+		r.Recipient = SAMLACSURL()
+	}
+	if r.NotOnOrAfter.IsZero() {
+		r.NotOnOrAfter = now.Add(5 * time.Minute)
+	}
+	return fmt.Sprintf(`<saml:Assertion ID="%[1]s" Version="2.0" IssueInstant="%[2]s">`+
+		`<saml:Issuer>%[3]s</saml:Issuer>{{sig:%[1]s}}`+
+		`<saml:Subject>`+
+		`<saml:NameID Format="urn:oasis:names:tc:SAML:2.0:nameid-format:persistent">%[4]s</saml:NameID>`+
+		`<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">`+
+		`<saml:SubjectConfirmationData InResponseTo="%[5]s" Recipient="%[6]s" NotOnOrAfter="%[7]s"/>`+
+		`</saml:SubjectConfirmation>`+
+		`</saml:Subject>`+
+		`<saml:Conditions NotBefore="%[8]s" NotOnOrAfter="%[7]s">`+
+		`<saml:AudienceRestriction><saml:Audience>%[9]s</saml:Audience></saml:AudienceRestriction>`+
+		`</saml:Conditions>`+
+		`<saml:AuthnStatement AuthnInstant="%[2]s"/>`+
+		`<saml:AttributeStatement>`+
+		`<saml:Attribute Name="mail"><saml:AttributeValue>user@example.com</saml:AttributeValue></saml:Attribute>`+
+		`<saml:Attribute Name="groups"><saml:AttributeValue>staff</saml:AttributeValue><saml:AttributeValue>ops</saml:AttributeValue></saml:Attribute>`+
+		`</saml:AttributeStatement>`+
+		`</saml:Assertion>`,
+		r.AssertionID, now.Format(time.RFC3339), testIdPEntityID, r.NameID, r.RequestID, r.Recipient,
+		r.NotOnOrAfter.Format(time.RFC3339), now.Add(-time.Minute).Format(time.RFC3339), r.Audience)
+}
+
+// wrap puts assertions, and extensions when set, into a Response.
+func (r testResponse) wrap(extensions string, assertions ...string) string {
+	if extensions != "" {
+		extensions = "<samlp:Extensions>" + extensions + "</samlp:Extensions>"
+	}
+	return fmt.Sprintf(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" `+
+		`ID="r-%s" Version="2.0" IssueInstant="%s" Destination="%s" InResponseTo="%s">`+
+		`<saml:Issuer>%s</saml:Issuer>%s`+
+		`<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>`+
+		`%s</samlp:Response>`,
+		r.AssertionID, time.Now().UTC().Format(time.RFC3339), SAMLACSURL(), r.RequestID, testIdPEntityID,
+		extensions, strings.Join(assertions, ""))
+}
+
+var testSAMLSequence int
+
+// newTestResponse returns a response with a fresh assertion ID, as the
+// replay cache remembers them across tests.
+func newTestResponse(nameID string) testResponse {
+	testSAMLSequence++
+	return testResponse{
+		RequestID:   fmt.Sprintf("req-%d", testSAMLSequence),
+		AssertionID: fmt.Sprintf("a-%d-%d", time.Now().UnixNano(), testSAMLSequence),
+		NameID:      nameID,
+	}
+}
+
+func newTestSAMLProvider(signer *testSigner) *SAMLProvider {
+	return &SAMLProvider{
+		Name:     "test",
+		EntityID: testIdPEntityID,
+		Certs:    []*x509.Certificate{signer.cert},
+	}
+}
+
+func encodeSAML(doc string) string {
+	return base64.StdEncoding.EncodeToString([]byte(sigMarker.ReplaceAllString(doc, "")))
+}
+
+func TestParseResponse(t *testing.T) {
+	setSAMLConfig(t)
+	signer := newTestSigner(t)
+	provider := newTestSAMLProvider(signer)
+
+	r := newTestResponse("user-123")
+	signed := signer.sign(t, r.wrap("", r.assertion()), r.AssertionID)
+
+	assertion, err := provider.ParseResponse(encodeSAML(signed), r.RequestID)
+	if err != nil {
+		t.Fatalf("ParseResponse: %v", err)
+	}
+	if assertion.NameID != "user-123" {
+		t.Errorf("NameID = %q", assertion.NameID)
+	}
+	if got := assertion.Attributes["mail"]; len(got) != 1 || got[0] != "user@example.com" {
+		t.Errorf("mail = %v", got)
+	}
+	if got := assertion.Attributes["groups"]; len(got) != 2 || got[0] != "staff" || got[1] != "ops" {
+		t.Errorf("groups = %v", got)
+	}
+}
+
+func TestParseResponseSignedResponse(t *testing.T) {
+	setSAMLConfig(t)
+	signer := newTestSigner(t)
+	provider := newTestSAMLProvider(signer)
+
+	// a signature on the Response covers the assertion inside it
+	r := newTestResponse("user-123")
+	doc := strings.Replace(r.wrap("", r.assertion()), "</saml:Issuer>", "</saml:Issuer>{{sig:r-"+r.AssertionID+"}}", 1)
+	signed := signer.sign(t, doc, "r-"+r.AssertionID)
+
+	if _, err := provider.ParseResponse(encodeSAML(signed), r.RequestID); err != nil {
+		t.Fatalf("ParseResponse: %v", err)
+	}
+}
+
+func TestParseResponseRejectsReplay(t *testing.T) {
+	setSAMLConfig(t)
+	signer := newTestSigner(t)
+	provider := newTestSAMLProvider(signer)
+
+	r := newTestResponse("user-123")
+	encoded := encodeSAML(signer.sign(t, r.wrap("", r.assertion()), r.AssertionID))
+
+	if _, err := provider.ParseResponse(encoded, r.RequestID); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if _, err := provider.ParseResponse(encoded, r.RequestID); !errors.Is(err, ErrInvalidSAMLResponse) {
+		t.Errorf("replay: got %v, want ErrInvalidSAMLResponse", err)
+	}
+}
+
+func TestParseResponseRejectsInvalidAssertions(t *testing.T) {
+	setSAMLConfig(t)
+	signer := newTestSigner(t)
+	provider := newTestSAMLProvider(signer)
+
+	cases := map[string]func(r testResponse) (string, string){
+		"wrong audience": func(r testResponse) (string, string) {
+			r.Audience = "https://other-sp.example.com/metadata"
+			return signer.sign(t, r.wrap("", r.assertion()), r.AssertionID), r.RequestID
+		},
+		"wrong recipient": func(r testResponse) (string, string) {
+			r.Recipient = "https://other-sp.example.com/acs"
+			return signer.sign(t, r.wrap("", r.assertion()), r.AssertionID), r.RequestID
+		},
+		"expired": func(r testResponse) (string, string) {
+			r.NotOnOrAfter = time.Now().Add(-time.Hour)
+			return signer.sign(t, r.wrap("", r.assertion()), r.AssertionID), r.RequestID
+		},
+		"other request": func(r testResponse) (string, string) {
+			return signer.sign(t, r.wrap("", r.assertion()), r.AssertionID), "req-other"
+		},
+		"unsigned": func(r testResponse) (string, string) {
+			return r.wrap("", r.assertion()), r.RequestID
+		},
+		"untrusted signer": func(r testResponse) (string, string) {
+			return newTestSigner(t).sign(t, r.wrap("", r.assertion()), r.AssertionID), r.RequestID
+		},
+		"tampered digest": func(r testResponse) (string, string) {
+			signed := signer.sign(t, r.wrap("", r.assertion()), r.AssertionID)
+			return strings.Replace(signed, ">user-123<", ">admin<", 1), r.RequestID
+		},
+	}
+
+	for name, build := range cases {
+		t.Run(name, func(t *testing.T) {
+			doc, requestID := build(newTestResponse("user-123"))
+			if _, err := provider.ParseResponse(encodeSAML(doc), requestID); !errors.Is(err, ErrInvalidSAMLResponse) {
+				t.Errorf("got %v, want ErrInvalidSAMLResponse", err)
+			}
+		})
+	}
+}
+
+// TestParseResponseRejectsSignatureWrapping moves a genuinely signed
+// assertion out of the way of a forged one, the ways XML signature wrapping
+// attacks do.
+func TestParseResponseRejectsSignatureWrapping(t *testing.T) {
+	setSAMLConfig(t)
+	signer := newTestSigner(t)
+	provider := newTestSAMLProvider(signer)
+
+	signedAssertion := regexp.MustCompile(`<saml:Assertion .*</saml:Assertion>`)
+	signatureElement := regexp.MustCompile(`<ds:Signature .*</ds:Signature>`)
+
+	cases := map[string]func(r testResponse, original string) string{
+		// the signed assertion next to a forged one
+		"second assertion": func(r testResponse, original string) string {
+			forged := newTestResponse("admin")
+			forged.RequestID = r.RequestID
+			return r.wrap("", forged.assertion(), original)
+		},
+		// the signed assertion moved into Extensions, and a forged one
+		// taking over its ID and signature
+		"moved id": func(r testResponse, original string) string {
+			forged := r
+			forged.NameID = "admin"
+			forgedAssertion := strings.Replace(forged.assertion(), "{{sig:"+r.AssertionID+"}}", signatureElement.FindString(original), 1)
+			return r.wrap(original, forgedAssertion)
+		},
+		// the signed assertion moved into Extensions, and a forged one with
+		// its own ID carrying the signature that points at the original
+		"copied signature": func(r testResponse, original string) string {
+			forged := newTestResponse("admin")
+			forged.RequestID = r.RequestID
+			forgedAssertion := strings.Replace(forged.assertion(), "{{sig:"+forged.AssertionID+"}}", signatureElement.FindString(original), 1)
+			return r.wrap(original, forgedAssertion)
+		},
+		// the signed assertion tucked inside the forged one's signature
+		"nested in signature": func(r testResponse, original string) string {
+			forged := r
+			forged.NameID = "admin"
+			signature := strings.Replace(signatureElement.FindString(original), "</ds:Signature>",
+				"<ds:Object>"+original+"</ds:Object></ds:Signature>", 1)
+			return r.wrap("", strings.Replace(forged.assertion(), "{{sig:"+r.AssertionID+"}}", signature, 1))
+		},
+	}
+
+	for name, wrap := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := newTestResponse("user-123")
+			original := signedAssertion.FindString(signer.sign(t, r.wrap("", r.assertion()), r.AssertionID))
+			if original == "" {
+				t.Fatal("signed assertion not found")
+			}
+
+			doc := wrap(r, original)
+			if _, err := provider.ParseResponse(encodeSAML(doc), r.RequestID); !errors.Is(err, ErrInvalidSAMLResponse) {
+				t.Errorf("got %v, want ErrInvalidSAMLResponse", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/revandpratama/auth4me/config"
+)
+
+// RoleRule maps new users to a role by their email domain, a group in the
+// identity provider's groups claim or the value of any other claim.
+type RoleRule struct {
+	Kind  string // domain, group or claim
+	Claim string // claim name, for claim rules
+	Value string
+	Role  string
+}
+
+var loadRoleRules = sync.OnceValues(func() ([]RoleRule, error) {
+	return ParseRoleRules(config.ENV.ROLE_MAPPING_RULES)
+})
+
+// ParseRoleRules reads rules written as kind=value:role separated by
+// semicolons, for example
+//
+//	domain=example.com:staff;group=admins:admin;claim.hd=example.com:staff
+func ParseRoleRules(spec string) ([]RoleRule, error) {
+	rules := []RoleRule{}
+	for entry := range strings.SplitSeq(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		match, role, ok := strings.Cut(entry, ":")
+		kind, value, hasValue := strings.Cut(match, "=")
+		if !ok || !hasValue || value == "" || role == "" {
+			return nil, fmt.Errorf("invalid role mapping rule %q", entry)
+		}
+
+		rule := RoleRule{Kind: kind, Value: value, Role: role}
+		switch {
+		case kind == "domain":
+			rule.Value = strings.ToLower(value)
+		case kind == "group":
+		case strings.HasPrefix(kind, "claim.") && len(kind) > len("claim."):
+			rule.Kind = "claim"
+			rule.Claim = strings.TrimPrefix(kind, "claim.")
+		default:
+			return nil, fmt.Errorf("invalid role mapping rule %q", entry)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// MapRole returns the role of the first rule matching the new user, or
+// DEFAULT_ROLE when none does. claims may be nil for sign-ups that did not
+// come through an identity provider.
+func MapRole(email string, claims map[string]any) (string, error) {
+	rules, err := loadRoleRules()
+	if err != nil {
+		return "", err
+	}
+
+	domain := EmailDomain(email)
+	for _, rule := range rules {
+		switch rule.Kind {
+		case "domain":
+			if domain == rule.Value {
+				return rule.Role, nil
+			}
+		case "group":
+			if claimContains(claims["groups"], rule.Value) {
+				return rule.Role, nil
+			}
+		case "claim":
+			if claimContains(claims[rule.Claim], rule.Value) {
+				return rule.Role, nil
+			}
+		}
+	}
+
+	return config.ENV.DEFAULT_ROLE, nil
+}
+
+// claimContains matches a string claim by equality and a list claim by
+// membership.
+func claimContains(claim any, value string) bool {
+	switch v := claim.(type) {
+	case string:
+		return v == value
+	case []any:
+		return slices.ContainsFunc(v, func(item any) bool {
+			s, ok := item.(string)
+			return ok && s == value
+		})
+	case []string:
+		return slices.Contains(v, value)
+	}
+	return false
+}
+
+// IsSignupDomainAllowed reports whether an account may be created for email
+// under ALLOWED_SIGNUP_DOMAINS. An empty list allows every domain.
+func IsSignupDomainAllowed(email string) bool {
+	if strings.TrimSpace(config.ENV.ALLOWED_SIGNUP_DOMAINS) == "" {
+		return true
+	}
+
+	domain := EmailDomain(email)
+	for allowed := range strings.SplitSeq(config.ENV.ALLOWED_SIGNUP_DOMAINS, ",") {
+		if strings.ToLower(strings.TrimSpace(allowed)) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+func EmailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
+	}
+	return strings.ToLower(email[at+1:])
+}
@@ -0,0 +1,73 @@
+package pkg
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/revandpratama/auth4me/config"
+	"github.com/rs/zerolog/log"
+)
+
+type SMSSender interface {
+	Send(to string, message string) error
+}
+
+// NewSMSSender picks the provider configured in SMS_PROVIDER. The log sender
+// is the default and only prints messages, for development and tests.
+func NewSMSSender() SMSSender {
+	switch config.ENV.SMS_PROVIDER {
+	case "twilio":
+		return &twilioSMSSender{
+			accountSID: config.ENV.TWILIO_ACCOUNT_SID,
+			authToken:  config.ENV.TWILIO_AUTH_TOKEN,
+			from:       config.ENV.TWILIO_FROM,
+			client:     &http.Client{Timeout: 10 * time.Second},
+		}
+	default:
+		return &logSMSSender{}
+	}
+}
+
+type logSMSSender struct{}
+
+func (s *logSMSSender) Send(to string, message string) error {
+	log.Info().Str("to", to).Msg(message)
+	return nil
+}
+
+type twilioSMSSender struct {
+	accountSID string
+	authToken  string
+	from       string
+	client     *http.Client
+}
+
+func (s *twilioSMSSender) Send(to string, message string) error {
+	form := url.Values{}
+	form.Set("To", to)
+	form.Set("From", s.from)
+	form.Set("Body", message)
+
+	endpoint := fmt.Sprintf("https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", s.accountSID)
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.accountSID, s.authToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send sms failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("send sms failed: twilio responded %s", resp.Status)
+	}
+
+	return nil
+}
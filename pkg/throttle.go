@@ -0,0 +1,33 @@
+package pkg
+
+import (
+	"sync"
+	"time"
+)
+
+var throttleStore = make(map[string][]time.Time)
+var throttleMu sync.Mutex
+
+// AllowAction reports whether key may perform another action, allowing at
+// most limit actions per window and none within minInterval of the last one.
+// Allowed actions are recorded.
+func AllowAction(key string, limit int, window time.Duration, minInterval time.Duration) bool {
+	throttleMu.Lock()
+	defer throttleMu.Unlock()
+
+	now := time.Now()
+	recent := []time.Time{}
+	for _, at := range throttleStore[key] {
+		if now.Sub(at) < window {
+			recent = append(recent, at)
+		}
+	}
+
+	if len(recent) >= limit || (len(recent) > 0 && now.Sub(recent[len(recent)-1]) < minInterval) {
+		throttleStore[key] = recent
+		return false
+	}
+
+	throttleStore[key] = append(recent, now)
+	return true
+}
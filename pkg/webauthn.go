@@ -0,0 +1,72 @@
+package pkg
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/revandpratama/auth4me/config"
+)
+
+const webAuthnSessionTTL = 5 * time.Minute
+
+func NewWebAuthn() (*webauthn.WebAuthn, error) {
+	origins := []string{}
+	for _, origin := range strings.Split(config.ENV.WEBAUTHN_RP_ORIGINS, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:                  config.ENV.WEBAUTHN_RP_ID,
+		RPDisplayName:         config.ENV.WEBAUTHN_RP_NAME,
+		RPOrigins:             origins,
+		AttestationPreference: protocol.PreferNoAttestation,
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        webauthn.TimeoutConfig{Enforce: true, Timeout: webAuthnSessionTTL},
+			Registration: webauthn.TimeoutConfig{Enforce: true, Timeout: webAuthnSessionTTL},
+		},
+	})
+}
+
+var webAuthnSessionStore = make(map[string]webauthn.SessionData)
+var webAuthnMu sync.Mutex
+
+// SaveWebAuthnSession keeps the challenge of a ceremony until it is finished.
+func SaveWebAuthnSession(key string, session *webauthn.SessionData) {
+	webAuthnMu.Lock()
+	defer webAuthnMu.Unlock()
+
+	now := time.Now()
+	for k, s := range webAuthnSessionStore {
+		if now.After(s.Expires) {
+			delete(webAuthnSessionStore, k)
+		}
+	}
+
+	data := *session
+	if data.Expires.IsZero() {
+		data.Expires = now.Add(webAuthnSessionTTL)
+	}
+	webAuthnSessionStore["webauthn:"+key] = data
+}
+
+// ConsumeWebAuthnSession returns the stored challenge and removes it, so each
+// challenge can only be answered once.
+func ConsumeWebAuthnSession(key string) (*webauthn.SessionData, bool) {
+	webAuthnMu.Lock()
+	defer webAuthnMu.Unlock()
+	key = "webauthn:" + key
+	data, exists := webAuthnSessionStore[key]
+	if !exists {
+		return nil, false
+	}
+	delete(webAuthnSessionStore, key)
+	if time.Now().After(data.Expires) {
+		return nil, false
+	}
+	return &data, true
+}
@@ -0,0 +1,245 @@
+package pkg
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+)
+
+// XML parsing and signature checks for SAML. Canonicalization and signature
+// verification are left to goxmldsig; this file only adds namespace-aware
+// lookups and the subset of XML Signature that SAML IdPs need to use.
+
+const (
+	nsDSig          = dsig.Namespace
+	algExcC14N      = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	algEnveloped    = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	algSHA256       = "http://www.w3.org/2001/04/xmlenc#sha256"
+	algSHA512       = "http://www.w3.org/2001/04/xmlenc#sha512"
+	algRSASHA256    = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	algRSASHA512    = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	maxXMLTreeDepth = 64
+)
+
+// SHA-1 based algorithms are deliberately missing, although goxmldsig
+// would accept them.
+var (
+	digestAlgorithms    = []string{algSHA256, algSHA512}
+	signatureAlgorithms = []string{algRSASHA256, algRSASHA512}
+)
+
+var (
+	ErrMalformedXML   = errors.New("malformed xml")
+	ErrXMLNotSigned   = errors.New("xml element is not signed")
+	ErrInvalidXMLSign = errors.New("invalid xml signature")
+)
+
+// xmlElement adds the namespace-aware lookups SAML parsing needs to an
+// etree element.
+type xmlElement struct {
+	*etree.Element
+}
+
+// parseXML builds the tree of a document. Document type declarations are
+// refused, there is no legitimate use for them in SAML messages.
+func parseXML(data []byte) (*xmlElement, error) {
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedXML, err)
+	}
+
+	for _, token := range doc.Child {
+		switch t := token.(type) {
+		case *etree.Directive:
+			return nil, fmt.Errorf("%w: document type declarations are not allowed", ErrMalformedXML)
+		case *etree.CharData:
+			if !t.IsWhitespace() {
+				return nil, fmt.Errorf("%w: text outside the root element", ErrMalformedXML)
+			}
+		}
+	}
+	if roots := doc.ChildElements(); len(roots) != 1 {
+		return nil, fmt.Errorf("%w: expected exactly one root element", ErrMalformedXML)
+	}
+
+	root := &xmlElement{doc.Root()}
+	if err := root.checkTree(1); err != nil {
+		return nil, err
+	}
+
+	return root, nil
+}
+
+// checkTree bounds the nesting and refuses undeclared prefixes, which etree
+// would otherwise leave without a namespace.
+func (e *xmlElement) checkTree(depth int) error {
+	if depth > maxXMLTreeDepth {
+		return fmt.Errorf("%w: nested too deep", ErrMalformedXML)
+	}
+	if e.Space != "" && e.Space != "xml" && e.NamespaceURI() == "" {
+		return fmt.Errorf("%w: undeclared prefix %q", ErrMalformedXML, e.Space)
+	}
+	for _, child := range e.ChildElements() {
+		if err := (&xmlElement{child}).checkTree(depth + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *xmlElement) is(space string, local string) bool {
+	return e.Tag == local && e.NamespaceURI() == space
+}
+
+// attr returns an unprefixed attribute.
+func (e *xmlElement) attr(local string) string {
+	for _, a := range e.Attr {
+		if a.Space == "" && a.Key == local {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (e *xmlElement) childElements(space string, local string) []*xmlElement {
+	var found []*xmlElement
+	for _, child := range e.ChildElements() {
+		if el := (&xmlElement{child}); el.is(space, local) {
+			found = append(found, el)
+		}
+	}
+	return found
+}
+
+// child returns the only child with the name, nil when there is none or
+// more than one.
+func (e *xmlElement) child(space string, local string) *xmlElement {
+	found := e.childElements(space, local)
+	if len(found) != 1 {
+		return nil
+	}
+	return found[0]
+}
+
+func (e *xmlElement) text() string {
+	var b strings.Builder
+	for _, child := range e.Child {
+		if data, ok := child.(*etree.CharData); ok {
+			b.WriteString(data.Data)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// walk calls fn for e and every element below it.
+func (e *xmlElement) walk(fn func(*xmlElement)) {
+	fn(e)
+	for _, child := range e.ChildElements() {
+		(&xmlElement{child}).walk(fn)
+	}
+}
+
+// verifyEnvelopedSignature checks the ds:Signature child of el with one of
+// certs and returns the signed element as goxmldsig verified it, detached
+// from the document. Callers must read the signed content from the returned
+// element and nowhere else, so nothing next to the signature is trusted.
+func verifyEnvelopedSignature(el *xmlElement, certs []*x509.Certificate) (*xmlElement, error) {
+
+	if err := checkSignaturePolicy(el); err != nil {
+		return nil, err
+	}
+
+	// the copy goxmldsig validates has to keep the namespaces declared on
+	// the ancestors of el
+	nsCtx, err := etreeutils.NSBuildParentContext(el.Element)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedXML, err)
+	}
+	detached, err := etreeutils.NSDetatch(nsCtx, el.Element)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedXML, err)
+	}
+
+	ctx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: certs})
+	signed, err := ctx.Validate(detached)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidXMLSign, err)
+	}
+
+	return &xmlElement{signed}, nil
+}
+
+// checkSignaturePolicy narrows what goxmldsig accepts to what SAML IdPs
+// send: one enveloped signature with exclusive canonicalization and SHA-2,
+// whose only Reference points at el by its ID.
+func checkSignaturePolicy(el *xmlElement) error {
+
+	signatures := el.childElements(nsDSig, "Signature")
+	if len(signatures) == 0 {
+		return ErrXMLNotSigned
+	}
+	if len(signatures) > 1 {
+		return fmt.Errorf("%w: more than one signature", ErrInvalidXMLSign)
+	}
+
+	signedInfo := signatures[0].child(nsDSig, "SignedInfo")
+	if signedInfo == nil {
+		return fmt.Errorf("%w: missing SignedInfo", ErrInvalidXMLSign)
+	}
+
+	c14nMethod := signedInfo.child(nsDSig, "CanonicalizationMethod")
+	if c14nMethod == nil || c14nMethod.attr("Algorithm") != algExcC14N {
+		return fmt.Errorf("%w: unsupported canonicalization", ErrInvalidXMLSign)
+	}
+
+	signatureMethod := signedInfo.child(nsDSig, "SignatureMethod")
+	if signatureMethod == nil || !slices.Contains(signatureAlgorithms, signatureMethod.attr("Algorithm")) {
+		return fmt.Errorf("%w: unsupported signature algorithm", ErrInvalidXMLSign)
+	}
+
+	references := signedInfo.childElements(nsDSig, "Reference")
+	if len(references) != 1 {
+		return fmt.Errorf("%w: expected exactly one Reference", ErrInvalidXMLSign)
+	}
+	reference := references[0]
+	if id := el.attr("ID"); id == "" || reference.attr("URI") != "#"+id {
+		return fmt.Errorf("%w: reference does not point at the signed element", ErrInvalidXMLSign)
+	}
+
+	var enveloped, excC14N bool
+	if transforms := reference.child(nsDSig, "Transforms"); transforms != nil {
+		for _, transform := range transforms.childElements(nsDSig, "Transform") {
+			switch transform.attr("Algorithm") {
+			case algEnveloped:
+				enveloped = true
+			case algExcC14N:
+				excC14N = true
+			default:
+				return fmt.Errorf("%w: unsupported transform %s", ErrInvalidXMLSign, transform.attr("Algorithm"))
+			}
+		}
+	}
+	if !enveloped || !excC14N {
+		return fmt.Errorf("%w: expected enveloped signature with exclusive canonicalization", ErrInvalidXMLSign)
+	}
+
+	digestMethod := reference.child(nsDSig, "DigestMethod")
+	if digestMethod == nil || !slices.Contains(digestAlgorithms, digestMethod.attr("Algorithm")) {
+		return fmt.Errorf("%w: unsupported digest algorithm", ErrInvalidXMLSign)
+	}
+
+	return nil
+}
+
+// decodeXMLBase64 accepts the line breaks base64Binary values often carry.
+func decodeXMLBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
@@ -0,0 +1,249 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+)
+
+// testSigner signs XML the way an IdP does: an enveloped signature with
+// exclusive canonicalization and RSA-SHA256, carrying its certificate in
+// KeyInfo.
+type testSigner struct {
+	cert *x509.Certificate
+	ctx  *dsig.SigningContext
+}
+
+func newTestSigner(t *testing.T) *testSigner {
+	t.Helper()
+	return newTestSignerValidUntil(t, time.Now().Add(time.Hour))
+}
+
+func newTestSignerValidUntil(t *testing.T, notAfter time.Time) *testSigner {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test idp"},
+		NotBefore:    notAfter.Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, err := dsig.NewSigningContext(key, [][]byte{der})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	return &testSigner{cert: cert, ctx: ctx}
+}
+
+// sigMarker marks where the signature of the element with the ID goes.
+var sigMarker = regexp.MustCompile(`\{\{sig:[^}]*\}\}`)
+
+// sign replaces the {{sig:id}} marker in doc with a signature over the
+// element with that ID. Other markers are left for later calls, so inner
+// elements are signed first.
+func (s *testSigner) sign(t *testing.T, doc string, id string) string {
+	t.Helper()
+
+	marker := "{{sig:" + id + "}}"
+	if !strings.Contains(doc, marker) {
+		t.Fatalf("no %s marker in document", marker)
+	}
+
+	root := mustParseXML(t, sigMarker.ReplaceAllString(doc, ""))
+	signature, err := s.ctx.ConstructSignature(detachXML(t, findXMLByID(t, root, id)), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := etree.NewDocument()
+	out.SetRoot(signature)
+	rendered, err := out.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Replace(doc, marker, rendered, 1)
+}
+
+// detachXML copies el out of its document with the namespaces it inherits.
+func detachXML(t *testing.T, el *xmlElement) *etree.Element {
+	t.Helper()
+	nsCtx, err := etreeutils.NSBuildParentContext(el.Element)
+	if err != nil {
+		t.Fatal(err)
+	}
+	detached, err := etreeutils.NSDetatch(nsCtx, el.Element)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return detached
+}
+
+func mustParseXML(t *testing.T, doc string) *xmlElement {
+	t.Helper()
+	root, err := parseXML([]byte(doc))
+	if err != nil {
+		t.Fatalf("parseXML: %v\n%s", err, doc)
+	}
+	return root
+}
+
+func findXMLByID(t *testing.T, root *xmlElement, id string) *xmlElement {
+	t.Helper()
+	var found *xmlElement
+	root.walk(func(el *xmlElement) {
+		if found == nil && el.attr("ID") == id {
+			found = el
+		}
+	})
+	if found == nil {
+		t.Fatalf("no element with ID %s", id)
+	}
+	return found
+}
+
+func TestParseXMLRejectsUnsafeDocuments(t *testing.T) {
+	cases := map[string]string{
+		"doctype":          `<!DOCTYPE doc [<!ENTITY x "y">]><doc>&x;</doc>`,
+		"two roots":        `<doc/><doc/>`,
+		"text outside":     `<doc/>text`,
+		"undeclared":       `<p:doc/>`,
+		"mismatched close": `<doc></other>`,
+		"nested too deep":  strings.Repeat("<a>", maxXMLTreeDepth+1) + strings.Repeat("</a>", maxXMLTreeDepth+1),
+	}
+	for name, doc := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseXML([]byte(doc)); !errors.Is(err, ErrMalformedXML) {
+				t.Errorf("got %v, want ErrMalformedXML", err)
+			}
+		})
+	}
+}
+
+const testSignedDoc = `<doc xmlns="urn:test" ID="d1">{{sig:d1}}<value>42</value></doc>`
+
+func TestVerifyEnvelopedSignature(t *testing.T) {
+	signer := newTestSigner(t)
+	signed := signer.sign(t, testSignedDoc, "d1")
+
+	root := mustParseXML(t, signed)
+	verified, err := verifyEnvelopedSignature(root, []*x509.Certificate{signer.cert})
+	if err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+	// the verified copy is what callers read, without the signature
+	if value := verified.child("urn:test", "value"); value == nil || value.text() != "42" {
+		t.Errorf("verified element lost its content")
+	}
+	if verified.child(nsDSig, "Signature") != nil {
+		t.Errorf("verified element still carries the signature")
+	}
+
+	other := newTestSigner(t)
+	if _, err := verifyEnvelopedSignature(root, []*x509.Certificate{other.cert}); !errors.Is(err, ErrInvalidXMLSign) {
+		t.Errorf("signature checked with another certificate: got %v, want ErrInvalidXMLSign", err)
+	}
+
+	// a rotated IdP key: any of the trusted certificates may match
+	if _, err := verifyEnvelopedSignature(root, []*x509.Certificate{other.cert, signer.cert}); err != nil {
+		t.Errorf("second certificate not tried: %v", err)
+	}
+}
+
+func TestVerifyEnvelopedSignatureInheritedNamespaces(t *testing.T) {
+	signer := newTestSigner(t)
+
+	// the signed element uses a prefix declared on its parent only
+	doc := `<t:wrapper xmlns:t="urn:test"><t:doc ID="d1">{{sig:d1}}<t:value>42</t:value></t:doc></t:wrapper>`
+	root := mustParseXML(t, signer.sign(t, doc, "d1"))
+
+	verified, err := verifyEnvelopedSignature(root.child("urn:test", "doc"), []*x509.Certificate{signer.cert})
+	if err != nil {
+		t.Fatalf("valid signature rejected: %v", err)
+	}
+	if value := verified.child("urn:test", "value"); value == nil || value.text() != "42" {
+		t.Errorf("verified element lost its namespace")
+	}
+}
+
+func TestVerifyEnvelopedSignatureRejectsTampering(t *testing.T) {
+	signer := newTestSigner(t)
+	signed := signer.sign(t, testSignedDoc, "d1")
+	certs := []*x509.Certificate{signer.cert}
+
+	digestValue := regexp.MustCompile(`<ds:DigestValue>[^<]*</ds:DigestValue>`)
+
+	cases := map[string]string{
+		"changed content": strings.Replace(signed, "<value>42</value>", "<value>43</value>", 1),
+		"added content":   strings.Replace(signed, "</doc>", "<value>43</value></doc>", 1),
+		"tampered digest": digestValue.ReplaceAllString(signed, "<ds:DigestValue>"+base64.StdEncoding.EncodeToString(make([]byte, 32))+"</ds:DigestValue>"),
+		// the digest of the changed content is right, but the signature
+		// over SignedInfo no longer is
+		"recomputed digest": func() string {
+			changed := strings.Replace(testSignedDoc, "<value>42</value>", "<value>43</value>", 1)
+			canonical, err := dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("").Canonicalize(mustParseXML(t, sigMarker.ReplaceAllString(changed, "")).Element)
+			if err != nil {
+				t.Fatal(err)
+			}
+			digest := sha256.Sum256(canonical)
+			return digestValue.ReplaceAllString(strings.Replace(signed, "<value>42</value>", "<value>43</value>", 1),
+				"<ds:DigestValue>"+base64.StdEncoding.EncodeToString(digest[:])+"</ds:DigestValue>")
+		}(),
+		"changed reference": strings.Replace(signed, `URI="#d1"`, `URI="#d2"`, 1),
+		"extra reference": strings.Replace(signed, "</ds:SignedInfo>",
+			`<ds:Reference URI="#d1"><ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/><ds:DigestValue>AAAA</ds:DigestValue></ds:Reference></ds:SignedInfo>`, 1),
+		"sha1 signature": strings.Replace(signed, "xmldsig-more#rsa-sha256", "xmldsig#rsa-sha1", 1),
+		"sha1 digest":    strings.Replace(signed, "xmlenc#sha256", "xmldsig#sha1", 1),
+		"inclusive c14n": strings.ReplaceAll(signed, "http://www.w3.org/2001/10/xml-exc-c14n#", "http://www.w3.org/TR/2001/REC-xml-c14n-20010315"),
+	}
+
+	for name, doc := range cases {
+		t.Run(name, func(t *testing.T) {
+			root := mustParseXML(t, doc)
+			if _, err := verifyEnvelopedSignature(root, certs); !errors.Is(err, ErrInvalidXMLSign) {
+				t.Errorf("got %v, want ErrInvalidXMLSign", err)
+			}
+		})
+	}
+}
+
+func TestVerifyEnvelopedSignatureRejectsExpiredCertificate(t *testing.T) {
+	signer := newTestSignerValidUntil(t, time.Now().Add(-time.Minute))
+	root := mustParseXML(t, signer.sign(t, testSignedDoc, "d1"))
+
+	if _, err := verifyEnvelopedSignature(root, []*x509.Certificate{signer.cert}); !errors.Is(err, ErrInvalidXMLSign) {
+		t.Errorf("got %v, want ErrInvalidXMLSign", err)
+	}
+}
+
+func TestVerifyEnvelopedSignatureUnsigned(t *testing.T) {
+	root := mustParseXML(t, `<doc xmlns="urn:test" ID="d1"><value>42</value></doc>`)
+	if _, err := verifyEnvelopedSignature(root, nil); !errors.Is(err, ErrXMLNotSigned) {
+		t.Errorf("got %v, want ErrXMLNotSigned", err)
+	}
+}